@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+	"github.com/mailcleaner/mailcleaner/internal/storage"
+)
+
+// exportCommand implements "mailcleaner export", which writes every account
+// and rule in a database to a JSON backup
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "database to export")
+	out := fs.String("out", "-", "file to write the backup to, - for stdout")
+	passwords := fs.Bool("passwords", false, "include account passwords in the backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		return errors.New("-db is required")
+	}
+
+	store, err := storage.New(*dbPath)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer store.Close()
+
+	backup, err := store.ExportAll(*passwords)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		return writeBackup(os.Stdout, backup)
+	}
+	// The backup may contain passwords, so keep it private
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeBackup(f, backup); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d accounts to %s", len(backup.Accounts), *out)
+	return nil
+}
+
+// writeBackup writes backup as indented JSON
+func writeBackup(w io.Writer, backup *models.Backup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(backup)
+}
+
+// importCommand implements "mailcleaner import", which adds the accounts and
+// rules in a JSON backup to a database
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "database to import into")
+	in := fs.String("in", "-", "backup file to read, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dbPath == "" {
+		return errors.New("-db is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var backup models.Backup
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+
+	store, err := storage.New(*dbPath)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer store.Close()
+
+	if err := store.ImportAll(&backup); err != nil {
+		return err
+	}
+
+	rules, withoutPassword := 0, 0
+	for _, account := range backup.Accounts {
+		rules += len(account.Rules)
+		if account.Password == "" {
+			withoutPassword++
+		}
+	}
+	log.Printf("Imported %d accounts and %d rules", len(backup.Accounts), rules)
+	if withoutPassword > 0 {
+		log.Printf("%d accounts have no password; set them in the web UI before running", withoutPassword)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+	"github.com/mailcleaner/mailcleaner/internal/storage"
+)
+
+func TestExportImportCommands(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.db")
+	dstPath := filepath.Join(dir, "dst.db")
+	backupPath := filepath.Join(dir, "backup.json")
+
+	src, err := storage.New(srcPath)
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	account := &models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p", Enabled: true}
+	src.CreateAccount(account)
+	src.CreateRule(&models.Rule{AccountID: account.ID, Name: "GitHub", Pattern: "@github.com", PatternType: "sender", MoveToFolder: "GitHub", Enabled: true})
+	src.Close()
+
+	if err := exportCommand([]string{"-db", srcPath, "-out", backupPath}); err != nil {
+		t.Fatalf("exportCommand() error = %v", err)
+	}
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		t.Fatalf("Backup not written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Backup permissions = %o, want 600", perm)
+	}
+
+	if err := importCommand([]string{"-db", dstPath, "-in", backupPath}); err != nil {
+		t.Fatalf("importCommand() error = %v", err)
+	}
+
+	dst, err := storage.New(dstPath)
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	defer dst.Close()
+
+	accounts, _ := dst.ListAccounts()
+	if len(accounts) != 1 || accounts[0].Name != "Work" {
+		t.Fatalf("Accounts = %+v, want Work", accounts)
+	}
+	if accounts[0].Password != "" {
+		t.Error("Passwords should be left out of the backup by default")
+	}
+	rules, _ := dst.ListRules(accounts[0].ID)
+	if len(rules) != 1 || rules[0].Pattern != "@github.com" {
+		t.Errorf("Rules = %+v, want the GitHub rule", rules)
+	}
+}
+
+func TestExportCommandPasswords(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.db")
+	dstPath := filepath.Join(dir, "dst.db")
+	backupPath := filepath.Join(dir, "backup.json")
+
+	src, err := storage.New(srcPath)
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	src.CreateAccount(&models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"})
+	src.Close()
+
+	if err := exportCommand([]string{"-db", srcPath, "-out", backupPath, "-passwords"}); err != nil {
+		t.Fatalf("exportCommand() error = %v", err)
+	}
+	if err := importCommand([]string{"-db", dstPath, "-in", backupPath}); err != nil {
+		t.Fatalf("importCommand() error = %v", err)
+	}
+
+	dst, err := storage.New(dstPath)
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	defer dst.Close()
+
+	accounts, _ := dst.ListAccounts()
+	if len(accounts) != 1 || accounts[0].Password != "p" {
+		t.Errorf("Accounts = %+v, want the password to be kept", accounts)
+	}
+}
+
+func TestBackupCommandsRequireDB(t *testing.T) {
+	if err := exportCommand(nil); err == nil {
+		t.Error("exportCommand() without -db should fail")
+	}
+	if err := importCommand(nil); err == nil {
+		t.Error("importCommand() without -db should fail")
+	}
+}
@@ -2,14 +2,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	imapClient "github.com/mailcleaner/mailcleaner/internal/imap"
 	"github.com/mailcleaner/mailcleaner/internal/models"
+	"github.com/mailcleaner/mailcleaner/internal/storage"
 )
 
 // LegacyConfig holds the legacy configuration format for backwards compatibility
@@ -20,25 +29,119 @@ type LegacyConfig struct {
 	Password string       `json:"password"`
 	TLS      *bool        `json:"tls,omitempty"`
 	Rules    []LegacyRule `json:"rules"`
+
+	// Templates holds rule fields shared by several rules, by name
+	Templates map[string]LegacyRule `json:"templates,omitempty"`
 }
 
 // LegacyRule defines the legacy rule format
 type LegacyRule struct {
 	Sender       string `json:"sender"`
 	MoveToFolder string `json:"move_to_folder"`
+
+	// Use names a template whose fields fill in the ones the rule leaves
+	// empty
+	Use string `json:"use,omitempty"`
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"export": exportCommand,
+			"import": importCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					return
+				}
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
+
 	configPath := flag.String("config", "config.json", "path to config file")
 	dryRun := flag.Bool("dry-run", false, "show what would be done without making changes")
+	verbose := flag.Bool("verbose", false, "log full senders, subjects, rule names and patterns of matched messages")
+	ruleSender := flag.String("rule", "", "only run the rule with this sender pattern (with -db, or this name)")
+	accountName := flag.String("account", "", "with -db, only run the account with this name")
+	dbPath := flag.String("db", "", "run the accounts and rules saved by the web server in this database instead of -config")
+	show := flag.Bool("show-config", false, "print the config as it will be used, with the password redacted, and exit")
+	since := flag.String("since", "", "only process mail that arrived since this long ago (e.g. 7d or 12h) or since this date (e.g. 2024-05-01 or an RFC 3339 time)")
+	auditPath := flag.String("audit-log", "", "append a JSON line for every message moved, or that would be in a dry run, to this file")
 	flag.Parse()
 
+	// Senders, subjects and the rules that name them are redacted, so logs
+	// collected from scheduled runs, or dry runs pasted into a bug report,
+	// don't contain message details
+	opts := runOptions{dryRun: *dryRun, redact: !*verbose}
+
+	if *since != "" {
+		var err error
+		opts.since, err = parseSince(*since, time.Now())
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *auditPath != "" {
+		var err error
+		opts.audit, err = imapClient.OpenAuditLog(*auditPath)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer opts.audit.Close()
+	}
+
+	if *dbPath != "" {
+		if *show {
+			log.Fatalf("-show-config can't be combined with -db")
+		}
+		filter := storeFilter{account: *accountName, rule: *ruleSender}
+		if err := runStore(*dbPath, filter, opts); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if *accountName != "" {
+		log.Fatalf("-account can only be used with -db")
+	}
+
 	config, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	if err := run(config, *dryRun); err != nil {
+	if *show {
+		if err := showConfig(os.Stdout, config); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	if err := config.Validate(); err != nil {
+		problems, single := validationProblems(err)
+		if single != nil {
+			log.Fatalf("Invalid config %s: %v", *configPath, single)
+		}
+		log.Printf("Invalid config %s:", *configPath)
+		for _, problem := range problems {
+			log.Printf("  - %v", problem)
+		}
+		os.Exit(1)
+	}
+	for _, warning := range config.Warnings() {
+		log.Printf("Warning: %s", warning)
+	}
+
+	if *ruleSender != "" {
+		config.Rules, err = filterRules(config.Rules, *ruleSender)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	if err := run(config, opts); err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 }
@@ -54,18 +157,181 @@ func loadConfig(path string) (*LegacyConfig, error) {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
 
+	config.applyTemplates()
+	if err := config.expandEnv(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
-func run(config *LegacyConfig, dryRun bool) error {
+// applyTemplates fills in the empty fields of each rule that uses a template
+// from that template, so fields set on the rule take precedence. Unknown
+// templates are left for Validate to report.
+func (c *LegacyConfig) applyTemplates() {
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		tmpl, ok := c.Templates[r.Use]
+		if r.Use == "" || !ok {
+			continue
+		}
+		if r.Sender == "" {
+			r.Sender = tmpl.Sender
+		}
+		if r.MoveToFolder == "" {
+			r.MoveToFolder = tmpl.MoveToFolder
+		}
+	}
+}
+
+// expandEnv replaces ${VAR} and $VAR references in the server, username and
+// rule values with environment variables; $$ stands for a literal $. The
+// password is left as-is so existing passwords containing $ keep working.
+// Referencing an unset variable is an error.
+func (c *LegacyConfig) expandEnv() error {
+	var missing []string
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok && !slices.Contains(missing, name) {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+
+	c.Server = expand(c.Server)
+	c.Username = expand(c.Username)
+	for i := range c.Rules {
+		c.Rules[i].Sender = expand(c.Rules[i].Sender)
+		c.Rules[i].MoveToFolder = expand(c.Rules[i].MoveToFolder)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Validate checks the config for missing or invalid values. All problems are
+// reported together, joined with errors.Join, so they can be fixed in one go.
+func (c *LegacyConfig) Validate() error {
+	var errs []error
+	if c.Server == "" {
+		errs = append(errs, errors.New("server is required"))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", c.Port))
+	}
+	if c.Username == "" {
+		errs = append(errs, errors.New("username is required"))
+	}
+	if c.Password == "" {
+		errs = append(errs, errors.New("password is required"))
+	}
+	names := make([]string, 0, len(c.Templates))
+	for name := range c.Templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if c.Templates[name].Use != "" {
+			errs = append(errs, fmt.Errorf("template %q: templates can't use other templates", name))
+		}
+	}
+	for i, r := range c.Rules {
+		if _, ok := c.Templates[r.Use]; r.Use != "" && !ok {
+			errs = append(errs, fmt.Errorf("rule %d: unknown template %q", i+1, r.Use))
+			continue
+		}
+		if r.Sender == "" {
+			errs = append(errs, fmt.Errorf("rule %d: sender is required", i+1))
+		}
+		if r.MoveToFolder == "" {
+			errs = append(errs, fmt.Errorf("rule %d: move_to_folder is required", i+1))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validationProblems returns the problems joined in an error from Validate.
+// Any other error is returned as is.
+func validationProblems(err error) ([]error, error) {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil, err
+	}
+	return joined.Unwrap(), nil
+}
+
+// Warnings reports rules whose sender pattern is so broad it would move
+// nearly every message. Unlike the problems found by Validate, they don't
+// stop the run.
+func (c *LegacyConfig) Warnings() []string {
+	var warnings []string
+	for i, r := range c.Rules {
+		rule := models.Rule{Pattern: r.Sender, PatternType: "sender"}
+		for _, warning := range models.PatternWarnings(&rule) {
+			warnings = append(warnings, fmt.Sprintf("rule %d: %s", i+1, warning))
+		}
+	}
+	return warnings
+}
+
+// redactedPassword replaces the password in the output of showConfig
+const redactedPassword = "***"
+
+// showConfig writes config to w as JSON the way it will be used: with
+// environment variables expanded and the TLS default filled in. A password
+// is replaced by redactedPassword; an empty one is left empty so that a
+// missing password is still visible.
+func showConfig(w io.Writer, config *LegacyConfig) error {
+	resolved := *config
+	useTLS := config.useTLS()
+	resolved.TLS = &useTLS
+	if resolved.Password != "" {
+		resolved.Password = redactedPassword
+	}
+	if resolved.Rules == nil {
+		resolved.Rules = []LegacyRule{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(resolved)
+}
+
+// useTLS reports whether to connect with TLS, which is the default
+func (c *LegacyConfig) useTLS() bool {
+	return c.TLS == nil || *c.TLS
+}
+
+// filterRules returns the rules whose sender pattern equals sender, ignoring
+// case, so a single newly added rule can be tried without a full pass
+func filterRules(rules []LegacyRule, sender string) ([]LegacyRule, error) {
+	var filtered []LegacyRule
+	for _, r := range rules {
+		if strings.EqualFold(r.Sender, sender) {
+			filtered = append(filtered, r)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no rule with sender %q", sender)
+	}
+	return filtered, nil
+}
+
+func run(config *LegacyConfig, opts runOptions) error {
 	// Convert legacy config to new models
-	useTLS := config.TLS == nil || *config.TLS
 	account := &models.Account{
 		Server:   config.Server,
 		Port:     config.Port,
 		Username: config.Username,
 		Password: config.Password,
-		TLS:      useTLS,
+		TLS:      config.useTLS(),
 	}
 
 	var rules []models.Rule
@@ -81,6 +347,148 @@ func run(config *LegacyConfig, dryRun bool) error {
 		})
 	}
 
+	return applyRules(account, rules, opts)
+}
+
+// storeJob is an account saved in the web server's database together with
+// its rules
+type storeJob struct {
+	account models.Account
+	rules   []models.Rule
+}
+
+// loadStoreJobs reads every enabled account and its rules from the store. It
+// is called on each run, so rules edited in the web UI take effect on the next
+// run without any extra steps.
+func loadStoreJobs(store *storage.Store) ([]storeJob, error) {
+	accounts, err := store.ListAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %w", err)
+	}
+
+	jobs := make([]storeJob, 0, len(accounts))
+	for _, account := range accounts {
+		if !account.Enabled {
+			continue
+		}
+		rules, err := store.ListRules(account.ID)
+		if err != nil {
+			return nil, fmt.Errorf("listing rules for %s: %w", account.Name, err)
+		}
+		jobs = append(jobs, storeJob{account: account, rules: rules})
+	}
+	return jobs, nil
+}
+
+// storeFilter narrows a run of the database down to one account or rule, as
+// the -account and -rule flags ask. Empty fields don't filter.
+type storeFilter struct {
+	account string // account name
+	rule    string // rule name or pattern
+}
+
+// filterStoreJobs returns the jobs for the accounts and rules that filter
+// asks for, comparing names and patterns ignoring case. Accounts left without
+// rules are dropped. Matching nothing is an error, so a typo doesn't pass for
+// a run with nothing to do.
+func filterStoreJobs(jobs []storeJob, filter storeFilter) ([]storeJob, error) {
+	if filter.account != "" {
+		var filtered []storeJob
+		for _, job := range jobs {
+			if strings.EqualFold(job.account.Name, filter.account) {
+				filtered = append(filtered, job)
+			}
+		}
+		if len(filtered) == 0 {
+			return nil, fmt.Errorf("no enabled account named %q", filter.account)
+		}
+		jobs = filtered
+	}
+
+	if filter.rule != "" {
+		var filtered []storeJob
+		for _, job := range jobs {
+			var rules []models.Rule
+			for _, r := range job.rules {
+				if strings.EqualFold(r.Name, filter.rule) || strings.EqualFold(r.Pattern, filter.rule) {
+					rules = append(rules, r)
+				}
+			}
+			if len(rules) > 0 {
+				filtered = append(filtered, storeJob{account: job.account, rules: rules})
+			}
+		}
+		if len(filtered) == 0 {
+			return nil, fmt.Errorf("no rule named or with pattern %q", filter.rule)
+		}
+		jobs = filtered
+	}
+	return jobs, nil
+}
+
+// runStore applies the rules of the accounts in the database at dbPath that
+// filter selects. Accounts without rules are skipped, and a failing account
+// doesn't stop the others from running.
+func runStore(dbPath string, filter storeFilter, opts runOptions) error {
+	store, err := storage.New(dbPath)
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer store.Close()
+
+	jobs, err := loadStoreJobs(store)
+	if err != nil {
+		return err
+	}
+	if jobs, err = filterStoreJobs(jobs, filter); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, job := range jobs {
+		if len(job.rules) == 0 {
+			continue
+		}
+		log.Printf("Account %s:", job.account.Name)
+		if err := applyRules(&job.account, job.rules, opts); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", job.account.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runOptions are the command-line options applying rules takes
+type runOptions struct {
+	dryRun bool
+	redact bool                 // see formatMoveLog
+	since  time.Time            // if set, mail that arrived earlier is skipped
+	audit  *imapClient.AuditLog // if set, moves are recorded in it
+}
+
+// parseSince parses the -since flag: a number of days such as 7d, a
+// duration such as 12h, a date such as 2024-05-01 or an RFC 3339 time.
+// Days and durations count back from now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid -since %q: want e.g. 7d, 12h, 2024-05-01 or an RFC 3339 time", s)
+}
+
+// applyRules connects to the account and applies the rules to its primary
+// mailbox, usually INBOX
+func applyRules(account *models.Account, rules []models.Rule, opts runOptions) error {
 	// Connect to IMAP server
 	addr := fmt.Sprintf("%s:%d", account.Server, account.Port)
 	log.Printf("Connecting to %s...", addr)
@@ -90,11 +498,17 @@ func run(config *LegacyConfig, dryRun bool) error {
 		return fmt.Errorf("connecting: %w", err)
 	}
 	defer client.Close()
+	if opts.audit != nil {
+		client.SetAuditLog(opts.audit)
+	}
+	if !opts.since.IsZero() {
+		client.Since(opts.since)
+	}
 
 	log.Println("Logged in successfully")
 
 	// Apply rules
-	result, err := client.ApplyRules(rules, "INBOX", dryRun)
+	result, err := client.ApplyRules(rules, account.Inbox(), opts.dryRun, 0)
 	if err != nil {
 		return fmt.Errorf("applying rules: %w", err)
 	}
@@ -102,15 +516,77 @@ func run(config *LegacyConfig, dryRun bool) error {
 	log.Printf("Processed %d messages, %d matched rules", result.TotalMessages, result.MatchedMessages)
 
 	for _, msg := range result.Messages {
-		if msg.MatchedRule != nil {
-			log.Printf("  %s -> %s (from: %s, subject: %s)",
-				msg.MatchedRule.Pattern, msg.MatchedRule.MoveToFolder, msg.From, msg.Subject)
+		if msg.MatchedRule != nil && !msg.AlreadyInTarget && !msg.SampledOut {
+			log.Print(formatMoveLog(msg, opts.redact))
 		}
 	}
+	if result.SampledOut > 0 {
+		log.Printf("Skipped %d matches outside their rule's sample_percent", result.SampledOut)
+	}
 
-	if dryRun {
-		log.Println("Dry run - no changes made")
+	if opts.dryRun {
+		summary := dryRunSummary(rules, result, opts.redact)
+		if len(summary) == 0 {
+			log.Println("DRY RUN - no changes made, and a real run would move nothing")
+		} else {
+			log.Println("DRY RUN - no changes made. A real run would:")
+			for _, line := range summary {
+				log.Print(line)
+			}
+		}
 	}
 
 	return nil
 }
+
+// dryRunSummary describes, in rule order, what a real run would do for each
+// rule with matches. Matches already in the rule's folder or outside its
+// sample_percent are left out, as applying skips them. With redact set, rule
+// names are redacted as in formatMoveLog, as they often name a sender.
+func dryRunSummary(rules []models.Rule, result *models.PreviewResult, redact bool) []string {
+	counts := make(map[*models.Rule]int)
+	for _, msg := range result.Messages {
+		if msg.MatchedRule != nil && !msg.AlreadyInTarget && !msg.SampledOut {
+			counts[msg.MatchedRule]++
+		}
+	}
+
+	var lines []string
+	for i := range rules {
+		rule := &rules[i]
+		n := counts[rule]
+		name := rule.Name
+		if redact {
+			name = redactValue(name)
+		}
+		switch {
+		case n == 0:
+		case rule.Action == models.ActionArchive:
+			lines = append(lines, fmt.Sprintf("  %s: would archive %d", name, n))
+		default:
+			lines = append(lines, fmt.Sprintf("  %s: would move %d to %s", name, n, rule.MoveToFolder))
+		}
+	}
+	return lines
+}
+
+// formatMoveLog formats the log line for a matched message. With redact set,
+// the sender, subject and the rule's pattern, usually part of an address,
+// are replaced by a short hash so the same message can still be correlated
+// across log lines.
+func formatMoveLog(msg models.Message, redact bool) string {
+	pattern, from, subject := msg.MatchedRule.Pattern, msg.From, msg.Subject
+	if redact {
+		pattern, from, subject = redactValue(pattern), redactValue(from), redactValue(subject)
+	}
+	return fmt.Sprintf("  %s -> %s (from: %s, subject: %s)",
+		pattern, msg.MatchedRule.MoveToFolder, from, subject)
+}
+
+func redactValue(s string) string {
+	if s == "" {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "[redacted:" + hex.EncodeToString(sum[:4]) + "]"
+}
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+	"github.com/mailcleaner/mailcleaner/internal/storage"
+	"github.com/mailcleaner/mailcleaner/testserver"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -146,3 +159,538 @@ func TestLoadConfigInvalidJSON(t *testing.T) {
 		t.Error("loadConfig() should fail for invalid JSON")
 	}
 }
+
+func TestFormatMoveLogRedaction(t *testing.T) {
+	msg := models.Message{
+		From:    "alice@example.com",
+		Subject: "Quarterly salary review",
+		MatchedRule: &models.Rule{
+			Pattern:      "example.com",
+			MoveToFolder: "HR",
+		},
+	}
+
+	redacted := formatMoveLog(msg, true)
+	if strings.Contains(redacted, msg.Subject) {
+		t.Errorf("Redacted log contains raw subject: %s", redacted)
+	}
+	if strings.Contains(redacted, msg.From) {
+		t.Errorf("Redacted log contains raw sender: %s", redacted)
+	}
+	if strings.Contains(redacted, msg.MatchedRule.Pattern) {
+		t.Errorf("Redacted log contains raw pattern: %s", redacted)
+	}
+	if !strings.Contains(redacted, "-> HR") {
+		t.Errorf("Redacted log should still contain the destination: %s", redacted)
+	}
+	if redacted != formatMoveLog(msg, true) {
+		t.Error("Redaction should be stable for the same message")
+	}
+
+	full := formatMoveLog(msg, false)
+	if !strings.Contains(full, msg.Subject) || !strings.Contains(full, msg.From) {
+		t.Errorf("Unredacted log should contain sender and subject: %s", full)
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	rules := []LegacyRule{
+		{Sender: "@newsletter.com", MoveToFolder: "Newsletters"},
+		{Sender: "@github.com", MoveToFolder: "GitHub"},
+		{Sender: "@GitHub.com", MoveToFolder: "GitHub/Archive"},
+	}
+
+	filtered, err := filterRules(rules, "@github.com")
+	if err != nil {
+		t.Fatalf("filterRules() error = %v", err)
+	}
+	if len(filtered) != 2 {
+		t.Fatalf("Filtered count = %d, want 2", len(filtered))
+	}
+	for _, r := range filtered {
+		if !strings.EqualFold(r.Sender, "@github.com") {
+			t.Errorf("Unexpected rule %+v", r)
+		}
+	}
+
+	if _, err := filterRules(rules, "@missing.com"); err == nil {
+		t.Error("Expected error for unknown rule")
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"7d", time.Date(2024, 5, 3, 15, 30, 0, 0, time.UTC)},
+		{"0d", now},
+		{"12h", time.Date(2024, 5, 10, 3, 30, 0, 0, time.UTC)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-05-01T08:00:00+02:00", time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.value, now)
+		if err != nil {
+			t.Errorf("parseSince(%q) error = %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "week", "-7d", "-1h", "2024-13-01"} {
+		if _, err := parseSince(value, now); err == nil {
+			t.Errorf("parseSince(%q) should fail", value)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := &LegacyConfig{
+		Server:   "imap.example.com",
+		Port:     993,
+		Username: "user@example.com",
+		Password: "secret",
+		Rules:    []LegacyRule{{Sender: "@github.com", MoveToFolder: "GitHub"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	config := &LegacyConfig{
+		Port:     70000,
+		Username: "user@example.com",
+		Rules: []LegacyRule{
+			{Sender: "@github.com", MoveToFolder: "GitHub"},
+			{Sender: "", MoveToFolder: ""},
+		},
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Validate() should fail")
+	}
+
+	problems, single := validationProblems(err)
+	if single != nil {
+		t.Fatalf("Validate() returned a single error: %v", single)
+	}
+	want := []string{
+		"server is required",
+		"port 70000 is out of range",
+		"password is required",
+		"rule 2: sender is required",
+		"rule 2: move_to_folder is required",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Got %d problems, want %d: %v", len(problems), len(want), err)
+	}
+	for i, w := range want {
+		if problems[i].Error() != w {
+			t.Errorf("Problem %d = %q, want %q", i, problems[i], w)
+		}
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	config := &LegacyConfig{
+		Rules: []LegacyRule{
+			{Sender: "@github.com", MoveToFolder: "GitHub"},
+			{Sender: "x", MoveToFolder: "Misc"},
+			{Sender: ".com", MoveToFolder: "Misc"},
+		},
+	}
+
+	warnings := config.Warnings()
+	if len(warnings) != 2 {
+		t.Fatalf("Got warnings %q, want 2", warnings)
+	}
+	if !strings.HasPrefix(warnings[0], "rule 2: ") || !strings.HasPrefix(warnings[1], "rule 3: ") {
+		t.Errorf("Warnings = %q, want them for rules 2 and 3", warnings)
+	}
+}
+
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigTemplates(t *testing.T) {
+	t.Setenv("MC_TEAM", "platform")
+
+	path := writeTempConfig(t, `{
+		"server": "imap.example.com",
+		"port": 993,
+		"username": "user@example.com",
+		"password": "secret",
+		"templates": {
+			"services": {"move_to_folder": "Services/${MC_TEAM}"},
+			"github": {"sender": "@github.com", "move_to_folder": "GitHub"}
+		},
+		"rules": [
+			{"sender": "@gitlab.com", "use": "services"},
+			{"use": "github"},
+			{"use": "github", "move_to_folder": "GitHub/Notifications"},
+			{"sender": "@slack.com", "move_to_folder": "Slack"}
+		]
+	}`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	want := []struct{ sender, folder string }{
+		{"@gitlab.com", "Services/platform"},
+		{"@github.com", "GitHub"},
+		{"@github.com", "GitHub/Notifications"}, // the rule's own field wins
+		{"@slack.com", "Slack"},
+	}
+	for i, w := range want {
+		r := config.Rules[i]
+		if r.Sender != w.sender || r.MoveToFolder != w.folder {
+			t.Errorf("Rule[%d] = %q -> %q, want %q -> %q", i, r.Sender, r.MoveToFolder, w.sender, w.folder)
+		}
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	config := &LegacyConfig{
+		Server:   "imap.example.com",
+		Port:     993,
+		Username: "user@example.com",
+		Password: "secret",
+		Templates: map[string]LegacyRule{
+			"nested":   {Use: "services"},
+			"services": {MoveToFolder: "Services"},
+		},
+		Rules: []LegacyRule{
+			{Sender: "@github.com", Use: "services"},
+			{Sender: "@gitlab.com", Use: "missing"},
+		},
+	}
+	config.applyTemplates()
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Validate() should fail")
+	}
+
+	problems, single := validationProblems(err)
+	if single != nil {
+		t.Fatalf("Validate() returned a single error: %v", single)
+	}
+	want := []string{
+		`template "nested": templates can't use other templates`,
+		`rule 2: unknown template "missing"`,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Got %d problems, want %d: %v", len(problems), len(want), err)
+	}
+	for i, w := range want {
+		if problems[i].Error() != w {
+			t.Errorf("Problem %d = %q, want %q", i, problems[i], w)
+		}
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("MC_HOST", "imap.staging.example.com")
+	t.Setenv("MC_USER", "ops")
+
+	path := writeTempConfig(t, `{
+		"server": "${MC_HOST}",
+		"port": 993,
+		"username": "$MC_USER@example.com",
+		"password": "pa$$word",
+		"rules": [
+			{"sender": "cost$$@example.com", "move_to_folder": "Archive/${MC_USER}"}
+		]
+	}`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if config.Server != "imap.staging.example.com" {
+		t.Errorf("Server = %q, want %q", config.Server, "imap.staging.example.com")
+	}
+	if config.Username != "ops@example.com" {
+		t.Errorf("Username = %q, want %q", config.Username, "ops@example.com")
+	}
+	if config.Password != "pa$$word" {
+		t.Errorf("Password = %q, want it unexpanded", config.Password)
+	}
+	if config.Rules[0].Sender != "cost$@example.com" {
+		t.Errorf("Rule[0].Sender = %q, want %q", config.Rules[0].Sender, "cost$@example.com")
+	}
+	if config.Rules[0].MoveToFolder != "Archive/ops" {
+		t.Errorf("Rule[0].MoveToFolder = %q, want %q", config.Rules[0].MoveToFolder, "Archive/ops")
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	t.Setenv("MC_HOST", "imap.staging.example.com")
+
+	path := writeTempConfig(t, `{
+		"server": "${MC_HOST}",
+		"port": 993,
+		"username": "user@example.com",
+		"password": "secret",
+		"rules": [
+			{"sender": "@github.com", "move_to_folder": "GitHub"}
+		]
+	}`)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	var out strings.Builder
+	if err := showConfig(&out, config); err != nil {
+		t.Fatalf("showConfig() error = %v", err)
+	}
+	got := out.String()
+
+	for _, want := range []string{
+		`"server": "imap.staging.example.com"`,
+		`"port": 993`,
+		`"password": "***"`,
+		`"tls": true`,
+		`"move_to_folder": "GitHub"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("showConfig() output missing %s:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("showConfig() output contains the password:\n%s", got)
+	}
+	if config.Password != "secret" {
+		t.Errorf("showConfig() modified the config, Password = %q", config.Password)
+	}
+}
+
+func TestShowConfigEmptyPassword(t *testing.T) {
+	config := &LegacyConfig{Server: "imap.example.com", Port: 143, TLS: new(bool)}
+
+	var out strings.Builder
+	if err := showConfig(&out, config); err != nil {
+		t.Fatalf("showConfig() error = %v", err)
+	}
+	got := out.String()
+
+	if !strings.Contains(got, `"password": ""`) || !strings.Contains(got, `"tls": false`) {
+		t.Errorf("Expected an empty password and tls false, got:\n%s", got)
+	}
+}
+
+func TestLoadConfigMissingEnv(t *testing.T) {
+	path := writeTempConfig(t, `{
+		"server": "${MC_UNSET_HOST}",
+		"port": 993,
+		"username": "user",
+		"password": "secret",
+		"rules": []
+	}`)
+
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "MC_UNSET_HOST") {
+		t.Errorf("loadConfig() error = %v, want it to name MC_UNSET_HOST", err)
+	}
+}
+
+func TestLoadStoreJobsPicksUpNewRules(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	defer store.Close()
+
+	account := &models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p", Enabled: true}
+	store.CreateAccount(account)
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "GitHub", Pattern: "@github.com", PatternType: "sender", MoveToFolder: "GitHub", Enabled: true})
+
+	jobs, err := loadStoreJobs(store)
+	if err != nil {
+		t.Fatalf("loadStoreJobs() error = %v", err)
+	}
+	if len(jobs) != 1 || len(jobs[0].rules) != 1 {
+		t.Fatalf("Got %+v, want 1 account with 1 rule", jobs)
+	}
+
+	// A rule added from the web UI is seen by the next run
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter@", PatternType: "sender", MoveToFolder: "News", Enabled: true})
+
+	jobs, err = loadStoreJobs(store)
+	if err != nil {
+		t.Fatalf("loadStoreJobs() error = %v", err)
+	}
+	if len(jobs[0].rules) != 2 {
+		t.Errorf("Rules count = %d, want 2", len(jobs[0].rules))
+	}
+	if jobs[0].account.Password != "p" {
+		t.Error("Account should be loaded with its password")
+	}
+}
+
+func TestLoadStoreJobsSkipsDisabledAccounts(t *testing.T) {
+	store, err := storage.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("storage.New() error = %v", err)
+	}
+	defer store.Close()
+
+	work := &models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p", Enabled: true}
+	home := &models.Account{Name: "Home", Server: "imap.example.com", Port: 993, Username: "h", Password: "p", Enabled: true}
+	store.CreateAccount(work)
+	store.CreateAccount(home)
+	store.CreateRule(&models.Rule{AccountID: work.ID, Name: "GitHub", Pattern: "@github.com", PatternType: "sender", MoveToFolder: "GitHub", Enabled: true})
+	store.CreateRule(&models.Rule{AccountID: home.ID, Name: "News", Pattern: "newsletter@", PatternType: "sender", MoveToFolder: "News", Enabled: true})
+
+	home.Enabled = false
+	if err := store.UpdateAccount(home); err != nil {
+		t.Fatalf("UpdateAccount() error = %v", err)
+	}
+
+	jobs, err := loadStoreJobs(store)
+	if err != nil {
+		t.Fatalf("loadStoreJobs() error = %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].account.ID != work.ID {
+		t.Fatalf("Got %+v, want only the enabled account", jobs)
+	}
+}
+
+func TestApplyRulesDryRunSummary(t *testing.T) {
+	ts, err := testserver.New("testuser", "testpass")
+	if err != nil {
+		t.Fatalf("testserver.New() error = %v", err)
+	}
+	defer ts.Close()
+
+	ts.AddMessage("news@example.com", "Issue 1", "Body")
+	ts.AddMessage("news@example.com", "Issue 2", "Body")
+	ts.AddMessage("shop@example.com", "Receipt", "Body")
+	ts.AddMessage("friend@example.com", "Hello", "Body")
+	ts.CreateFolder("Newsletters")
+
+	host, port, _ := net.SplitHostPort(ts.Addr)
+	account := &models.Account{Name: "Test", Server: host, Username: "testuser", Password: "testpass"}
+	account.Port, _ = strconv.Atoi(port)
+	rules := []models.Rule{
+		{Name: "News", Pattern: "news@", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+		{Name: "Shops", Pattern: "shop@", PatternType: "sender", Action: models.ActionArchive, MoveToFolder: "Archive", Enabled: true},
+		{Name: "Unused", Pattern: "nobody@", PatternType: "sender", MoveToFolder: "Other", Enabled: true},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	if err := applyRules(account, rules, runOptions{dryRun: true}); err != nil {
+		t.Fatalf("applyRules() error = %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"DRY RUN - no changes made", "News: would move 2 to Newsletters", "Shops: would archive 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Unused") {
+		t.Errorf("Expected rules without matches to be left out:\n%s", out)
+	}
+
+	// Redacted, neither the messages nor the rules naming their senders
+	// show up
+	buf.Reset()
+	if err := applyRules(account, rules, runOptions{dryRun: true, redact: true}); err != nil {
+		t.Fatalf("applyRules() error = %v", err)
+	}
+	out = buf.String()
+	for _, secret := range []string{"news@", "shop@", "Issue 1", "News:", "Shops:"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Redacted output contains %q:\n%s", secret, out)
+		}
+	}
+	if want := redactValue("News") + ": would move 2 to Newsletters"; !strings.Contains(out, want) {
+		t.Errorf("Output missing %q:\n%s", want, out)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 4 {
+		t.Errorf("INBOX has %d messages after a dry run, want 4", n)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 0 {
+		t.Errorf("Newsletters has %d messages after a dry run, want 0", n)
+	}
+}
+
+func TestValidationProblemsSingleError(t *testing.T) {
+	plain := errors.New("broken")
+	if problems, err := validationProblems(plain); problems != nil || err != plain {
+		t.Errorf("validationProblems(plain) = %v, %v; want nil, the error itself", problems, err)
+	}
+}
+
+func TestFilterStoreJobs(t *testing.T) {
+	jobs := []storeJob{
+		{account: models.Account{Name: "Work"}, rules: []models.Rule{
+			{Name: "GitHub", Pattern: "@github.com"},
+			{Name: "News", Pattern: "newsletter@"},
+		}},
+		{account: models.Account{Name: "Home"}, rules: []models.Rule{
+			{Name: "Shops", Pattern: "shop@"},
+			{Name: "Newsletters", Pattern: "newsletter@"},
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		filter storeFilter
+		want   map[string][]string // account -> rule names
+	}{
+		{"no filter", storeFilter{}, map[string][]string{"Work": {"GitHub", "News"}, "Home": {"Shops", "Newsletters"}}},
+		{"account", storeFilter{account: "home"}, map[string][]string{"Home": {"Shops", "Newsletters"}}},
+		{"rule by name", storeFilter{rule: "github"}, map[string][]string{"Work": {"GitHub"}}},
+		{"rule by pattern", storeFilter{rule: "Newsletter@"}, map[string][]string{"Work": {"News"}, "Home": {"Newsletters"}}},
+		{"account and rule", storeFilter{account: "Home", rule: "newsletter@"}, map[string][]string{"Home": {"Newsletters"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := filterStoreJobs(jobs, tt.filter)
+			if err != nil {
+				t.Fatalf("filterStoreJobs() error = %v", err)
+			}
+			got := make(map[string][]string)
+			for _, job := range filtered {
+				for _, r := range job.rules {
+					got[job.account.Name] = append(got[job.account.Name], r.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterStoreJobs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, filter := range []storeFilter{{account: "Nobody"}, {rule: "nothing@"}, {account: "Work", rule: "shop@"}} {
+		if _, err := filterStoreJobs(jobs, filter); err == nil {
+			t.Errorf("filterStoreJobs(%+v) should fail when nothing matches", filter)
+		}
+	}
+}
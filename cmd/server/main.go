@@ -2,15 +2,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mailcleaner/mailcleaner/internal/api"
+	imapClient "github.com/mailcleaner/mailcleaner/internal/imap"
 	"github.com/mailcleaner/mailcleaner/internal/storage"
 )
 
@@ -25,20 +33,39 @@ func getPort() int {
 }
 
 func main() {
+	// run returns once its deferred closes have run, so the store and audit
+	// log are closed before exiting
+	if err := run(); err != nil {
+		log.Printf("Server error: %v", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the server as configured by the flags and serves until it is
+// told to stop. An error, including failing to finish in-flight requests on
+// shutdown, makes the process exit non-zero.
+func run() error {
 	port := flag.Int("port", getPort(), "port to listen on")
 	dbPath := flag.String("db", "", "path to database file (default: ~/.mailcleaner/data.db)")
 	staticDir := flag.String("static", "", "path to static files directory")
+	allowedOrigins := flag.String("allowed-origins", os.Getenv("ALLOWED_ORIGINS"), "comma-separated origins allowed to make cross-origin API requests (default: local development servers)")
+	requestTimeout := flag.Duration("request-timeout", api.DefaultRequestTimeout, "how long requests that talk to an IMAP server may take before failing with 504")
+	applyTimeout := flag.Duration("apply-timeout", api.DefaultApplyTimeout, "how long apply requests may take before failing with 504; negative for no limit")
+	accountRateLimit := flag.Int("account-rate-limit", api.DefaultAccountRateLimit, "requests per minute each account may make to its IMAP server, -1 for no limit")
+	accountRateBurst := flag.Int("account-rate-burst", api.DefaultAccountRateBurst, "requests each account may make to its IMAP server at once")
+	auditPath := flag.String("audit-log", "", "append a JSON line for every message moved or deleted, or that would be moved in a dry run, to this file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
 	flag.Parse()
 
 	// Determine database path
 	if *dbPath == "" {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			log.Fatalf("Failed to get home directory: %v", err)
+			return fmt.Errorf("get home directory: %w", err)
 		}
 		dataDir := filepath.Join(homeDir, ".mailcleaner")
 		if err := os.MkdirAll(dataDir, 0755); err != nil {
-			log.Fatalf("Failed to create data directory: %v", err)
+			return fmt.Errorf("create data directory: %w", err)
 		}
 		*dbPath = filepath.Join(dataDir, "data.db")
 	}
@@ -48,31 +75,96 @@ func main() {
 	// Initialize storage
 	store, err := storage.New(*dbPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		return fmt.Errorf("initialize storage: %w", err)
 	}
 	defer store.Close()
 
 	// Create API handler and router
 	handler := api.NewHandler(store)
-	router := api.NewRouter(handler)
+	defer handler.Close()
+	if *auditPath != "" {
+		audit, err := imapClient.OpenAuditLog(*auditPath)
+		if err != nil {
+			return fmt.Errorf("open audit log: %w", err)
+		}
+		defer audit.Close()
+		handler.SetAuditLog(audit)
+		log.Printf("Writing audit log: %s", *auditPath)
+	}
+	router := api.NewRouter(handler, api.RouterConfig{
+		AllowedOrigins:   parseOrigins(*allowedOrigins),
+		RequestTimeout:   *requestTimeout,
+		ApplyTimeout:     *applyTimeout,
+		AccountRateLimit: *accountRateLimit,
+		AccountRateBurst: *accountRateBurst,
+	})
 
 	// Add WebSocket routes
-	api.AddWebSocketRoutes(router, store)
+	api.AddWebSocketRoutes(router, handler)
 
 	// Serve static files if directory provided
 	if *staticDir != "" {
 		log.Printf("Serving static files from: %s", *staticDir)
-		fs := http.FileServer(http.Dir(*staticDir))
-		router.Handle("/*", http.StripPrefix("/", fs))
+		api.AddStaticRoutes(router, *staticDir)
 	}
 
 	// Start server
 	addr := fmt.Sprintf(":%d", *port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
+
 	log.Printf("Starting server on http://localhost%s", addr)
 	log.Printf("API available at http://localhost%s/api", addr)
 	log.Printf("WebSocket available at ws://localhost%s/ws/preview", addr)
 
-	if err := http.ListenAndServe(addr, router); err != nil {
-		log.Fatalf("Server error: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Handler: router}
+	if err := serve(ctx, srv, listener, *shutdownTimeout); err != nil {
+		return err
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// parseOrigins splits a comma-separated list of origins, ignoring blanks
+func parseOrigins(s string) []string {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// serve runs srv on listener until ctx is cancelled, then shuts it down,
+// giving in-flight requests up to drainTimeout to finish.
+func serve(ctx context.Context, srv *http.Server, listener net.Listener, drainTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests...", drainTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServeWaitsForInFlightRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, listener, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	respCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			respCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		respCh <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+
+	res := <-respCh
+	if res.err != nil {
+		t.Fatalf("In-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("Expected body 'done', got %q", res.body)
+	}
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, srv, listener, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + listener.Addr().String())
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		if err == nil {
+			t.Error("Expected error when drain timeout is exceeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after drain timeout")
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://mail.example.com, ,https://admin.example.com ")
+	want := []string{"https://mail.example.com", "https://admin.example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseOrigins() = %v, want %v", got, want)
+	}
+	if got := parseOrigins(""); got != nil {
+		t.Errorf("parseOrigins(\"\") = %v, want nil", got)
+	}
+}
@@ -8,10 +8,10 @@ require (
 	github.com/go-chi/cors v1.2.1
 	github.com/gorilla/websocket v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.19
+	golang.org/x/net v0.17.0
 )
 
 require (
 	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
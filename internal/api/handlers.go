@@ -2,9 +2,17 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -15,33 +23,141 @@ import (
 
 // Handler holds dependencies for API handlers
 type Handler struct {
-	store *storage.Store
+	store       *storage.Store
+	idempotency *idempotencyStore
+	snapshots   *snapshotStore
+	audit       *imapClient.AuditLog
+	limiter     *rateLimiter // nil if requests aren't limited
+	stopSweep   func()       // stops the limiter's sweeping, see Close
 }
 
 // NewHandler creates a new Handler
 func NewHandler(store *storage.Store) *Handler {
-	return &Handler{store: store}
+	return &Handler{
+		store:       store,
+		idempotency: newIdempotencyStore(idempotencyTTL),
+		snapshots:   newSnapshotStore(previewSnapshotTTL),
+	}
+}
+
+// Close stops the background work NewRouter started for the handler, the
+// sweeping of its rate limiter
+func (h *Handler) Close() {
+	if h.stopSweep != nil {
+		h.stopSweep()
+		h.stopSweep = nil
+	}
+}
+
+// SetAuditLog makes the handler record every message it moves or deletes,
+// and every move a dry run would make, in log
+func (h *Handler) SetAuditLog(log *imapClient.AuditLog) {
+	h.audit = log
+}
+
+// connect connects to account, recording moves and deletes in the audit log
+func (h *Handler) connect(ctx context.Context, account *models.Account) (*imapClient.Client, error) {
+	client, err := imapClient.ConnectContext(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if h.audit != nil {
+		client.SetAuditLog(h.audit)
+	}
+	return client, nil
 }
 
 // Response helpers
 
+// respondJSON writes data as the JSON response body with the given status.
+// The body is encoded before anything is written, so a value that can't be
+// encoded gets a 500 instead of a truncated body under the intended status.
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	var body bytes.Buffer
 	if data != nil {
-		json.NewEncoder(w).Encode(data)
+		if err := json.NewEncoder(&body).Encode(data); err != nil {
+			log.Printf("Encoding %T response: %v", data, err)
+			status = http.StatusInternalServerError
+			body.Reset()
+			body.WriteString(`{"error":"failed to encode response"}` + "\n")
+		}
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
 }
 
 func respondError(w http.ResponseWriter, status int, message string) {
 	respondJSON(w, status, map[string]string{"error": message})
 }
 
+// Pagination
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// pageResponse is returned by list endpoints when a page is requested.
+// NextCursor is empty on the last page.
+type pageResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func newPageResponse(items interface{}, next int64) pageResponse {
+	resp := pageResponse{Items: items}
+	if next > 0 {
+		resp.NextCursor = strconv.FormatInt(next, 10)
+	}
+	return resp
+}
+
+// parsePage reads the limit and cursor query parameters. paged is false when
+// neither is given, in which case list endpoints return the full list as
+// before.
+func parsePage(r *http.Request) (cursor int64, limit int, paged bool, err error) {
+	query := r.URL.Query()
+	limitStr, cursorStr := query.Get("limit"), query.Get("cursor")
+	if limitStr == "" && cursorStr == "" {
+		return 0, 0, false, nil
+	}
+
+	limit = defaultPageSize
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return 0, 0, false, errors.New("invalid limit")
+		}
+		limit = min(limit, maxPageSize)
+	}
+	if cursorStr != "" {
+		cursor, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || cursor < 0 {
+			return 0, 0, false, errors.New("invalid cursor")
+		}
+	}
+	return cursor, limit, true, nil
+}
+
 // Account Handlers
 
 // ListAccounts returns all accounts
 func (h *Handler) ListAccounts(w http.ResponseWriter, r *http.Request) {
-	accounts, err := h.store.ListAccounts()
+	cursor, limit, paged, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var accounts []models.Account
+	var next int64
+	if paged {
+		accounts, next, err = h.store.ListAccountsPage(cursor, limit)
+	} else {
+		accounts, err = h.store.ListAccounts()
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -53,6 +169,10 @@ func (h *Handler) ListAccounts(w http.ResponseWriter, r *http.Request) {
 		safeAccounts[i] = a.ToSafe()
 	}
 
+	if paged {
+		respondJSON(w, http.StatusOK, newPageResponse(safeAccounts, next))
+		return
+	}
 	respondJSON(w, http.StatusOK, safeAccounts)
 }
 
@@ -79,20 +199,23 @@ func (h *Handler) GetAccount(w http.ResponseWriter, r *http.Request) {
 
 // CreateAccount creates a new account
 func (h *Handler) CreateAccount(w http.ResponseWriter, r *http.Request) {
-	var account models.Account
+	account := models.Account{Enabled: true}
 	if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
 		respondError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
 
-	if account.Name == "" || account.Server == "" || account.Username == "" || account.Password == "" {
-		respondError(w, http.StatusBadRequest, "name, server, username, and password are required")
-		return
-	}
-
 	if account.Port == 0 {
 		account.Port = 993
 	}
+	if account.FetchConcurrency == 0 {
+		account.FetchConcurrency = 1
+	}
+
+	if err := validateAccount(&account); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err := h.store.CreateAccount(&account); err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
@@ -102,6 +225,29 @@ func (h *Handler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusCreated, account.ToSafe())
 }
 
+// validateAccount checks the fields of an account about to be saved
+func validateAccount(account *models.Account) error {
+	if account.Name == "" || account.Server == "" || account.Username == "" || account.Password == "" {
+		return errors.New("name, server, username, and password are required")
+	}
+	if account.Port < 1 || account.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if account.FetchConcurrency < 1 || account.FetchConcurrency > models.MaxFetchConcurrency {
+		return fmt.Errorf("fetch_concurrency must be between 1 and %d", models.MaxFetchConcurrency)
+	}
+	if account.ScanWindowDays < 0 {
+		return errors.New("scan_window_days must not be negative")
+	}
+	if account.CommandTimeoutSeconds < 0 {
+		return errors.New("command_timeout_seconds must not be negative")
+	}
+	if _, err := imapClient.ProxyDialer(account.ProxyURL); err != nil {
+		return err
+	}
+	return nil
+}
+
 // UpdateAccount updates an existing account
 func (h *Handler) UpdateAccount(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
@@ -120,7 +266,8 @@ func (h *Handler) UpdateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var account models.Account
+	// Accounts stay enabled or disabled unless enabled is given
+	account := models.Account{Enabled: existing.Enabled}
 	if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
 		respondError(w, http.StatusBadRequest, "invalid request body")
 		return
@@ -132,6 +279,24 @@ func (h *Handler) UpdateAccount(w http.ResponseWriter, r *http.Request) {
 		account.Password = existing.Password
 	}
 
+	if account.Port == 0 {
+		account.Port = existing.Port
+	}
+	if account.FetchConcurrency == 0 {
+		account.FetchConcurrency = max(existing.FetchConcurrency, 1)
+	}
+
+	// The proxy URL is returned with its password redacted; sent back
+	// unchanged, it keeps the stored one
+	if account.ProxyURL != "" && account.ProxyURL == models.RedactURL(existing.ProxyURL) {
+		account.ProxyURL = existing.ProxyURL
+	}
+
+	if err := validateAccount(&account); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	if err := h.store.UpdateAccount(&account); err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -140,6 +305,69 @@ func (h *Handler) UpdateAccount(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, account.ToSafe())
 }
 
+// PatchAccount updates only the account fields given in the request body
+func (h *Handler) PatchAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	existing, err := h.store.GetAccount(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	var patch models.AccountPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// As with UpdateAccount, an empty password or the redacted proxy URL
+	// keeps the stored value
+	if patch.Password != nil && *patch.Password == "" {
+		patch.Password = nil
+	}
+	if patch.ProxyURL != nil && *patch.ProxyURL != "" && *patch.ProxyURL == models.RedactURL(existing.ProxyURL) {
+		patch.ProxyURL = nil
+	}
+
+	// Validate the account as it will be after the patch. Accounts saved
+	// before fetch_concurrency was checked may have 0, which means 1.
+	patched := *existing
+	if patched.FetchConcurrency == 0 {
+		patched.FetchConcurrency = 1
+	}
+	patch.Apply(&patched)
+	if err := validateAccount(&patched); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.store.PatchAccount(id, &patch); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	account, err := h.store.GetAccount(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, account.ToSafe())
+}
+
 // DeleteAccount deletes an account
 func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
@@ -148,10 +376,15 @@ func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.DeleteAccount(id); err != nil {
+	deleted, err := h.store.DeleteAccount(id)
+	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if deleted == 0 {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
 
 	respondJSON(w, http.StatusNoContent, nil)
 }
@@ -174,15 +407,33 @@ func (h *Handler) TestAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status, err := imapClient.TestAccountConnection(account)
+	status, err := imapClient.TestAccountConnectionContext(r.Context(), account)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if r.Context().Err() != nil {
+		// The test was cut short, so it says nothing about the account
+		return
+	}
+
+	if err := h.recordVerification(account.ID, status); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	respondJSON(w, http.StatusOK, status)
 }
 
+// recordVerification persists the outcome of a connection test on the account
+func (h *Handler) recordVerification(accountID int64, status *models.ConnectionStatus) error {
+	verifyStatus := models.VerifyFailed
+	if status.Success {
+		verifyStatus = models.VerifySuccess
+	}
+	return h.store.RecordAccountVerification(accountID, time.Now(), verifyStatus)
+}
+
 // TestAccountDirect tests a connection with provided credentials (no save)
 func (h *Handler) TestAccountDirect(w http.ResponseWriter, r *http.Request) {
 	var account models.Account
@@ -194,16 +445,46 @@ func (h *Handler) TestAccountDirect(w http.ResponseWriter, r *http.Request) {
 	if account.Port == 0 {
 		account.Port = 993
 	}
+	if !h.checkAccountLimit(w, connectionKey(&account)) {
+		return
+	}
 
-	status, err := imapClient.TestAccountConnection(&account)
+	status, err := imapClient.TestAccountConnectionContext(r.Context(), &account)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if r.Context().Err() != nil {
+		// The test was cut short, so it says nothing about the account
+		return
+	}
+
+	// When re-testing a saved account (e.g. from its edit form), record the
+	// result against it, unless the form has other settings than the saved
+	// ones: the result says nothing about the account as stored
+	if account.ID != 0 {
+		existing, err := h.store.GetAccount(account.ID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if existing != nil && sameConnection(existing, &account) {
+			if err := h.recordVerification(existing.ID, status); err != nil {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
 
 	respondJSON(w, http.StatusOK, status)
 }
 
+// sameConnection reports whether a and b connect to the same server with
+// the same credentials
+func sameConnection(a, b *models.Account) bool {
+	return a.Server == b.Server && a.Port == b.Port && a.Username == b.Username && a.Password == b.Password
+}
+
 // GetAccountFolders returns all folders for an account
 func (h *Handler) GetAccountFolders(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
@@ -222,210 +503,806 @@ func (h *Handler) GetAccountFolders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client, err := imapClient.Connect(account)
+	client, err := imapClient.ConnectContext(r.Context(), account)
 	if err != nil {
-		respondError(w, http.StatusBadGateway, err.Error())
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
 		return
 	}
 	defer client.Close()
 
-	folders, err := client.ListFolders()
+	list := client.ListFolders
+	pattern := r.URL.Query().Get("pattern")
+	withStatus := r.URL.Query().Get("with_status") == "true"
+	switch {
+	case pattern != "" && withStatus:
+		respondError(w, http.StatusBadRequest, "pattern can't be combined with with_status")
+		return
+	case pattern != "":
+		list = func() ([]models.Folder, error) { return client.ListFoldersMatching(pattern) }
+	case withStatus:
+		list = client.ListFoldersWithStatus
+	}
+	folders, err := list()
+	if err != nil && len(folders) > 0 {
+		// Let the client show what was listed before the failure
+		respondJSON(w, imapErrorStatus(err, http.StatusInternalServerError), partialFoldersResponse{
+			Error:   err.Error(),
+			Folders: folders,
+		})
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusOK, folders)
 }
 
-// Rule Handlers
+// partialFoldersResponse is the error response of GetAccountFolders when
+// the server failed partway through listing the folders
+type partialFoldersResponse struct {
+	Error   string          `json:"error"`
+	Folders []models.Folder `json:"folders"`
+}
 
-// ListRules returns all rules for an account
-func (h *Handler) ListRules(w http.ResponseWriter, r *http.Request) {
-	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+// GetAccountQuota returns the account's quota usage, if the server reports it
+func (h *Handler) GetAccountQuota(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "invalid account ID")
 		return
 	}
 
-	rules, err := h.store.ListRules(accountID)
+	account, err := h.store.GetAccount(id)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
 
-	respondJSON(w, http.StatusOK, rules)
-}
-
-// GetRule returns a single rule
-func (h *Handler) GetRule(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	client, err := imapClient.ConnectContext(r.Context(), account)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
 		return
 	}
+	defer client.Close()
 
-	rule, err := h.store.GetRule(id)
+	quota, err := client.Quota()
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if rule == nil {
-		respondError(w, http.StatusNotFound, "rule not found")
-		return
-	}
 
-	respondJSON(w, http.StatusOK, rule)
+	respondJSON(w, http.StatusOK, quota)
 }
 
-// CreateRule creates a new rule
-func (h *Handler) CreateRule(w http.ResponseWriter, r *http.Request) {
-	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+// GetAccountSize returns the total size of a folder's messages. With the
+// sample query parameter, only that many message sizes are fetched and the
+// total is extrapolated, for folders too large to size exactly.
+func (h *Handler) GetAccountSize(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "invalid account ID")
 		return
 	}
 
-	var rule models.Rule
-	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
-		return
+	sample := 0
+	if sampleStr := r.URL.Query().Get("sample"); sampleStr != "" {
+		if sample, err = strconv.Atoi(sampleStr); err != nil || sample < 0 {
+			respondError(w, http.StatusBadRequest, "invalid sample")
+			return
+		}
 	}
 
-	rule.AccountID = accountID
-
-	if rule.Name == "" || rule.Pattern == "" || rule.MoveToFolder == "" {
-		respondError(w, http.StatusBadRequest, "name, pattern, and move_to_folder are required")
+	account, err := h.store.GetAccount(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
 		return
 	}
 
-	if rule.PatternType == "" {
-		rule.PatternType = "sender"
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = account.Inbox()
 	}
 
-	if err := h.store.CreateRule(&rule); err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+	client, err := imapClient.ConnectContext(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return
+	}
+	defer client.Close()
+
+	bytes, count, sampled, err := client.EstimateMailboxSize(folder, sample)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusCreated, rule)
+	size := models.MailboxSize{Folder: folder, Bytes: bytes, Messages: count}
+	if sample > 0 && sample < count {
+		size.Estimated, size.Sampled = true, sampled
+	}
+	respondJSON(w, http.StatusOK, size)
 }
 
-// UpdateRule updates an existing rule
-func (h *Handler) UpdateRule(w http.ResponseWriter, r *http.Request) {
+// GetAccountCapabilities returns the capabilities of the account's server
+func (h *Handler) GetAccountCapabilities(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		respondError(w, http.StatusBadRequest, "invalid account ID")
 		return
 	}
 
-	existing, err := h.store.GetRule(id)
+	account, err := h.store.GetAccount(id)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if existing == nil {
-		respondError(w, http.StatusNotFound, "rule not found")
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
 		return
 	}
 
-	var rule models.Rule
-	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	client, err := imapClient.ConnectContext(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
 		return
 	}
+	defer client.Close()
 
-	rule.ID = id
-	rule.AccountID = existing.AccountID
-
-	if err := h.store.UpdateRule(&rule); err != nil {
+	caps, err := client.Capabilities()
+	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusOK, rule)
+	respondJSON(w, http.StatusOK, caps)
 }
 
-// DeleteRule deletes a rule
-func (h *Handler) DeleteRule(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid rule ID")
+// GetAccountSenders returns the senders of the most recent messages in a
+// folder, most frequent first
+func (h *Handler) GetAccountSenders(w http.ResponseWriter, r *http.Request) {
+	account := h.accountFromURL(w, r)
+	if account == nil {
 		return
 	}
 
-	if err := h.store.DeleteRule(id); err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+	senders, ok := h.senderFrequency(w, r, account)
+	if !ok {
 		return
 	}
 
-	respondJSON(w, http.StatusNoContent, nil)
+	respondJSON(w, http.StatusOK, senders)
 }
 
-// Preview Handler
-
-// PreviewRules previews the effect of rules on an account's emails
-func (h *Handler) PreviewRules(w http.ResponseWriter, r *http.Request) {
-	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+// accountFromURL returns the account named by the {id} URL parameter. If
+// there is none it responds with an error and returns nil.
+func (h *Handler) accountFromURL(w http.ResponseWriter, r *http.Request) *models.Account {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "invalid account ID")
-		return
+		return nil
 	}
 
-	account, err := h.store.GetAccount(accountID)
+	account, err := h.store.GetAccount(id)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil
 	}
 	if account == nil {
 		respondError(w, http.StatusNotFound, "account not found")
-		return
-	}
-
-	rules, err := h.store.ListRules(accountID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil
 	}
+	return account
+}
 
-	// Get optional parameters
+// senderFrequency counts the senders of the most recent messages in the
+// account's folder, as given by the folder and limit query parameters. If
+// that fails it responds with an error and returns false.
+func (h *Handler) senderFrequency(w http.ResponseWriter, r *http.Request, account *models.Account) ([]models.SenderCount, bool) {
 	folder := r.URL.Query().Get("folder")
 	if folder == "" {
-		folder = "INBOX"
+		folder = account.Inbox()
 	}
 
-	limit := 100
+	limit := 200
 	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
 			limit = l
 		}
 	}
 
-	client, err := imapClient.Connect(account)
+	client, err := h.connect(r.Context(), account)
 	if err != nil {
-		respondError(w, http.StatusBadGateway, err.Error())
-		return
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return nil, false
 	}
 	defer client.Close()
 
-	result, err := client.PreviewRules(rules, folder, limit)
+	senders, err := client.SenderFrequency(folder, limit)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return nil, false
 	}
-
-	respondJSON(w, http.StatusOK, result)
+	return senders, true
 }
 
-// ApplyRules applies rules to move emails
-func (h *Handler) ApplyRules(w http.ResponseWriter, r *http.Request) {
+// Rule Handlers
+
+// ListRules returns all rules for an account
+func (h *Handler) ListRules(w http.ResponseWriter, r *http.Request) {
 	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, "invalid account ID")
 		return
 	}
 
-	account, err := h.store.GetAccount(accountID)
+	cursor, limit, paged, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if paged {
+		rules, next, err := h.store.ListRulesPage(accountID, cursor, limit)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if rules == nil {
+			rules = []models.Rule{}
+		}
+		respondJSON(w, http.StatusOK, newPageResponse(rules, next))
+		return
+	}
+
+	rules, err := h.store.ListRules(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// AnalyzeRules reports the account's rules that never match because a rule
+// evaluated before them matches everything they would
+func (h *Handler) AnalyzeRules(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	account, err := h.store.GetAccount(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	rules, err := h.store.ListRules(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.AnalyzeRules(rules))
+}
+
+// ListRuleSuggestions proposes unsaved rules for the account's most frequent
+// senders that no enabled rule covers yet
+func (h *Handler) ListRuleSuggestions(w http.ResponseWriter, r *http.Request) {
+	account := h.accountFromURL(w, r)
+	if account == nil {
+		return
+	}
+
+	rules, err := h.store.ListRules(account.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	senders, ok := h.senderFrequency(w, r, account)
+	if !ok {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.SuggestRules(senders, rules))
+}
+
+// ListAllRules returns rules across all accounts, annotated with the account
+// name. Results can be narrowed with the enabled and account_id query parameters.
+func (h *Handler) ListAllRules(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var enabledFilter *bool
+	if v := query.Get("enabled"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid enabled filter")
+			return
+		}
+		enabledFilter = &enabled
+	}
+
+	var accountFilter int64
+	if v := query.Get("account_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid account ID")
+			return
+		}
+		accountFilter = id
+	}
+
+	rules, err := h.store.ListAllRulesWithAccount()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filtered := make([]models.RuleWithAccount, 0, len(rules))
+	for _, rule := range rules {
+		if enabledFilter != nil && rule.Enabled != *enabledFilter {
+			continue
+		}
+		if accountFilter != 0 && rule.AccountID != accountFilter {
+			continue
+		}
+		filtered = append(filtered, rule)
+	}
+
+	respondJSON(w, http.StatusOK, filtered)
+}
+
+// GetRule returns a single rule
+func (h *Handler) GetRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		return
+	}
+
+	rule, err := h.store.GetRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rule == nil {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rule)
+}
+
+// CreateRule creates a new rule
+func (h *Handler) CreateRule(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	var rule models.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	rule.AccountID = accountID
+
+	account, err := h.store.GetAccount(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	if err := validateRule(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	duplicate, err := h.store.FindDuplicateRule(accountID, rule.Pattern, rule.PatternType, rule.MoveToFolder)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := h.store.CreateRule(&rule); err != nil {
+		// The account was deleted between the check above and the insert
+		if errors.Is(err, storage.ErrForeignKey) {
+			respondError(w, http.StatusConflict, "account no longer exists")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := ruleResponse{Rule: rule, Warnings: models.PatternWarnings(&rule)}
+	if duplicate != nil {
+		resp.Warning = fmt.Sprintf("an identical enabled rule already exists: %q (id %d)", duplicate.Name, duplicate.ID)
+	}
+
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// validateRule defaults the rule's pattern type to sender and its action to
+// move, and checks the required, action-specific and optional condition
+// fields. Archive rules may leave move_to_folder empty, as the server's
+// \Archive folder is used.
+func validateRule(rule *models.Rule) error {
+	if rule.Name == "" || rule.Pattern == "" {
+		return errors.New("name and pattern are required")
+	}
+	if rule.PatternType == "" {
+		rule.PatternType = "sender"
+	}
+	if rule.Action == "" {
+		rule.Action = models.ActionMove
+	}
+
+	switch rule.Action {
+	case models.ActionMove:
+		if rule.MoveToFolder == "" {
+			return errors.New("move_to_folder is required unless action is archive")
+		}
+	case models.ActionArchive:
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	if len(rule.Patterns()) == 0 {
+		return errors.New("pattern must list at least one alternative")
+	}
+	if rule.OlderThanDays < 0 {
+		return errors.New("older_than_days must not be negative")
+	}
+	if rule.SamplePercent < 0 || rule.SamplePercent > 100 {
+		return errors.New("sample_percent must be between 0 and 100")
+	}
+	if rule.ExcludeKeyword != "" && !imapClient.ValidKeyword(rule.ExcludeKeyword) {
+		return fmt.Errorf("invalid exclude_keyword %q", rule.ExcludeKeyword)
+	}
+	return nil
+}
+
+// ruleResponse is a created or updated rule plus warnings about it: Warning
+// when it duplicates an existing enabled rule, and Warnings when its pattern
+// is overly broad
+type ruleResponse struct {
+	models.Rule
+	Warning  string   `json:"warning,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CloneRule creates a disabled copy of an existing rule
+func (h *Handler) CloneRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		return
+	}
+
+	clone, err := h.store.CloneRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if clone == nil {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, clone)
+}
+
+// UpdateRule updates an existing rule
+func (h *Handler) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		return
+	}
+
+	existing, err := h.store.GetRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	var rule models.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	rule.ID = id
+	rule.AccountID = existing.AccountID
+
+	if err := validateRule(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.store.UpdateRule(&rule); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ruleResponse{Rule: rule, Warnings: models.PatternWarnings(&rule)})
+}
+
+// PatchRule updates only the rule fields given in the request body
+func (h *Handler) PatchRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		return
+	}
+
+	existing, err := h.store.GetRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing == nil {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	var patch models.RulePatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Validate the rule as it will be after the patch
+	rule := *existing
+	patch.Apply(&rule)
+	if err := validateRule(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// validateRule fills in the default pattern type and action
+	if patch.PatternType != nil {
+		patch.PatternType = &rule.PatternType
+	}
+	if patch.Action != nil {
+		patch.Action = &rule.Action
+	}
+
+	if err := h.store.PatchRule(id, &patch); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	updated, err := h.store.GetRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if updated == nil {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ruleResponse{Rule: *updated, Warnings: models.PatternWarnings(updated)})
+}
+
+// DeleteRule deletes a rule
+func (h *Handler) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid rule ID")
+		return
+	}
+
+	deleted, err := h.store.DeleteRule(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if deleted == 0 {
+		respondError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	respondJSON(w, http.StatusNoContent, nil)
+}
+
+// Admin Handlers
+
+// AdminCleanup deletes rules orphaned from deleted accounts and returns how
+// many were removed
+func (h *Handler) AdminCleanup(w http.ResponseWriter, r *http.Request) {
+	deleted, err := h.store.DeleteOrphanedRules()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]int64{"deleted_rules": deleted})
+}
+
+// Preview Handler
+
+// PreviewRules previews the effect of rules on an account's emails
+func (h *Handler) PreviewRules(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	account, err := h.store.GetAccount(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+
+	rules, err := h.store.ListRules(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get optional parameters
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = account.Inbox()
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	offset, token, paged, err := parsePreviewPage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if paged && folder == imapClient.AllFolders {
+		respondError(w, http.StatusBadRequest, "paging is not supported when previewing all folders")
+		return
+	}
+
+	client, err := imapClient.ConnectContext(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return
+	}
+	defer client.Close()
+
+	if paged {
+		result, status, err := h.previewPage(client, accountID, rules, folder, token, offset, limit)
+		if err != nil {
+			respondError(w, status, err.Error())
+			return
+		}
+		result.Warning = noRulesWarning(rules)
+		respondJSON(w, http.StatusOK, result)
+		return
+	}
+
+	if folder == imapClient.AllFolders {
+		results, err := client.PreviewAllFolders(rules, limit)
+		if err != nil {
+			respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+			return
+		}
+		results.Warning = noRulesWarning(rules)
+		respondJSON(w, http.StatusOK, results)
+		return
+	}
+
+	result, err := client.PreviewRules(rules, folder, limit)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return
+	}
+	result.Warning = noRulesWarning(rules)
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+// parsePreviewPage reads the offset and snapshot query parameters of a
+// paginated preview. paged is false when neither is given, in which case the
+// most recent messages are previewed as before.
+func parsePreviewPage(r *http.Request) (offset int, token string, paged bool, err error) {
+	query := r.URL.Query()
+	offsetStr, token := query.Get("offset"), query.Get("snapshot")
+	if offsetStr == "" && token == "" {
+		return 0, "", false, nil
+	}
+	if offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, "", false, errors.New("invalid offset")
+		}
+	}
+	return offset, token, true, nil
+}
+
+// previewPage previews limit messages of a snapshot of folder starting at
+// offset. Without a token a new snapshot of the whole folder is taken;
+// further pages are requested with the token returned in the result and see
+// the same messages even if new mail arrives in between.
+func (h *Handler) previewPage(client *imapClient.Client, accountID int64, rules []models.Rule, folder, token string, offset, limit int) (*models.PreviewResult, int, error) {
+	var snap *previewSnapshot
+	if token != "" {
+		if snap = h.snapshots.get(token, accountID, folder); snap == nil {
+			return nil, http.StatusNotFound, errors.New("preview snapshot not found or expired")
+		}
+		client.ExpectUIDValidity(folder, snap.uidValidity)
+		if _, err := client.SelectFolder(folder); err != nil {
+			return nil, imapErrorStatus(err, http.StatusInternalServerError), err
+		}
+	} else {
+		if _, err := client.SelectFolder(folder); err != nil {
+			return nil, imapErrorStatus(err, http.StatusInternalServerError), err
+		}
+		uids, err := client.SnapshotUIDs(0)
+		if err != nil {
+			return nil, imapErrorStatus(err, http.StatusInternalServerError), err
+		}
+		snap = &previewSnapshot{accountID: accountID, folder: folder, uidValidity: client.UIDValidity(), uids: uids}
+		if token, err = h.snapshots.add(snap); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	start := min(offset, len(snap.uids))
+	end := min(start+limit, len(snap.uids))
+	result, err := client.PreviewRulesByUID(rules, "", snap.uids[start:end])
+	if err != nil {
+		return nil, imapErrorStatus(err, http.StatusInternalServerError), err
+	}
+	result.Snapshot = token
+	result.SnapshotTotal = len(snap.uids)
+	if end < len(snap.uids) {
+		result.NextOffset = end
+	}
+	return result, http.StatusOK, nil
+}
+
+// ApplyRules applies rules to move emails
+func (h *Handler) ApplyRules(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "accountId"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	account, err := h.store.GetAccount(accountID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -435,33 +1312,295 @@ func (h *Handler) ApplyRules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rules, err := h.store.ListRules(accountID)
+	opts, err := parseApplyOptions(r)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	folder := r.URL.Query().Get("folder")
-	if folder == "" {
-		folder = "INBOX"
-	}
+	h.respondIdempotent(w, r, func() (interface{}, int, error) {
+		return h.applyAccount(r.Context(), account, opts)
+	})
+}
+
+// maxConcurrentApplies bounds how many accounts ApplyAllAccounts works on at
+// once
+const maxConcurrentApplies = 4
+
+// accountApplyResult is the outcome of applying rules to one account of
+// ApplyAllAccounts
+type accountApplyResult struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
 
-	dryRun := r.URL.Query().Get("dry_run") == "true"
+// accountApplyResults are the results of ApplyAllAccounts by account ID
+type accountApplyResults map[int64]*accountApplyResult
 
-	client, err := imapClient.Connect(account)
+// ApplyAllAccounts applies rules to the accounts listed in the accounts
+// query parameter, or to every enabled account when it is omitted. Each
+// account is applied as by ApplyRules, and a failing account doesn't stop
+// the others. The response maps account IDs to their results.
+func (h *Handler) ApplyAllAccounts(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseApplyOptions(r)
 	if err != nil {
-		respondError(w, http.StatusBadGateway, err.Error())
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if opts.uidValidity != 0 {
+		respondError(w, http.StatusBadRequest, "uid_validity can't be used across accounts")
+		return
+	}
+	if opts.resume {
+		respondError(w, http.StatusBadRequest, "resume can't be used across accounts")
 		return
 	}
+
+	results := make(accountApplyResults)
+	var accounts []*models.Account
+	if param := r.URL.Query().Get("accounts"); param != "" {
+		for _, field := range strings.Split(param, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid account ID %q", field))
+				return
+			}
+			if _, seen := results[id]; seen {
+				continue
+			}
+
+			account, err := h.store.GetAccount(id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if account == nil {
+				results[id] = &accountApplyResult{Error: "account not found"}
+				continue
+			}
+			results[id] = &accountApplyResult{}
+			accounts = append(accounts, account)
+		}
+	} else {
+		all, err := h.store.ListAccounts()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := range all {
+			if all[i].Enabled {
+				results[all[i].ID] = &accountApplyResult{}
+				accounts = append(accounts, &all[i])
+			}
+		}
+	}
+
+	h.respondIdempotent(w, r, func() (interface{}, int, error) {
+		sem := make(chan struct{}, maxConcurrentApplies)
+		var wg sync.WaitGroup
+		for _, account := range accounts {
+			wg.Add(1)
+			go func(account *models.Account, out *accountApplyResult) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				// Each account counts against its own limit, as if
+				// applied to on its own
+				if ok, _ := h.limiter.allow(accountKey(account.ID)); !ok {
+					out.Error = errTooManyRequests
+					return
+				}
+				result, _, err := h.applyAccount(r.Context(), account, opts)
+				if err != nil {
+					out.Error = err.Error()
+					return
+				}
+				out.Result = result
+			}(account, results[account.ID])
+		}
+		wg.Wait()
+		return results, http.StatusOK, nil
+	})
+}
+
+// applyOptions are the query parameters of an apply request
+type applyOptions struct {
+	folder       string
+	dryRun       bool
+	tagProcessed bool
+	autoCreate   bool
+	uidValidity  uint32
+	maxMoves     int
+	resume       bool
+}
+
+// parseApplyOptions reads the apply query parameters from r
+func parseApplyOptions(r *http.Request) (applyOptions, error) {
+	opts := applyOptions{
+		folder:       r.URL.Query().Get("folder"),
+		dryRun:       r.URL.Query().Get("dry_run") == "true",
+		tagProcessed: r.URL.Query().Get("tag_processed") == "true",
+		autoCreate:   r.URL.Query().Get("auto_create_folders") == "true",
+		resume:       r.URL.Query().Get("resume") == "true",
+	}
+	// Continue an apply interrupted by a crash or shutdown from the
+	// progress recorded for it
+	if opts.resume {
+		if opts.folder == imapClient.AllFolders {
+			return opts, errors.New("resume can't be used with folder=all")
+		}
+		if r.URL.Query().Has("uid_validity") {
+			return opts, errors.New("resume can't be combined with uid_validity")
+		}
+	}
+	// UIDVALIDITY from an earlier preview; if the folder has since been
+	// reset, the previewed UIDs may now refer to different messages
+	if v := r.URL.Query().Get("uid_validity"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return opts, errors.New("invalid uid_validity")
+		}
+		opts.uidValidity = uint32(parsed)
+		if opts.folder == imapClient.AllFolders {
+			return opts, errors.New("uid_validity can't be used with folder=all")
+		}
+	}
+
+	// Cap on the messages moved, so a cautious user can apply in batches
+	if v := r.URL.Query().Get("max_moves"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return opts, errors.New("invalid max_moves")
+		}
+		opts.maxMoves = n
+	}
+	return opts, nil
+}
+
+// applyAccount applies the account's rules as described by opts. On failure
+// it returns the HTTP status to respond with.
+func (h *Handler) applyAccount(ctx context.Context, account *models.Account, opts applyOptions) (interface{}, int, error) {
+	if opts.folder == "" {
+		opts.folder = account.Inbox()
+	}
+
+	rules, err := h.store.ListRules(account.ID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var run *models.ApplyRun
+	if opts.resume {
+		if run, err = h.store.GetInProgressRun(account.ID, opts.folder); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if run == nil {
+			return nil, http.StatusNotFound, fmt.Errorf("no interrupted apply of %s to resume", opts.folder)
+		}
+	}
+
+	client, err := h.connect(ctx, account)
+	if err != nil {
+		return nil, imapErrorStatus(err, http.StatusBadGateway), err
+	}
 	defer client.Close()
 
-	result, err := client.ApplyRules(rules, folder, dryRun)
+	if opts.uidValidity != 0 {
+		client.ExpectUIDValidity(opts.folder, opts.uidValidity)
+	}
+	if opts.tagProcessed {
+		client.TagProcessed(models.ProcessedKeyword)
+	}
+	if opts.autoCreate {
+		client.CreateMissingFolders()
+	}
+
+	if opts.folder == imapClient.AllFolders {
+		results, err := client.ApplyRulesAllFolders(rules, opts.dryRun, opts.maxMoves)
+		if err != nil {
+			return nil, imapErrorStatus(err, http.StatusInternalServerError), err
+		}
+		results.Warning = noRulesWarning(rules)
+		return results, http.StatusOK, nil
+	}
+
+	if run != nil && run.LastUID != 0 {
+		client.ExpectUIDValidity(opts.folder, run.UIDValidity)
+		client.ResumeBefore(run.LastUID)
+	}
+	// Record each move, so that if the apply is cut short it can be resumed
+	if !opts.dryRun {
+		if run == nil {
+			run = &models.ApplyRun{AccountID: account.ID, Folder: opts.folder}
+			if err := h.store.StartApplyRun(run); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+		}
+		client.OnMoved(func(uid uint32) error {
+			return h.store.RecordApplyProgress(run.ID, client.UIDValidity(), uid)
+		})
+	}
+
+	result, err := client.ApplyRules(rules, opts.folder, opts.dryRun, opts.maxMoves)
+	if errors.Is(err, imapClient.ErrUIDValidityChanged) {
+		if opts.resume {
+			return nil, http.StatusConflict, fmt.Errorf("%w; apply again without resume", err)
+		}
+		return nil, http.StatusConflict, fmt.Errorf("%w; preview again before applying", err)
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil, imapErrorStatus(err, http.StatusInternalServerError), err
 	}
+	if !opts.dryRun {
+		if err := h.store.FinishApplyRun(run.ID); err != nil {
+			log.Printf("Finishing apply run %d: %v", run.ID, err)
+		}
+	}
+	result.Warning = noRulesWarning(rules)
+	return result, http.StatusOK, nil
+}
 
-	respondJSON(w, http.StatusOK, result)
+// imapErrorStatus returns the HTTP status to respond with for an error from
+// the IMAP client, or fallback if it isn't one of the client's errors
+func imapErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, imapClient.ErrAuthFailed):
+		return http.StatusUnauthorized
+	case errors.Is(err, imapClient.ErrConnect):
+		return http.StatusBadGateway
+	case errors.Is(err, imapClient.ErrFolderNotFound), errors.Is(err, imapClient.ErrMessageNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, imapClient.ErrReadOnly), errors.Is(err, imapClient.ErrDestinationNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, imapClient.ErrUIDValidityChanged), errors.Is(err, imapClient.ErrFolderExists):
+		return http.StatusConflict
+	case errors.Is(err, imapClient.ErrThrottled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, imapClient.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return fallback
+}
+
+// hasEnabledRules reports whether any of rules is enabled
+func hasEnabledRules(rules []models.Rule) bool {
+	for _, rule := range rules {
+		if rule.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// noRulesWarning returns the result warning for running rules, so that a
+// preview or apply without any enabled rules isn't mistaken for one that
+// found nothing to match
+func noRulesWarning(rules []models.Rule) string {
+	if hasEnabledRules(rules) {
+		return ""
+	}
+	return models.WarningNoEnabledRules
 }
 
 // CreateFolder creates a new folder in an account
@@ -495,17 +1634,231 @@ func (h *Handler) CreateFolder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client, err := imapClient.Connect(account)
+	client, err := imapClient.ConnectContext(r.Context(), account)
 	if err != nil {
-		respondError(w, http.StatusBadGateway, err.Error())
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
 		return
 	}
 	defer client.Close()
 
-	if err := client.CreateFolder(req.Name); err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+	err = client.CreateFolder(req.Name)
+	if errors.Is(err, imapClient.ErrFolderExists) && r.URL.Query().Get("if_not_exists") == "true" {
+		respondJSON(w, http.StatusOK, map[string]string{"name": req.Name})
+		return
+	}
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, map[string]string{"name": req.Name})
 }
+
+// moveMessageRequest is the body of a single-message move
+type moveMessageRequest struct {
+	Folder       string `json:"folder"`
+	SourceFolder string `json:"source_folder"`
+}
+
+// MoveMessage moves a single message to another folder, for manual triage
+// from the preview
+func (h *Handler) MoveMessage(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	uid, err := strconv.ParseUint(chi.URLParam(r, "uid"), 10, 32)
+	if err != nil || uid == 0 {
+		respondError(w, http.StatusBadRequest, "invalid message UID")
+		return
+	}
+
+	var req moveMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Folder == "" {
+		respondError(w, http.StatusBadRequest, "folder is required")
+		return
+	}
+	account, err := h.store.GetAccount(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if req.SourceFolder == "" {
+		req.SourceFolder = account.Inbox()
+	}
+
+	client, err := h.connect(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return
+	}
+	defer client.Close()
+
+	if err := client.MoveMessageFrom(req.SourceFolder, uint32(uid), req.Folder); err != nil {
+		// A missing destination is a bad request; a missing source folder
+		// is not found, as imapErrorStatus has it
+		if errors.Is(err, imapClient.ErrDestinationNotFound) {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"uid":    uid,
+		"folder": req.Folder,
+	})
+}
+
+// GetUnsubscribeInfo returns how to unsubscribe from the mailing list that
+// sent a message, from its List-Unsubscribe header. The message is looked up
+// in the folder query parameter, the account's inbox by default.
+func (h *Handler) GetUnsubscribeInfo(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	uid, err := strconv.ParseUint(chi.URLParam(r, "uid"), 10, 32)
+	if err != nil || uid == 0 {
+		respondError(w, http.StatusBadRequest, "invalid message UID")
+		return
+	}
+
+	account, err := h.store.GetAccount(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = account.Inbox()
+	}
+
+	client, err := h.connect(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder(folder); err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return
+	}
+	info, err := client.GetUnsubscribeInfo(uint32(uid))
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return
+	}
+	if info == nil {
+		respondError(w, http.StatusNotFound, "message has no List-Unsubscribe header")
+		return
+	}
+	respondJSON(w, http.StatusOK, info)
+}
+
+// messageActionRequest is the body of a batch message action
+type messageActionRequest struct {
+	UIDs         []uint32 `json:"uids"`
+	Action       string   `json:"action"`
+	Folder       string   `json:"folder"`
+	Keyword      string   `json:"keyword"`
+	SourceFolder string   `json:"source_folder"`
+}
+
+// MessageActions moves, deletes or marks as read a user-selected set of
+// messages
+func (h *Handler) MessageActions(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid account ID")
+		return
+	}
+
+	var req messageActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if !imapClient.ValidAction(req.Action) {
+		respondError(w, http.StatusBadRequest, "action must be one of move, delete, mark_read, add_keyword")
+		return
+	}
+	if len(req.UIDs) == 0 {
+		respondError(w, http.StatusBadRequest, "uids is required")
+		return
+	}
+	for _, uid := range req.UIDs {
+		if uid == 0 {
+			respondError(w, http.StatusBadRequest, "invalid message UID")
+			return
+		}
+	}
+	if req.Action == imapClient.ActionMove && req.Folder == "" {
+		respondError(w, http.StatusBadRequest, "folder is required for move")
+		return
+	}
+	if req.Action == imapClient.ActionAddKeyword && !imapClient.ValidKeyword(req.Keyword) {
+		respondError(w, http.StatusBadRequest, "a valid keyword is required for add_keyword")
+		return
+	}
+	account, err := h.store.GetAccount(accountID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if account == nil {
+		respondError(w, http.StatusNotFound, "account not found")
+		return
+	}
+	if req.SourceFolder == "" {
+		req.SourceFolder = account.Inbox()
+	}
+
+	client, err := h.connect(r.Context(), account)
+	if err != nil {
+		respondError(w, imapErrorStatus(err, http.StatusBadGateway), err.Error())
+		return
+	}
+	defer client.Close()
+
+	target := req.Folder
+	if req.Action == imapClient.ActionAddKeyword {
+		target = req.Keyword
+	}
+
+	affected, err := client.ApplyAction(req.SourceFolder, req.UIDs, req.Action, target)
+	if err != nil {
+		// As in MoveMessage, only a missing destination is a bad request
+		if errors.Is(err, imapClient.ErrDestinationNotFound) {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondError(w, imapErrorStatus(err, http.StatusInternalServerError), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"action":   req.Action,
+		"affected": affected,
+	})
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// IdempotencyKeyHeader lets a client retry an apply request without moving
+// messages twice: a repeat with the same key gets the original response.
+// Reusing a key for a request with another query or body is an error.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyTTL is how long a completed apply is remembered for its key
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotentResults is how many completed requests are remembered at
+// once. Remembering one more forgets the oldest, whose key then executes
+// again.
+const maxIdempotentResults = 1000
+
+// idempotencyKey identifies a request by its path, which includes the
+// account ID, and the client's key
+type idempotencyKey struct {
+	path string
+	key  string
+}
+
+// idempotentResult is the response of a request with an idempotency key.
+// done is closed once the request has finished. fingerprint identifies the
+// request that first used the key, see requestFingerprint.
+type idempotentResult struct {
+	fingerprint string
+	done        chan struct{}
+	result      interface{}
+	status      int
+	err         error
+	expires     time.Time
+}
+
+// idempotencyStore remembers the responses of successful requests by key
+// for ttl, at most max at once. Failed requests are forgotten, so that a
+// retry executes again.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	now     func() time.Time
+	results map[idempotencyKey]*idempotentResult
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		max:     maxIdempotentResults,
+		now:     time.Now,
+		results: make(map[idempotencyKey]*idempotentResult),
+	}
+}
+
+// begin returns the result for key and whether the caller, the request with
+// the given fingerprint, owns it. The owner must execute the request and
+// call finish; anyone else waits on done.
+func (s *idempotencyStore) begin(key idempotencyKey, fingerprint string) (*idempotentResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for k, res := range s.results {
+		if !res.expires.IsZero() && now.After(res.expires) {
+			delete(s.results, k)
+		}
+	}
+
+	if res, ok := s.results[key]; ok {
+		return res, false
+	}
+	for len(s.results) >= s.max {
+		if !s.evictOldest() {
+			break
+		}
+	}
+	res := &idempotentResult{fingerprint: fingerprint, done: make(chan struct{})}
+	s.results[key] = res
+	return res, true
+}
+
+// finish records the outcome of the request owning res and wakes up any
+// requests waiting for it. A result that failed in part, such as an apply to
+// several accounts of which one was rate limited, is forgotten like a failed
+// one, so that a retry executes again.
+func (s *idempotencyStore) finish(key idempotencyKey, res *idempotentResult, result interface{}, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res.result, res.status, res.err = replayable(result), status, err
+	if err != nil || partlyFailed(result) {
+		// The key may have been evicted and used again since
+		if s.results[key] == res {
+			delete(s.results, key)
+		}
+	} else {
+		res.expires = s.now().Add(s.ttl)
+	}
+	close(res.done)
+}
+
+// evictOldest forgets the completed request that expires first, and reports
+// whether there was one. Requests still in progress are kept, so that their
+// waiters get the result; there are only as many as requests being served.
+// s.mu must be held.
+func (s *idempotencyStore) evictOldest() bool {
+	var oldest idempotencyKey
+	found := false
+	for k, res := range s.results {
+		if res.expires.IsZero() {
+			continue
+		}
+		if !found || res.expires.Before(s.results[oldest].expires) {
+			oldest, found = k, true
+		}
+	}
+	if found {
+		delete(s.results, oldest)
+	}
+	return found
+}
+
+// replayable returns the part of an apply result that is kept for replaying
+// it. Apply results list every message fetched; only the ones a rule matched
+// are kept.
+func replayable(result interface{}) interface{} {
+	switch result := result.(type) {
+	case *models.PreviewResult:
+		if result == nil {
+			return result
+		}
+		trimmed := *result
+		trimmed.Messages = nil
+		for _, msg := range result.Messages {
+			if msg.MatchedRule != nil {
+				trimmed.Messages = append(trimmed.Messages, msg)
+			}
+		}
+		if trimmed.Messages == nil {
+			trimmed.Messages = []models.Message{}
+		}
+		return &trimmed
+	case *models.FolderResults:
+		if result == nil {
+			return result
+		}
+		trimmed := *result
+		trimmed.Folders = make(map[string]*models.PreviewResult, len(result.Folders))
+		for folder, r := range result.Folders {
+			trimmed.Folders[folder] = replayable(r).(*models.PreviewResult)
+		}
+		return &trimmed
+	case accountApplyResults:
+		trimmed := make(accountApplyResults, len(result))
+		for id, r := range result {
+			trimmed[id] = &accountApplyResult{Result: replayable(r.Result), Error: r.Error}
+		}
+		return trimmed
+	}
+	return result
+}
+
+// partlyFailed reports whether result is one that failed for some of what it
+// covers
+func partlyFailed(result interface{}) bool {
+	results, ok := result.(accountApplyResults)
+	if !ok {
+		return false
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// respondIdempotent responds with the result of fn, or, if the request has
+// an Idempotency-Key header that was seen before, with the result of the
+// request that first used it
+func (h *Handler) respondIdempotent(w http.ResponseWriter, r *http.Request, fn func() (interface{}, int, error)) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		result, status, err := fn()
+		respondResult(w, result, status, err)
+		return
+	}
+
+	fingerprint, err := requestFingerprint(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "reading request body: "+err.Error())
+		return
+	}
+
+	k := idempotencyKey{path: r.URL.Path, key: key}
+	res, owner := h.idempotency.begin(k, fingerprint)
+	if !owner {
+		if res.fingerprint != fingerprint {
+			respondError(w, http.StatusUnprocessableEntity, IdempotencyKeyHeader+" was already used for a different request")
+			return
+		}
+		select {
+		case <-res.done:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		respondResult(w, res.result, res.status, res.err)
+		return
+	}
+
+	finished := false
+	defer func() {
+		// Don't leave waiters hanging if fn panics
+		if !finished {
+			h.idempotency.finish(k, res, nil, http.StatusInternalServerError, errors.New("request failed"))
+		}
+	}()
+	result, status, err := fn()
+	h.idempotency.finish(k, res, result, status, err)
+	finished = true
+	respondResult(w, result, status, err)
+}
+
+// requestFingerprint identifies what a request asks for beyond its path: its
+// query, with the parameters in a canonical order, and its body. The body is
+// read and replaced, so the handler can still read it.
+func requestFingerprint(r *http.Request) (string, error) {
+	hash := sha256.New()
+	io.WriteString(hash, r.URL.Query().Encode())
+	hash.Write([]byte{0})
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// respondResult responds with result, or with err if it isn't nil
+func respondResult(w http.ResponseWriter, result interface{}, status int, err error) {
+	if err != nil {
+		respondError(w, status, err.Error())
+		return
+	}
+	respondJSON(w, status, result)
+}
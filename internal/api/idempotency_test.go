@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func applyWithKey(t *testing.T, handler *Handler, key string) (*httptest.ResponseRecorder, models.PreviewResult) {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/api/accounts/1/apply", nil)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("accountId", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+
+	handler.ApplyRules(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result models.PreviewResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return w, result
+}
+
+func TestApplyRulesIdempotencyKey(t *testing.T) {
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	ts, account := setupTestIMAPAccount(t, store)
+	ts.AddMessage("newsletter@example.com", "First", "Content")
+	ts.CreateFolder("Newsletters")
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true})
+
+	_, first := applyWithKey(t, handler, "key-1")
+	if first.MatchedMessages != 1 {
+		t.Fatalf("Expected 1 match, got %d", first.MatchedMessages)
+	}
+
+	// A retry with the same key returns the original result without moving
+	// the new message
+	ts.AddMessage("newsletter@example.com", "Second", "Content")
+	w, retry := applyWithKey(t, handler, "key-1")
+	if retry.MatchedMessages != 1 || retry.Messages[0].Subject != "First" {
+		t.Errorf("Expected the original result, got %+v", retry)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected the replayed response to be marked")
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 1 {
+		t.Errorf("Expected the retry not to move anything, Newsletters has %d", n)
+	}
+
+	// A different key executes again
+	w, second := applyWithKey(t, handler, "key-2")
+	if second.MatchedMessages != 1 || second.Messages[0].Subject != "Second" {
+		t.Errorf("Expected a new result, got %+v", second)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected a fresh response not to be marked as replayed")
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 2 {
+		t.Errorf("Expected 2 messages in Newsletters, got %d", n)
+	}
+}
+
+func TestApplyRulesIdempotencyKeyReused(t *testing.T) {
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	ts, account := setupTestIMAPAccount(t, store)
+	ts.AddMessage("newsletter@example.com", "First", "Content")
+	ts.CreateFolder("Newsletters")
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true})
+
+	apply := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, nil)
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("accountId", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		handler.ApplyRules(w, req)
+		return w
+	}
+
+	if w := apply("/api/accounts/1/apply?dry_run=true&folder=INBOX"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The same parameters in another order are the same request
+	w := apply("/api/accounts/1/apply?folder=INBOX&dry_run=true")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected a replayed 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A real run must not get the dry run's result
+	if w := apply("/api/accounts/1/apply?folder=INBOX"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a key reused with other parameters, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 0 {
+		t.Errorf("Expected nothing moved, Newsletters has %d", n)
+	}
+}
+
+func TestIdempotencyStoreExpires(t *testing.T) {
+	now := time.Now()
+	s := newIdempotencyStore(time.Hour)
+	s.now = func() time.Time { return now }
+
+	key := idempotencyKey{path: "/api/accounts/1/apply", key: "k"}
+	res, owner := s.begin(key, "")
+	if !owner {
+		t.Fatal("Expected the first request to own the key")
+	}
+	s.finish(key, res, "done", http.StatusOK, nil)
+
+	if got, owner := s.begin(key, ""); owner || got.result != "done" {
+		t.Errorf("Expected the stored result within the TTL, got owner=%v result=%v", owner, got.result)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, owner := s.begin(key, ""); !owner {
+		t.Error("Expected the key to be forgotten after the TTL")
+	}
+}
+
+func TestIdempotencyStoreForgetsFailures(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+
+	key := idempotencyKey{path: "/api/accounts/1/apply", key: "k"}
+	res, _ := s.begin(key, "")
+	s.finish(key, res, nil, http.StatusBadGateway, errors.New("connection refused"))
+
+	if _, owner := s.begin(key, ""); !owner {
+		t.Error("Expected a failed request to be executed again")
+	}
+}
+
+func TestIdempotencyStoreWaitsForInFlight(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+
+	key := idempotencyKey{path: "/api/accounts/1/apply", key: "k"}
+	res, _ := s.begin(key, "")
+	waiting, owner := s.begin(key, "")
+	if owner {
+		t.Fatal("Expected a concurrent request not to own the key")
+	}
+
+	select {
+	case <-waiting.done:
+		t.Fatal("Expected the result to be pending")
+	default:
+	}
+	s.finish(key, res, "done", http.StatusOK, nil)
+	<-waiting.done
+	if waiting.result != "done" {
+		t.Errorf("Expected the owner's result, got %v", waiting.result)
+	}
+}
+
+func TestIdempotencyStoreEvictsOldest(t *testing.T) {
+	now := time.Now()
+	s := newIdempotencyStore(time.Hour)
+	s.max = 2
+	s.now = func() time.Time { return now }
+
+	keys := []idempotencyKey{
+		{path: "/api/apply", key: "a"},
+		{path: "/api/apply", key: "b"},
+		{path: "/api/apply", key: "c"},
+	}
+	for _, key := range keys {
+		res, _ := s.begin(key, "")
+		s.finish(key, res, "done", http.StatusOK, nil)
+		now = now.Add(time.Minute)
+	}
+
+	if len(s.results) != 2 {
+		t.Errorf("Expected 2 remembered results, got %d", len(s.results))
+	}
+	if _, owner := s.begin(keys[0], ""); !owner {
+		t.Error("Expected the oldest result to be evicted")
+	}
+}
+
+func TestIdempotencyStoreKeepsMatchedMessages(t *testing.T) {
+	s := newIdempotencyStore(time.Hour)
+	rule := &models.Rule{ID: 1}
+	result := &models.PreviewResult{
+		TotalMessages:   2,
+		MatchedMessages: 1,
+		Messages:        []models.Message{{UID: 1, MatchedRule: rule}, {UID: 2}},
+	}
+
+	key := idempotencyKey{path: "/api/accounts/1/apply", key: "k"}
+	res, _ := s.begin(key, "")
+	s.finish(key, res, result, http.StatusOK, nil)
+
+	stored := res.result.(*models.PreviewResult)
+	if len(stored.Messages) != 1 || stored.Messages[0].UID != 1 {
+		t.Errorf("Expected only the matched message to be kept, got %+v", stored.Messages)
+	}
+	if stored.TotalMessages != 2 {
+		t.Errorf("Expected the totals to be kept, got %d", stored.TotalMessages)
+	}
+}
+
+func TestApplyAllAccountsIdempotencyKeyRetriesFailedAccounts(t *testing.T) {
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	ts, account := setupTestIMAPAccount(t, store)
+	ts.AddMessage("newsletter@example.com", "First", "Content")
+	ts.CreateFolder("Newsletters")
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true})
+
+	router := NewRouter(handler, RouterConfig{AccountRateLimit: 1, AccountRateBurst: 1})
+	defer handler.Close()
+	now := time.Now()
+	handler.limiter.now = func() time.Time { return now }
+
+	apply := func() (*httptest.ResponseRecorder, map[int64]accountApplyResult) {
+		req := httptest.NewRequest("POST", "/api/apply", nil)
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var results map[int64]accountApplyResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return w, results
+	}
+
+	// Use up the account's only token, so the apply is rate limited
+	handler.limiter.allow(accountKey(account.ID))
+	if _, results := apply(); results[account.ID].Error != errTooManyRequests {
+		t.Fatalf("Expected the account to be rate limited, got %+v", results[account.ID])
+	}
+
+	// Once the limit has refilled, a retry with the same key applies
+	now = now.Add(time.Minute)
+	w, results := apply()
+	if w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Expected a partly failed result not to be replayed")
+	}
+	if results[account.ID].Error != "" {
+		t.Errorf("Expected the retry to succeed, got %q", results[account.ID].Error)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 1 {
+		t.Errorf("Expected the retry to move the message, Newsletters has %d", n)
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// DefaultAccountRateLimit is how many requests per minute may talk to one
+// account's IMAP server when no other limit is configured
+const DefaultAccountRateLimit = 60
+
+// DefaultAccountRateBurst is how many requests to one account's IMAP server
+// may be made back to back when no other burst is configured
+const DefaultAccountRateBurst = 10
+
+// rateLimiterSweepInterval is how often buckets that have refilled are
+// dropped
+const rateLimiterSweepInterval = time.Minute
+
+// tokenBucket holds the tokens left for one key as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per key: each key may make burst requests at
+// once, refilled at rate requests per second
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	now     func() time.Time
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for key. If none is left it returns false and how long
+// until one is. A nil limiter allows everything.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens, b.updated = l.refill(b, now), now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled, which are the same as no
+// bucket
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for k, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// sweepEvery sweeps the buckets every interval until stop is called, so
+// that allow doesn't have to look at every bucket
+func (l *rateLimiter) sweepEvery(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.sweep()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// refill returns the tokens b has at now, at most burst
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// errTooManyRequests is the error for a request over the account's limit
+const errTooManyRequests = "too many requests for this account, try again later"
+
+// checkAccountLimit takes a token for the IMAP account identified by key. If
+// none is left it responds with 429 Too Many Requests and a Retry-After
+// header, and returns false.
+func (h *Handler) checkAccountLimit(w http.ResponseWriter, key string) bool {
+	ok, wait := h.limiter.allow(key)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondError(w, http.StatusTooManyRequests, errTooManyRequests)
+	}
+	return ok
+}
+
+// accountKey is the limiter key of a saved account
+func accountKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// connectionKey is the limiter key of an account given by its settings,
+// which may not be saved: the same login on the same server is the same
+// account to its IMAP provider
+func connectionKey(account *models.Account) string {
+	return "login:" + strings.ToLower(account.Server) + "/" + account.Username
+}
+
+// accountRateLimit limits requests per account ID, taken from the
+// {accountId} or {id} URL parameter, so that one client can't get an account
+// blocked by its IMAP provider. Requests over the limit get 429 Too Many
+// Requests with a Retry-After header.
+func (h *Handler) accountRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "accountId")
+		if id == "" {
+			id = chi.URLParam(r, "id")
+		}
+		if !h.checkAccountLimit(w, id) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(60, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("1"); !ok {
+			t.Fatalf("Request %d within the burst was limited", i+1)
+		}
+	}
+	ok, wait := l.allow("1")
+	if ok {
+		t.Fatal("Expected the request after the burst to be limited")
+	}
+	if wait != time.Second {
+		t.Errorf("wait = %s, want 1s", wait)
+	}
+
+	if ok, _ := l.allow("2"); !ok {
+		t.Error("Expected another key to have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("1"); !ok {
+		t.Error("Expected a token to be refilled after a second")
+	}
+	if ok, _ := l.allow("1"); ok {
+		t.Error("Expected only one token to be refilled")
+	}
+}
+
+func TestRateLimiterForgetsRefilledBuckets(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(60, 2)
+	l.now = func() time.Time { return now }
+
+	l.allow("1")
+	l.allow("2")
+	l.allow("2")
+	now = now.Add(time.Second)
+	l.sweep()
+
+	if _, ok := l.buckets["1"]; ok {
+		t.Error("Expected the refilled bucket to be dropped")
+	}
+	if _, ok := l.buckets["2"]; !ok {
+		t.Error("Expected the bucket still refilling to be kept")
+	}
+}
+
+func TestAccountRateLimitDirectTest(t *testing.T) {
+	handler, _, cleanup := setupTestHandler(t)
+	defer cleanup()
+	router := NewRouter(handler, RouterConfig{AccountRateLimit: 1, AccountRateBurst: 1})
+	defer handler.Close()
+
+	test := func(username string) int {
+		body := `{"server": "127.0.0.1", "port": 1, "username": "` + username + `", "password": "p"}`
+		req := httptest.NewRequest("POST", "/api/accounts/test", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := test("a"); code == http.StatusTooManyRequests {
+		t.Fatal("First test of a login got 429")
+	}
+	if code := test("a"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for the second test of a login, got %d", code)
+	}
+	if code := test("b"); code == http.StatusTooManyRequests {
+		t.Error("Expected another login not to be limited")
+	}
+}
+
+func TestAccountRateLimitAccountIDParam(t *testing.T) {
+	handler, _, cleanup := setupTestHandler(t)
+	defer cleanup()
+	handler.limiter = newRateLimiter(1, 1)
+
+	limited := handler.accountRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func() int {
+		req := httptest.NewRequest("GET", "/api/accounts/1/preview", nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("accountId", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	call()
+	if code := call(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", code)
+	}
+}
+
+func TestAccountRateLimitWebSocketPreview(t *testing.T) {
+	handler, store, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+	handler.limiter = newRateLimiter(1, 1)
+	store.CreateAccount(&models.Account{Name: "Test", Server: "127.0.0.1", Port: 1, Username: "u", Password: "p"})
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLivePreview))
+	defer server.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	// preview sends a request and returns the error it ends with
+	preview := func() string {
+		payload, _ := json.Marshal(PreviewRequest{AccountID: 1})
+		if err := conn.WriteJSON(WSMessage{Type: "preview", Payload: payload}); err != nil {
+			t.Fatalf("Failed to write message: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var response WSMessage
+			if err := conn.ReadJSON(&response); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if response.Type == "error" {
+				return response.Error
+			}
+		}
+	}
+
+	if got := preview(); got == errTooManyRequests {
+		t.Fatal("First preview was limited")
+	}
+	if got := preview(); got != errTooManyRequests {
+		t.Errorf("Expected the second preview to be limited, got %q", got)
+	}
+}
+
+func TestAccountRateLimitPreview(t *testing.T) {
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	for _, name := range []string{"Busy", "Quiet"} {
+		// An unreachable server fails fast; only the status code matters here
+		store.CreateAccount(&models.Account{Name: name, Server: "127.0.0.1", Port: 1, Username: "u", Password: "p"})
+	}
+	router := NewRouter(handler, RouterConfig{AccountRateLimit: 1, AccountRateBurst: 3})
+	defer handler.Close()
+
+	preview := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/accounts/"+id+"/preview?folder=INBOX", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := preview("1"); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("Request %d within the burst got 429", i+1)
+		}
+	}
+	w := preview("1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429 after the burst, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+
+	if w := preview("2"); w.Code == http.StatusTooManyRequests {
+		t.Error("Expected another account not to be limited")
+	}
+}
+
+func TestAccountRateLimitDisabled(t *testing.T) {
+	handler, _, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	router := NewRouter(handler, RouterConfig{AccountRateLimit: -1, AccountRateBurst: 1})
+	defer handler.Close()
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/api/accounts/1/preview", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("Request %d got 429 with the limit disabled", i+1)
+		}
+	}
+}
+
+func TestAccountRateLimitApplyAll(t *testing.T) {
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	// An unreachable server fails fast; only whether it was limited matters
+	store.CreateAccount(&models.Account{Name: "Busy", Server: "127.0.0.1", Port: 1, Username: "u", Password: "p", Enabled: true})
+	router := NewRouter(handler, RouterConfig{AccountRateLimit: 1, AccountRateBurst: 1})
+	defer handler.Close()
+
+	apply := func() string {
+		req := httptest.NewRequest("POST", "/api/apply?dry_run=true", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var results map[int64]accountApplyResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return results[1].Error
+	}
+
+	if got := apply(); got == errTooManyRequests {
+		t.Fatal("First apply was limited")
+	}
+	if got := apply(); got != errTooManyRequests {
+		t.Errorf("Expected the second apply to be limited for the account, got %q", got)
+	}
+}
+
+func TestRateLimiterSweepEveryStops(t *testing.T) {
+	l := newRateLimiter(60, 1)
+	stop := l.sweepEvery(time.Millisecond)
+	stop()
+	stop() // stopping again is harmless
+}
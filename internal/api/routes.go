@@ -2,14 +2,80 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 )
 
+// compressibleContentTypes lists the response types gzip applies to. Streaming
+// types such as text/event-stream and application/x-ndjson are deliberately
+// left out so progress updates are flushed to the client as they happen.
+var compressibleContentTypes = []string{
+	"application/json",
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// DefaultAllowedOrigins are the CORS origins allowed when none are
+// configured: the frontend's development servers
+var DefaultAllowedOrigins = []string{"http://localhost:5173", "http://localhost:3000", "http://127.0.0.1:5173"}
+
+// RouterConfig configures NewRouter. The zero value uses the defaults.
+type RouterConfig struct {
+	// Origins allowed to make cross-origin requests, DefaultAllowedOrigins
+	// if empty
+	AllowedOrigins []string
+
+	// How long a request that talks to an IMAP server may take before 504
+	// Gateway Timeout is returned, DefaultRequestTimeout if zero
+	RequestTimeout time.Duration
+
+	// How long an apply request may take before 504 Gateway Timeout is
+	// returned, DefaultApplyTimeout if zero. Negative sets no deadline, so
+	// an apply is never cut short in the middle of moving a message.
+	ApplyTimeout time.Duration
+
+	// Requests per minute each account may make to its IMAP server,
+	// DefaultAccountRateLimit if zero. Negative disables the limit.
+	AccountRateLimit int
+
+	// Requests each account may make at once before AccountRateLimit
+	// applies, DefaultAccountRateBurst if zero
+	AccountRateBurst int
+}
+
 // NewRouter creates a new chi router with all routes configured
-func NewRouter(h *Handler) *chi.Mux {
+func NewRouter(h *Handler, cfg RouterConfig) *chi.Mux {
+	if len(cfg.AllowedOrigins) == 0 {
+		cfg.AllowedOrigins = DefaultAllowedOrigins
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	imapTimeout := requestTimeout(cfg.RequestTimeout)
+	if cfg.ApplyTimeout == 0 {
+		cfg.ApplyTimeout = DefaultApplyTimeout
+	}
+	applyTimeout := requestTimeout(cfg.ApplyTimeout)
+	if cfg.AccountRateLimit == 0 {
+		cfg.AccountRateLimit = DefaultAccountRateLimit
+	}
+	if cfg.AccountRateBurst <= 0 {
+		cfg.AccountRateBurst = DefaultAccountRateBurst
+	}
+	if cfg.AccountRateLimit > 0 {
+		h.Close()
+		h.limiter = newRateLimiter(cfg.AccountRateLimit, cfg.AccountRateBurst)
+		h.stopSweep = h.limiter.sweepEvery(rateLimiterSweepInterval)
+	}
+	accountLimit := h.accountRateLimit
+
 	r := chi.NewRouter()
 
 	// Middleware
@@ -17,12 +83,13 @@ func NewRouter(h *Handler) *chi.Mux {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	r.Use(middleware.Compress(5, compressibleContentTypes...))
 
 	// CORS for frontend
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173", "http://localhost:3000", "http://127.0.0.1:5173"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With", IdempotencyKeyHeader},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -38,36 +105,65 @@ func NewRouter(h *Handler) *chi.Mux {
 		r.Route("/accounts", func(r chi.Router) {
 			r.Get("/", h.ListAccounts)
 			r.Post("/", h.CreateAccount)
-			r.Post("/test", h.TestAccountDirect)
+			r.With(imapTimeout).Post("/test", h.TestAccountDirect)
 
 			r.Route("/{id}", func(r chi.Router) {
 				r.Get("/", h.GetAccount)
 				r.Put("/", h.UpdateAccount)
+				r.Patch("/", h.PatchAccount)
 				r.Delete("/", h.DeleteAccount)
-				r.Post("/test", h.TestAccount)
-				r.Get("/folders", h.GetAccountFolders)
-				r.Post("/folders", h.CreateFolder)
+
+				// Routes that talk to the IMAP server
+				r.Group(func(r chi.Router) {
+					r.Use(accountLimit, imapTimeout)
+					r.Post("/test", h.TestAccount)
+					r.Get("/folders", h.GetAccountFolders)
+					r.Post("/folders", h.CreateFolder)
+					r.Get("/quota", h.GetAccountQuota)
+					r.Get("/size", h.GetAccountSize)
+					r.Get("/capabilities", h.GetAccountCapabilities)
+					r.Get("/senders", h.GetAccountSenders)
+
+					// Preview
+					r.Get("/preview", h.PreviewRules)
+
+					// Manual message actions
+					r.Post("/messages/actions", h.MessageActions)
+					r.Post("/messages/{uid}/move", h.MoveMessage)
+					r.Get("/messages/{uid}/unsubscribe", h.GetUnsubscribeInfo)
+				})
+
+				// Apply runs under its own, longer timeout
+				r.With(accountLimit, applyTimeout).Post("/apply", h.ApplyRules)
 
 				// Rules for this account
 				r.Route("/rules", func(r chi.Router) {
 					r.Get("/", h.ListRules)
 					r.Post("/", h.CreateRule)
+					r.With(accountLimit, imapTimeout).Get("/suggestions", h.ListRuleSuggestions)
+					r.Get("/analyze", h.AnalyzeRules)
 				})
-
-				// Preview and apply
-				r.Get("/preview", h.PreviewRules)
-				r.Post("/apply", h.ApplyRules)
 			})
 		})
 
+		// Apply rules across accounts
+		r.With(applyTimeout).Post("/apply", h.ApplyAllAccounts)
+
 		// Rule routes (for direct access)
 		r.Route("/rules", func(r chi.Router) {
+			r.Get("/", h.ListAllRules)
+
 			r.Route("/{id}", func(r chi.Router) {
 				r.Get("/", h.GetRule)
 				r.Put("/", h.UpdateRule)
+				r.Patch("/", h.PatchRule)
 				r.Delete("/", h.DeleteRule)
+				r.Post("/clone", h.CloneRule)
 			})
 		})
+
+		// Maintenance
+		r.Post("/admin/cleanup", h.AdminCleanup)
 	})
 
 	return r
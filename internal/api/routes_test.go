@@ -1,8 +1,10 @@
 package api
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -29,9 +31,10 @@ func setupTestRouter(t *testing.T) (*http.Handler, *storage.Store, func()) {
 	}
 
 	handler := NewHandler(store)
-	router := NewRouter(handler)
+	router := NewRouter(handler, RouterConfig{})
 
 	cleanup := func() {
+		handler.Close()
 		store.Close()
 		os.Remove(tmpFile.Name())
 	}
@@ -55,13 +58,49 @@ func TestNewRouter(t *testing.T) {
 	defer store.Close()
 
 	handler := NewHandler(store)
-	router := NewRouter(handler)
+	router := NewRouter(handler, RouterConfig{})
+	defer handler.Close()
 
 	if router == nil {
 		t.Fatal("Expected non-nil router")
 	}
 }
 
+func TestCORSAllowedOrigins(t *testing.T) {
+	store, err := storage.New(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	preflight := func(router http.Handler, origin string) string {
+		req := httptest.NewRequest("OPTIONS", "/api/accounts", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	handler := NewHandler(store)
+	defer handler.Close()
+	router := NewRouter(handler, RouterConfig{AllowedOrigins: []string{"https://mail.example.com"}})
+	if got := preflight(router, "https://mail.example.com"); got != "https://mail.example.com" {
+		t.Errorf("Expected configured origin to be allowed, got %q", got)
+	}
+	for _, origin := range []string{"https://evil.example.net", "http://localhost:5173"} {
+		if got := preflight(router, origin); got != "" {
+			t.Errorf("Expected %s not to be allowed, got %q", origin, got)
+		}
+	}
+
+	// Without configured origins the development servers are allowed
+	router = NewRouter(handler, RouterConfig{})
+	if got := preflight(router, "http://localhost:5173"); got != "http://localhost:5173" {
+		t.Errorf("Expected default origin to be allowed, got %q", got)
+	}
+}
+
 func TestHealthEndpoint(t *testing.T) {
 	h, _, cleanup := setupTestRouter(t)
 	defer cleanup()
@@ -412,3 +451,60 @@ func TestContentTypeJSON(t *testing.T) {
 		t.Errorf("Expected Content-Type 'application/json', got %s", contentType)
 	}
 }
+
+func TestGzipCompression(t *testing.T) {
+	h, store, cleanup := setupTestRouter(t)
+	defer cleanup()
+
+	for i := 0; i < 50; i++ {
+		store.CreateAccount(&models.Account{
+			Name:     fmt.Sprintf("Account %d", i),
+			Server:   "imap.test.com",
+			Port:     993,
+			Username: fmt.Sprintf("user%d@test.com", i),
+			Password: "pass",
+			TLS:      true,
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/accounts", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	(*h).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expected Content-Encoding 'gzip', got %q", enc)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to create gzip reader: %v", err)
+	}
+	defer gz.Close()
+
+	var accounts []models.AccountWithoutPassword
+	if err := json.NewDecoder(gz).Decode(&accounts); err != nil {
+		t.Fatalf("Failed to decode gzipped response: %v", err)
+	}
+	if len(accounts) != 50 {
+		t.Errorf("Expected 50 accounts, got %d", len(accounts))
+	}
+}
+
+func TestNoCompressionWithoutAcceptEncoding(t *testing.T) {
+	h, _, cleanup := setupTestRouter(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "/api/accounts", nil)
+	w := httptest.NewRecorder()
+
+	(*h).ServeHTTP(w, req)
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", enc)
+	}
+}
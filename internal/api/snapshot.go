@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// previewSnapshotTTL is how long a preview snapshot can be paged through
+// after its first page
+const previewSnapshotTTL = 10 * time.Minute
+
+// maxPreviewSnapshots is how many snapshots are held at once. Adding one
+// more evicts the oldest, whose client has to start its preview over.
+const maxPreviewSnapshots = 1000
+
+// previewSnapshot is the list of messages a paginated preview pages through,
+// captured when the first page was requested so that mail arriving between
+// pages doesn't shift them
+type previewSnapshot struct {
+	accountID   int64
+	folder      string
+	uidValidity uint32
+	uids        []uint32 // most recent first
+	expires     time.Time
+}
+
+// snapshotStore holds preview snapshots by token for ttl, at most max at once
+type snapshotStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	max       int
+	now       func() time.Time
+	snapshots map[string]*previewSnapshot
+}
+
+func newSnapshotStore(ttl time.Duration) *snapshotStore {
+	return &snapshotStore{
+		ttl:       ttl,
+		max:       maxPreviewSnapshots,
+		now:       time.Now,
+		snapshots: make(map[string]*previewSnapshot),
+	}
+}
+
+// add stores snap and returns the token for getting it back
+func (s *snapshotStore) add(snap *previewSnapshot) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	for len(s.snapshots) >= s.max {
+		s.evictOldest()
+	}
+	snap.expires = s.now().Add(s.ttl)
+	s.snapshots[token] = snap
+	return token, nil
+}
+
+// get returns the snapshot of the account's folder stored under token, or
+// nil if there is none or it has expired
+func (s *snapshotStore) get(token string, accountID int64, folder string) *previewSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	snap, ok := s.snapshots[token]
+	if !ok || snap.accountID != accountID || snap.folder != folder {
+		return nil
+	}
+	return snap
+}
+
+// expire drops expired snapshots. s.mu must be held.
+func (s *snapshotStore) expire() {
+	now := s.now()
+	for token, snap := range s.snapshots {
+		if now.After(snap.expires) {
+			delete(s.snapshots, token)
+		}
+	}
+}
+
+// evictOldest drops the snapshot that expires first. s.mu must be held.
+func (s *snapshotStore) evictOldest() {
+	var oldest string
+	for token, snap := range s.snapshots {
+		if oldest == "" || snap.expires.Before(s.snapshots[oldest].expires) {
+			oldest = token
+		}
+	}
+	delete(s.snapshots, oldest)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotStoreExpires(t *testing.T) {
+	now := time.Now()
+	s := newSnapshotStore(10 * time.Minute)
+	s.now = func() time.Time { return now }
+
+	token, err := s.add(&previewSnapshot{accountID: 1, folder: "INBOX", uids: []uint32{2, 1}})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	if s.get(token, 1, "INBOX") == nil {
+		t.Error("Expected the snapshot within the TTL")
+	}
+	if s.get(token, 2, "INBOX") != nil || s.get(token, 1, "Work") != nil {
+		t.Error("Expected the snapshot only for its own account and folder")
+	}
+
+	now = now.Add(time.Hour)
+	if s.get(token, 1, "INBOX") != nil {
+		t.Error("Expected the snapshot to be forgotten after the TTL")
+	}
+}
+
+func TestSnapshotStoreEvictsOldest(t *testing.T) {
+	now := time.Now()
+	s := newSnapshotStore(10 * time.Minute)
+	s.max = 2
+	s.now = func() time.Time { return now }
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		token, err := s.add(&previewSnapshot{accountID: 1, folder: "INBOX"})
+		if err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+		tokens = append(tokens, token)
+		now = now.Add(time.Second)
+	}
+
+	if len(s.snapshots) != 2 {
+		t.Errorf("Holding %d snapshots, want 2", len(s.snapshots))
+	}
+	if s.get(tokens[0], 1, "INBOX") != nil {
+		t.Error("Expected the oldest snapshot to be evicted")
+	}
+	if s.get(tokens[1], 1, "INBOX") == nil || s.get(tokens[2], 1, "INBOX") == nil {
+		t.Error("Expected the newer snapshots to be kept")
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AddStaticRoutes serves the frontend build from dir. Paths that don't match a
+// file fall back to index.html so client-side routes like /accounts/5 survive a
+// page refresh. Missing assets (paths with a file extension) and anything under
+// /api or /ws still return 404.
+func AddStaticRoutes(r *chi.Mux, dir string) {
+	r.Handle("/*", NewSPAHandler(dir))
+}
+
+// NewSPAHandler returns a handler that serves static files from dir with an
+// index.html fallback for client-side routes
+func NewSPAHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+
+		if isReservedPath(urlPath) {
+			respondError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(urlPath))); err == nil && !info.IsDir() {
+			fs.ServeHTTP(w, r)
+			return
+		}
+
+		if path.Ext(urlPath) != "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+	})
+}
+
+// isReservedPath reports whether a path belongs to the API or WebSocket
+// endpoints and must never be answered with the SPA shell
+func isReservedPath(p string) bool {
+	for _, prefix := range []string{"/api", "/ws"} {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
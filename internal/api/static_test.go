@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupStaticRouter(t *testing.T) http.Handler {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>app</html>"), 0644); err != nil {
+		t.Fatalf("Failed to write index.html: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0755); err != nil {
+		t.Fatalf("Failed to create assets dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "assets", "app.js"), []byte("console.log('app')"), 0644); err != nil {
+		t.Fatalf("Failed to write app.js: %v", err)
+	}
+
+	handler, _, cleanup := setupTestHandler(t)
+	t.Cleanup(cleanup)
+
+	router := NewRouter(handler, RouterConfig{})
+	defer handler.Close()
+	AddStaticRoutes(router, dir)
+	return router
+}
+
+func TestSPAFallbackServesIndexForClientRoute(t *testing.T) {
+	router := setupStaticRouter(t)
+
+	req := httptest.NewRequest("GET", "/accounts/5", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<html>app</html>") {
+		t.Errorf("Expected index.html body, got %q", w.Body.String())
+	}
+}
+
+func TestSPAServesExistingAsset(t *testing.T) {
+	router := setupStaticRouter(t)
+
+	req := httptest.NewRequest("GET", "/assets/app.js", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "console.log") {
+		t.Errorf("Expected app.js body, got %q", w.Body.String())
+	}
+}
+
+func TestSPAMissingAssetReturns404(t *testing.T) {
+	router := setupStaticRouter(t)
+
+	req := httptest.NewRequest("GET", "/assets/missing.js", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestSPAUnknownAPIRouteReturns404(t *testing.T) {
+	router := setupStaticRouter(t)
+
+	req := httptest.NewRequest("GET", "/api/nonexistent", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "<html>app</html>") {
+		t.Error("Expected API 404, got index.html")
+	}
+}
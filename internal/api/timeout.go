@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultRequestTimeout bounds requests that talk to an IMAP server when no
+// other timeout is configured
+const DefaultRequestTimeout = 2 * time.Minute
+
+// DefaultApplyTimeout bounds apply requests when no other timeout is
+// configured. Applying moves messages one by one, and cutting it short in the
+// middle of a move can leave a message copied but not yet removed, so it gets
+// far longer than other requests.
+const DefaultApplyTimeout = 30 * time.Minute
+
+// requestTimeout gives each request a context deadline of d, which cancels
+// the IMAP operations of handlers connecting with imap.ConnectContext. If the
+// handler hasn't finished by then, the client gets 504 Gateway Timeout and
+// anything the handler writes afterwards is discarded.
+//
+// A negative d sets no deadline. Responses are otherwise buffered until the
+// handler returns, so this is only suitable for routes that don't stream.
+func requestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d < 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// Re-panic on the request goroutine so Recoverer sees it
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				for k, v := range tw.header {
+					w.Header()[k] = v
+				}
+				if tw.status == 0 {
+					tw.status = http.StatusOK
+				}
+				w.WriteHeader(tw.status)
+				w.Write(tw.buf.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if ctx.Err() == context.DeadlineExceeded {
+					respondError(w, http.StatusGatewayTimeout, "request timed out")
+				}
+			}
+		})
+	}
+}
+
+// timeoutWriter buffers a response for requestTimeout
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestRequestTimeoutSlowHandler(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+		respondJSON(w, http.StatusOK, map[string]string{"status": "too late"})
+	})
+
+	req := httptest.NewRequest("GET", "/slow", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	requestTimeout(50*time.Millisecond)(slow).ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected a response within the timeout, took %s", elapsed)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the handler's context to be cancelled")
+	}
+}
+
+func TestRequestTimeoutFastHandler(t *testing.T) {
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		respondJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
+	})
+
+	req := httptest.NewRequest("GET", "/fast", nil)
+	w := httptest.NewRecorder()
+
+	requestTimeout(time.Second)(fast).ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d", w.Code)
+	}
+	if w.Header().Get("X-Test") != "yes" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected handler headers to be kept, got %v", w.Header())
+	}
+	if w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("Unexpected body %q", w.Body.String())
+	}
+}
+
+func TestRequestTimeoutNegative(t *testing.T) {
+	var hasDeadline bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest("POST", "/apply", nil)
+	w := httptest.NewRecorder()
+	requestTimeout(-1)(handler).ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", w.Code)
+	}
+	if hasDeadline {
+		t.Error("Expected no deadline with a negative timeout")
+	}
+}
+
+// hungServer returns the port of a server that accepts connections but never
+// sends a greeting
+func hungServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestFoldersTimesOutOnHungServer(t *testing.T) {
+	port := hungServer(t)
+
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	store.CreateAccount(&models.Account{Name: "Hung", Server: "127.0.0.1", Port: port, Username: "u", Password: "p", Enabled: true})
+
+	router := NewRouter(handler, RouterConfig{RequestTimeout: 100 * time.Millisecond})
+	defer handler.Close()
+	req := httptest.NewRequest("GET", "/api/accounts/1/folders", nil)
+	w := httptest.NewRecorder()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, req.WithContext(ctx))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the request to time out")
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApplyUsesApplyTimeout(t *testing.T) {
+	port := hungServer(t)
+
+	handler, store, cleanup := setupTestHandler(t)
+	defer cleanup()
+
+	store.CreateAccount(&models.Account{Name: "Hung", Server: "127.0.0.1", Port: port, Username: "u", Password: "p", Enabled: true})
+
+	router := NewRouter(handler, RouterConfig{RequestTimeout: 50 * time.Millisecond, ApplyTimeout: 500 * time.Millisecond})
+	defer handler.Close()
+	req := httptest.NewRequest("POST", "/api/apply", nil)
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	router.ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("Expected apply to get the apply timeout, timed out after %s", elapsed)
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -15,6 +16,24 @@ import (
 	"github.com/mailcleaner/mailcleaner/internal/storage"
 )
 
+// wsWriteTimeout bounds each write to a WebSocket client
+const wsWriteTimeout = 10 * time.Second
+
+// Default cadence of preview progress updates for unmatched messages, see
+// PreviewRequest
+const (
+	defaultProgressEvery    = 25
+	defaultProgressInterval = 100 * time.Millisecond
+)
+
+// previewChunkSize is how many messages a live preview fetches at a time
+const previewChunkSize = 100
+
+// maxLivePreviewMessages is how many messages the result of a live preview
+// carries. Messages past it are still matched, counted and reported in
+// progress, but not held until the end.
+const maxLivePreviewMessages = 1000
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -25,12 +44,14 @@ var upgrader = websocket.Upgrader{
 
 // WebSocketHandler handles WebSocket connections for live preview
 type WebSocketHandler struct {
-	store *storage.Store
+	store       *storage.Store
+	limiter     *rateLimiter // nil if previews aren't limited
+	maxMessages int          // messages kept for the result
 }
 
 // NewWebSocketHandler creates a new WebSocketHandler
 func NewWebSocketHandler(store *storage.Store) *WebSocketHandler {
-	return &WebSocketHandler{store: store}
+	return &WebSocketHandler{store: store, maxMessages: maxLivePreviewMessages}
 }
 
 // Message types for WebSocket communication
@@ -38,12 +59,35 @@ type WSMessage struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 	Error   string          `json:"error,omitempty"`
+	Warning string          `json:"warning,omitempty"`
 }
 
 type PreviewRequest struct {
 	AccountID int64  `json:"account_id"`
 	Folder    string `json:"folder"`
 	Limit     int    `json:"limit"`
+
+	// Progress is sent for every matched message, and otherwise at most
+	// every ProgressEvery messages or ProgressIntervalMs milliseconds,
+	// whichever comes first. Zero uses the defaults.
+	ProgressEvery      int `json:"progress_every,omitempty"`
+	ProgressIntervalMs int `json:"progress_interval_ms,omitempty"`
+
+	// TagProcessed previews an apply with tag_processed, skipping messages
+	// already tagged as processed
+	TagProcessed bool `json:"tag_processed,omitempty"`
+}
+
+// progressCadence returns how often progress is sent for unmatched messages
+func (r *PreviewRequest) progressCadence() (every int, interval time.Duration) {
+	every, interval = defaultProgressEvery, defaultProgressInterval
+	if r.ProgressEvery > 0 {
+		every = r.ProgressEvery
+	}
+	if r.ProgressIntervalMs > 0 {
+		interval = time.Duration(r.ProgressIntervalMs) * time.Millisecond
+	}
+	return every, interval
 }
 
 type PreviewProgress struct {
@@ -79,110 +123,170 @@ func (h *WebSocketHandler) HandleLivePreview(w http.ResponseWriter, r *http.Requ
 			break
 		}
 
+		var err error
 		switch msg.Type {
 		case "preview":
-			h.handlePreviewRequest(conn, msg.Payload)
+			err = h.handlePreviewRequest(conn, msg.Payload)
 		case "ping":
-			conn.WriteJSON(WSMessage{Type: "pong"})
+			err = writeJSON(conn, WSMessage{Type: "pong"})
 		default:
-			conn.WriteJSON(WSMessage{Type: "error", Error: "unknown message type"})
+			err = writeJSON(conn, WSMessage{Type: "error", Error: "unknown message type"})
+		}
+		if err != nil {
+			// The client is gone, so there is no one to send anything to
+			log.Printf("WebSocket write error: %v", err)
+			break
 		}
 	}
 }
 
-func (h *WebSocketHandler) handlePreviewRequest(conn *websocket.Conn, payload json.RawMessage) {
+// handlePreviewRequest runs a preview, streaming progress to the client. It
+// returns an error only when writing to the client fails, in which case the
+// preview is abandoned.
+func (h *WebSocketHandler) handlePreviewRequest(conn *websocket.Conn, payload json.RawMessage) error {
 	var req PreviewRequest
 	if err := json.Unmarshal(payload, &req); err != nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: "invalid preview request"})
-		return
+		return writeJSON(conn, WSMessage{Type: "error", Error: "invalid preview request"})
 	}
 
-	if req.Folder == "" {
-		req.Folder = "INBOX"
-	}
 	if req.Limit == 0 {
 		req.Limit = 100
 	}
 
 	// Send connecting status
-	h.sendProgress(conn, "connecting", 0, 0, "Connecting to IMAP server...")
+	if err := h.sendProgress(conn, "connecting", 0, 0, "Connecting to IMAP server..."); err != nil {
+		return err
+	}
 
 	account, err := h.store.GetAccount(req.AccountID)
 	if err != nil || account == nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: "account not found"})
-		return
+		return writeJSON(conn, WSMessage{Type: "error", Error: "account not found"})
+	}
+	if ok, _ := h.limiter.allow(accountKey(account.ID)); !ok {
+		return writeJSON(conn, WSMessage{Type: "error", Error: errTooManyRequests})
+	}
+	if req.Folder == "" {
+		req.Folder = account.Inbox()
 	}
 
 	rules, err := h.store.ListRules(req.AccountID)
 	if err != nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: "failed to load rules"})
-		return
+		return writeJSON(conn, WSMessage{Type: "error", Error: "failed to load rules"})
 	}
 
 	client, err := imapClient.Connect(account)
 	if err != nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: err.Error()})
-		return
+		return writeJSON(conn, WSMessage{Type: "error", Error: err.Error()})
 	}
 	defer client.Close()
+	if req.TagProcessed {
+		client.TagProcessed(models.ProcessedKeyword)
+	}
 
-	h.sendProgress(conn, "connected", 0, 0, "Connected successfully")
+	if err := h.sendProgress(conn, "connected", 0, 0, "Connected successfully"); err != nil {
+		return err
+	}
+
+	if !hasEnabledRules(rules) {
+		if err := writeJSON(conn, WSMessage{Type: "warning", Warning: models.WarningNoEnabledRules}); err != nil {
+			return err
+		}
+	}
 
 	// Select folder
-	h.sendProgress(conn, "selecting", 0, 0, "Selecting folder: "+req.Folder)
+	if err := h.sendProgress(conn, "selecting", 0, 0, "Selecting folder: "+req.Folder); err != nil {
+		return err
+	}
 	totalMessages, err := client.SelectFolder(req.Folder)
 	if err != nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: err.Error()})
-		return
+		return writeJSON(conn, WSMessage{Type: "error", Error: err.Error()})
 	}
 
-	h.sendProgress(conn, "fetching", 0, totalMessages, "Fetching messages...")
-
-	// Fetch messages
-	messages, err := client.FetchMessages(req.Limit)
-	if err != nil {
-		conn.WriteJSON(WSMessage{Type: "error", Error: err.Error()})
-		return
+	if err := h.sendProgress(conn, "fetching", 0, totalMessages, "Fetching messages..."); err != nil {
+		return err
 	}
 
-	h.sendProgress(conn, "processing", 0, len(messages), "Processing rules...")
-
-	// Apply rules and send progress for each message
+	// Fetch messages a chunk at a time, applying rules and sending progress
+	// as each chunk arrives
 	result := &models.PreviewResult{
-		TotalMessages: len(messages),
-		RuleMatches:   make(map[int64]int),
+		UIDValidity: client.UIDValidity(),
+		RuleMatches: make(map[int64]int),
+		Warning:     noRulesWarning(rules),
 	}
-
-	for i := range messages {
-		msg := &messages[i]
-
-		for j := range rules {
-			rule := &rules[j]
-			if !rule.Enabled {
-				continue
-			}
-
-			if msg.MatchesRule(rule) {
-				msg.MatchedRule = rule
-				result.MatchedMessages++
-				result.RuleMatches[rule.ID]++
-				break
+	messages := []models.Message{}
+	processed := 0
+	throttle := newProgressThrottle(req.progressCadence())
+	var writeErr error
+	err = client.FetchMessagesInChunks(req.Limit, previewChunkSize, func(chunk []models.Message, total int) error {
+		offset := processed
+		if offset == 0 {
+			if writeErr = h.sendProgress(conn, "processing", 0, total, "Processing rules..."); writeErr != nil {
+				return writeErr
 			}
 		}
-
-		// Send progress update with message data
-		h.sendProgressWithMessage(conn, "processing", i+1, len(messages),
-			"Processing message "+strconv.Itoa(i+1)+" of "+strconv.Itoa(len(messages)), msg)
+		client.MatchMessages(rules, chunk, result)
+		if writeErr = h.sendMatchProgress(conn, chunk, offset, total, throttle); writeErr != nil {
+			return writeErr
+		}
+		processed += len(chunk)
+		keep := min(len(chunk), h.maxMessages-len(messages))
+		messages = append(messages, chunk[:max(keep, 0)]...)
+		return nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		return writeJSON(conn, WSMessage{Type: "error", Error: err.Error()})
 	}
 
+	result.TotalMessages = processed
 	result.Messages = messages
 
 	// Send final result
 	resultData, _ := json.Marshal(result)
-	conn.WriteJSON(WSMessage{Type: "result", Payload: resultData})
+	return writeJSON(conn, WSMessage{Type: "result", Payload: resultData})
+}
+
+// progressThrottle tracks the last progress update sent by sendMatchProgress, so
+// that updates for unmatched messages are coalesced across chunks
+type progressThrottle struct {
+	every      int
+	interval   time.Duration
+	lastSent   int
+	lastSentAt time.Time
+}
+
+func newProgressThrottle(every int, interval time.Duration) *progressThrottle {
+	return &progressThrottle{every: every, interval: interval, lastSentAt: time.Now()}
 }
 
-func (h *WebSocketHandler) sendProgress(conn *websocket.Conn, stage string, current, total int, message string) {
+// sendMatchProgress sends progress for messages matched by the client's
+// MatchMessages, which are those at offset of the total being previewed.
+// Progress is sent with each matched message, and for unmatched ones
+// coalesced by throttle to one update per every messages or interval, plus
+// one for the last message. It stops at the first failed write.
+func (h *WebSocketHandler) sendMatchProgress(conn *websocket.Conn, messages []models.Message, offset, total int, throttle *progressThrottle) error {
+	for i := range messages {
+		msg := &messages[i]
+		current := offset + i + 1
+		var msgData *models.Message
+		if msg.MatchedRule != nil {
+			msgData = msg
+		} else if current-throttle.lastSent < throttle.every && time.Since(throttle.lastSentAt) < throttle.interval && current < total {
+			continue
+		}
+
+		if err := h.sendProgressWithMessage(conn, "processing", current, total,
+			"Processing message "+strconv.Itoa(current)+" of "+strconv.Itoa(total), msgData); err != nil {
+			return fmt.Errorf("sending progress for message %d of %d: %w", current, total, err)
+		}
+		throttle.lastSent, throttle.lastSentAt = current, time.Now()
+	}
+	return nil
+}
+
+func (h *WebSocketHandler) sendProgress(conn *websocket.Conn, stage string, current, total int, message string) error {
 	progress := PreviewProgress{
 		Stage:   stage,
 		Current: current,
@@ -190,10 +294,10 @@ func (h *WebSocketHandler) sendProgress(conn *websocket.Conn, stage string, curr
 		Message: message,
 	}
 	data, _ := json.Marshal(progress)
-	conn.WriteJSON(WSMessage{Type: "progress", Payload: data})
+	return writeJSON(conn, WSMessage{Type: "progress", Payload: data})
 }
 
-func (h *WebSocketHandler) sendProgressWithMessage(conn *websocket.Conn, stage string, current, total int, message string, msgData *models.Message) {
+func (h *WebSocketHandler) sendProgressWithMessage(conn *websocket.Conn, stage string, current, total int, message string, msgData *models.Message) error {
 	progress := PreviewProgress{
 		Stage:       stage,
 		Current:     current,
@@ -202,11 +306,20 @@ func (h *WebSocketHandler) sendProgressWithMessage(conn *websocket.Conn, stage s
 		MessageData: msgData,
 	}
 	data, _ := json.Marshal(progress)
-	conn.WriteJSON(WSMessage{Type: "progress", Payload: data})
+	return writeJSON(conn, WSMessage{Type: "progress", Payload: data})
+}
+
+// writeJSON writes v to the client, giving up after wsWriteTimeout so a slow
+// or stalled client can't block the handler forever
+func writeJSON(conn *websocket.Conn, v interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(v)
 }
 
-// AddWebSocketRoutes adds WebSocket routes to the router
-func AddWebSocketRoutes(r *chi.Mux, store *storage.Store) {
-	wsHandler := NewWebSocketHandler(store)
+// AddWebSocketRoutes adds WebSocket routes to the router. Previews share
+// h's per-account rate limit, as set up by NewRouter.
+func AddWebSocketRoutes(r *chi.Mux, h *Handler) {
+	wsHandler := NewWebSocketHandler(h.store)
+	wsHandler.limiter = h.limiter
 	r.Get("/ws/preview", wsHandler.HandleLivePreview)
 }
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -478,10 +479,11 @@ func TestAddWebSocketRoutes(t *testing.T) {
 	defer store.Close()
 
 	handler := NewHandler(store)
-	router := NewRouter(handler)
+	router := NewRouter(handler, RouterConfig{})
+	defer handler.Close()
 
 	// Add WebSocket routes
-	AddWebSocketRoutes(router, store)
+	AddWebSocketRoutes(router, handler)
 
 	// Create test server
 	server := httptest.NewServer(router)
@@ -543,3 +545,361 @@ func TestConnectionClose(t *testing.T) {
 
 	conn.Close()
 }
+
+// dialTestConn returns both ends of a WebSocket connection to a test server
+func dialTestConn(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+
+	serverConns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(ts.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	server = <-serverConns
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func TestSendMatchProgressStopsWhenClientGone(t *testing.T) {
+	handler, _, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+
+	conn, client := dialTestConn(t)
+
+	// Drop the client without a close handshake and wait for the server to
+	// see it go
+	client.Close()
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("Expected read to fail after the client closed")
+	}
+
+	rule := &models.Rule{ID: 1, Pattern: "sender@example.com", PatternType: "sender", MoveToFolder: "Archive", Enabled: true}
+	messages := make([]models.Message, 1000)
+	for i := range messages {
+		messages[i] = models.Message{UID: uint32(i + 1), From: "sender@example.com", Subject: "Subject", MatchedRule: rule}
+	}
+
+	if err := handler.sendMatchProgress(conn, messages, 0, len(messages), newProgressThrottle(1, 0)); err == nil {
+		t.Fatal("Expected an error writing to a closed client")
+	}
+}
+
+func TestSendMatchProgressThrottlesProgress(t *testing.T) {
+	handler, _, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+
+	conn, client := dialTestConn(t)
+
+	// Every 100th message matches
+	rule := &models.Rule{ID: 1, Pattern: "match@", PatternType: "sender", MoveToFolder: "Archive", Enabled: true}
+	messages := make([]models.Message, 1000)
+	for i := range messages {
+		messages[i] = models.Message{UID: uint32(i + 1), From: "other@example.com", Subject: "Subject"}
+		if i%100 == 0 {
+			messages[i].From = "match@example.com"
+			messages[i].MatchedRule = rule
+		}
+	}
+
+	frames := make(chan []PreviewProgress, 1)
+	go func() {
+		var got []PreviewProgress
+		for {
+			var msg WSMessage
+			if err := client.ReadJSON(&msg); err != nil {
+				frames <- got
+				return
+			}
+			var progress PreviewProgress
+			json.Unmarshal(msg.Payload, &progress)
+			got = append(got, progress)
+		}
+	}()
+
+	if err := handler.sendMatchProgress(conn, messages, 0, len(messages), newProgressThrottle(25, time.Hour)); err != nil {
+		t.Fatalf("sendMatchProgress failed: %v", err)
+	}
+	conn.Close()
+	got := <-frames
+
+	// 10 matched messages, one update per 25 messages otherwise
+	if len(got) > 60 {
+		t.Errorf("Expected progress to be coalesced, got %d frames for %d messages", len(got), len(messages))
+	}
+	withMessage := 0
+	for _, p := range got {
+		if p.MessageData != nil {
+			withMessage++
+			if !strings.HasPrefix(p.MessageData.From, "match@") {
+				t.Errorf("Unexpected message data for unmatched message %d", p.MessageData.UID)
+			}
+		}
+	}
+	if withMessage != 10 {
+		t.Errorf("Expected all 10 matched messages to be sent, got %d", withMessage)
+	}
+	if len(got) == 0 || got[len(got)-1].Current != len(messages) {
+		t.Error("Expected a final progress update for the last message")
+	}
+}
+
+func TestHandleLivePreviewWarnsWithoutEnabledRules(t *testing.T) {
+	handler, store, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+
+	ts, account := setupTestIMAPAccount(t, store)
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	store.CreateRule(&models.Rule{
+		AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "Newsletters", Enabled: false,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLivePreview))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(PreviewRequest{AccountID: account.ID})
+	if err := conn.WriteJSON(WSMessage{Type: "preview", Payload: payload}); err != nil {
+		t.Fatalf("Failed to send preview request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	warned := false
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		switch msg.Type {
+		case "warning":
+			if msg.Warning != models.WarningNoEnabledRules {
+				t.Errorf("Expected warning %q, got %q", models.WarningNoEnabledRules, msg.Warning)
+			}
+			warned = true
+		case "error":
+			t.Fatalf("Unexpected error: %s", msg.Error)
+		case "result":
+			var result models.PreviewResult
+			if err := json.Unmarshal(msg.Payload, &result); err != nil {
+				t.Fatalf("Failed to unmarshal result: %v", err)
+			}
+			if result.Warning != models.WarningNoEnabledRules {
+				t.Errorf("Expected result warning %q, got %q", models.WarningNoEnabledRules, result.Warning)
+			}
+			if !warned {
+				t.Error("Expected a warning message before the result")
+			}
+			return
+		}
+	}
+}
+
+func TestHandleLivePreviewLargeFolderInChunks(t *testing.T) {
+	handler, store, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+
+	// Several chunks' worth of messages, every 50th from a newsletter
+	const count = 2*previewChunkSize + previewChunkSize/2
+	ts, account := setupTestIMAPAccount(t, store)
+	for i := 0; i < count; i++ {
+		from := "other@example.com"
+		if i%50 == 0 {
+			from = "newsletter@example.com"
+		}
+		ts.AddMessage(from, fmt.Sprintf("Message %d", i), "Content")
+	}
+	store.CreateRule(&models.Rule{
+		AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "Newsletters", Enabled: true,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLivePreview))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(PreviewRequest{AccountID: account.ID, Limit: count, ProgressEvery: 10})
+	if err := conn.WriteJSON(WSMessage{Type: "preview", Payload: payload}); err != nil {
+		t.Fatalf("Failed to send preview request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lastCurrent, processingFrames, matchedFrames := 0, 0, 0
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		switch msg.Type {
+		case "error":
+			t.Fatalf("Unexpected error: %s", msg.Error)
+		case "progress":
+			var progress PreviewProgress
+			json.Unmarshal(msg.Payload, &progress)
+			if progress.Stage != "processing" || progress.Current == 0 {
+				continue
+			}
+			processingFrames++
+			if progress.Total != count {
+				t.Errorf("Expected progress out of %d, got %d", count, progress.Total)
+			}
+			if progress.Current <= lastCurrent {
+				t.Errorf("Expected progress to increase, got %d after %d", progress.Current, lastCurrent)
+			}
+			lastCurrent = progress.Current
+			if progress.MessageData != nil {
+				matchedFrames++
+			}
+		case "result":
+			var result models.PreviewResult
+			if err := json.Unmarshal(msg.Payload, &result); err != nil {
+				t.Fatalf("Failed to unmarshal result: %v", err)
+			}
+			if processingFrames < count/10 {
+				t.Errorf("Expected progress for each chunk before the result, got %d frames", processingFrames)
+			}
+			if lastCurrent != count {
+				t.Errorf("Expected progress up to %d, got %d", count, lastCurrent)
+			}
+			if result.TotalMessages != count || len(result.Messages) != count {
+				t.Errorf("Expected all %d messages to be processed, got %d (%d messages)", count, result.TotalMessages, len(result.Messages))
+			}
+			if result.MatchedMessages != count/50 || matchedFrames != count/50 {
+				t.Errorf("Expected %d matches, got %d in the result and %d in progress", count/50, result.MatchedMessages, matchedFrames)
+			}
+			return
+		}
+	}
+}
+
+func TestHandleLivePreviewCapsResultMessages(t *testing.T) {
+	handler, store, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+	handler.maxMessages = 5
+
+	ts, account := setupTestIMAPAccount(t, store)
+	for i := 0; i < 12; i++ {
+		ts.AddMessage("newsletter@example.com", fmt.Sprintf("Message %d", i), "Content")
+	}
+	store.CreateRule(&models.Rule{
+		AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "Newsletters", Enabled: true,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLivePreview))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(PreviewRequest{AccountID: account.ID, Limit: -1})
+	if err := conn.WriteJSON(WSMessage{Type: "preview", Payload: payload}); err != nil {
+		t.Fatalf("Failed to send preview request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if msg.Type == "error" {
+			t.Fatalf("Unexpected error: %s", msg.Error)
+		}
+		if msg.Type != "result" {
+			continue
+		}
+
+		var result models.PreviewResult
+		if err := json.Unmarshal(msg.Payload, &result); err != nil {
+			t.Fatalf("Failed to unmarshal result: %v", err)
+		}
+		if len(result.Messages) != 5 {
+			t.Errorf("Expected the result to carry 5 messages, got %d", len(result.Messages))
+		}
+		if result.TotalMessages != 12 || result.MatchedMessages != 12 {
+			t.Errorf("Expected all 12 messages to be counted, got %d processed and %d matched",
+				result.TotalMessages, result.MatchedMessages)
+		}
+		if len(result.Messages) > 0 && result.Messages[0].Subject != "Message 11" {
+			t.Errorf("Expected the most recent message first, got %q", result.Messages[0].Subject)
+		}
+		return
+	}
+}
+
+func TestHandleLivePreviewMarksAlreadyInTarget(t *testing.T) {
+	handler, store, cleanup := setupTestWebSocket(t)
+	defer cleanup()
+
+	ts, account := setupTestIMAPAccount(t, store)
+	ts.CreateFolder("Newsletters")
+	ts.AddMessageToFolder("Newsletters", "newsletter@example.com", "Sorted", "Content")
+	store.CreateRule(&models.Rule{
+		AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "Newsletters", Enabled: true,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLivePreview))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(PreviewRequest{AccountID: account.ID, Folder: "Newsletters"})
+	if err := conn.WriteJSON(WSMessage{Type: "preview", Payload: payload}); err != nil {
+		t.Fatalf("Failed to send preview request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if msg.Type == "error" {
+			t.Fatalf("Unexpected error: %s", msg.Error)
+		}
+		if msg.Type != "result" {
+			continue
+		}
+
+		var result models.PreviewResult
+		if err := json.Unmarshal(msg.Payload, &result); err != nil {
+			t.Fatalf("Failed to unmarshal result: %v", err)
+		}
+		if len(result.Messages) != 1 || !result.Messages[0].AlreadyInTarget {
+			t.Errorf("Expected the sorted message to be already in its target, got %+v", result.Messages)
+		}
+		return
+	}
+}
@@ -0,0 +1,177 @@
+package imap
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// DefaultArchiveFolder is where archived mail goes when the server has no
+// folder marked \Archive and the rule doesn't name a fallback
+const DefaultArchiveFolder = "Archive"
+
+// ArchiveFolder returns the folder the server marks with the \Archive
+// special-use attribute (RFC 6154). If there is none, fallback is returned,
+// or DefaultArchiveFolder if fallback is empty. The lookup is done once per
+// connection.
+func (c *Client) ArchiveFolder(fallback string) (string, error) {
+	if !c.archiveLoaded {
+		folders, err := c.cachedFolders()
+		if err != nil {
+			return "", err
+		}
+
+		var archive string
+		for _, f := range folders {
+			if hasAttr(f.Attributes, imap.ArchiveAttr) {
+				archive = f.Name
+				break
+			}
+		}
+
+		c.archiveFolder = archive
+		c.archiveLoaded = true
+	}
+
+	if c.archiveFolder != "" {
+		return c.archiveFolder, nil
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return DefaultArchiveFolder, nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// destination returns the folder msg, matched by rule, is moved to. Sender
+// placeholders in the rule's folder are filled in from msg; with a nil msg
+// they are left as they are. If the rule has fallbacks, the first of its
+// folders that exists is used.
+func (c *Client) destination(rule *models.Rule, msg *models.Message) (string, error) {
+	if rule.Action == models.ActionArchive {
+		return c.ArchiveFolder(rule.MoveToFolder)
+	}
+	if msg == nil && hasPlaceholder(rule.MoveToFolder) {
+		return rule.MoveToFolder, nil
+	}
+
+	folders := rule.Destinations()
+	if msg != nil && hasPlaceholder(rule.MoveToFolder) {
+		delimiter, err := c.hierarchyDelimiter()
+		if err != nil {
+			return "", err
+		}
+		for i, f := range folders {
+			folders[i] = expandFolder(f, msg.From, delimiter)
+		}
+	}
+	if len(folders) == 1 {
+		return folders[0], nil
+	}
+	return c.firstExisting(folders)
+}
+
+// firstExisting returns the first of folders that exists, or the first one
+// if none do, so that it is the one created when missing folders are. The
+// choice is remembered for the connection.
+func (c *Client) firstExisting(folders []string) (string, error) {
+	key := strings.Join(folders, "\n")
+	if folder, ok := c.fallbackChoices[key]; ok {
+		return folder, nil
+	}
+
+	choice := folders[0]
+	for _, f := range folders {
+		err := c.requireFolder(f)
+		if err == nil {
+			choice = f
+			break
+		}
+		if !errors.Is(err, ErrFolderNotFound) {
+			return "", err
+		}
+	}
+
+	if c.fallbackChoices == nil {
+		c.fallbackChoices = make(map[string]string)
+	}
+	c.fallbackChoices[key] = choice
+	return choice, nil
+}
+
+// Placeholders a move rule's folder may contain, so that one rule can sort
+// mail into a folder per sender or per sender domain
+const (
+	placeholderSender = "{sender}"
+	placeholderDomain = "{domain}"
+)
+
+// unknownSender replaces the placeholders when a message has no sender
+const unknownSender = "unknown"
+
+// maxPlaceholderLength is the longest a sender or domain substituted into a
+// folder name may be, in bytes; longer ones are cut short
+const maxPlaceholderLength = 64
+
+// hasPlaceholder reports whether folder depends on the message's sender
+func hasPlaceholder(folder string) bool {
+	return strings.Contains(folder, placeholderSender) || strings.Contains(folder, placeholderDomain)
+}
+
+// expandFolder replaces the sender placeholders in folder with the address
+// and domain of from. The sender chooses its own address, so the values are
+// made safe first, see folderSafe.
+func expandFolder(folder, from, delimiter string) string {
+	if !hasPlaceholder(folder) {
+		return folder
+	}
+
+	sender, domain := senderAddress(from), ""
+	if at := strings.LastIndex(sender, "@"); at != -1 {
+		domain = sender[at+1:]
+	}
+	if sender == "" {
+		sender = unknownSender
+	}
+	if domain == "" {
+		domain = unknownSender
+	}
+	return strings.NewReplacer(
+		placeholderSender, folderSafe(sender, delimiter),
+		placeholderDomain, folderSafe(domain, delimiter),
+	).Replace(folder)
+}
+
+// folderSafe makes s safe to use as part of a folder name: the hierarchy
+// delimiter, which would create nested folders, the LIST wildcards % and *
+// and control characters are replaced with "_", and s is cut to
+// maxPlaceholderLength bytes
+func folderSafe(s, delimiter string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '%' || r == '*' || unicode.IsControl(r) || strings.ContainsRune(delimiter, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) <= maxPlaceholderLength {
+		return s
+	}
+	s = s[:maxPlaceholderLength]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
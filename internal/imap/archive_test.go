@@ -0,0 +1,144 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestArchiveFolderSpecialUse(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Archive")
+	ts.SetSpecialUse("All Mail", `\Archive`)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	folder, err := client.ArchiveFolder("Old")
+	if err != nil {
+		t.Fatalf("ArchiveFolder failed: %v", err)
+	}
+	if folder != "All Mail" {
+		t.Errorf("Expected the \\Archive folder %q, got %q", "All Mail", folder)
+	}
+}
+
+func TestArchiveFolderFallback(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	folder, err := client.ArchiveFolder("Old")
+	if err != nil {
+		t.Fatalf("ArchiveFolder failed: %v", err)
+	}
+	if folder != "Old" {
+		t.Errorf("Expected fallback %q, got %q", "Old", folder)
+	}
+
+	folder, _ = client.ArchiveFolder("")
+	if folder != DefaultArchiveFolder {
+		t.Errorf("Expected default %q, got %q", DefaultArchiveFolder, folder)
+	}
+}
+
+func TestApplyRulesArchive(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	ts.AddMessage("friend@example.com", "Hello", "Content")
+	ts.SetSpecialUse("All Mail", `\Archive`)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", Action: models.ActionArchive, Enabled: true},
+	}
+
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	if ts.GetMessageCount("All Mail") != 1 {
+		t.Errorf("Expected 1 message in All Mail, got %d", ts.GetMessageCount("All Mail"))
+	}
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected 1 message left in INBOX, got %d", ts.GetMessageCount("INBOX"))
+	}
+}
+
+func TestApplyRulesFallbackFolders(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("INBOX.Receipts")
+	ts.AddMessage("shop@example.com", "Receipt", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "shop@", PatternType: "sender", MoveToFolder: "Receipts", Fallbacks: []string{"Shopping", "INBOX.Receipts"}, Enabled: true},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.MatchedMessages != 1 {
+		t.Fatalf("Expected 1 match, got %d", result.MatchedMessages)
+	}
+	if n := ts.GetMessageCount("INBOX.Receipts"); n != 1 {
+		t.Errorf("Expected the message in the first existing folder INBOX.Receipts, got %d", n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 0 {
+		t.Errorf("Expected INBOX to be empty, got %d", n)
+	}
+}
+
+func TestApplyRulesFallbackFoldersCreatesFirst(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("shop@example.com", "Receipt", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.CreateMissingFolders()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "shop@", PatternType: "sender", MoveToFolder: "Receipts", Fallbacks: []string{"Shopping"}, Enabled: true},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if len(result.CreatedFolders) != 1 || result.CreatedFolders[0] != "Receipts" {
+		t.Errorf("Expected only Receipts to be created, got %v", result.CreatedFolders)
+	}
+	if n := ts.GetMessageCount("Receipts"); n != 1 {
+		t.Errorf("Expected the message in Receipts, got %d", n)
+	}
+}
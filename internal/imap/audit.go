@@ -0,0 +1,129 @@
+package imap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// Audited actions
+const (
+	AuditMove   = "move"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records one message moved or deleted, or that would have been
+// in a dry run. The subject is hashed so the log can be kept without storing
+// message contents, while entries for the same message can still be matched.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	AccountID   int64     `json:"account_id"`
+	Account     string    `json:"account"`
+	Action      string    `json:"action"`
+	RuleID      int64     `json:"rule_id,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	UID         uint32    `json:"uid"`
+	From        string    `json:"from,omitempty"`
+	SubjectHash string    `json:"subject_hash,omitempty"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination,omitempty"`
+	DryRun      bool      `json:"dry_run"`
+}
+
+// AuditLog appends AuditEntry records to a writer as JSON lines. It is safe
+// for concurrent use by several clients.
+type AuditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+// NewAuditLog returns an AuditLog writing to w
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, now: time.Now}
+}
+
+// OpenAuditLog opens the file at path for appending, creating it if needed,
+// and returns an AuditLog writing to it. Close the log when done.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return NewAuditLog(f), nil
+}
+
+// Close closes the underlying writer if it is an io.Closer
+func (l *AuditLog) Close() error {
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Write appends entry, timestamped now if it has no time yet. Each entry is
+// written with a single call, so lines from concurrent writers never mix.
+func (l *AuditLog) Write(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = l.now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	return nil
+}
+
+// SetAuditLog makes the client record every message it moves or deletes in
+// log, as well as the moves ApplyRules would make in a dry run
+func (c *Client) SetAuditLog(log *AuditLog) {
+	c.auditLog = log
+}
+
+// audit records an action on the message with the given UID in the selected
+// folder. msg and rule describe the message and the rule that matched it, if
+// known.
+func (c *Client) audit(action string, uid uint32, msg *models.Message, rule *models.Rule, dest string, dryRun bool) error {
+	if c.auditLog == nil {
+		return nil
+	}
+	entry := AuditEntry{
+		AccountID:   c.account.ID,
+		Account:     c.account.Name,
+		Action:      action,
+		UID:         uid,
+		Source:      c.selected,
+		Destination: dest,
+		DryRun:      dryRun,
+	}
+	if rule != nil {
+		entry.RuleID, entry.Rule = rule.ID, rule.Name
+	}
+	if msg != nil {
+		entry.From = msg.From
+		entry.SubjectHash = hashSubject(msg.Subject)
+	}
+	return c.auditLog.Write(entry)
+}
+
+// hashSubject returns the hex SHA-256 of subject, or "" for no subject
+func hashSubject(subject string) string {
+	if subject == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
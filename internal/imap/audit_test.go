@@ -0,0 +1,249 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// readAuditLog decodes the JSON lines written to buf
+func readAuditLog(t *testing.T, buf *bytes.Buffer) []AuditEntry {
+	t.Helper()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestApplyRulesAuditLog(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+	account.ID = 7
+	account.Name = "Work"
+
+	ts.AddMessage("newsletter@example.com", "Weekly news", "Content")
+	ts.AddMessage("friend@example.com", "Hello", "Content")
+	ts.CreateFolder("Newsletters")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	client.SetAuditLog(NewAuditLog(&buf))
+
+	rules := []models.Rule{
+		{ID: 3, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	entries := readAuditLog(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d: %+v", len(entries), entries)
+	}
+	got := entries[0]
+	sum := sha256.Sum256([]byte("Weekly news"))
+	if got.AccountID != 7 || got.Account != "Work" {
+		t.Errorf("Account = %d %q, want 7 \"Work\"", got.AccountID, got.Account)
+	}
+	if got.Action != AuditMove || got.RuleID != 3 || got.Rule != "News" {
+		t.Errorf("Action and rule = %q %d %q, want move 3 \"News\"", got.Action, got.RuleID, got.Rule)
+	}
+	if got.UID != 1 || got.From != "newsletter@example.com" {
+		t.Errorf("UID and from = %d %q, want 1 \"newsletter@example.com\"", got.UID, got.From)
+	}
+	if got.SubjectHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("SubjectHash = %q, want the SHA-256 of the subject", got.SubjectHash)
+	}
+	if got.Source != "INBOX" || got.Destination != "Newsletters" {
+		t.Errorf("Source and destination = %q %q, want INBOX Newsletters", got.Source, got.Destination)
+	}
+	if got.DryRun {
+		t.Error("Expected a real move not to be marked as a dry run")
+	}
+	if got.Time.IsZero() {
+		t.Error("Expected the entry to be timestamped")
+	}
+}
+
+func TestApplyRulesAuditLogDryRun(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter 1", "Content")
+	ts.AddMessage("newsletter@example.com", "Newsletter 2", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	client.SetAuditLog(NewAuditLog(&buf))
+
+	rules := []models.Rule{
+		{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+	if _, err := client.ApplyRules(rules, "INBOX", true, 1); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	entries := readAuditLog(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit entry within the limit, got %d: %+v", len(entries), entries)
+	}
+	if !entries[0].DryRun || entries[0].Destination != "Newsletters" {
+		t.Errorf("Entry = %+v, want a dry run move to Newsletters", entries[0])
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 2 {
+		t.Errorf("Expected a dry run to leave 2 messages in INBOX, got %d", n)
+	}
+}
+
+func TestApplyActionDeleteAuditLog(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("spam@example.com", "Spam 1", "Content")
+	ts.AddMessage("spam@example.com", "Spam 2", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	client.SetAuditLog(NewAuditLog(&buf))
+
+	if _, err := client.ApplyAction("INBOX", []uint32{1, 2}, ActionDelete, ""); err != nil {
+		t.Fatalf("ApplyAction failed: %v", err)
+	}
+
+	entries := readAuditLog(t, &buf)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Action != AuditDelete || entry.UID != uint32(i+1) || entry.Source != "INBOX" {
+			t.Errorf("Entry %d = %+v, want a delete of UID %d from INBOX", i, entry, i+1)
+		}
+		if entry.From != "spam@example.com" || entry.SubjectHash != hashSubject(fmt.Sprintf("Spam %d", i+1)) {
+			t.Errorf("Entry %d = %+v, want the deleted message's sender and subject", i, entry)
+		}
+	}
+}
+
+func TestMoveMessageFromAuditLog(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("news@example.com", "Weekly", "Content")
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	var buf bytes.Buffer
+	client.SetAuditLog(NewAuditLog(&buf))
+
+	if err := client.MoveMessageFrom("INBOX", 1, "Archive"); err != nil {
+		t.Fatalf("MoveMessageFrom failed: %v", err)
+	}
+
+	entries := readAuditLog(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Action != AuditMove || entry.UID != 1 || entry.Destination != "Archive" {
+		t.Errorf("Entry = %+v, want a move of UID 1 to Archive", entry)
+	}
+	if entry.From != "news@example.com" || entry.SubjectHash != hashSubject("Weekly") {
+		t.Errorf("Entry = %+v, want the moved message's sender and subject", entry)
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestApplyActionAuditLogFailure(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("spam@example.com", "Spam", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	client.SetAuditLog(NewAuditLog(failingWriter{}))
+
+	// The message is gone by the time the entry fails to be written, so
+	// the delete itself succeeded
+	if _, err := client.ApplyAction("INBOX", []uint32{1}, ActionDelete, ""); err != nil {
+		t.Errorf("Expected an audit log failure not to fail the action, got %v", err)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 0 {
+		t.Errorf("Expected the message to be deleted, INBOX has %d", n)
+	}
+}
+
+func TestApplyRulesAuditLogFailure(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("news@example.com", "Weekly", "Content")
+	ts.CreateFolder("Newsletters")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	client.SetAuditLog(NewAuditLog(failingWriter{}))
+	var moved []uint32
+	client.OnMoved(func(uid uint32) error {
+		moved = append(moved, uid)
+		return nil
+	})
+
+	rules := []models.Rule{{ID: 1, Name: "News", Pattern: "news@", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true}}
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Errorf("Expected an audit log failure not to fail the apply, got %v", err)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 1 {
+		t.Errorf("Expected the message to be moved, Newsletters has %d", n)
+	}
+	if len(moved) != 1 {
+		t.Errorf("Expected the move to be recorded as progress, got %v", moved)
+	}
+}
@@ -0,0 +1,93 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// CreateMissingFolders makes ApplyRules create destination folders that
+// don't exist yet, along with any missing parent folders, instead of failing
+// to move messages there. The folders created are listed in the result.
+func (c *Client) CreateMissingFolders() {
+	c.createMissing = true
+}
+
+// hierarchyDelimiter returns the server's hierarchy delimiter, looked up
+// once per connection. It is taken from the cached folder list if that has
+// been loaded, and otherwise asked for with LIST "" "". It is empty if the
+// server has a flat folder namespace.
+func (c *Client) hierarchyDelimiter() (string, error) {
+	if c.delimiterLoaded {
+		return c.delimiter, nil
+	}
+	if c.foldersLoaded && len(c.folders) > 0 {
+		c.delimiter = c.folders[0].Delimiter
+		c.delimiterLoaded = true
+		return c.delimiter, nil
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.conn.List("", "", mailboxes)
+	}()
+
+	var delimiter string
+	for m := range mailboxes {
+		delimiter = m.Delimiter
+	}
+	if err := <-done; err != nil {
+		return "", fmt.Errorf("listing hierarchy delimiter: %w", err)
+	}
+
+	c.delimiter = delimiter
+	c.delimiterLoaded = true
+	return delimiter, nil
+}
+
+// ensureFolder creates name if it doesn't exist, creating its parents first
+// for servers that don't do so themselves. It returns the folders created,
+// parents first.
+func (c *Client) ensureFolder(name string) ([]string, error) {
+	resolved, err := c.ResolveFolder(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.requireFolder(resolved); err == nil {
+		return nil, nil
+	} else if !errors.Is(err, ErrFolderNotFound) {
+		return nil, err
+	}
+
+	delimiter, err := c.hierarchyDelimiter()
+	if err != nil {
+		return nil, err
+	}
+	parts := []string{resolved}
+	if delimiter != "" {
+		parts = strings.Split(resolved, delimiter)
+	}
+
+	var created []string
+	for i := range parts {
+		path := strings.Join(parts[:i+1], delimiter)
+		if i < len(parts)-1 {
+			err := c.requireFolder(path)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrFolderNotFound) {
+				return created, err
+			}
+		}
+		c.forgetFolders()
+		if err := c.conn.Create(path); err != nil {
+			return created, fmt.Errorf("creating %s: %w", path, err)
+		}
+		created = append(created, path)
+	}
+	return created, nil
+}
@@ -0,0 +1,111 @@
+package imap
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestApplyRulesCreatesMissingFolders(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Clients")
+	ts.AddMessage("billing@acme.com", "Invoice", "Content")
+	ts.AddMessage("news@example.com", "Newsletter", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.CreateMissingFolders()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "acme.com", PatternType: "sender", MoveToFolder: "Clients/Acme", Enabled: true},
+		{ID: 2, Pattern: "news@", PatternType: "sender", MoveToFolder: "Lists/News/Example", Enabled: true},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	created := slices.Clone(result.CreatedFolders)
+	slices.Sort(created)
+	want := []string{"Clients/Acme", "Lists", "Lists/News", "Lists/News/Example"}
+	if !slices.Equal(created, want) {
+		t.Errorf("Expected created folders %v, got %v", want, result.CreatedFolders)
+	}
+
+	if n := ts.GetMessageCount("Clients/Acme"); n != 1 {
+		t.Errorf("Expected 1 message in Clients/Acme, got %d", n)
+	}
+	if n := ts.GetMessageCount("Lists/News/Example"); n != 1 {
+		t.Errorf("Expected 1 message in Lists/News/Example, got %d", n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 0 {
+		t.Errorf("Expected INBOX to be empty, got %d", n)
+	}
+}
+
+func TestApplyRulesMissingFolderWithoutAutoCreate(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("billing@acme.com", "Invoice", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "acme.com", PatternType: "sender", MoveToFolder: "Clients/Acme", Enabled: true},
+	}
+
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err == nil {
+		t.Error("Expected apply to fail when the destination doesn't exist")
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 1 {
+		t.Errorf("Expected the message to stay in INBOX, got %d", n)
+	}
+}
+
+func TestApplyRulesDryRunDoesNotCreateFolders(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("billing@acme.com", "Invoice", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.CreateMissingFolders()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "acme.com", PatternType: "sender", MoveToFolder: "Clients/Acme", Enabled: true},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", true, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if len(result.CreatedFolders) != 0 {
+		t.Errorf("Expected a dry run not to create folders, got %v", result.CreatedFolders)
+	}
+
+	folders, err := client.ListFolders()
+	if err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+	for _, f := range folders {
+		if f.Name == "Clients" || f.Name == "Clients/Acme" {
+			t.Errorf("Expected %s not to be created", f.Name)
+		}
+	}
+}
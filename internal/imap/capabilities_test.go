@@ -0,0 +1,52 @@
+package imap
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	caps, err := client.Capabilities()
+	client.Close()
+	if err != nil {
+		t.Fatalf("Capabilities failed: %v", err)
+	}
+
+	if !slices.Contains(caps, "IMAP4rev1") {
+		t.Errorf("Expected IMAP4rev1 in %v", caps)
+	}
+	if !slices.IsSorted(caps) {
+		t.Errorf("Expected sorted capabilities, got %v", caps)
+	}
+	for _, c := range []string{"QUOTA", "COMPRESS=DEFLATE"} {
+		if slices.Contains(caps, c) {
+			t.Errorf("Expected %s not to be advertised yet, got %v", c, caps)
+		}
+	}
+
+	ts.SetQuota(1000, 50)
+	ts.EnableCompress()
+
+	client, err = Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	caps, err = client.Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities failed: %v", err)
+	}
+	for _, c := range []string{"IMAP4rev1", "QUOTA", "COMPRESS=DEFLATE"} {
+		if !slices.Contains(caps, c) {
+			t.Errorf("Expected %s in %v", c, caps)
+		}
+	}
+}
@@ -2,8 +2,17 @@
 package imap
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -14,48 +23,261 @@ import (
 
 // Client wraps the IMAP client with mailcleaner-specific functionality
 type Client struct {
-	conn     *client.Client
+	conn     *timedConn
 	account  *models.Account
 	selected string
+
+	// Time taken by Connect to dial and log in, see TestConnection
+	connectTime time.Duration
+	loginTime   time.Duration
+
+	// Personal namespace prefix, see ResolveFolder
+	namespaceLoaded bool
+	namespacePrefix string
+
+	// UIDVALIDITY of each folder as first seen by this client
+	uidValidity map[string]uint32
+
+	// Every folder as listed by LIST "" "*", see cachedFolders
+	foldersLoaded bool
+	folders       []models.Folder
+
+	// Special-use \Archive folder, see ArchiveFolder
+	archiveLoaded bool
+	archiveFolder string
+
+	// Folder chosen among a rule's destination and its fallbacks, by the
+	// candidates joined with newlines, see firstExisting
+	fallbackChoices map[string]string
+
+	// Keyword marking messages rules have acted on, see TagProcessed
+	processedKeyword string
+
+	// Arrival date before which messages are skipped, see Since
+	since time.Time
+
+	// Whether ApplyRules creates missing destination folders, see
+	// CreateMissingFolders, and the hierarchy delimiter used to do so
+	createMissing   bool
+	delimiterLoaded bool
+	delimiter       string
+
+	// Whether COMPRESS=DEFLATE is active, see startCompression
+	compressed bool
+
+	// Where moves and deletes are recorded, see SetAuditLog
+	auditLog *AuditLog
+
+	// Where an interrupted apply stopped and how to record progress, see
+	// ResumeBefore and OnMoved
+	resumeBefore uint32
+	onMoved      func(uid uint32) error
+
+	// Context the client was connected with, see ConnectContext. stop is
+	// closed by Close to end the goroutine watching ctx.
+	ctx  context.Context
+	stop chan struct{}
+}
+
+// ErrUIDValidityChanged is returned when a folder's UIDVALIDITY differs from
+// the value seen earlier, meaning previously fetched UIDs no longer identify
+// the same messages
+var ErrUIDValidityChanged = errors.New("UIDVALIDITY changed")
+
+// ErrFolderNotFound is returned when a folder to select or move messages to
+// doesn't exist on the server
+var ErrFolderNotFound = errors.New("folder not found")
+
+// ErrDestinationNotFound is returned when the folder a message would be moved
+// to doesn't exist, as opposed to the folder it is in. It is also an
+// ErrFolderNotFound.
+var ErrDestinationNotFound = fmt.Errorf("destination %w", ErrFolderNotFound)
+
+// ErrFolderExists is returned when creating a folder that already exists
+var ErrFolderExists = errors.New("folder already exists")
+
+// ErrMessageNotFound is returned when the selected folder has no message with
+// a requested UID
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrDestinationNotAllowed is returned when messages would be moved to a
+// folder that isn't among the account's allowed destinations
+var ErrDestinationNotAllowed = errors.New("destination folder not allowed")
+
+// ErrConnect is returned when the server can't be reached
+var ErrConnect = errors.New("cannot connect")
+
+// ErrAuthFailed is returned when the server rejects the account's
+// credentials
+var ErrAuthFailed = errors.New("login failed")
+
+// ErrReadOnly is returned when messages would be moved or changed in a folder
+// the server only allows reading
+var ErrReadOnly = errors.New("folder is read-only")
+
+// ConnectContext is like Connect, but gives up when ctx is done. Once
+// connected, the connection is closed when ctx is done, so a command in
+// progress fails instead of hanging.
+func ConnectContext(ctx context.Context, account *models.Account) (*Client, error) {
+	type result struct {
+		client *Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := Connect(account)
+		done <- result{c, err}
+	}()
+
+	var c *Client
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return nil, res.err
+		}
+		c = res.client
+	case <-ctx.Done():
+		// Don't leak the connection if it is established after all
+		go func() {
+			if res := <-done; res.err == nil {
+				res.client.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%w to %s:%d: %w", ErrConnect, account.Server, account.Port, ctx.Err())
+	}
+
+	c.ctx = ctx
+	c.stop = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Terminate()
+		case <-c.stop:
+		}
+	}()
+	return c, nil
 }
 
 // Connect creates a new IMAP connection to the given account
 func Connect(account *models.Account) (*Client, error) {
 	addr := fmt.Sprintf("%s:%d", account.Server, account.Port)
 
-	var conn *client.Client
-	var err error
-
-	if account.TLS {
-		conn, err = client.DialTLS(addr, nil)
-	} else {
-		conn, err = client.Dial(addr)
-	}
+	start := time.Now()
+	raw, deflate, err := dial(addr, account)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+		return nil, fmt.Errorf("%w to %s: %w", ErrConnect, addr, err)
 	}
+	connected := time.Now()
+	// A stuck command, including the login, fails instead of blocking
+	// forever
+	conn := &timedConn{Client: raw, timeout: account.CommandTimeout()}
 
 	if err := conn.Login(account.Username, account.Password); err != nil {
+		if errors.Is(err, ErrTimeout) {
+			return nil, fmt.Errorf("%w to %s: %w", ErrConnect, addr, err)
+		}
 		conn.Logout()
-		return nil, fmt.Errorf("login failed: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
 	}
 
-	return &Client{
-		conn:    conn,
-		account: account,
-	}, nil
+	c := &Client{
+		conn:        conn,
+		account:     account,
+		connectTime: connected.Sub(start),
+		loginTime:   time.Since(connected),
+	}
+	if deflate != nil {
+		if err := c.startCompression(deflate); err != nil {
+			conn.Logout()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// dial opens the connection to the server. For accounts with Compress set the
+// connection is returned as a deflateConn too, to be switched to DEFLATE
+// after login.
+func dial(addr string, account *models.Account) (*client.Client, *deflateConn, error) {
+	if !account.Compress && account.ProxyURL == "" {
+		var conn *client.Client
+		var err error
+		if account.TLS {
+			conn, err = client.DialTLS(addr, nil)
+		} else {
+			conn, err = client.Dial(addr)
+		}
+		return conn, nil, err
+	}
+
+	raw, err := dialRaw(addr, account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var deflate *deflateConn
+	netConn := raw
+	if account.Compress {
+		deflate = &deflateConn{Conn: raw}
+		netConn = deflate
+	}
+
+	conn, err := client.New(netConn)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	return conn, deflate, nil
+}
+
+// dialRaw opens the connection to the server, through the account's proxy if
+// it has one, and starts TLS on it if the account uses TLS
+func dialRaw(addr string, account *models.Account) (net.Conn, error) {
+	dialer, err := ProxyDialer(account.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !account.TLS {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: account.Server})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 // Close logs out and closes the connection
 func (c *Client) Close() error {
+	if c.stop != nil {
+		close(c.stop)
+	}
+	if c.ctx != nil && c.ctx.Err() != nil {
+		// The connection is closed, or about to be, because ctx is done
+		c.conn.Terminate()
+		return c.ctx.Err()
+	}
 	return c.conn.Logout()
 }
 
 // TestConnection tests if the account credentials are valid
 func (c *Client) TestConnection() (*models.ConnectionStatus, error) {
-	status := &models.ConnectionStatus{Success: true, Message: "Connection successful"}
+	status := &models.ConnectionStatus{
+		Success:   true,
+		Message:   "Connection successful",
+		ConnectMs: c.connectTime.Milliseconds(),
+		LoginMs:   c.loginTime.Milliseconds(),
+	}
 
 	// List mailboxes
+	start := time.Now()
 	mailboxes := make(chan *imap.MailboxInfo, 100)
 	done := make(chan error, 1)
 
@@ -74,24 +296,99 @@ func (c *Client) TestConnection() (*models.ConnectionStatus, error) {
 	if err := <-done; err != nil {
 		return nil, fmt.Errorf("listing mailboxes: %w", err)
 	}
+	status.ListMs = time.Since(start).Milliseconds()
 
-	// Get INBOX message count
-	mbox, err := c.conn.Select("INBOX", true)
+	// Get the primary mailbox's message count
+	inbox := c.account.Inbox()
+	mbox, err := c.conn.Select(inbox, true)
 	if err != nil {
-		return nil, fmt.Errorf("selecting INBOX: %w", err)
+		return nil, fmt.Errorf("selecting %s: %w", inbox, err)
 	}
 	status.TotalEmails = int(mbox.Messages)
 
+	// Usually already known from logging in, so this costs no round trip
+	if status.Capabilities, err = c.Capabilities(); err != nil {
+		return nil, err
+	}
+
 	return status, nil
 }
 
-// ListFolders returns all folders/mailboxes in the account
+// Capabilities returns the capabilities the server advertises, sorted
+func (c *Client) Capabilities() ([]string, error) {
+	caps, err := c.conn.Capability()
+	if err != nil {
+		return nil, fmt.Errorf("getting capabilities: %w", err)
+	}
+
+	result := make([]string, 0, len(caps))
+	for name := range caps {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// ListFolders returns all folders/mailboxes in the account. If listing fails
+// partway, the folders received before the failure are returned along with
+// the error. The list is cached for the connection, see cachedFolders.
 func (c *Client) ListFolders() ([]models.Folder, error) {
+	folders, err := c.cachedFolders()
+	return slices.Clone(folders), err
+}
+
+// cachedFolders returns every folder, listed once per connection so that
+// the existence checks and special-use lookups of a preview or apply share a
+// single LIST. Creating a folder through the client drops the cache. A
+// failed listing isn't cached. The result must not be modified.
+func (c *Client) cachedFolders() ([]models.Folder, error) {
+	if c.foldersLoaded {
+		return c.folders, nil
+	}
+	folders, err := c.list("*")
+	if err != nil {
+		return folders, err
+	}
+	c.folders = folders
+	c.foldersLoaded = true
+	return folders, nil
+}
+
+// forgetFolders drops the cached folder list after the folders change
+func (c *Client) forgetFolders() {
+	c.foldersLoaded = false
+	c.folders = nil
+}
+
+// ListFoldersMatching is ListFolders for the folders whose names match an
+// IMAP LIST pattern. In the pattern, "*" matches any characters including
+// the hierarchy delimiter, while "%" stops at the delimiter, so it matches
+// one level only: "%" lists the top-level folders and "Work/%" the direct
+// children of Work, which lets a folder tree be expanded level by level.
+func (c *Client) ListFoldersMatching(pattern string) ([]models.Folder, error) {
+	if pattern == "*" {
+		return c.ListFolders()
+	}
+	if c.foldersLoaded {
+		var folders []models.Folder
+		for _, f := range c.folders {
+			info := imap.MailboxInfo{Name: f.Name, Delimiter: f.Delimiter}
+			if info.Match("", pattern) {
+				folders = append(folders, f)
+			}
+		}
+		return folders, nil
+	}
+	return c.list(pattern)
+}
+
+// list lists the folders matching pattern with LIST
+func (c *Client) list(pattern string) ([]models.Folder, error) {
 	mailboxes := make(chan *imap.MailboxInfo, 100)
 	done := make(chan error, 1)
 
 	go func() {
-		done <- c.conn.List("", "*", mailboxes)
+		done <- c.conn.List("", pattern, mailboxes)
 	}()
 
 	var folders []models.Folder
@@ -104,88 +401,386 @@ func (c *Client) ListFolders() ([]models.Folder, error) {
 	}
 
 	if err := <-done; err != nil {
-		return nil, fmt.Errorf("listing mailboxes: %w", err)
+		return folders, fmt.Errorf("listing mailboxes: %w", err)
 	}
 
 	return folders, nil
 }
 
-// SelectFolder selects a mailbox/folder
+// SelectFolder selects a mailbox/folder. It returns ErrFolderNotFound if the
+// folder doesn't exist.
 func (c *Client) SelectFolder(name string) (int, error) {
-	mbox, err := c.conn.Select(name, true)
+	mbox, err := c.selectMailbox(name, true)
 	if err != nil {
-		return 0, fmt.Errorf("selecting %s: %w", name, err)
+		return 0, err
 	}
 	c.selected = name
 	return int(mbox.Messages), nil
 }
 
+// ExpectUIDValidity records the UIDVALIDITY a folder is expected to have,
+// typically taken from an earlier preview. Selecting the folder fails with
+// ErrUIDValidityChanged if the server reports a different value.
+func (c *Client) ExpectUIDValidity(folder string, uidValidity uint32) {
+	if c.uidValidity == nil {
+		c.uidValidity = make(map[string]uint32)
+	}
+	c.uidValidity[folder] = uidValidity
+}
+
+// TagProcessed makes ApplyRules tag every message it acts on with keyword
+// before moving it, and makes PreviewRules and ApplyRules skip messages that
+// already carry it, so repeated runs never act on the same message twice
+func (c *Client) TagProcessed(keyword string) {
+	c.processedKeyword = keyword
+}
+
+// ResumeBefore makes ApplyRules, dry runs included, only move messages with
+// a UID below uid, continuing an interrupted apply of the same folder that
+// got as far as moving the message with that UID. Messages are moved newest
+// first, so those with higher UIDs have already been dealt with. UIDs only
+// stay meaningful while the folder's UIDVALIDITY is unchanged, so pair it
+// with ExpectUIDValidity.
+func (c *Client) ResumeBefore(uid uint32) {
+	c.resumeBefore = uid
+}
+
+// OnMoved sets fn to be called with each message's UID after ApplyRules
+// moves it, so progress can be recorded for ResumeBefore. An error from fn
+// stops the apply.
+func (c *Client) OnMoved(fn func(uid uint32) error) {
+	c.onMoved = fn
+}
+
+// Since makes the client skip messages that arrived before t, on top of the
+// account's scan window, e.g. for a one-off run over recent mail. Like the
+// scan window it is applied with SEARCH SINCE, which compares dates only, so
+// every message that arrived on t's day is included.
+func (c *Client) Since(t time.Time) {
+	c.since = t
+}
+
+// UIDValidity returns the UIDVALIDITY of the selected folder, or 0 if no
+// folder has been selected
+func (c *Client) UIDValidity() uint32 {
+	return c.uidValidity[c.selected]
+}
+
+// selectMailbox selects a folder and checks its UIDVALIDITY against the value
+// recorded for it, recording it on first selection. Folders are selected
+// read-only unless messages are about to be moved out of them.
+func (c *Client) selectMailbox(name string, readOnly bool) (*imap.MailboxStatus, error) {
+	mbox, err := c.conn.Select(name, readOnly)
+	if err != nil {
+		// Servers word a missing mailbox differently, so ask whether it
+		// exists rather than parsing the NO response. If the LIST fails too,
+		// the connection is the problem and the original error is kept.
+		if found, listErr := c.folderExists(name); listErr == nil && !found {
+			return nil, fmt.Errorf("selecting %s: %w", name, ErrFolderNotFound)
+		}
+		return nil, fmt.Errorf("selecting %s: %w", name, err)
+	}
+
+	if expected, ok := c.uidValidity[name]; ok && expected != mbox.UidValidity {
+		return nil, fmt.Errorf("%s: %w (was %d, now %d)", name, ErrUIDValidityChanged, expected, mbox.UidValidity)
+	}
+	if !readOnly && mbox.ReadOnly {
+		return nil, fmt.Errorf("%s: %w", name, ErrReadOnly)
+	}
+	c.ExpectUIDValidity(name, mbox.UidValidity)
+
+	return mbox, nil
+}
+
 // FetchMessages fetches messages from the currently selected folder
 func (c *Client) FetchMessages(limit int) ([]models.Message, error) {
+	mbox, err := c.reselect()
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't send a FETCH for an empty folder: "1:0" or "1:*" on an empty
+	// mailbox is an error on some servers
+	if mbox.Messages == 0 {
+		return []models.Message{}, nil
+	}
+	from, to := computeFetchRange(mbox.Messages, fetchLimit(limit))
+	seqNums, err := c.scanWindow(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(seqNums) == 0 {
+		return []models.Message{}, nil
+	}
+
+	var result []models.Message
+	if n := c.fetchConcurrency(); n > 1 && len(seqNums) >= n {
+		result, err = c.fetchConcurrent(seqNums, n)
+	} else {
+		result, err = c.fetchSeqNums(c.conn, seqNums)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		// The server reported messages but returned none, e.g. because
+		// they were expunged in the meantime
+		return []models.Message{}, nil
+	}
+
+	return result, nil
+}
+
+// FetchMessagesInChunks fetches the same messages as FetchMessages, most
+// recent first, but size at a time, so that a large folder is never held in
+// memory as a whole and the first messages are available quickly. Each chunk
+// is passed to fn together with the number of messages being fetched in
+// total. Fetching stops at the first error returned by fn.
+func (c *Client) FetchMessagesInChunks(limit, size int, fn func(chunk []models.Message, total int) error) error {
+	mbox, err := c.reselect()
+	if err != nil {
+		return err
+	}
+	if mbox.Messages == 0 {
+		return nil
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	from, to := computeFetchRange(mbox.Messages, fetchLimit(limit))
+	seqNums, err := c.scanWindow(from, to)
+	if err != nil {
+		return err
+	}
+	total := len(seqNums)
+	for end := total; end > 0; end -= size {
+		start := max(end-size, 0)
+		chunk, err := c.fetchSeqNums(c.conn, seqNums[start:end])
+		if err != nil {
+			return err
+		}
+		if err := fn(chunk, total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reselect selects the current folder again, read-only, to get its current
+// status before fetching. The account's primary mailbox, usually INBOX, is
+// selected if no folder is.
+func (c *Client) reselect() (*imap.MailboxStatus, error) {
 	if c.selected == "" {
-		if _, err := c.SelectFolder("INBOX"); err != nil {
+		if _, err := c.SelectFolder(c.account.Inbox()); err != nil {
 			return nil, err
 		}
 	}
+	return c.selectMailbox(c.selected, true)
+}
+
+// scanWindow returns the sequence numbers in the range [from, to] of the
+// messages to fetch, ascending. Messages that arrived before the account's
+// scan window are left out, so older mail isn't fetched: only the messages
+// SEARCH SINCE returns are kept, as sequence order isn't arrival order once
+// older mail has been moved or copied into the folder. The window starts at
+// the later of the account's scan window and the date set with Since;
+// without either every message in the range is kept.
+func (c *Client) scanWindow(from, to uint32) ([]uint32, error) {
+	since := c.since
+	if days := c.account.ScanWindowDays; days > 0 {
+		if start := time.Now().AddDate(0, 0, -days); start.After(since) {
+			since = start
+		}
+	}
+	if since.IsZero() {
+		seqNums := make([]uint32, 0, to-from+1)
+		for n := from; n <= to; n++ {
+			seqNums = append(seqNums, n)
+		}
+		return seqNums, nil
+	}
 
-	mbox, err := c.conn.Select(c.selected, true)
+	criteria := imap.NewSearchCriteria()
+	criteria.Since = since
+	found, err := c.conn.Search(criteria)
 	if err != nil {
-		return nil, fmt.Errorf("selecting %s: %w", c.selected, err)
+		return nil, fmt.Errorf("searching messages since %s: %w", criteria.Since.Format(time.DateOnly), err)
 	}
 
-	if mbox.Messages == 0 {
-		return []models.Message{}, nil
+	var seqNums []uint32
+	for _, n := range found {
+		if n >= from && n <= to {
+			seqNums = append(seqNums, n)
+		}
+	}
+	slices.Sort(seqNums)
+	return seqNums, nil
+}
+
+// computeFetchRange returns the sequence range [from, to] of the limit most
+// recent of total messages, or of all of them if limit is 0 or at least
+// total. total must be at least 1.
+func computeFetchRange(total, limit uint32) (from, to uint32) {
+	if limit == 0 || limit >= total {
+		return 1, total
 	}
+	return total - limit + 1, total
+}
 
-	// Calculate range (fetch most recent messages first)
-	from := uint32(1)
-	to := mbox.Messages
-	// Safe conversion: ensure limit is positive and within uint32 bounds
-	if limit > 0 && limit <= int(^uint32(0)) {
-		limitU32 := uint32(limit)
-		if limitU32 < mbox.Messages {
-			from = mbox.Messages - limitU32 + 1
+// fetchLimit converts a message limit to the range used by
+// computeFetchRange, where 0 means no limit
+func fetchLimit(limit int) uint32 {
+	if limit <= 0 {
+		return 0
+	}
+	if uint64(limit) > uint64(math.MaxUint32) {
+		return math.MaxUint32
+	}
+	return uint32(limit)
+}
+
+// fetchConcurrency returns the account's fetch concurrency, bounded to
+// [1, models.MaxFetchConcurrency]
+func (c *Client) fetchConcurrency() int {
+	n := c.account.FetchConcurrency
+	if n < 1 {
+		return 1
+	}
+	if n > models.MaxFetchConcurrency {
+		return models.MaxFetchConcurrency
+	}
+	return n
+}
+
+// fetchConcurrent splits the ascending sequence numbers seqNums into n
+// chunks and fetches them in parallel. The first chunk uses this client's
+// connection, the rest each use a new connection with the same folder
+// selected. Results are returned most recent first, as with fetchSeqNums.
+func (c *Client) fetchConcurrent(seqNums []uint32, n int) ([]models.Message, error) {
+	chunkSize := (len(seqNums) + n - 1) / n
+
+	type chunkResult struct {
+		messages []models.Message
+		err      error
+	}
+	results := make([]chunkResult, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		start := i * chunkSize
+		if start >= len(seqNums) {
+			break
 		}
+		end := min(start+chunkSize, len(seqNums))
+
+		wg.Add(1)
+		go func(i int, chunk []uint32) {
+			defer wg.Done()
+
+			if i == 0 {
+				results[i].messages, results[i].err = c.fetchSeqNums(c.conn, chunk)
+				return
+			}
+
+			worker, err := c.connectWorker()
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			defer worker.Close()
+
+			if _, err := worker.conn.Select(c.selected, true); err != nil {
+				results[i].err = fmt.Errorf("selecting %s: %w", c.selected, err)
+				return
+			}
+			results[i].messages, results[i].err = c.fetchSeqNums(worker.conn, chunk)
+		}(i, seqNums[start:end])
+	}
+	wg.Wait()
+
+	total := 0
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		total += len(r.messages)
+	}
+
+	// Later chunks hold the more recent messages
+	merged := make([]models.Message, 0, total)
+	for i := len(results) - 1; i >= 0; i-- {
+		merged = append(merged, results[i].messages...)
+	}
+	return merged, nil
+}
+
+// connectWorker opens another connection to the account, bound to the same
+// context as c
+func (c *Client) connectWorker() (*Client, error) {
+	if c.ctx != nil {
+		return ConnectContext(c.ctx, c.account)
 	}
+	return Connect(c.account)
+}
+
+// messageItems are the fetch items toMessage needs
+var messageItems = []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags, newsletterSection.FetchItem()}
+
+// toMessage converts a message fetched with messageItems. Its envelope must
+// not be nil.
+func toMessage(msg *imap.Message) models.Message {
+	return models.Message{
+		UID:        msg.Uid,
+		SeqNum:     msg.SeqNum,
+		From:       formatAddresses(msg.Envelope.From),
+		To:         formatAddresses(msg.Envelope.To),
+		ReplyTo:    formatAddresses(msg.Envelope.ReplyTo),
+		Subject:    msg.Envelope.Subject,
+		Date:       msg.Envelope.Date,
+		Flags:      msg.Flags,
+		Newsletter: isNewsletter(msg),
+	}
+}
 
+// fetchSeqNums fetches the envelopes of the messages with the ascending
+// sequence numbers seqNums, most recent (highest sequence number) first
+func (c *Client) fetchSeqNums(conn *timedConn, seqNums []uint32) ([]models.Message, error) {
 	seqSet := new(imap.SeqSet)
-	seqSet.AddRange(from, to)
+	seqSet.AddNum(seqNums...)
 
 	messages := make(chan *imap.Message, 100)
 	done := make(chan error, 1)
 
 	go func() {
-		done <- c.conn.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags}, messages)
+		done <- c.fetch(conn, seqSet, messageItems, messages)
 	}()
 
-	var result []models.Message
+	// Place each message by its sequence number so the result is newest
+	// first without a reversal pass, whatever order the server responds in.
+	// Slots left empty (UID 0) by expunged messages are dropped below.
+	result := make([]models.Message, len(seqNums))
 	for msg := range messages {
-		if msg.Envelope == nil {
+		i, ok := slices.BinarySearch(seqNums, msg.SeqNum)
+		if msg.Envelope == nil || !ok {
 			continue
 		}
 
-		m := models.Message{
-			UID:     msg.Uid,
-			SeqNum:  msg.SeqNum,
-			From:    formatAddresses(msg.Envelope.From),
-			To:      formatAddresses(msg.Envelope.To),
-			Subject: msg.Envelope.Subject,
-			Date:    msg.Envelope.Date,
-			Flags:   msg.Flags,
-		}
-		result = append(result, m)
+		result[len(seqNums)-1-i] = toMessage(msg)
 	}
 
 	if err := <-done; err != nil {
 		return nil, fmt.Errorf("fetching messages: %w", err)
 	}
 
-	// Reverse to show most recent first
-	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
-		result[i], result[j] = result[j], result[i]
+	n := 0
+	for _, m := range result {
+		if m.UID != 0 {
+			result[n] = m
+			n++
+		}
 	}
-
-	return result, nil
+	return result[:n], nil
 }
 
 // PreviewRules applies rules to messages and returns match results without moving
@@ -200,14 +795,32 @@ func (c *Client) PreviewRules(rules []models.Rule, folder string, limit int) (*m
 	if err != nil {
 		return nil, err
 	}
+	return c.previewMessages(rules, messages), nil
+}
 
+// previewMessages matches messages from the selected folder against rules
+func (c *Client) previewMessages(rules []models.Rule, messages []models.Message) *models.PreviewResult {
 	result := &models.PreviewResult{
 		TotalMessages: len(messages),
+		UIDValidity:   c.UIDValidity(),
 		RuleMatches:   make(map[int64]int),
 	}
+	c.MatchMessages(rules, messages, result)
+	result.Messages = messages
+	return result
+}
 
+// MatchMessages matches messages from the selected folder against rules as
+// PreviewRules does, setting each message's match and adding the counts to
+// result. A preview that fetches messages in chunks calls it for each chunk,
+// so that it shows what applying would do.
+func (c *Client) MatchMessages(rules []models.Rule, messages []models.Message, result *models.PreviewResult) {
+	targets := make(map[*models.Rule]string)
 	for i := range messages {
 		msg := &messages[i]
+		if c.processedKeyword != "" && msg.HasFlag(c.processedKeyword) {
+			continue
+		}
 		for j := range rules {
 			rule := &rules[j]
 			if !rule.Enabled {
@@ -216,67 +829,520 @@ func (c *Client) PreviewRules(rules []models.Rule, folder string, limit int) (*m
 
 			if matchesRule(msg, rule) {
 				msg.MatchedRule = rule
+				msg.AlreadyInTarget = c.inTarget(rule, msg, targets)
+				if !msg.AlreadyInTarget && !rule.Samples(msg.UID) {
+					msg.SampledOut = true
+					result.SampledOut++
+				}
 				result.MatchedMessages++
 				result.RuleMatches[rule.ID]++
 				break
 			}
 		}
 	}
+}
 
-	result.Messages = messages
-	return result, nil
+// inTarget reports whether rule moves msg to the selected folder, which
+// would make moving it a no-op. Resolved destinations of rules that don't
+// depend on the message are cached in targets.
+func (c *Client) inTarget(rule *models.Rule, msg *models.Message, targets map[*models.Rule]string) bool {
+	dest, ok := targets[rule]
+	if !ok {
+		var err error
+		if dest, err = c.destination(rule, msg); err == nil {
+			dest, err = c.ResolveFolder(dest)
+		}
+		if err != nil {
+			// Applying will report the error
+			dest = ""
+		}
+		if !hasPlaceholder(rule.MoveToFolder) {
+			targets[rule] = dest
+		}
+	}
+	if dest == "" {
+		return false
+	}
+
+	selected, err := c.ResolveFolder(c.selected)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(dest, "INBOX") {
+		return strings.EqualFold(selected, "INBOX")
+	}
+	return dest == selected
 }
 
 // MoveMessage moves a message to a destination folder
 func (c *Client) MoveMessage(uid uint32, destFolder string) error {
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uid)
+	return c.moveSet(seqSet, destFolder)
+}
+
+// moveSet copies the messages with the given UIDs to destFolder, then deletes
+// and expunges the originals
+func (c *Client) moveSet(seqSet *imap.SeqSet, destFolder string) error {
+	if err := c.checkDestination(destFolder); err != nil {
+		return err
+	}
+	destFolder, err := c.ResolveFolder(destFolder)
+	if err != nil {
+		return err
+	}
 
 	// Copy to destination folder
-	if err := c.conn.UidCopy(seqSet, destFolder); err != nil {
+	if err := c.uidCopy(c.conn, seqSet, destFolder); err != nil {
 		return fmt.Errorf("copying to %s: %w", destFolder, err)
 	}
 
-	// Mark original as deleted
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.DeletedFlag}
-	if err := c.conn.UidStore(seqSet, item, flags, nil); err != nil {
+	return c.deleteSet(seqSet)
+}
+
+// deleteSet marks the messages with the given UIDs as deleted and expunges them
+func (c *Client) deleteSet(seqSet *imap.SeqSet) error {
+	if err := c.uidAddFlags(c.conn, seqSet, imap.DeletedFlag); err != nil {
 		return fmt.Errorf("marking as deleted: %w", err)
 	}
 
 	// Expunge deleted messages
-	if err := c.conn.Expunge(nil); err != nil {
+	if err := c.expunge(c.conn); err != nil {
 		return fmt.Errorf("expunging: %w", err)
 	}
 
 	return nil
 }
 
-// ApplyRules applies rules to messages and moves matching ones
-func (c *Client) ApplyRules(rules []models.Rule, folder string, dryRun bool) (*models.PreviewResult, error) {
+// checkDestination returns ErrDestinationNotAllowed if the account doesn't
+// allow moving messages to folder
+func (c *Client) checkDestination(folder string) error {
+	if !c.account.AllowsDestination(folder) {
+		return fmt.Errorf("%s: %w", folder, ErrDestinationNotAllowed)
+	}
+	return nil
+}
+
+// MoveMessageFrom moves a single message from sourceFolder to destFolder,
+// selecting the source read-write. The destination must already exist; if it
+// doesn't, ErrDestinationNotFound is returned. ErrMessageNotFound is returned
+// if the source has no message with the UID.
+func (c *Client) MoveMessageFrom(sourceFolder string, uid uint32, destFolder string) error {
+	if err := c.checkDestination(destFolder); err != nil {
+		return err
+	}
+	if err := c.requireFolder(destFolder); err != nil {
+		if errors.Is(err, ErrFolderNotFound) {
+			return fmt.Errorf("%s: %w", destFolder, ErrDestinationNotFound)
+		}
+		return err
+	}
+
+	if _, err := c.selectMailbox(sourceFolder, false); err != nil {
+		return err
+	}
+	c.selected = sourceFolder
+
+	// Moving a UID that isn't there does nothing without failing, so make
+	// sure it is
+	uids, err := c.presentUIDs([]uint32{uid})
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		return fmt.Errorf("UID %d in %s: %w", uid, sourceFolder, ErrMessageNotFound)
+	}
+	audited, err := c.auditedMessages(uids)
+	if err != nil {
+		return err
+	}
+	if err := c.MoveMessage(uid, destFolder); err != nil {
+		return err
+	}
+	c.auditAll(AuditMove, uids, audited, destFolder)
+	return nil
+}
+
+// Batch message actions supported by ApplyAction
+const (
+	ActionMove       = "move"
+	ActionDelete     = "delete"
+	ActionMarkRead   = "mark_read"
+	ActionAddKeyword = "add_keyword"
+)
+
+// ValidAction reports whether action is one ApplyAction supports
+func ValidAction(action string) bool {
+	switch action {
+	case ActionMove, ActionDelete, ActionMarkRead, ActionAddKeyword:
+		return true
+	}
+	return false
+}
+
+// ApplyAction performs action on the messages with the given UIDs in
+// sourceFolder. All UIDs go in a single command, and moves and deletes are
+// expunged once for the whole batch. target is the destination folder for
+// ActionMove, which must already exist (ErrDestinationNotFound if it doesn't),
+// and the keyword for ActionAddKeyword.
+//
+// UIDs that aren't in sourceFolder, e.g. because the messages were moved
+// elsewhere since, are skipped. It returns how many messages were acted on.
+func (c *Client) ApplyAction(sourceFolder string, uids []uint32, action, target string) (int, error) {
+	if !ValidAction(action) {
+		return 0, fmt.Errorf("unknown action %q", action)
+	}
+	if len(uids) == 0 {
+		return 0, nil
+	}
+
+	switch action {
+	case ActionMove:
+		if err := c.checkDestination(target); err != nil {
+			return 0, err
+		}
+		if err := c.requireFolder(target); err != nil {
+			if errors.Is(err, ErrFolderNotFound) {
+				return 0, fmt.Errorf("%s: %w", target, ErrDestinationNotFound)
+			}
+			return 0, err
+		}
+	case ActionAddKeyword:
+		if !ValidKeyword(target) {
+			return 0, fmt.Errorf("invalid keyword %q", target)
+		}
+	}
+
+	if _, err := c.selectMailbox(sourceFolder, false); err != nil {
+		return 0, err
+	}
+	c.selected = sourceFolder
+
+	uids, err := c.presentUIDs(uids)
+	if err != nil || len(uids) == 0 {
+		return 0, err
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	var audited map[uint32]models.Message
+	if action == ActionMove || action == ActionDelete {
+		if audited, err = c.auditedMessages(uids); err != nil {
+			return 0, err
+		}
+	}
+
+	switch action {
+	case ActionMove:
+		if err := c.moveSet(seqSet, target); err != nil {
+			return 0, err
+		}
+		c.auditAll(AuditMove, uids, audited, target)
+	case ActionDelete:
+		if err := c.deleteSet(seqSet); err != nil {
+			return 0, err
+		}
+		c.auditAll(AuditDelete, uids, audited, "")
+	case ActionMarkRead:
+		err = c.addFlags(seqSet, imap.SeenFlag)
+	default:
+		err = c.addFlags(seqSet, target)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(uids), nil
+}
+
+// presentUIDs returns those of uids that are in the selected folder, each
+// once
+func (c *Client) presentUIDs(uids []uint32) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddNum(uids...)
+	found, err := c.uidSearch(c.conn, criteria)
+	if err != nil {
+		return nil, fmt.Errorf("searching messages: %w", err)
+	}
+	return found, nil
+}
+
+// auditedMessages fetches the envelopes of the messages with the given UIDs
+// in the selected folder, to be recorded by auditAll once they are moved or
+// deleted. Without an audit log nothing is fetched.
+func (c *Client) auditedMessages(uids []uint32) (map[uint32]models.Message, error) {
+	if c.auditLog == nil {
+		return nil, nil
+	}
+	return c.fetchByUID(uids)
+}
+
+// auditAll records action on each of the messages with the given UIDs, as
+// described by messages. The action has been carried out by then, so a
+// failure to record it is logged rather than reported as if the action had
+// failed.
+func (c *Client) auditAll(action string, uids []uint32, messages map[uint32]models.Message, dest string) {
+	for _, uid := range uids {
+		var msg *models.Message
+		if m, ok := messages[uid]; ok {
+			msg = &m
+		}
+		if err := c.audit(action, uid, msg, nil, dest, false); err != nil {
+			log.Printf("Recording %s of message %d in %s: %v", action, uid, c.selected, err)
+		}
+	}
+}
+
+// SetFlags adds flags to the message with the given UID in the selected
+// folder, which must have been selected read-write. Besides system flags such
+// as \Seen, custom keywords like "Processed" may be set.
+func (c *Client) SetFlags(uid uint32, flags ...string) error {
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "\\") && !ValidKeyword(flag) {
+			return fmt.Errorf("invalid keyword %q", flag)
+		}
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	return c.addFlags(seqSet, flags...)
+}
+
+func (c *Client) addFlags(seqSet *imap.SeqSet, flags ...string) error {
+	if err := c.uidAddFlags(c.conn, seqSet, flags...); err != nil {
+		return fmt.Errorf("adding flags %v: %w", flags, err)
+	}
+	return nil
+}
+
+// ValidKeyword reports whether s can be used as an IMAP keyword: a non-empty
+// atom that doesn't start with a backslash, which is reserved for system flags
+func ValidKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireFolder returns ErrFolderNotFound if the folder doesn't exist
+func (c *Client) requireFolder(name string) error {
+	resolved, err := c.ResolveFolder(name)
+	if err != nil {
+		return err
+	}
+
+	found, err := c.folderExists(resolved)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s: %w", name, ErrFolderNotFound)
+	}
+	return nil
+}
+
+// folderExists reports whether the server lists a folder named exactly name.
+// INBOX is matched case-insensitively, as servers do.
+func (c *Client) folderExists(name string) (bool, error) {
+	folders, err := c.cachedFolders()
+	if err != nil {
+		return false, err
+	}
+	for _, f := range folders {
+		if f.Name == name || strings.EqualFold(name, "INBOX") && strings.EqualFold(f.Name, "INBOX") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ApplyRules applies rules to messages and moves matching ones. If limit is
+// positive, at most limit messages are moved and the result's Remaining is
+// the number of matches left behind.
+func (c *Client) ApplyRules(rules []models.Rule, folder string, dryRun bool, limit int) (*models.PreviewResult, error) {
 	preview, err := c.PreviewRules(rules, folder, 0)
 	if err != nil {
 		return nil, err
 	}
 
+	if n := c.movable(preview.Messages); limit > 0 && n > limit {
+		preview.Remaining = n - limit
+	}
+
 	if dryRun {
+		c.auditDryRun(preview.Messages, limit)
 		return preview, nil
 	}
 
-	for _, msg := range preview.Messages {
-		if msg.MatchedRule != nil {
-			if err := c.MoveMessage(msg.UID, msg.MatchedRule.MoveToFolder); err != nil {
-				return nil, fmt.Errorf("moving message %d: %w", msg.UID, err)
+	// Make sure the UIDs from the preview still refer to the same messages
+	mbox, err := c.selectMailbox(c.selected, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message counts of the affected folders before moving, to report how
+	// they changed
+	before := map[string]int{c.selected: int(mbox.Messages)}
+
+	// Work out every destination first, so that one that isn't allowed
+	// fails the apply before anything is moved
+	type move struct {
+		msg  *models.Message
+		dest string
+	}
+	var moves []move
+	for i := range preview.Messages {
+		msg := &preview.Messages[i]
+		if limit > 0 && len(moves) == limit {
+			break
+		}
+		if c.willMove(msg) {
+			dest, err := c.destination(msg.MatchedRule, msg)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.checkDestination(dest); err != nil {
+				return nil, fmt.Errorf("rule %q: %w", msg.MatchedRule.Name, err)
 			}
+			moves = append(moves, move{msg: msg, dest: dest})
 		}
 	}
 
+	ensured := make(map[string]bool)
+	for _, m := range moves {
+		msg, dest := m.msg, m.dest
+		if c.createMissing && !ensured[dest] {
+			created, err := c.ensureFolder(dest)
+			if err != nil {
+				return nil, err
+			}
+			preview.CreatedFolders = append(preview.CreatedFolders, created...)
+			ensured[dest] = true
+		}
+		if _, ok := before[dest]; !ok {
+			// A folder that can't be counted is left out of the
+			// deltas; if it doesn't exist, moving reports that
+			if n, err := c.messageCount(dest); err == nil {
+				before[dest] = n
+			}
+		}
+		if c.processedKeyword != "" {
+			if err := c.SetFlags(msg.UID, c.processedKeyword); err != nil {
+				return nil, fmt.Errorf("tagging message %d: %w", msg.UID, err)
+			}
+		}
+		if err := c.MoveMessage(msg.UID, dest); err != nil {
+			return nil, fmt.Errorf("moving message %d: %w", msg.UID, err)
+		}
+		// The message has been moved, so as in auditAll a failure to
+		// record it doesn't fail the apply
+		if err := c.audit(AuditMove, msg.UID, msg, msg.MatchedRule, dest, false); err != nil {
+			log.Printf("Recording %s of message %d in %s: %v", AuditMove, msg.UID, c.selected, err)
+		}
+		if c.onMoved != nil {
+			if err := c.onMoved(msg.UID); err != nil {
+				return nil, fmt.Errorf("recording progress after moving message %d: %w", msg.UID, err)
+			}
+		}
+	}
+
+	if len(moves) > 0 {
+		preview.FolderDeltas = c.folderDeltas(before)
+	}
 	return preview, nil
 }
 
-// CreateFolder creates a new folder/mailbox
+// folderDeltas returns how the message count of each folder in before has
+// changed since. The messages have been moved by then, so a folder that
+// can't be counted is left out rather than failing the apply. The selected
+// folder is counted from the EXISTS of selecting it again, as STATUS isn't
+// meant for the selected mailbox (RFC 3501, section 6.3.10).
+func (c *Client) folderDeltas(before map[string]int) map[string]int {
+	deltas := make(map[string]int, len(before))
+	for name, n := range before {
+		var after int
+		if name == c.selected {
+			mbox, err := c.reselect()
+			if err != nil {
+				continue
+			}
+			after = int(mbox.Messages)
+		} else {
+			var err error
+			if after, err = c.messageCount(name); err != nil {
+				continue
+			}
+		}
+		deltas[name] = after - n
+	}
+	return deltas
+}
+
+// auditDryRun records the moves a dry run of ApplyRules would make. A
+// destination that can't be worked out is left empty; applying reports why.
+// As with auditAll, a failure to record a move is logged.
+func (c *Client) auditDryRun(messages []models.Message, limit int) {
+	if c.auditLog == nil {
+		return
+	}
+	n := 0
+	for i := range messages {
+		msg := &messages[i]
+		if !c.willMove(msg) {
+			continue
+		}
+		if limit > 0 && n == limit {
+			break
+		}
+		n++
+		dest, _ := c.destination(msg.MatchedRule, msg)
+		if err := c.audit(AuditMove, msg.UID, msg, msg.MatchedRule, dest, true); err != nil {
+			log.Printf("Recording dry run %s of message %d in %s: %v", AuditMove, msg.UID, c.selected, err)
+		}
+	}
+}
+
+// movable counts the messages ApplyRules would move
+func (c *Client) movable(messages []models.Message) int {
+	n := 0
+	for i := range messages {
+		if c.willMove(&messages[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+// willMove reports whether ApplyRules moves msg: it matches a rule, isn't
+// already in the rule's destination, is in the rule's sample and wasn't
+// dealt with by the apply being resumed
+func (c *Client) willMove(msg *models.Message) bool {
+	return msg.MatchedRule != nil && !msg.AlreadyInTarget && !msg.SampledOut &&
+		(c.resumeBefore == 0 || msg.UID < c.resumeBefore)
+}
+
+// CreateFolder creates a new folder/mailbox. It returns ErrFolderExists if
+// there already is one with that name.
 func (c *Client) CreateFolder(name string) error {
-	return c.conn.Create(name)
+	resolved, err := c.ResolveFolder(name)
+	if err != nil {
+		return err
+	}
+	c.forgetFolders()
+	if err := c.conn.Create(resolved); err != nil {
+		// Servers word this differently, and not all of them send the
+		// ALREADYEXISTS response code (RFC 5530), so check for the folder
+		if exists, _ := c.folderExists(resolved); exists {
+			return fmt.Errorf("%s: %w", name, ErrFolderExists)
+		}
+		return fmt.Errorf("creating %s: %w", name, err)
+	}
+	return nil
 }
 
 // matchesRule delegates to Message.MatchesRule for pattern matching
@@ -296,51 +1362,44 @@ func formatAddresses(addresses []*imap.Address) string {
 	return strings.Join(parts, ", ")
 }
 
+// connectionTestTimeout is the longest TestAccountConnection takes
+const connectionTestTimeout = 30 * time.Second
+
+// errConnectionTestTimeout is why a connection test that took too long was
+// given up on
+var errConnectionTestTimeout = errors.New("connection test timed out")
+
 // TestAccountConnection tests an account connection without keeping the client
 func TestAccountConnection(account *models.Account) (*models.ConnectionStatus, error) {
-	timeout := time.After(30 * time.Second)
-	done := make(chan struct {
-		status *models.ConnectionStatus
-		err    error
-	}, 1)
-
-	go func() {
-		client, err := Connect(account)
-		if err != nil {
-			done <- struct {
-				status *models.ConnectionStatus
-				err    error
-			}{
-				status: &models.ConnectionStatus{
-					Success: false,
-					Message: err.Error(),
-				},
-				err: nil,
-			}
-			return
-		}
-		defer client.Close()
+	return TestAccountConnectionContext(context.Background(), account)
+}
 
-		status, err := client.TestConnection()
-		done <- struct {
-			status *models.ConnectionStatus
-			err    error
-		}{status: status, err: err}
-	}()
+// TestAccountConnectionContext is TestAccountConnection, giving up when ctx is
+// done, such as when the request asking for the test is cancelled
+func TestAccountConnectionContext(ctx context.Context, account *models.Account) (*models.ConnectionStatus, error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, connectionTestTimeout, errConnectionTestTimeout)
+	defer cancel()
 
-	select {
-	case result := <-done:
-		if result.err != nil {
-			return &models.ConnectionStatus{
-				Success: false,
-				Message: result.err.Error(),
-			}, nil
-		}
-		return result.status, nil
-	case <-timeout:
+	status, err := testConnection(ctx, account)
+	if err != nil {
+		message := err.Error()
+		if context.Cause(ctx) == errConnectionTestTimeout {
+			message = fmt.Sprintf("Connection timeout after %d seconds", int(connectionTestTimeout.Seconds()))
+		}
 		return &models.ConnectionStatus{
 			Success: false,
-			Message: "Connection timeout after 30 seconds",
+			Message: message,
 		}, nil
 	}
+	return status, nil
+}
+
+// testConnection connects to account and tests the connection
+func testConnection(ctx context.Context, account *models.Account) (*models.ConnectionStatus, error) {
+	client, err := ConnectContext(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.TestConnection()
 }
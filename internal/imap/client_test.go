@@ -1,8 +1,16 @@
 package imap
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
 	"net"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,7 +18,7 @@ import (
 	"github.com/mailcleaner/mailcleaner/testserver"
 )
 
-func setupTestServer(t *testing.T) (*testserver.TestServer, *models.Account, func()) {
+func setupTestServer(t testing.TB) (*testserver.TestServer, *models.Account, func()) {
 	ts, err := testserver.New("testuser", "testpass")
 	if err != nil {
 		t.Fatalf("Failed to create test server: %v", err)
@@ -65,8 +73,42 @@ func TestConnectInvalidCredentials(t *testing.T) {
 	account.Password = "wrongpassword"
 
 	_, err := Connect(account)
-	if err == nil {
-		t.Error("Expected error for invalid credentials")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected ErrAuthFailed for invalid credentials, got %v", err)
+	}
+}
+
+func TestConnectInjectedLoginFailure(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.FailNextLogin()
+
+	_, err := Connect(account)
+	if err == nil || !strings.Contains(err.Error(), testserver.ErrInjectedLogin.Error()) {
+		t.Fatalf("Expected the injected login failure, got %v", err)
+	}
+
+	// Only the next login fails
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	client.Close()
+}
+
+func TestConnectContextSlowServer(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetLatency(500 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := ConnectContext(ctx, account)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
 	}
 }
 
@@ -80,8 +122,8 @@ func TestConnectInvalidServer(t *testing.T) {
 	}
 
 	_, err := Connect(account)
-	if err == nil {
-		t.Error("Expected error for invalid server")
+	if !errors.Is(err, ErrConnect) {
+		t.Errorf("Expected ErrConnect for invalid server, got %v", err)
 	}
 }
 
@@ -102,6 +144,164 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestConnectContextDeadline(t *testing.T) {
+	// A server that accepts connections but never sends a greeting
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	account := &models.Account{Server: "127.0.0.1", Port: addr.Port, Username: "u", Password: "p"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = ConnectContext(ctx, account)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected ConnectContext to return at the deadline, took %s", elapsed)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "Subject", "Body")
+	account.CommandTimeoutSeconds = 1
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	ts.SetLatency(5 * time.Second)
+	defer ts.SetLatency(0)
+
+	start := time.Now()
+	if _, err := client.FetchMessages(10); err == nil {
+		t.Fatal("Expected a command slower than the timeout to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the command to fail at the timeout, took %s", elapsed)
+	}
+}
+
+func TestCommandTimeoutIdle(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "Subject", "Body")
+	account.CommandTimeoutSeconds = 1
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	// Only commands are timed, not the time between them
+	time.Sleep(1500 * time.Millisecond)
+
+	messages, err := client.FetchMessages(10)
+	if err != nil {
+		t.Fatalf("Expected a command after an idle gap to succeed, got %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(messages))
+	}
+}
+
+func TestCommandTimeoutFinishedAtDeadline(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	conn := &timedConn{Client: client.conn.Client, timeout: 10 * time.Millisecond}
+
+	// The timer fires while the command runs, but the command still
+	// succeeded, so its result stands
+	err = conn.run(func() error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected a command that succeeded to keep its result, got %v", err)
+	}
+
+	err = conn.run(func() error {
+		time.Sleep(50 * time.Millisecond)
+		return errors.New("connection closed")
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a command failing after the timer fired to time out, got %v", err)
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "Subject", "Body")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := ConnectContext(ctx, account)
+	if err != nil {
+		t.Fatalf("ConnectContext failed: %v", err)
+	}
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+	if _, err := client.FetchMessages(10); err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err = client.FetchMessages(10); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected FetchMessages to fail after cancellation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Close to report cancellation, got %v", err)
+	}
+}
+
 func TestTestConnection(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
@@ -130,6 +330,41 @@ func TestTestConnection(t *testing.T) {
 	if len(status.Folders) == 0 {
 		t.Error("Expected at least one folder")
 	}
+	if !slices.Contains(status.Capabilities, "IMAP4rev1") {
+		t.Errorf("Expected IMAP4rev1 in capabilities, got %v", status.Capabilities)
+	}
+}
+
+func TestTestConnectionTimings(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	status, err := TestAccountConnection(account)
+	if err != nil {
+		t.Fatalf("TestAccountConnection failed: %v", err)
+	}
+	if !status.Success {
+		t.Fatalf("Expected success, got: %s", status.Message)
+	}
+
+	if status.ConnectMs < 0 || status.LoginMs < 0 || status.ListMs < 0 {
+		t.Errorf("Expected non-negative timings, got connect=%d login=%d list=%d",
+			status.ConnectMs, status.LoginMs, status.ListMs)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	for _, key := range []string{"connect_ms", "login_ms", "list_ms"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("Expected %s in %s", key, data)
+		}
+	}
 }
 
 func TestListFolders(t *testing.T) {
@@ -170,6 +405,160 @@ func TestListFolders(t *testing.T) {
 	}
 }
 
+func TestListFoldersMatching(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Personal")
+	ts.CreateFolder("Work")
+	ts.CreateFolder("Work/Clients")
+	ts.CreateFolder("Work/Clients/Acme")
+	ts.CreateFolder("Work/Projects")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"%", []string{"INBOX", "Personal", "Work"}},
+		{"Work/%", []string{"Work/Clients", "Work/Projects"}},
+		{"Work/*", []string{"Work/Clients", "Work/Clients/Acme", "Work/Projects"}},
+		{"Work/Clients/%", []string{"Work/Clients/Acme"}},
+		{"Missing/%", nil},
+	}
+	for _, tt := range tests {
+		folders, err := client.ListFoldersMatching(tt.pattern)
+		if err != nil {
+			t.Fatalf("ListFoldersMatching(%q) failed: %v", tt.pattern, err)
+		}
+		var names []string
+		for _, f := range folders {
+			names = append(names, f.Name)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("ListFoldersMatching(%q) = %v, want %v", tt.pattern, names, tt.want)
+		}
+	}
+}
+
+func TestFolderListCached(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Receipts")
+	ts.CreateFolder("All Mail")
+	ts.SetSpecialUse("All Mail", `\Archive`)
+	ts.AddMessage("shop@example.com", "Your order", "Content")
+	ts.AddMessage("shop@example.com", "Shipped", "Content")
+	ts.AddMessage("old@example.com", "Old thread", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Name: "Shop", Pattern: "shop@", PatternType: "sender", MoveToFolder: "Orders", Fallbacks: []string{"Receipts"}, Enabled: true, Priority: 2},
+		{ID: 2, Name: "Old", Pattern: "old@", PatternType: "sender", Action: models.ActionArchive, Enabled: true, Priority: 1},
+	}
+	if _, err := client.ListFolders(); err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if _, err := client.ListFoldersMatching("%"); err != nil {
+		t.Fatalf("ListFoldersMatching failed: %v", err)
+	}
+	if n := ts.ListCommands(); n != 1 {
+		t.Errorf("Expected a single LIST, got %d", n)
+	}
+	if n := ts.GetMessageCount("Receipts"); n != 2 {
+		t.Errorf("Expected 2 messages in Receipts, got %d", n)
+	}
+	if n := ts.GetMessageCount("All Mail"); n != 1 {
+		t.Errorf("Expected 1 message archived, got %d", n)
+	}
+
+	// Creating a folder drops the cache, so the new folder is listed
+	if err := client.CreateFolder("Orders"); err != nil {
+		t.Fatalf("CreateFolder failed: %v", err)
+	}
+	folders, err := client.ListFolders()
+	if err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+	if !slices.ContainsFunc(folders, func(f models.Folder) bool { return f.Name == "Orders" }) {
+		t.Errorf("Expected the created folder to be listed, got %+v", folders)
+	}
+	if n := ts.ListCommands(); n != 2 {
+		t.Errorf("Expected a second LIST after creating a folder, got %d", n)
+	}
+}
+
+func TestCreateFolderExists(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Newsletters")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.CreateFolder("Newsletters"); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("Expected ErrFolderExists, got %v", err)
+	}
+	if err := client.CreateFolder("Receipts"); err != nil {
+		t.Fatalf("CreateFolder failed: %v", err)
+	}
+	if err := client.CreateFolder("Receipts"); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("Expected ErrFolderExists creating a folder twice, got %v", err)
+	}
+}
+
+func TestListFoldersPartialFailure(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Newsletters")
+	ts.CreateFolder("Spam")
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	ts.FailListAfter(2)
+	folders, err := client.ListFolders()
+	if err == nil {
+		t.Fatal("Expected an error when listing fails partway")
+	}
+	if len(folders) != 2 {
+		t.Errorf("Expected the 2 folders listed before the failure, got %+v", folders)
+	}
+
+	// The failure is one-off
+	folders, err = client.ListFolders()
+	if err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+	if len(folders) != 4 {
+		t.Errorf("Expected 4 folders, got %d", len(folders))
+	}
+}
+
 func TestSelectFolder(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
@@ -212,8 +601,28 @@ func TestSelectFolderInvalid(t *testing.T) {
 	defer client.Close()
 
 	_, err = client.SelectFolder("NonExistentFolder")
+	if !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("Expected ErrFolderNotFound for non-existent folder, got %v", err)
+	}
+}
+
+func TestSelectFolderDroppedConnection(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	ts.DropConnectionAfter(0)
+	_, err = client.SelectFolder("INBOX")
 	if err == nil {
-		t.Error("Expected error for non-existent folder")
+		t.Fatal("Expected an error after the connection dropped")
+	}
+	if errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("Expected a connection failure not to look like a missing folder, got %v", err)
 	}
 }
 
@@ -249,14 +658,11 @@ func TestFetchMessages(t *testing.T) {
 	}
 }
 
-func TestFetchMessagesWithLimit(t *testing.T) {
+func TestFetchMessagesInjectedError(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	// Add 10 messages
-	for i := 0; i < 10; i++ {
-		ts.AddMessage("sender@example.com", "Subject "+strconv.Itoa(i), "Body")
-	}
+	ts.AddMessage("sender@example.com", "Subject", "Body")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -264,21 +670,1117 @@ func TestFetchMessagesWithLimit(t *testing.T) {
 	}
 	defer client.Close()
 
-	messages, err := client.FetchMessages(5)
-	if err != nil {
-		t.Fatalf("FetchMessages failed: %v", err)
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
 	}
 
-	if len(messages) != 5 {
-		t.Errorf("Expected 5 messages (limited), got %d", len(messages))
+	ts.FailNextFetch()
+	_, err = client.FetchMessages(10)
+	if err == nil || !strings.Contains(err.Error(), testserver.ErrInjectedFetch.Error()) {
+		t.Fatalf("Expected the injected fetch error, got %v", err)
+	}
+
+	// The connection is still usable afterwards
+	messages, err := client.FetchMessages(10)
+	if err != nil {
+		t.Fatalf("FetchMessages failed after the injected error: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(messages))
 	}
 }
 
-func TestFetchMessagesEmptyFolder(t *testing.T) {
+func TestFetchMessagesDroppedConnection(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Subject", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	ts.DropConnectionAfter(0)
+	if _, err := client.FetchMessages(10); err == nil {
+		t.Fatal("Expected FetchMessages to fail when the connection is dropped")
+	}
+	if _, err := client.FetchMessages(10); err == nil {
+		t.Error("Expected the dropped connection to stay unusable")
+	}
+}
+
+func TestFetchMessagesInChunks(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 25; i++ {
+		ts.AddMessage("sender@example.com", "Subject "+strconv.Itoa(i), "Body")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	all, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+
+	var chunked []models.Message
+	var sizes []int
+	err = client.FetchMessagesInChunks(0, 10, func(chunk []models.Message, total int) error {
+		if total != 25 {
+			t.Errorf("Expected a total of 25, got %d", total)
+		}
+		sizes = append(sizes, len(chunk))
+		chunked = append(chunked, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("FetchMessagesInChunks failed: %v", err)
+	}
+
+	if fmt.Sprint(sizes) != "[10 10 5]" {
+		t.Errorf("Expected chunks of 10, 10 and 5, got %v", sizes)
+	}
+	if len(chunked) != len(all) {
+		t.Fatalf("Expected %d messages, got %d", len(all), len(chunked))
+	}
+	for i := range all {
+		if chunked[i].UID != all[i].UID {
+			t.Fatalf("Message %d: expected UID %d as from FetchMessages, got %d", i, all[i].UID, chunked[i].UID)
+		}
+	}
+
+	// A limit fetches the most recent messages, and an error from fn stops
+	stop := errors.New("stop")
+	calls := 0
+	err = client.FetchMessagesInChunks(15, 10, func(chunk []models.Message, total int) error {
+		calls++
+		if total != 15 {
+			t.Errorf("Expected a total of 15, got %d", total)
+		}
+		if chunk[0].UID != 25 {
+			t.Errorf("Expected the most recent message first, got UID %d", chunk[0].UID)
+		}
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected fetching to stop after the first chunk, got %v after %d calls", err, calls)
+	}
+}
+
+func TestFetchMessagesScanWindow(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	now := time.Now()
+	ts.AddMessageWithDate("INBOX", "old@example.com", "Old", "body", now.AddDate(0, 0, -90))
+	ts.AddMessageWithDate("INBOX", "older@example.com", "Older", "body", now.AddDate(0, 0, -60))
+	ts.AddMessageWithDate("INBOX", "recent@example.com", "Recent", "body", now.AddDate(0, 0, -3))
+	ts.AddMessage("new@example.com", "New", "body")
+
+	account.ScanWindowDays = 30
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	messages, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+	var subjects []string
+	for _, m := range messages {
+		subjects = append(subjects, m.Subject)
+	}
+	if want := []string{"New", "Recent"}; !slices.Equal(subjects, want) {
+		t.Errorf("Fetched %v, want only the messages in the window %v", subjects, want)
+	}
+
+	var chunked []string
+	err = client.FetchMessagesInChunks(0, 1, func(chunk []models.Message, total int) error {
+		if total != 2 {
+			t.Errorf("total = %d, want 2", total)
+		}
+		for _, m := range chunk {
+			chunked = append(chunked, m.Subject)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("FetchMessagesInChunks failed: %v", err)
+	}
+	if want := []string{"New", "Recent"}; !slices.Equal(chunked, want) {
+		t.Errorf("Fetched %v in chunks, want %v", chunked, want)
+	}
+}
+
+func TestFetchMessagesScanWindowOutOfOrder(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Old mail moved into the folder after recent mail arrived
+	now := time.Now()
+	ts.AddMessageWithDate("INBOX", "recent@example.com", "Recent", "body", now.AddDate(0, 0, -3))
+	ts.AddMessageWithDate("INBOX", "old@example.com", "Old", "body", now.AddDate(0, 0, -90))
+	ts.AddMessage("new@example.com", "New", "body")
+
+	account.ScanWindowDays = 30
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	for _, concurrency := range []int{1, 2} {
+		account.FetchConcurrency = concurrency
+		messages, err := client.FetchMessages(0)
+		if err != nil {
+			t.Fatalf("FetchMessages failed: %v", err)
+		}
+		var subjects []string
+		for _, m := range messages {
+			subjects = append(subjects, m.Subject)
+		}
+		if want := []string{"New", "Recent"}; !slices.Equal(subjects, want) {
+			t.Errorf("Fetched %v with concurrency %d, want only the messages in the window %v", subjects, concurrency, want)
+		}
+	}
+
+	uids, err := client.SnapshotUIDs(0)
+	if err != nil {
+		t.Fatalf("SnapshotUIDs failed: %v", err)
+	}
+	if want := []uint32{3, 1}; !slices.Equal(uids, want) {
+		t.Errorf("SnapshotUIDs = %v, want %v", uids, want)
+	}
+}
+
+func TestPreviewRulesSince(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	now := time.Now()
+	ts.AddMessageWithDate("INBOX", "news@example.com", "Last month", "body", now.AddDate(0, 0, -30))
+	ts.AddMessageWithDate("INBOX", "news@example.com", "Last week", "body", now.AddDate(0, 0, -10))
+	ts.AddMessageWithDate("INBOX", "news@example.com", "Yesterday", "body", now.AddDate(0, 0, -1))
+
+	// The account's wider scan window doesn't let older mail back in
+	account.ScanWindowDays = 60
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.Since(now.AddDate(0, 0, -7))
+
+	rules := []models.Rule{
+		{ID: 1, Name: "News", Pattern: "news@", PatternType: "sender", MoveToFolder: "News", Enabled: true},
+	}
+	result, err := client.PreviewRules(rules, "INBOX", 0)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+	if result.MatchedMessages != 1 || len(result.Messages) != 1 || result.Messages[0].Subject != "Yesterday" {
+		t.Errorf("Expected only the message from yesterday to match, got %d matches in %+v", result.MatchedMessages, result.Messages)
+	}
+}
+
+func TestFetchMessagesScanWindowEmpty(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessageWithDate("INBOX", "old@example.com", "Old", "body", time.Now().AddDate(0, 0, -90))
+
+	account.ScanWindowDays = 30
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	messages, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages in the window, got %d", len(messages))
+	}
+}
+
+func TestFetchMessagesWithLimit(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Add 10 messages
+	for i := 0; i < 10; i++ {
+		ts.AddMessage("sender@example.com", "Subject "+strconv.Itoa(i), "Body")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	messages, err := client.FetchMessages(5)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+
+	if len(messages) != 5 {
+		t.Errorf("Expected 5 messages (limited), got %d", len(messages))
+	}
+}
+
+func TestFetchMessagesConcurrent(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 53; i++ {
+		ts.AddMessage("sender"+strconv.Itoa(i)+"@example.com", "Subject "+strconv.Itoa(i), "Body")
+	}
+
+	serialClient, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer serialClient.Close()
+
+	serial, err := serialClient.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("Serial FetchMessages failed: %v", err)
+	}
+
+	concurrentAccount := *account
+	concurrentAccount.FetchConcurrency = 4
+	concurrentClient, err := Connect(&concurrentAccount)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer concurrentClient.Close()
+
+	concurrent, err := concurrentClient.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("Concurrent FetchMessages failed: %v", err)
+	}
+
+	if len(concurrent) != 53 {
+		t.Fatalf("Expected 53 messages, got %d", len(concurrent))
+	}
+	if len(concurrent) != len(serial) {
+		t.Fatalf("Expected %d messages, got %d", len(serial), len(concurrent))
+	}
+	for i := range serial {
+		if concurrent[i].UID != serial[i].UID || concurrent[i].Subject != serial[i].Subject {
+			t.Errorf("Message %d: expected UID %d (%s), got UID %d (%s)",
+				i, serial[i].UID, serial[i].Subject, concurrent[i].UID, concurrent[i].Subject)
+		}
+	}
+}
+
+func TestFetchMessagesNewestFirst(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 1; i <= 20; i++ {
+		ts.AddMessage("sender@example.com", "Subject "+strconv.Itoa(i), "Body")
+	}
+
+	for _, concurrency := range []int{1, 3} {
+		for _, limit := range []int{0, 7} {
+			concurrentAccount := *account
+			concurrentAccount.FetchConcurrency = concurrency
+			client, err := Connect(&concurrentAccount)
+			if err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+
+			messages, err := client.FetchMessages(limit)
+			client.Close()
+			if err != nil {
+				t.Fatalf("FetchMessages(%d) with concurrency %d failed: %v", limit, concurrency, err)
+			}
+
+			want := 20
+			if limit > 0 {
+				want = limit
+			}
+			if len(messages) != want {
+				t.Fatalf("Concurrency %d, limit %d: expected %d messages, got %d", concurrency, limit, want, len(messages))
+			}
+			for i, msg := range messages {
+				if expected := "Subject " + strconv.Itoa(20-i); msg.Subject != expected {
+					t.Errorf("Concurrency %d, limit %d: message %d is %q, want %q", concurrency, limit, i, msg.Subject, expected)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkFetchMessages(b *testing.B) {
+	ts, account, cleanup := setupTestServer(b)
+	defer cleanup()
+
+	for i := 0; i < 1000; i++ {
+		ts.AddMessage("sender@example.com", "Subject "+strconv.Itoa(i), "Body")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		b.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.FetchMessages(0); err != nil {
+			b.Fatalf("FetchMessages failed: %v", err)
+		}
+	}
+}
+
+func TestFetchConcurrencyBounds(t *testing.T) {
+	tests := []struct {
+		configured int
+		expected   int
+	}{
+		{0, 1},
+		{-3, 1},
+		{1, 1},
+		{4, 4},
+		{models.MaxFetchConcurrency + 10, models.MaxFetchConcurrency},
+	}
+
+	for _, tt := range tests {
+		c := &Client{account: &models.Account{FetchConcurrency: tt.configured}}
+		if got := c.fetchConcurrency(); got != tt.expected {
+			t.Errorf("fetchConcurrency() with %d = %d, want %d", tt.configured, got, tt.expected)
+		}
+	}
+}
+
+func TestFetchMessagesEmptyFolder(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	_ = ts // No messages added
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	messages, err := client.FetchMessages(10)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+
+	if len(messages) != 0 {
+		t.Errorf("Expected 0 messages, got %d", len(messages))
+	}
+}
+
+func TestComputeFetchRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    uint32
+		limit    uint32
+		from, to uint32
+	}{
+		{"single message", 1, 10, 1, 1},
+		{"single message limit 1", 1, 1, 1, 1},
+		{"single message without limit", 1, 0, 1, 1},
+		{"without limit", 10, 0, 1, 10},
+		{"limit well below total", 10, 3, 8, 10},
+		{"limit one less than total", 10, 9, 2, 10},
+		{"limit equals total", 10, 10, 1, 10},
+		{"limit one more than total", 10, 11, 1, 10},
+		{"limit well above total", 10, 50, 1, 10},
+		{"largest folder", math.MaxUint32, 1, math.MaxUint32, math.MaxUint32},
+		{"largest limit", 10, math.MaxUint32, 1, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := computeFetchRange(tt.total, tt.limit)
+			if from != tt.from || to != tt.to {
+				t.Errorf("computeFetchRange(%d, %d) = %d, %d; want %d, %d",
+					tt.total, tt.limit, from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestFetchLimit(t *testing.T) {
+	tests := []struct {
+		limit    int
+		expected uint32
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 1},
+		{100, 100},
+		{math.MaxInt32, math.MaxInt32},
+		{math.MaxInt, math.MaxUint32},
+	}
+
+	for _, tt := range tests {
+		if got := fetchLimit(tt.limit); got != tt.expected {
+			t.Errorf("fetchLimit(%d) = %d, want %d", tt.limit, got, tt.expected)
+		}
+	}
+}
+
+func TestFetchMessagesLimitBoundaries(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 1; i <= 5; i++ {
+		ts.AddMessage("sender@example.com", fmt.Sprintf("Message %d", i), "Content")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		limit    int
+		expected int
+	}{
+		{4, 4}, // one less than the count
+		{5, 5}, // equal to the count
+		{6, 5}, // one more than the count
+	}
+	for _, tt := range tests {
+		messages, err := client.FetchMessages(tt.limit)
+		if err != nil {
+			t.Fatalf("FetchMessages(%d) failed: %v", tt.limit, err)
+		}
+		if len(messages) != tt.expected {
+			t.Errorf("FetchMessages(%d) returned %d messages, want %d", tt.limit, len(messages), tt.expected)
+			continue
+		}
+		if messages[0].Subject != "Message 5" {
+			t.Errorf("FetchMessages(%d) should start with the newest message, got %q", tt.limit, messages[0].Subject)
+		}
+	}
+}
+
+func TestFetchMessagesSingleMessage(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("only@example.com", "Only message", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	for _, limit := range []int{0, 1, 10} {
+		messages, err := client.FetchMessages(limit)
+		if err != nil {
+			t.Fatalf("FetchMessages(%d) failed: %v", limit, err)
+		}
+		if len(messages) != 1 || messages[0].Subject != "Only message" {
+			t.Errorf("FetchMessages(%d) = %+v, want the single message", limit, messages)
+		}
+	}
+}
+
+func TestPreviewRulesEmptyFolder(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Empty")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{{ID: 1, Pattern: "example.com", PatternType: "sender", MoveToFolder: "Test", Enabled: true}}
+	result, err := client.PreviewRules(rules, "Empty", 10)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+	if result.TotalMessages != 0 || result.MatchedMessages != 0 {
+		t.Errorf("Expected an empty result, got %+v", result)
+	}
+	if result.Messages == nil {
+		t.Error("Messages should be an empty list, not nil, so it encodes as []")
+	}
+}
+
+func TestPreviewRules(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Add messages
+	ts.AddMessage("newsletter@example.com", "Weekly Newsletter", "Content")
+	ts.AddMessage("support@company.com", "Support Ticket", "Content")
+	ts.AddMessage("newsletter@other.com", "Another Newsletter", "Content")
+	ts.AddMessage("friend@example.com", "Hello!", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{
+			ID:           1,
+			Name:         "Newsletter Filter",
+			Pattern:      "newsletter",
+			PatternType:  "sender",
+			MoveToFolder: "Newsletters",
+			Enabled:      true,
+		},
+		{
+			ID:           2,
+			Name:         "Support Filter",
+			Pattern:      "support",
+			PatternType:  "sender",
+			MoveToFolder: "Support",
+			Enabled:      true,
+		},
+	}
+
+	result, err := client.PreviewRules(rules, "INBOX", 100)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+
+	if result.TotalMessages != 4 {
+		t.Errorf("Expected 4 total messages, got %d", result.TotalMessages)
+	}
+
+	if result.MatchedMessages != 3 {
+		t.Errorf("Expected 3 matched messages, got %d", result.MatchedMessages)
+	}
+
+	if result.RuleMatches[1] != 2 {
+		t.Errorf("Expected rule 1 to match 2 messages, got %d", result.RuleMatches[1])
+	}
+
+	if result.RuleMatches[2] != 1 {
+		t.Errorf("Expected rule 2 to match 1 message, got %d", result.RuleMatches[2])
+	}
+}
+
+func TestPreviewRulesReplyTo(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessageWithReplyTo("INBOX", "noreply@mailer.example.com", "Weekly Digest <digest@news.example.com>", "This week", "Content")
+	ts.AddMessage("noreply@mailer.example.com", "Password reset", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Name: "Digest", Pattern: "digest@", PatternType: "reply_to", MoveToFolder: "Newsletters", Enabled: true},
+	}
+	result, err := client.PreviewRules(rules, "INBOX", 100)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+
+	if result.MatchedMessages != 1 {
+		t.Fatalf("Expected 1 matched message, got %d", result.MatchedMessages)
+	}
+	for _, msg := range result.Messages {
+		if msg.Subject != "This week" {
+			continue
+		}
+		if msg.ReplyTo != "Weekly Digest <digest@news.example.com>" {
+			t.Errorf("ReplyTo = %q, want the envelope's Reply-To address", msg.ReplyTo)
+		}
+		if msg.MatchedRule == nil {
+			t.Error("Expected the message to match on its Reply-To address")
+		}
+	}
+}
+
+func TestPreviewRulesDisabled(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{
+			ID:           1,
+			Name:         "Disabled Rule",
+			Pattern:      "newsletter",
+			PatternType:  "sender",
+			MoveToFolder: "Newsletters",
+			Enabled:      false, // Disabled
+		},
+	}
+
+	result, err := client.PreviewRules(rules, "", 100)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+
+	if result.MatchedMessages != 0 {
+		t.Errorf("Expected 0 matched messages for disabled rule, got %d", result.MatchedMessages)
+	}
+}
+
+func TestMoveMessage(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Add message and create destination folder
+	ts.AddMessage("sender@example.com", "Test", "Body")
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	// Select INBOX first
+	_, err = client.SelectFolder("INBOX")
+	if err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	// Move the message (UID 1)
+	// Note: This may fail if mailbox is opened read-only
+	err = client.MoveMessage(1, "Archive")
+	if err != nil {
+		// Expected to fail in read-only mode - test that error is returned
+		t.Logf("MoveMessage returned expected error in read-only mode: %v", err)
+		return
+	}
+
+	// If it succeeds, verify the move
+	if ts.GetMessageCount("Archive") != 1 {
+		t.Errorf("Expected Archive to have 1 message, got %d", ts.GetMessageCount("Archive"))
+	}
+}
+
+func TestMoveMessageFrom(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "First", "Body")
+	ts.AddMessage("sender@example.com", "Second", "Body")
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.MoveMessageFrom("INBOX", 2, "Archive"); err != nil {
+		t.Fatalf("MoveMessageFrom failed: %v", err)
+	}
+
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected 1 message in INBOX, got %d", ts.GetMessageCount("INBOX"))
+	}
+	if ts.GetMessageCount("Archive") != 1 {
+		t.Errorf("Expected 1 message in Archive, got %d", ts.GetMessageCount("Archive"))
+	}
+}
+
+func TestMoveMessageFromReadOnlyFolder(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Test", "Body")
+	ts.CreateFolder("Archive")
+	ts.SetReadOnly("INBOX", true)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	err = client.MoveMessageFrom("INBOX", 1, "Archive")
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	if ts.GetMessageCount("INBOX") != 1 || ts.GetMessageCount("Archive") != 0 {
+		t.Errorf("Expected nothing to be moved")
+	}
+
+	// Reading the folder is still fine
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Errorf("Expected a read-only folder to be selectable, got %v", err)
+	}
+}
+
+func TestMoveMessageFromMissingDestination(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Test", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	err = client.MoveMessageFrom("INBOX", 1, "Nowhere")
+	if !errors.Is(err, ErrFolderNotFound) {
+		t.Fatalf("Expected ErrFolderNotFound, got %v", err)
+	}
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected message to stay in INBOX")
+	}
+}
+
+func TestMoveMessageFromMissingUID(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Test", "Body")
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	err = client.MoveMessageFrom("INBOX", 99, "Archive")
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("Expected ErrMessageNotFound, got %v", err)
+	}
+	if ts.GetMessageCount("INBOX") != 1 || ts.GetMessageCount("Archive") != 0 {
+		t.Errorf("Expected nothing to be moved")
+	}
+}
+
+func TestApplyActionMove(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		ts.AddMessage("sender@example.com", fmt.Sprintf("Message %d", i), "Body")
+	}
+	ts.CreateFolder("Archive")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	affected, err := client.ApplyAction("INBOX", []uint32{1, 3, 4}, ActionMove, "Archive")
+	if err != nil {
+		t.Fatalf("ApplyAction failed: %v", err)
+	}
+	if affected != 3 {
+		t.Errorf("affected = %d, want 3", affected)
+	}
+
+	if ts.GetMessageCount("INBOX") != 2 {
+		t.Errorf("Expected 2 messages in INBOX, got %d", ts.GetMessageCount("INBOX"))
+	}
+	if ts.GetMessageCount("Archive") != 3 {
+		t.Errorf("Expected 3 messages in Archive, got %d", ts.GetMessageCount("Archive"))
+	}
+
+	client.SelectFolder("Archive")
+	moved, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+	subjects := make(map[string]bool)
+	for _, msg := range moved {
+		subjects[msg.Subject] = true
+	}
+	for _, want := range []string{"Message 0", "Message 2", "Message 3"} {
+		if !subjects[want] {
+			t.Errorf("Expected %q in Archive, got %v", want, subjects)
+		}
+	}
+}
+
+func TestApplyActionCountsPresentMessages(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "Body")
+	ts.AddMessage("b@example.com", "Two", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	// UID 2 twice and UID 9, which doesn't exist
+	affected, err := client.ApplyAction("INBOX", []uint32{2, 2, 9}, ActionMarkRead, "")
+	if err != nil {
+		t.Fatalf("ApplyAction failed: %v", err)
+	}
+	if affected != 1 {
+		t.Errorf("affected = %d, want 1", affected)
+	}
+
+	affected, err = client.ApplyAction("INBOX", []uint32{9}, ActionDelete, "")
+	if err != nil {
+		t.Fatalf("ApplyAction failed: %v", err)
+	}
+	if affected != 0 || ts.GetMessageCount("INBOX") != 2 {
+		t.Errorf("Deleting a missing UID: affected = %d with %d messages left, want 0 and 2", affected, ts.GetMessageCount("INBOX"))
+	}
+}
+
+func TestApplyActionDeleteAndMarkRead(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "Body")
+	ts.AddMessage("b@example.com", "Two", "Body")
+	ts.AddMessage("c@example.com", "Three", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.ApplyAction("INBOX", []uint32{2}, ActionDelete, ""); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if ts.GetMessageCount("INBOX") != 2 {
+		t.Errorf("Expected 2 messages after delete, got %d", ts.GetMessageCount("INBOX"))
+	}
+
+	if _, err := client.ApplyAction("INBOX", []uint32{3}, ActionMarkRead, ""); err != nil {
+		t.Fatalf("mark_read failed: %v", err)
+	}
+	msgs, _ := client.FetchMessages(0)
+	for _, msg := range msgs {
+		if read := msg.HasFlag(models.SeenFlag); read != (msg.UID == 3) {
+			t.Errorf("Message %d: expected read=%v", msg.UID, msg.UID == 3)
+		}
+	}
+}
+
+func TestApplyActionInvalid(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.ApplyAction("INBOX", []uint32{1}, "archive", ""); err == nil {
+		t.Error("Expected error for unknown action")
+	}
+	if _, err := client.ApplyAction("INBOX", []uint32{1}, ActionMove, "Nowhere"); !errors.Is(err, ErrFolderNotFound) {
+		t.Errorf("Expected ErrFolderNotFound, got %v", err)
+	}
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected message to stay in INBOX")
+	}
+}
+
+func TestApplyRulesDryRun(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	ts.CreateFolder("Newsletters")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{
+			ID:           1,
+			Name:         "Newsletter Filter",
+			Pattern:      "newsletter",
+			PatternType:  "sender",
+			MoveToFolder: "Newsletters",
+			Enabled:      true,
+		},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", true, 0) // dry run
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	if result.MatchedMessages != 1 {
+		t.Errorf("Expected 1 matched message, got %d", result.MatchedMessages)
+	}
+
+	// Message should still be in INBOX (dry run)
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected message to still be in INBOX during dry run")
+	}
+}
+
+func TestApplyRulesResumeBefore(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 1; i <= 4; i++ {
+		ts.AddMessage("newsletter@example.com", fmt.Sprintf("Newsletter %d", i), "Content")
+	}
+	ts.CreateFolder("Newsletters")
+	rules := []models.Rule{
+		{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	// Interrupt the apply after two moves, as a crash would
+	var moved []uint32
+	interrupted := errors.New("interrupted")
+	client.OnMoved(func(uid uint32) error {
+		moved = append(moved, uid)
+		if len(moved) == 2 {
+			return interrupted
+		}
+		return nil
+	})
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); !errors.Is(err, interrupted) {
+		t.Fatalf("Expected the apply to be interrupted, got %v", err)
+	}
+	uidValidity := client.UIDValidity()
+	client.Close()
+	if !slices.Equal(moved, []uint32{4, 3}) {
+		t.Fatalf("Expected the newest messages to be moved first, got %v", moved)
+	}
+
+	// Mail arriving after the interruption is left for the next full apply
+	ts.AddMessage("newsletter@example.com", "Newsletter 5", "Content")
+
+	client, err = Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.ExpectUIDValidity("INBOX", uidValidity)
+	client.ResumeBefore(moved[len(moved)-1])
+	var resumed []uint32
+	client.OnMoved(func(uid uint32) error {
+		resumed = append(resumed, uid)
+		return nil
+	})
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+
+	if !slices.Equal(resumed, []uint32{2, 1}) {
+		t.Errorf("Expected the resume to move only UIDs 2 and 1, got %v", resumed)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 4 {
+		t.Errorf("Expected 4 messages in Newsletters, got %d", n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 1 {
+		t.Errorf("Expected only the newer message left in INBOX, got %d", n)
+	}
+}
+
+func TestApplyRulesActual(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	ts.AddMessage("friend@example.com", "Hello", "Content")
+	ts.CreateFolder("Newsletters")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{
+			ID:           1,
+			Name:         "Newsletter Filter",
+			Pattern:      "newsletter",
+			PatternType:  "sender",
+			MoveToFolder: "Newsletters",
+			Enabled:      true,
+		},
+	}
+
+	result, err := client.ApplyRules(rules, "INBOX", false, 0) // actual apply
+	if err != nil {
+		// Expected to fail in read-only mode - test that error is returned
+		t.Logf("ApplyRules returned expected error in read-only mode: %v", err)
+		return
+	}
+
+	if result.MatchedMessages != 1 {
+		t.Errorf("Expected 1 matched message, got %d", result.MatchedMessages)
+	}
+
+	// Newsletter should be moved, friend message should remain
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Errorf("Expected 1 message in INBOX after apply, got %d", ts.GetMessageCount("INBOX"))
+	}
+	if ts.GetMessageCount("Newsletters") != 1 {
+		t.Errorf("Expected 1 message in Newsletters after apply, got %d", ts.GetMessageCount("Newsletters"))
+	}
+}
+
+func TestApplyRulesFolderDeltas(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	_ = ts // No messages added
+	ts.AddMessage("newsletter@example.com", "Newsletter 1", "Content")
+	ts.AddMessage("newsletter@example.com", "Newsletter 2", "Content")
+	ts.AddMessage("friend@example.com", "Hello", "Content")
+	ts.AddMessageToFolder("Newsletters", "newsletter@example.com", "Older newsletter", "Content")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -286,25 +1788,36 @@ func TestFetchMessagesEmptyFolder(t *testing.T) {
 	}
 	defer client.Close()
 
-	messages, err := client.FetchMessages(10)
+	rules := []models.Rule{
+		{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+
+	dry, err := client.ApplyRules(rules, "INBOX", true, 0)
 	if err != nil {
-		t.Fatalf("FetchMessages failed: %v", err)
+		t.Fatalf("ApplyRules dry run failed: %v", err)
+	}
+	if dry.FolderDeltas != nil {
+		t.Errorf("Expected no deltas for a dry run, got %v", dry.FolderDeltas)
 	}
 
-	if len(messages) != 0 {
-		t.Errorf("Expected 0 messages, got %d", len(messages))
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	want := map[string]int{"INBOX": -2, "Newsletters": 2}
+	if !maps.Equal(result.FolderDeltas, want) {
+		t.Errorf("FolderDeltas = %v, want %v", result.FolderDeltas, want)
 	}
 }
 
-func TestPreviewRules(t *testing.T) {
+func TestApplyRulesSamplePercent(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	// Add messages
-	ts.AddMessage("newsletter@example.com", "Weekly Newsletter", "Content")
-	ts.AddMessage("support@company.com", "Support Ticket", "Content")
-	ts.AddMessage("newsletter@other.com", "Another Newsletter", "Content")
-	ts.AddMessage("friend@example.com", "Hello!", "Content")
+	for i := 1; i <= 200; i++ {
+		ts.AddMessage("newsletter@example.com", fmt.Sprintf("Newsletter %d", i), "Content")
+	}
+	ts.CreateFolder("Newsletters")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -313,86 +1826,102 @@ func TestPreviewRules(t *testing.T) {
 	defer client.Close()
 
 	rules := []models.Rule{
-		{
-			ID:           1,
-			Name:         "Newsletter Filter",
-			Pattern:      "newsletter",
-			PatternType:  "sender",
-			MoveToFolder: "Newsletters",
-			Enabled:      true,
-		},
-		{
-			ID:           2,
-			Name:         "Support Filter",
-			Pattern:      "support",
-			PatternType:  "sender",
-			MoveToFolder: "Support",
-			Enabled:      true,
-		},
+		{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true, SamplePercent: 25},
 	}
 
-	result, err := client.PreviewRules(rules, "INBOX", 100)
-	if err != nil {
-		t.Fatalf("PreviewRules failed: %v", err)
+	sampled := func(result *models.PreviewResult) []uint32 {
+		var uids []uint32
+		for _, msg := range result.Messages {
+			if msg.MatchedRule != nil && !msg.SampledOut {
+				uids = append(uids, msg.UID)
+			}
+		}
+		return uids
 	}
 
-	if result.TotalMessages != 4 {
-		t.Errorf("Expected 4 total messages, got %d", result.TotalMessages)
+	first, err := client.ApplyRules(rules, "INBOX", true, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules dry run failed: %v", err)
 	}
-
-	if result.MatchedMessages != 3 {
-		t.Errorf("Expected 3 matched messages, got %d", result.MatchedMessages)
+	second, err := client.ApplyRules(rules, "INBOX", true, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules dry run failed: %v", err)
+	}
+	if !slices.Equal(sampled(first), sampled(second)) {
+		t.Error("Expected the same messages to be sampled on every run")
 	}
 
-	if result.RuleMatches[1] != 2 {
-		t.Errorf("Expected rule 1 to match 2 messages, got %d", result.RuleMatches[1])
+	moved := len(sampled(first))
+	if moved < 30 || moved > 70 {
+		t.Errorf("Expected about 25%% of 200 matches sampled, got %d", moved)
+	}
+	if first.SampledOut != 200-moved {
+		t.Errorf("SampledOut = %d, want %d", first.SampledOut, 200-moved)
 	}
 
-	if result.RuleMatches[2] != 1 {
-		t.Errorf("Expected rule 2 to match 1 message, got %d", result.RuleMatches[2])
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.SampledOut != 200-moved {
+		t.Errorf("SampledOut = %d, want %d", result.SampledOut, 200-moved)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != moved {
+		t.Errorf("Expected %d messages moved, got %d", moved, n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 200-moved {
+		t.Errorf("Expected %d messages left in INBOX, got %d", 200-moved, n)
 	}
 }
 
-func TestPreviewRulesDisabled(t *testing.T) {
+func TestApplyRulesAllowedDestinations(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
 	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	ts.AddMessage("boss@example.com", "Report", "Content")
+	ts.CreateFolder("Newsletters")
+	ts.CreateFolder("Work")
 
+	account.AllowedDestinations = []string{"Newsletters"}
 	client, err := Connect(account)
 	if err != nil {
 		t.Fatalf("Connect failed: %v", err)
 	}
 	defer client.Close()
 
-	rules := []models.Rule{
-		{
-			ID:           1,
-			Name:         "Disabled Rule",
-			Pattern:      "newsletter",
-			PatternType:  "sender",
-			MoveToFolder: "Newsletters",
-			Enabled:      false, // Disabled
-		},
+	news := models.Rule{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true}
+	work := models.Rule{ID: 2, Name: "Work", Pattern: "boss", PatternType: "sender", MoveToFolder: "Work", Enabled: true}
+
+	// One rule moving off the list fails the apply before anything moves
+	_, err = client.ApplyRules([]models.Rule{news, work}, "INBOX", false, 0)
+	if !errors.Is(err, ErrDestinationNotAllowed) {
+		t.Fatalf("Expected ErrDestinationNotAllowed, got %v", err)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 2 {
+		t.Errorf("Expected nothing moved, got %d messages left in INBOX", n)
 	}
 
-	result, err := client.PreviewRules(rules, "", 100)
-	if err != nil {
-		t.Fatalf("PreviewRules failed: %v", err)
+	if _, err := client.ApplyRules([]models.Rule{news}, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules to an allowed destination failed: %v", err)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 1 {
+		t.Errorf("Expected 1 message moved to Newsletters, got %d", n)
 	}
 
-	if result.MatchedMessages != 0 {
-		t.Errorf("Expected 0 matched messages for disabled rule, got %d", result.MatchedMessages)
+	if err := client.MoveMessageFrom("INBOX", 2, "Work"); !errors.Is(err, ErrDestinationNotAllowed) {
+		t.Errorf("Expected MoveMessageFrom to be refused, got %v", err)
 	}
 }
 
-func TestMoveMessage(t *testing.T) {
+func TestApplyRulesLimit(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	// Add message and create destination folder
-	ts.AddMessage("sender@example.com", "Test", "Body")
-	ts.CreateFolder("Archive")
+	for i := 0; i < 3; i++ {
+		ts.AddMessage("newsletter@example.com", fmt.Sprintf("Newsletter %d", i), "Content")
+	}
+	ts.CreateFolder("Newsletters")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -400,33 +1929,32 @@ func TestMoveMessage(t *testing.T) {
 	}
 	defer client.Close()
 
-	// Select INBOX first
-	_, err = client.SelectFolder("INBOX")
-	if err != nil {
-		t.Fatalf("SelectFolder failed: %v", err)
+	rules := []models.Rule{
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
 	}
 
-	// Move the message (UID 1)
-	// Note: This may fail if mailbox is opened read-only
-	err = client.MoveMessage(1, "Archive")
+	result, err := client.ApplyRules(rules, "INBOX", false, 2)
 	if err != nil {
-		// Expected to fail in read-only mode - test that error is returned
-		t.Logf("MoveMessage returned expected error in read-only mode: %v", err)
-		return
+		t.Fatalf("ApplyRules failed: %v", err)
 	}
 
-	// If it succeeds, verify the move
-	if ts.GetMessageCount("Archive") != 1 {
-		t.Errorf("Expected Archive to have 1 message, got %d", ts.GetMessageCount("Archive"))
+	if result.MatchedMessages != 3 || result.Remaining != 1 {
+		t.Errorf("Expected 3 matches with 1 remaining, got %d with %d remaining", result.MatchedMessages, result.Remaining)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 2 {
+		t.Errorf("Expected 2 messages moved, got %d", n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 1 {
+		t.Errorf("Expected 1 message left in INBOX, got %d", n)
 	}
 }
 
-func TestApplyRulesDryRun(t *testing.T) {
+func TestApplyRulesSkipsMessagesAlreadyInTarget(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
-	ts.CreateFolder("Newsletters")
+	ts.AddMessageToFolder("Newsletters", "newsletter@example.com", "Filed", "Content")
+	ts.AddMessageToFolder("Newsletters", "friend@example.com", "Hello", "Content")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -435,38 +1963,48 @@ func TestApplyRulesDryRun(t *testing.T) {
 	defer client.Close()
 
 	rules := []models.Rule{
-		{
-			ID:           1,
-			Name:         "Newsletter Filter",
-			Pattern:      "newsletter",
-			PatternType:  "sender",
-			MoveToFolder: "Newsletters",
-			Enabled:      true,
-		},
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+		{ID: 2, Pattern: "friend", PatternType: "sender", MoveToFolder: "Friends", Enabled: true},
 	}
+	ts.CreateFolder("Friends")
 
-	result, err := client.ApplyRules(rules, "INBOX", true) // dry run
+	preview, err := client.PreviewRules(rules, "Newsletters", 0)
 	if err != nil {
-		t.Fatalf("ApplyRules failed: %v", err)
+		t.Fatalf("PreviewRules failed: %v", err)
 	}
-
-	if result.MatchedMessages != 1 {
-		t.Errorf("Expected 1 matched message, got %d", result.MatchedMessages)
+	for _, msg := range preview.Messages {
+		want := msg.Subject == "Filed"
+		if msg.AlreadyInTarget != want {
+			t.Errorf("%q: expected already_in_target=%v", msg.Subject, want)
+		}
 	}
 
-	// Message should still be in INBOX (dry run)
-	if ts.GetMessageCount("INBOX") != 1 {
-		t.Errorf("Expected message to still be in INBOX during dry run")
+	result, err := client.ApplyRules(rules, "Newsletters", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.MatchedMessages != 2 {
+		t.Errorf("Expected both messages to match, got %d", result.MatchedMessages)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 1 {
+		t.Errorf("Expected the filed message to stay in Newsletters alone, got %d messages", n)
+	}
+	// Moving it would have copied it to a new UID
+	if ts.GetMessageFlags("Newsletters", 1) == nil {
+		t.Error("Expected the filed message not to be moved")
+	}
+	if n := ts.GetMessageCount("Friends"); n != 1 {
+		t.Errorf("Expected 1 message moved to Friends, got %d", n)
 	}
 }
 
-func TestApplyRulesActual(t *testing.T) {
+func TestApplyRulesFolderPerSenderDomain(t *testing.T) {
 	ts, account, cleanup := setupTestServer(t)
 	defer cleanup()
 
-	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
-	ts.AddMessage("friend@example.com", "Hello", "Content")
-	ts.CreateFolder("Newsletters")
+	ts.AddMessage("notifications@github.com", "PR merged", "Content")
+	ts.AddMessage("alerts@GitLab.com", "Pipeline failed", "Content")
+	ts.AddMessage("friend@example.org", "Hello", "Content")
 
 	client, err := Connect(account)
 	if err != nil {
@@ -474,34 +2012,62 @@ func TestApplyRulesActual(t *testing.T) {
 	}
 	defer client.Close()
 
+	client.CreateMissingFolders()
+
 	rules := []models.Rule{
-		{
-			ID:           1,
-			Name:         "Newsletter Filter",
-			Pattern:      "newsletter",
-			PatternType:  "sender",
-			MoveToFolder: "Newsletters",
-			Enabled:      true,
-		},
+		{ID: 1, Pattern: "git", PatternType: "sender", MoveToFolder: "Services/{domain}", Enabled: true},
 	}
 
-	result, err := client.ApplyRules(rules, "INBOX", false) // actual apply
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
 	if err != nil {
-		// Expected to fail in read-only mode - test that error is returned
-		t.Logf("ApplyRules returned expected error in read-only mode: %v", err)
-		return
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.MatchedMessages != 2 {
+		t.Errorf("Expected 2 matches, got %d", result.MatchedMessages)
 	}
 
-	if result.MatchedMessages != 1 {
-		t.Errorf("Expected 1 matched message, got %d", result.MatchedMessages)
+	if n := ts.GetMessageCount("Services/github.com"); n != 1 {
+		t.Errorf("Expected 1 message in Services/github.com, got %d", n)
+	}
+	if n := ts.GetMessageCount("Services/gitlab.com"); n != 1 {
+		t.Errorf("Expected 1 message in Services/gitlab.com, got %d", n)
+	}
+	if n := ts.GetMessageCount("INBOX"); n != 1 {
+		t.Errorf("Expected 1 message left in INBOX, got %d", n)
 	}
 
-	// Newsletter should be moved, friend message should remain
-	if ts.GetMessageCount("INBOX") != 1 {
-		t.Errorf("Expected 1 message in INBOX after apply, got %d", ts.GetMessageCount("INBOX"))
+	// Sorted mail is already in its target
+	preview, err := client.PreviewRules(rules, "Services/github.com", 0)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
 	}
-	if ts.GetMessageCount("Newsletters") != 1 {
-		t.Errorf("Expected 1 message in Newsletters after apply, got %d", ts.GetMessageCount("Newsletters"))
+	if len(preview.Messages) != 1 || !preview.Messages[0].AlreadyInTarget {
+		t.Errorf("Expected the sorted message to be already in its target, got %+v", preview.Messages)
+	}
+}
+
+func TestExpandFolder(t *testing.T) {
+	tests := []struct {
+		folder, from, delimiter, want string
+	}{
+		{"Newsletters", "news@example.com", "/", "Newsletters"},
+		{"Senders/{sender}", "News <News@Example.com>", "/", "Senders/news@example.com"},
+		{"{domain}", "news@example.com", "/", "example.com"},
+		{"Senders/{sender}", "Smith, John <John@X.com>", "/", "Senders/john@x.com"},
+		{"By/{domain}/{sender}", "a@b.org", "/", "By/b.org/a@b.org"},
+		{"{domain}", "", "/", "unknown"},
+		{"{domain}", "undisclosed-recipients", "/", "unknown"},
+		// The sender can't add levels or LIST wildcards to the folder
+		{"Services.{domain}", "news@github.com", ".", "Services.github_com"},
+		{"Senders/{sender}", "a/../b@x.org", "/", "Senders/a_.._b@x.org"},
+		{"Senders/{sender}", "a%*@x.org", "/", "Senders/a__@x.org"},
+		{"{domain}", "a@" + strings.Repeat("x", 100) + ".org", "/", strings.Repeat("x", 64)},
+	}
+
+	for _, tt := range tests {
+		if got := expandFolder(tt.folder, tt.from, tt.delimiter); got != tt.want {
+			t.Errorf("expandFolder(%q, %q, %q) = %q, want %q", tt.folder, tt.from, tt.delimiter, got, tt.want)
+		}
 	}
 }
 
@@ -602,6 +2168,29 @@ func TestTestAccountConnectionTimeout(t *testing.T) {
 	}
 }
 
+func TestTestAccountConnectionContext(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetLatency(5 * time.Second)
+	defer ts.SetLatency(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	status, err := TestAccountConnectionContext(ctx, account)
+	if err != nil {
+		t.Fatalf("TestAccountConnectionContext error: %v", err)
+	}
+	if status.Success {
+		t.Error("Expected failure when the context is done first")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the test to stop with the context, took %s", elapsed)
+	}
+}
+
 func TestFormatAddresses(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -727,3 +2316,113 @@ func TestFetchMessagesAutoSelectsINBOX(t *testing.T) {
 		t.Errorf("Expected 1 message, got %d", len(messages))
 	}
 }
+
+func TestPreviewRulesReportsUIDValidity(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Test", "Body")
+	ts.SetUIDValidity("INBOX", 42)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.PreviewRules(nil, "INBOX", 10)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+	if result.UIDValidity != 42 {
+		t.Errorf("Expected UIDValidity 42, got %d", result.UIDValidity)
+	}
+}
+
+func TestApplyRulesAbortsOnUIDValidityChange(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("newsletter@example.com", "Newsletter", "Content")
+	ts.CreateFolder("Newsletters")
+
+	rules := []models.Rule{
+		{ID: 1, Name: "News", Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+
+	previewClient, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	preview, err := previewClient.PreviewRules(rules, "INBOX", 100)
+	previewClient.Close()
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+
+	// The server rebuilds its index between preview and apply
+	ts.SetUIDValidity("INBOX", preview.UIDValidity+1)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	client.ExpectUIDValidity("INBOX", preview.UIDValidity)
+
+	_, err = client.ApplyRules(rules, "INBOX", false, 0)
+	if !errors.Is(err, ErrUIDValidityChanged) {
+		t.Fatalf("Expected ErrUIDValidityChanged, got %v", err)
+	}
+
+	if ts.GetMessageCount("Newsletters") != 0 {
+		t.Error("Expected no messages to be moved")
+	}
+	if ts.GetMessageCount("INBOX") != 1 {
+		t.Error("Expected message to remain in INBOX")
+	}
+}
+
+func TestCustomInboxName(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "In INBOX", "body")
+	ts.AddMessageToFolder("Posteingang", "sender@example.com", "Primary 1", "body")
+	ts.AddMessageToFolder("Posteingang", "sender@example.com", "Primary 2", "body")
+
+	account.InboxName = "Posteingang"
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	status, err := client.TestConnection()
+	if err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	if status.TotalEmails != 2 {
+		t.Errorf("Expected TestConnection to count the 2 messages in Posteingang, got %d", status.TotalEmails)
+	}
+
+	// Without a selected folder, the primary mailbox is fetched
+	client, err = Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	messages, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+	var subjects []string
+	for _, m := range messages {
+		subjects = append(subjects, m.Subject)
+	}
+	if want := []string{"Primary 2", "Primary 1"}; !slices.Equal(subjects, want) {
+		t.Errorf("Fetched %v, want %v from Posteingang", subjects, want)
+	}
+}
@@ -0,0 +1,132 @@
+package imap
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// compressCommand is the COMPRESS command from RFC 4978
+type compressCommand struct{}
+
+func (cmd *compressCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "COMPRESS",
+		Arguments: []interface{}{imap.RawString("DEFLATE")},
+	}
+}
+
+// startCompression switches the connection to DEFLATE if the server
+// advertises COMPRESS=DEFLATE. Servers that don't, or that refuse the command
+// (e.g. because compression is already active at another layer), are used
+// uncompressed.
+func (c *Client) startCompression(conn *deflateConn) error {
+	supported, err := c.conn.Support("COMPRESS=DEFLATE")
+	if err != nil {
+		return fmt.Errorf("checking capabilities: %w", err)
+	}
+	if !supported {
+		return nil
+	}
+
+	status, err := c.conn.Execute(&compressCommand{}, nil)
+	if err != nil {
+		return fmt.Errorf("enabling compression: %w", err)
+	}
+	if status.Err() != nil {
+		return nil
+	}
+
+	// The server compresses everything after its OK, and only responds to
+	// the next command, which is compressed too
+	conn.start()
+	c.compressed = true
+	return nil
+}
+
+// Compressed reports whether the connection uses COMPRESS=DEFLATE
+func (c *Client) Compressed() bool {
+	return c.compressed
+}
+
+// deflateConn is a connection that can be switched to DEFLATE compression in
+// both directions once the server has accepted COMPRESS.
+//
+// go-imap reads responses on its own goroutine, which is usually blocked in
+// Read on the raw connection when compression starts. The bytes that read
+// returns are already compressed, so they are fed to the inflater first.
+type deflateConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	r       io.Reader     // nil until compression starts
+	w       *flate.Writer // nil until compression starts
+	pending bytes.Buffer  // compressed bytes read before noticing the switch
+}
+
+func (c *deflateConn) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.w, _ = flate.NewWriter(c.Conn, flate.DefaultCompression)
+	c.r = flate.NewReader(readerFunc(c.readCompressed))
+}
+
+// readCompressed returns the compressed input for the inflater. Only the
+// go-imap reader goroutine reads, so pending needs no locking here.
+func (c *deflateConn) readCompressed(p []byte) (int, error) {
+	if c.pending.Len() > 0 {
+		return c.pending.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func (c *deflateConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	r := c.r
+	c.mu.Unlock()
+	if r != nil {
+		return r.Read(p)
+	}
+
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	r = c.r
+	if r != nil {
+		c.pending.Write(p[:n])
+	}
+	c.mu.Unlock()
+	if r != nil {
+		return r.Read(p)
+	}
+	return n, err
+}
+
+func (c *deflateConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	w := c.w
+	c.mu.Unlock()
+	if w == nil {
+		return c.Conn.Write(p)
+	}
+
+	n, err := w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	// Each command must reach the server in full, so don't let the
+	// compressor hold any of it back
+	return n, w.Flush()
+}
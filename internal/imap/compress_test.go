@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestConnectCompress(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.EnableCompress()
+	ts.CreateFolder("Newsletters")
+	for i := 0; i < 20; i++ {
+		ts.AddMessage(fmt.Sprintf("newsletter%d@example.com", i), "Weekly "+strings.Repeat("news ", 50), "Content")
+	}
+	account.Compress = true
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if !client.Compressed() {
+		t.Fatal("Expected compression to be enabled")
+	}
+	if n := ts.CompressedConns(); n != 1 {
+		t.Errorf("Expected 1 compressed connection on the server, got %d", n)
+	}
+
+	// Commands and responses of all sizes still round-trip
+	rules := []models.Rule{{ID: 1, Pattern: "newsletter1", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true}}
+	result, err := client.ApplyRules(rules, "INBOX", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.TotalMessages != 20 || result.MatchedMessages != 11 {
+		t.Errorf("Expected 11 of 20 messages matched, got %d of %d", result.MatchedMessages, result.TotalMessages)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 11 {
+		t.Errorf("Expected 11 messages moved, got %d", n)
+	}
+}
+
+func TestConnectCompressNotAdvertised(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Hello", "Content")
+	account.Compress = true
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if client.Compressed() {
+		t.Error("Compression should not be used when the server doesn't advertise it")
+	}
+	if n := ts.CompressedConns(); n != 0 {
+		t.Errorf("Expected no compressed connections, got %d", n)
+	}
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+	if messages, err := client.FetchMessages(10); err != nil || len(messages) != 1 {
+		t.Errorf("FetchMessages() = %d messages, %v; want 1", len(messages), err)
+	}
+}
+
+func TestConnectCompressDisabled(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.EnableCompress()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if client.Compressed() || ts.CompressedConns() != 0 {
+		t.Error("Compression should only be used when the account asks for it")
+	}
+}
@@ -0,0 +1,128 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// AllFolders can be passed as the folder to preview or apply rules to every
+// folder returned by ScanFolders
+const AllFolders = "all"
+
+// skippedSpecialUse are the special-use attributes (RFC 6154) of folders that
+// are never scanned: mail in them is either not incoming mail or already
+// dealt with
+var skippedSpecialUse = []string{
+	imap.SentAttr,
+	imap.DraftsAttr,
+	imap.TrashAttr,
+	imap.JunkAttr,
+	imap.ArchiveAttr,
+	imap.AllAttr,
+}
+
+// ScanFolders returns the folders rules are applied to when all folders are
+// requested. Special-use folders such as Sent, Drafts and Trash are skipped,
+// as are folders that can't be selected and the destinations of the enabled
+// rules, so mail that has already been sorted isn't moved again.
+func (c *Client) ScanFolders(rules []models.Rule) ([]string, error) {
+	destinations := make(map[string]bool)
+	for i := range rules {
+		if !rules[i].Enabled {
+			continue
+		}
+		dest, err := c.destination(&rules[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if hasPlaceholder(dest) {
+			// Derived per message; already sorted mail is left alone as
+			// being in its target
+			continue
+		}
+		if dest, err = c.ResolveFolder(dest); err != nil {
+			return nil, err
+		}
+		destinations[dest] = true
+	}
+
+	folders, err := c.ListFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range folders {
+		if destinations[f.Name] || hasAttr(f.Attributes, imap.NoSelectAttr) || hasAnyAttr(f.Attributes, skippedSpecialUse) {
+			continue
+		}
+		names = append(names, f.Name)
+	}
+	return names, nil
+}
+
+func hasAnyAttr(attrs []string, want []string) bool {
+	for _, attr := range want {
+		if hasAttr(attrs, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// PreviewAllFolders previews rules against the most recent limit messages of
+// each folder returned by ScanFolders
+func (c *Client) PreviewAllFolders(rules []models.Rule, limit int) (*models.FolderResults, error) {
+	return c.eachFolder(rules, func(folder string) (*models.PreviewResult, error) {
+		return c.PreviewRules(rules, folder, limit)
+	})
+}
+
+// ApplyRulesAllFolders applies rules to every folder returned by ScanFolders.
+// A positive limit caps the messages moved over all folders; once it is used
+// up, the remaining folders are only previewed.
+func (c *Client) ApplyRulesAllFolders(rules []models.Rule, dryRun bool, limit int) (*models.FolderResults, error) {
+	left := limit
+	return c.eachFolder(rules, func(folder string) (*models.PreviewResult, error) {
+		if limit <= 0 {
+			return c.ApplyRules(rules, folder, dryRun, 0)
+		}
+		if left == 0 {
+			result, err := c.ApplyRules(rules, folder, true, 0)
+			if err != nil {
+				return nil, err
+			}
+			result.Remaining = c.movable(result.Messages)
+			return result, nil
+		}
+		result, err := c.ApplyRules(rules, folder, dryRun, left)
+		if err != nil {
+			return nil, err
+		}
+		left -= c.movable(result.Messages) - result.Remaining
+		return result, nil
+	})
+}
+
+func (c *Client) eachFolder(rules []models.Rule, fn func(folder string) (*models.PreviewResult, error)) (*models.FolderResults, error) {
+	folders, err := c.ScanFolders(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &models.FolderResults{
+		RuleMatches: make(map[int64]int),
+		Folders:     make(map[string]*models.PreviewResult),
+	}
+	for _, folder := range folders {
+		result, err := fn(folder)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", folder, err)
+		}
+		results.Add(folder, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,117 @@
+package imap
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestScanFoldersSkipsSpecialUseAndDestinations(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Work")
+	ts.CreateFolder("Newsletters")
+	ts.SetSpecialUse("Sent", `\Sent`)
+	ts.SetSpecialUse("Trash", `\Trash`)
+	ts.SetSpecialUse("Drafts", `\Drafts`)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+		{ID: 2, Pattern: "other", PatternType: "sender", MoveToFolder: "Work", Enabled: false},
+	}
+
+	folders, err := client.ScanFolders(rules)
+	if err != nil {
+		t.Fatalf("ScanFolders failed: %v", err)
+	}
+	slices.Sort(folders)
+	if !slices.Equal(folders, []string{"INBOX", "Work"}) {
+		t.Errorf("Got folders %v, want [INBOX Work]", folders)
+	}
+}
+
+func TestApplyRulesAllFolders(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Newsletters")
+	ts.AddMessage("newsletter@example.com", "Inbox newsletter", "Content")
+	ts.AddMessage("friend@example.com", "Hello", "Content")
+	ts.AddMessageToFolder("Work", "newsletter@example.com", "Work newsletter", "Content")
+	ts.AddMessageToFolder("Sent", "newsletter@example.com", "Reply", "Content")
+	ts.SetSpecialUse("Sent", `\Sent`)
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+
+	result, err := client.ApplyRulesAllFolders(rules, false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRulesAllFolders failed: %v", err)
+	}
+
+	if len(result.Folders) != 2 {
+		t.Fatalf("Expected results for INBOX and Work, got %v", result.Folders)
+	}
+	if result.Folders["INBOX"].MatchedMessages != 1 || result.Folders["Work"].MatchedMessages != 1 {
+		t.Errorf("Expected 1 match in each folder, got INBOX=%d Work=%d",
+			result.Folders["INBOX"].MatchedMessages, result.Folders["Work"].MatchedMessages)
+	}
+	if result.TotalMessages != 3 || result.MatchedMessages != 2 || result.RuleMatches[1] != 2 {
+		t.Errorf("Expected totals 3/2 with 2 matches for rule 1, got %d/%d %v",
+			result.TotalMessages, result.MatchedMessages, result.RuleMatches)
+	}
+
+	if n := ts.GetMessageCount("Newsletters"); n != 2 {
+		t.Errorf("Expected 2 messages in Newsletters, got %d", n)
+	}
+	if n := ts.GetMessageCount("Sent"); n != 1 {
+		t.Errorf("Sent should be left alone, has %d messages", n)
+	}
+}
+
+func TestApplyRulesAllFoldersLimit(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.CreateFolder("Newsletters")
+	ts.AddMessage("newsletter@example.com", "Inbox newsletter 1", "Content")
+	ts.AddMessage("newsletter@example.com", "Inbox newsletter 2", "Content")
+	ts.AddMessageToFolder("Work", "newsletter@example.com", "Work newsletter", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "newsletter", PatternType: "sender", MoveToFolder: "Newsletters", Enabled: true},
+	}
+
+	result, err := client.ApplyRulesAllFolders(rules, false, 2)
+	if err != nil {
+		t.Fatalf("ApplyRulesAllFolders failed: %v", err)
+	}
+
+	if result.MatchedMessages != 3 || result.Remaining != 1 {
+		t.Errorf("Expected 3 matches with 1 remaining, got %d with %d remaining", result.MatchedMessages, result.Remaining)
+	}
+	if n := ts.GetMessageCount("Newsletters"); n != 2 {
+		t.Errorf("Expected 2 messages moved over all folders, got %d", n)
+	}
+}
@@ -0,0 +1,136 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestSetFlagsKeyword(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "Body")
+	ts.AddMessage("b@example.com", "Two", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.conn.Select("INBOX", false); err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+
+	if err := client.SetFlags(1, "Processed", models.SeenFlag); err != nil {
+		t.Fatalf("SetFlags failed: %v", err)
+	}
+	// Setting it again must not duplicate it
+	if err := client.SetFlags(1, "Processed"); err != nil {
+		t.Fatalf("SetFlags failed: %v", err)
+	}
+
+	flags := ts.GetMessageFlags("INBOX", 1)
+	if len(flags) != 2 {
+		t.Errorf("Expected flags [Processed \\Seen], got %v", flags)
+	}
+
+	rules := []models.Rule{
+		{ID: 1, Name: "Processed", Pattern: "processed", PatternType: "keyword", MoveToFolder: "Done", Enabled: true},
+	}
+	result, err := client.PreviewRules(rules, "INBOX", 0)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+	if result.MatchedMessages != 1 {
+		t.Errorf("Expected 1 message with the keyword, got %d", result.MatchedMessages)
+	}
+}
+
+func TestSetFlagsInvalidKeyword(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	for _, keyword := range []string{"", "two words", "paren(", `quote"`} {
+		if err := client.SetFlags(1, keyword); err == nil {
+			t.Errorf("Expected error for keyword %q", keyword)
+		}
+	}
+}
+
+func TestApplyActionAddKeyword(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "Body")
+	ts.AddMessage("b@example.com", "Two", "Body")
+	ts.AddMessage("c@example.com", "Three", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.ApplyAction("INBOX", []uint32{1, 3}, ActionAddKeyword, "Receipts"); err != nil {
+		t.Fatalf("ApplyAction failed: %v", err)
+	}
+
+	for uid, want := range map[uint32]bool{1: true, 2: false, 3: true} {
+		got := false
+		for _, f := range ts.GetMessageFlags("INBOX", uid) {
+			got = got || strings.EqualFold(f, "Receipts")
+		}
+		if got != want {
+			t.Errorf("Message %d: keyword set = %v, want %v", uid, got, want)
+		}
+	}
+}
+
+func TestApplyRulesTagProcessed(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("shop@example.com", "Receipt", "Body")
+	ts.CreateFolder("Receipts")
+	ts.CreateFolder("Elsewhere")
+
+	rules := []models.Rule{
+		{ID: 1, Pattern: "shop@", PatternType: "sender", MoveToFolder: "Receipts", Enabled: true},
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+	client.TagProcessed(models.ProcessedKeyword)
+
+	if _, err := client.ApplyRules(rules, "INBOX", false, 0); err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if ts.GetMessageCount("Receipts") != 1 {
+		t.Fatalf("Expected message moved to Receipts, got %d", ts.GetMessageCount("Receipts"))
+	}
+
+	// A second run over the destination folder must leave the tagged message alone
+	rules[0].MoveToFolder = "Elsewhere"
+	result, err := client.ApplyRules(rules, "Receipts", false, 0)
+	if err != nil {
+		t.Fatalf("ApplyRules failed: %v", err)
+	}
+	if result.MatchedMessages != 0 {
+		t.Errorf("Expected tagged message to be skipped, got %d matches", result.MatchedMessages)
+	}
+	if ts.GetMessageCount("Elsewhere") != 0 {
+		t.Errorf("Expected nothing moved on the second run")
+	}
+}
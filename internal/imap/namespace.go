@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// ResolveFolder maps a folder name to its full name on the server. On servers
+// whose personal namespace has a prefix (e.g. "INBOX." on Dovecot and Courier)
+// a bare "Archive" resolves to "INBOX.Archive". INBOX itself and names that
+// already carry the prefix are returned unchanged.
+func (c *Client) ResolveFolder(name string) (string, error) {
+	prefix, err := c.personalPrefix()
+	if err != nil {
+		return "", err
+	}
+
+	if prefix == "" || strings.EqualFold(name, "INBOX") ||
+		strings.HasPrefix(strings.ToUpper(name), strings.ToUpper(prefix)) {
+		return name, nil
+	}
+	return prefix + name, nil
+}
+
+// personalPrefix returns the prefix of the personal namespace, including its
+// trailing delimiter. It is looked up once per connection and is empty when
+// the server doesn't support NAMESPACE.
+func (c *Client) personalPrefix() (string, error) {
+	if c.namespaceLoaded {
+		return c.namespacePrefix, nil
+	}
+
+	supported, err := c.conn.Support("NAMESPACE")
+	if err != nil {
+		return "", fmt.Errorf("checking capabilities: %w", err)
+	}
+
+	if supported {
+		handler := &namespaceHandler{}
+		status, err := c.conn.Execute(&namespaceCommand{}, handler)
+		if err != nil {
+			return "", fmt.Errorf("getting namespace: %w", err)
+		}
+		if err := status.Err(); err != nil {
+			return "", fmt.Errorf("getting namespace: %w", err)
+		}
+
+		c.namespacePrefix = handler.prefix
+		if handler.delimiter != "" && c.namespacePrefix != "" &&
+			!strings.HasSuffix(c.namespacePrefix, handler.delimiter) {
+			c.namespacePrefix += handler.delimiter
+		}
+	}
+
+	c.namespaceLoaded = true
+	return c.namespacePrefix, nil
+}
+
+// namespaceCommand is the NAMESPACE command from RFC 2342
+type namespaceCommand struct{}
+
+func (cmd *namespaceCommand) Command() *imap.Command {
+	return &imap.Command{Name: "NAMESPACE"}
+}
+
+// namespaceHandler records the first personal namespace from a NAMESPACE
+// response. Other-user and shared namespaces are ignored.
+type namespaceHandler struct {
+	prefix    string
+	delimiter string
+}
+
+func (h *namespaceHandler) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "NAMESPACE" {
+		return responses.ErrUnhandled
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	personal, ok := fields[0].([]interface{})
+	if !ok || len(personal) == 0 {
+		return nil
+	}
+	first, ok := personal[0].([]interface{})
+	if !ok || len(first) < 2 {
+		return fmt.Errorf("malformed NAMESPACE response")
+	}
+
+	h.prefix, _ = imap.ParseString(first[0])
+	if first[1] != nil {
+		h.delimiter, _ = imap.ParseString(first[1])
+	}
+	return nil
+}
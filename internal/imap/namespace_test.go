@@ -0,0 +1,123 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestResolveFolderWithoutNamespace(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	resolved, err := client.ResolveFolder("Archive")
+	if err != nil {
+		t.Fatalf("ResolveFolder failed: %v", err)
+	}
+	if resolved != "Archive" {
+		t.Errorf("Expected 'Archive', got %q", resolved)
+	}
+}
+
+func TestResolveFolderWithInboxPrefix(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetNamespace("INBOX.", ".")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Archive", "INBOX.Archive"},
+		{"INBOX", "INBOX"},
+		{"inbox", "inbox"},
+		{"INBOX.Work", "INBOX.Work"},
+	}
+
+	for _, tt := range tests {
+		resolved, err := client.ResolveFolder(tt.name)
+		if err != nil {
+			t.Fatalf("ResolveFolder(%q) failed: %v", tt.name, err)
+		}
+		if resolved != tt.expected {
+			t.Errorf("ResolveFolder(%q) = %q, want %q", tt.name, resolved, tt.expected)
+		}
+	}
+}
+
+func TestMoveMessageResolvesNamespace(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetNamespace("INBOX.", ".")
+	ts.CreateFolder("INBOX.Archive")
+	ts.AddMessage("sender@example.com", "Old mail", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	// Select read-write so the original can be flagged and expunged
+	if _, err := client.conn.Select("INBOX", false); err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+
+	if err := client.MoveMessage(1, "Archive"); err != nil {
+		t.Fatalf("MoveMessage failed: %v", err)
+	}
+
+	if count := ts.GetMessageCount("INBOX.Archive"); count != 1 {
+		t.Errorf("Expected 1 message in INBOX.Archive, got %d", count)
+	}
+	if count := ts.GetMessageCount("INBOX"); count != 0 {
+		t.Errorf("Expected 0 messages in INBOX, got %d", count)
+	}
+}
+
+func TestCreateFolderResolvesNamespace(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetNamespace("INBOX.", ".")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.CreateFolder("Projects"); err != nil {
+		t.Fatalf("CreateFolder failed: %v", err)
+	}
+
+	folders, err := client.ListFolders()
+	if err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+
+	found := false
+	for _, f := range folders {
+		if f.Name == "INBOX.Projects" {
+			found = true
+		}
+		if f.Name == "Projects" {
+			t.Error("Expected folder to be created under the INBOX. prefix")
+		}
+	}
+	if !found {
+		t.Error("Expected INBOX.Projects to be created")
+	}
+}
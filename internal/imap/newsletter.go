@@ -0,0 +1,132 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// newsletterSection fetches the headers mailing list software and bulk
+// senders add (RFC 2369, RFC 2919) without marking the message \Seen
+var newsletterSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"List-Unsubscribe", "List-Id"},
+	},
+	Peek: true,
+}
+
+// unsubscribeSection fetches the headers describing how to unsubscribe
+// (RFC 2369, RFC 8058) without marking the message \Seen
+var unsubscribeSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"List-Unsubscribe", "List-Unsubscribe-Post"},
+	},
+	Peek: true,
+}
+
+// isNewsletter reports whether msg, fetched with newsletterSection, has a
+// List-Unsubscribe or List-Id header
+func isNewsletter(msg *imap.Message) bool {
+	header := readHeader(msg.GetBody(newsletterSection))
+	return header.Get("List-Unsubscribe") != "" || header.Get("List-Id") != ""
+}
+
+// readHeader parses a fetched header section, returning as much of it as
+// could be read
+func readHeader(body imap.Literal) textproto.MIMEHeader {
+	if body == nil {
+		return textproto.MIMEHeader{}
+	}
+	header, _ := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+	if header == nil {
+		return textproto.MIMEHeader{}
+	}
+	return header
+}
+
+// GetUnsubscribeInfo returns how to unsubscribe from the mailing list that
+// sent the message with the given UID in the selected folder. It returns nil
+// if the message has no usable List-Unsubscribe header, and
+// ErrMessageNotFound if the folder has no message with that UID.
+func (c *Client) GetUnsubscribeInfo(uid uint32) (*models.Unsubscribe, error) {
+	if _, err := c.reselect(); err != nil {
+		return nil, err
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.uidFetch(c.conn, seqSet, []imap.FetchItem{imap.FetchUid, unsubscribeSection.FetchItem()}, messages)
+	}()
+
+	var found *imap.Message
+	for msg := range messages {
+		if msg.Uid == uid {
+			found = msg
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetching message %d: %w", uid, err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("UID %d in %s: %w", uid, c.selected, ErrMessageNotFound)
+	}
+
+	header := readHeader(found.GetBody(unsubscribeSection))
+	info := parseUnsubscribe(header.Get("List-Unsubscribe"), header.Get("List-Unsubscribe-Post"))
+	if info != nil {
+		info.UID = uid
+	}
+	return info, nil
+}
+
+// parseUnsubscribe parses the values of the List-Unsubscribe and
+// List-Unsubscribe-Post headers. List-Unsubscribe lists URIs in angle
+// brackets, separated by commas, e.g.
+// "<mailto:leave@example.com?subject=unsubscribe>, <https://example.com/u/1>".
+// URIs with other schemes are ignored. It returns nil if none are left.
+func parseUnsubscribe(value, post string) *models.Unsubscribe {
+	info := &models.Unsubscribe{}
+	rest := value
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			break
+		}
+		// Long URIs may be folded over several header lines
+		uri := strings.Join(strings.Fields(rest[start+1:start+end]), "")
+		rest = rest[start+end+1:]
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https":
+			info.URLs = append(info.URLs, uri)
+		case "mailto":
+			info.Mailto = append(info.Mailto, uri)
+		}
+	}
+	if len(info.URLs) == 0 && len(info.Mailto) == 0 {
+		return nil
+	}
+
+	// One-click unsubscribing is only defined for HTTPS
+	info.OneClick = strings.EqualFold(strings.TrimSpace(post), "List-Unsubscribe=One-Click") &&
+		len(info.URLs) > 0 && strings.HasPrefix(strings.ToLower(info.URLs[0]), "https:")
+	return info
+}
@@ -0,0 +1,156 @@
+package imap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestIsNewsletterCondition(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessageWithHeaders("INBOX", "news@shop.com", "Weekly deals", "Content", map[string]string{
+		"List-Unsubscribe": "<mailto:unsubscribe@shop.com>",
+	})
+	ts.AddMessage("orders@shop.com", "Your order", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	messages, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if want := msg.From == "news@shop.com"; msg.Newsletter != want {
+			t.Errorf("Newsletter for %s = %v, want %v", msg.From, msg.Newsletter, want)
+		}
+	}
+
+	newsletter := true
+	rules := []models.Rule{
+		{ID: 1, Name: "Newsletters", Pattern: "shop.com", PatternType: "from_domain", MoveToFolder: "Newsletters", Enabled: true, IsNewsletter: &newsletter},
+	}
+	result, err := client.PreviewRules(rules, "INBOX", 0)
+	if err != nil {
+		t.Fatalf("PreviewRules failed: %v", err)
+	}
+	if result.MatchedMessages != 1 {
+		t.Fatalf("Expected 1 match, got %d", result.MatchedMessages)
+	}
+	for _, msg := range result.Messages {
+		if matched := msg.MatchedRule != nil; matched != msg.Newsletter {
+			t.Errorf("Matched %s = %v, want only the newsletter to match", msg.From, matched)
+		}
+	}
+}
+
+func TestParseUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		post     string
+		expected *models.Unsubscribe
+	}{
+		{
+			name:     "http",
+			value:    "<https://example.com/unsubscribe?id=1>",
+			expected: &models.Unsubscribe{URLs: []string{"https://example.com/unsubscribe?id=1"}},
+		},
+		{
+			name:     "mailto",
+			value:    "<mailto:leave@lists.example.com?subject=unsubscribe>",
+			expected: &models.Unsubscribe{Mailto: []string{"mailto:leave@lists.example.com?subject=unsubscribe"}},
+		},
+		{
+			name:  "both, with one-click",
+			value: "<mailto:leave@example.com>, <https://example.com/u/1>",
+			post:  "List-Unsubscribe=One-Click",
+			expected: &models.Unsubscribe{
+				URLs:     []string{"https://example.com/u/1"},
+				Mailto:   []string{"mailto:leave@example.com"},
+				OneClick: true,
+			},
+		},
+		{
+			name:     "one-click needs https",
+			value:    "<http://example.com/u/1>",
+			post:     "List-Unsubscribe=One-Click",
+			expected: &models.Unsubscribe{URLs: []string{"http://example.com/u/1"}},
+		},
+		{
+			name:     "folded",
+			value:    "<https://example.com/unsubscribe/\r\n 0123456789>",
+			expected: &models.Unsubscribe{URLs: []string{"https://example.com/unsubscribe/0123456789"}},
+		},
+		{
+			name:     "other schemes ignored",
+			value:    "<ftp://example.com/unsubscribe>",
+			expected: nil,
+		},
+		{
+			name:     "no brackets",
+			value:    "https://example.com/unsubscribe",
+			expected: nil,
+		},
+		{
+			name:     "empty",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUnsubscribe(tt.value, tt.post); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("parseUnsubscribe() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetUnsubscribeInfo(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessageWithHeaders("INBOX", "news@shop.com", "Weekly deals", "Content", map[string]string{
+		"List-Unsubscribe":      "<mailto:leave@shop.com?subject=unsubscribe>, <https://shop.com/unsubscribe/42>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	})
+	ts.AddMessage("orders@shop.com", "Your order", "Content")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	info, err := client.GetUnsubscribeInfo(1)
+	if err != nil {
+		t.Fatalf("GetUnsubscribeInfo failed: %v", err)
+	}
+	want := &models.Unsubscribe{
+		UID:      1,
+		URLs:     []string{"https://shop.com/unsubscribe/42"},
+		Mailto:   []string{"mailto:leave@shop.com?subject=unsubscribe"},
+		OneClick: true,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("GetUnsubscribeInfo(1) = %+v, want %+v", info, want)
+	}
+
+	if info, err := client.GetUnsubscribeInfo(2); err != nil || info != nil {
+		t.Errorf("Expected no unsubscribe info for a message without the header, got %+v, %v", info, err)
+	}
+	if _, err := client.GetUnsubscribeInfo(99); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Expected ErrMessageNotFound for a missing UID, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package imap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyDialer returns the dialer for connections through the proxy at
+// rawURL, or a direct dialer if rawURL is empty. SOCKS5 proxies
+// (socks5://[user:pass@]host:port) and HTTP proxies supporting CONNECT
+// (http://[user:pass@]host:port) are supported.
+func ProxyDialer(rawURL string) (proxy.Dialer, error) {
+	if rawURL == "" {
+		return proxy.Direct, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", u.Redacted())
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return proxy.FromURL(u, proxy.Direct)
+	case "http":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return &httpProxyDialer{addr: addr, user: u.User}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5 or http", u.Scheme)
+	}
+}
+
+// httpProxyDialer tunnels connections through an HTTP proxy with CONNECT
+type httpProxyDialer struct {
+	addr string
+	user *url.Userinfo
+}
+
+func (d *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := proxy.Direct.Dial(network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending CONNECT to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response from proxy: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	// The server greeting may already have been read along with the response
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold data
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,104 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// Quota returns the quota for the quota root of the account's primary
+// mailbox, usually INBOX. If the server doesn't advertise the QUOTA
+// extension, a Quota with Supported set to false is returned.
+func (c *Client) Quota() (*models.Quota, error) {
+	supported, err := c.conn.Support("QUOTA")
+	if err != nil {
+		return nil, fmt.Errorf("checking capabilities: %w", err)
+	}
+	if !supported {
+		return &models.Quota{Supported: false}, nil
+	}
+
+	quota := &models.Quota{Supported: true}
+	status, err := c.conn.Execute(&getQuotaRoot{mailbox: c.account.Inbox()}, &quotaRootHandler{quota: quota})
+	if err != nil {
+		return nil, fmt.Errorf("getting quota root: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return nil, fmt.Errorf("getting quota root: %w", err)
+	}
+
+	return quota, nil
+}
+
+// getQuotaRoot is the GETQUOTAROOT command from RFC 2087
+type getQuotaRoot struct {
+	mailbox string
+}
+
+func (cmd *getQuotaRoot) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "GETQUOTAROOT",
+		Arguments: []interface{}{imap.FormatMailboxName(cmd.mailbox)},
+	}
+}
+
+// quotaRootHandler collects the QUOTAROOT and QUOTA responses to GETQUOTAROOT.
+// Only the first quota root is recorded.
+type quotaRootHandler struct {
+	quota    *models.Quota
+	gotQuota bool
+}
+
+func (h *quotaRootHandler) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	switch name {
+	case "QUOTAROOT":
+		if len(fields) > 1 {
+			root, _ := imap.ParseString(fields[1])
+			h.quota.Root = root
+		}
+		return nil
+	case "QUOTA":
+		if h.gotQuota || len(fields) < 2 {
+			return nil
+		}
+		h.gotQuota = true
+
+		root, _ := imap.ParseString(fields[0])
+		h.quota.Root = root
+
+		list, ok := fields[1].([]interface{})
+		if !ok {
+			return fmt.Errorf("malformed QUOTA response")
+		}
+		for i := 0; i+2 < len(list); i += 3 {
+			resource, _ := imap.ParseString(list[i])
+			usage, err := imap.ParseNumber(list[i+1])
+			if err != nil {
+				return fmt.Errorf("parsing %s usage: %w", resource, err)
+			}
+			limit, err := imap.ParseNumber(list[i+2])
+			if err != nil {
+				return fmt.Errorf("parsing %s limit: %w", resource, err)
+			}
+
+			switch strings.ToUpper(resource) {
+			case "STORAGE":
+				h.quota.Storage = &models.QuotaResource{Usage: usage, Limit: limit}
+			case "MESSAGE":
+				h.quota.Message = &models.QuotaResource{Usage: usage, Limit: limit}
+			}
+		}
+		return nil
+	}
+
+	return responses.ErrUnhandled
+}
@@ -0,0 +1,65 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotaUnsupported(t *testing.T) {
+	_, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	quota, err := client.Quota()
+	if err != nil {
+		t.Fatalf("Quota failed: %v", err)
+	}
+
+	if quota.Supported {
+		t.Error("Expected quota to be unsupported")
+	}
+	if quota.Storage != nil || quota.Message != nil {
+		t.Error("Expected no quota resources when unsupported")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.SetQuota(1000, 50)
+	ts.AddMessage("sender@example.com", "Big", strings.Repeat("x", 3000))
+	ts.AddMessage("sender@example.com", "Small", "hi")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	quota, err := client.Quota()
+	if err != nil {
+		t.Fatalf("Quota failed: %v", err)
+	}
+
+	if !quota.Supported {
+		t.Fatal("Expected quota to be supported")
+	}
+	if quota.Storage == nil {
+		t.Fatal("Expected STORAGE resource")
+	}
+	if quota.Storage.Usage != 3 || quota.Storage.Limit != 1000 {
+		t.Errorf("Expected storage 3/1000, got %d/%d", quota.Storage.Usage, quota.Storage.Limit)
+	}
+	if quota.Message == nil {
+		t.Fatal("Expected MESSAGE resource")
+	}
+	if quota.Message.Usage != 2 || quota.Message.Limit != 50 {
+		t.Errorf("Expected messages 2/50, got %d/%d", quota.Message.Usage, quota.Message.Limit)
+	}
+}
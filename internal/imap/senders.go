@@ -0,0 +1,62 @@
+package imap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// SenderFrequency counts messages per sender address in the most recent
+// scanLimit messages of folder (all messages if scanLimit is 0), ordered by
+// count with the most frequent sender first
+func (c *Client) SenderFrequency(folder string, scanLimit int) ([]models.SenderCount, error) {
+	if _, err := c.SelectFolder(folder); err != nil {
+		return nil, err
+	}
+
+	messages, err := c.FetchMessages(scanLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, msg := range messages {
+		if addr := senderAddress(msg.From); addr != "" {
+			counts[addr]++
+		}
+	}
+
+	senders := make([]models.SenderCount, 0, len(counts))
+	for addr, count := range counts {
+		senders = append(senders, models.SenderCount{Address: addr, Count: count})
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		if senders[i].Count != senders[j].Count {
+			return senders[i].Count > senders[j].Count
+		}
+		return senders[i].Address < senders[j].Address
+	})
+
+	return senders, nil
+}
+
+// senderAddress extracts the lowercased address of the first sender from a
+// From value as produced by formatAddresses. Display names aren't quoted
+// there and may hold commas, so a comma only ends the first sender once an
+// address has been seen; an address in angle brackets is taken as it is.
+func senderAddress(from string) string {
+	for i, r := range from {
+		switch r {
+		case '<':
+			if end := strings.Index(from[i:], ">"); end != -1 {
+				return strings.ToLower(strings.TrimSpace(from[i+1 : i+end]))
+			}
+		case ',':
+			if strings.Contains(from[:i], "@") {
+				return strings.ToLower(strings.TrimSpace(from[:i]))
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(from))
+}
@@ -0,0 +1,90 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+func TestSenderFrequency(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		ts.AddMessage("news@example.com", "News", "Body")
+	}
+	ts.AddMessage("NEWS@example.com", "News", "Body")
+	ts.AddMessage("alerts@example.com", "Alert", "Body")
+	ts.AddMessage("alerts@example.com", "Alert", "Body")
+	ts.AddMessage("friend@example.com", "Hi", "Body")
+	ts.AddMessage("boss@example.com", "Hi", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	senders, err := client.SenderFrequency("INBOX", 0)
+	if err != nil {
+		t.Fatalf("SenderFrequency failed: %v", err)
+	}
+
+	expected := []models.SenderCount{
+		{Address: "news@example.com", Count: 4},
+		{Address: "alerts@example.com", Count: 2},
+		{Address: "boss@example.com", Count: 1},
+		{Address: "friend@example.com", Count: 1},
+	}
+	if len(senders) != len(expected) {
+		t.Fatalf("Expected %d senders, got %d: %+v", len(expected), len(senders), senders)
+	}
+	for i, want := range expected {
+		if senders[i] != want {
+			t.Errorf("Sender %d: expected %+v, got %+v", i, want, senders[i])
+		}
+	}
+}
+
+func TestSenderFrequencyScanLimit(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("old@example.com", "Old", "Body")
+	ts.AddMessage("old@example.com", "Old", "Body")
+	ts.AddMessage("new@example.com", "New", "Body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	senders, err := client.SenderFrequency("INBOX", 1)
+	if err != nil {
+		t.Fatalf("SenderFrequency failed: %v", err)
+	}
+	if len(senders) != 1 || senders[0].Address != "new@example.com" {
+		t.Errorf("Expected only the most recent sender, got %+v", senders)
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	tests := []struct {
+		from     string
+		expected string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"John Doe <John@Example.com>", "john@example.com"},
+		{"a@example.com, b@example.com", "a@example.com"},
+		{"Smith, John <john@x.com>", "john@x.com"},
+		{"a@example.com, Bob <b@example.com>", "a@example.com"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := senderAddress(tt.from); got != tt.expected {
+			t.Errorf("senderAddress(%q) = %q, want %q", tt.from, got, tt.expected)
+		}
+	}
+}
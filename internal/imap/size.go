@@ -0,0 +1,67 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+)
+
+// MailboxSize returns the total RFC822.SIZE of the messages in folder and how
+// many there are, i.e. how much space deleting all of them would reclaim
+func (c *Client) MailboxSize(folder string) (bytes int64, count int, err error) {
+	bytes, count, _, err = c.mailboxSize(folder, 0)
+	return bytes, count, err
+}
+
+// EstimateMailboxSize is MailboxSize for huge folders: only the sizes of
+// sample messages spread evenly across the folder are fetched, and the total
+// is extrapolated from their average. With sample 0, or at least as many
+// messages as the folder has, the size is exact. sampled is how many
+// messages' sizes the estimate is based on, which can be fewer than sample
+// if some were deleted while fetching.
+func (c *Client) EstimateMailboxSize(folder string, sample int) (bytes int64, count, sampled int, err error) {
+	return c.mailboxSize(folder, sample)
+}
+
+func (c *Client) mailboxSize(folder string, sample int) (int64, int, int, error) {
+	n, err := c.SelectFolder(folder)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if n == 0 {
+		return 0, 0, 0, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	if sample <= 0 || sample >= n {
+		seqSet.AddRange(1, uint32(n))
+	} else {
+		for i := 0; i < sample; i++ {
+			seqSet.AddNum(uint32(i*n/sample) + 1)
+		}
+	}
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fetch(c.conn, seqSet, []imap.FetchItem{imap.FetchRFC822Size}, messages)
+	}()
+
+	var bytes int64
+	fetched := 0
+	for msg := range messages {
+		bytes += int64(msg.Size)
+		fetched++
+	}
+	if err := <-done; err != nil {
+		return 0, 0, 0, fmt.Errorf("fetching message sizes: %w", err)
+	}
+
+	if sample <= 0 || sample >= n {
+		return bytes, fetched, fetched, nil
+	}
+	if fetched == 0 {
+		return 0, n, 0, nil
+	}
+	return bytes * int64(n) / int64(fetched), n, fetched, nil
+}
@@ -0,0 +1,73 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailboxSize(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("sender@example.com", "Big", strings.Repeat("x", 3000))
+	ts.AddMessage("sender@example.com", "Small", "hi")
+	ts.AddMessageToFolder("Work", "sender@example.com", "Elsewhere", strings.Repeat("x", 500))
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	bytes, count, err := client.MailboxSize("INBOX")
+	if err != nil {
+		t.Fatalf("MailboxSize failed: %v", err)
+	}
+	if bytes != 3002 || count != 2 {
+		t.Errorf("MailboxSize = %d bytes in %d messages, want 3002 in 2", bytes, count)
+	}
+
+	ts.CreateFolder("Empty")
+	if bytes, count, err := client.MailboxSize("Empty"); err != nil || bytes != 0 || count != 0 {
+		t.Errorf("MailboxSize of an empty folder = %d, %d, %v, want 0, 0, nil", bytes, count, err)
+	}
+}
+
+func TestEstimateMailboxSize(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Every other message is twice as large, so an even sample averages 150
+	for i := 0; i < 10; i++ {
+		size := 100
+		if i%2 == 1 {
+			size = 200
+		}
+		ts.AddMessage("sender@example.com", "Message", strings.Repeat("x", size))
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	bytes, count, sampled, err := client.EstimateMailboxSize("INBOX", 4)
+	if err != nil {
+		t.Fatalf("EstimateMailboxSize failed: %v", err)
+	}
+	if count != 10 {
+		t.Errorf("count = %d, want 10", count)
+	}
+	if sampled != 4 {
+		t.Errorf("sampled = %d, want 4", sampled)
+	}
+	if bytes < 1000 || bytes > 2000 {
+		t.Errorf("Estimated %d bytes, want an extrapolation between 1000 and 2000", bytes)
+	}
+
+	// A sample as large as the folder is exact
+	if bytes, _, _, err := client.EstimateMailboxSize("INBOX", 10); err != nil || bytes != 1500 {
+		t.Errorf("EstimateMailboxSize with a full sample = %d, %v, want 1500", bytes, err)
+	}
+}
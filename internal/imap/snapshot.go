@@ -0,0 +1,125 @@
+package imap
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// SnapshotUIDs returns the UIDs of the messages FetchMessages(limit) would
+// fetch from the selected folder, most recent first. Unlike sequence numbers,
+// UIDs don't shift as mail arrives or is expunged, so the messages can be
+// fetched page by page with FetchMessagesByUID and each is seen exactly once.
+func (c *Client) SnapshotUIDs(limit int) ([]uint32, error) {
+	mbox, err := c.reselect()
+	if err != nil {
+		return nil, err
+	}
+	if mbox.Messages == 0 {
+		return []uint32{}, nil
+	}
+	from, to := computeFetchRange(mbox.Messages, fetchLimit(limit))
+	seqNums, err := c.scanWindow(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(seqNums) == 0 {
+		return []uint32{}, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(seqNums...)
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fetch(c.conn, seqSet, []imap.FetchItem{imap.FetchUid}, messages)
+	}()
+
+	// As in fetchSeqNums, slots left empty by expunged messages are dropped
+	uids := make([]uint32, len(seqNums))
+	for msg := range messages {
+		if i, ok := slices.BinarySearch(seqNums, msg.SeqNum); ok {
+			uids[len(seqNums)-1-i] = msg.Uid
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetching UIDs: %w", err)
+	}
+
+	n := 0
+	for _, uid := range uids {
+		if uid != 0 {
+			uids[n] = uid
+			n++
+		}
+	}
+	return uids[:n], nil
+}
+
+// FetchMessagesByUID fetches the envelopes of the messages with the given
+// UIDs from the selected folder, in the order of uids. Messages that have
+// been expunged in the meantime are left out.
+func (c *Client) FetchMessagesByUID(uids []uint32) ([]models.Message, error) {
+	if _, err := c.reselect(); err != nil {
+		return nil, err
+	}
+	if len(uids) == 0 {
+		return []models.Message{}, nil
+	}
+
+	byUID, err := c.fetchByUID(uids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.Message, 0, len(byUID))
+	for _, uid := range uids {
+		if msg, ok := byUID[uid]; ok {
+			result = append(result, msg)
+		}
+	}
+	return result, nil
+}
+
+// fetchByUID fetches the envelopes of the messages with the given UIDs from
+// the selected folder, by UID
+func (c *Client) fetchByUID(uids []uint32) (map[uint32]models.Message, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.uidFetch(c.conn, seqSet, messageItems, messages)
+	}()
+
+	byUID := make(map[uint32]models.Message, len(uids))
+	for msg := range messages {
+		if msg.Envelope == nil {
+			continue
+		}
+		byUID[msg.Uid] = toMessage(msg)
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("fetching messages: %w", err)
+	}
+	return byUID, nil
+}
+
+// PreviewRulesByUID is PreviewRules for the messages with the given UIDs,
+// typically one page of a SnapshotUIDs result
+func (c *Client) PreviewRulesByUID(rules []models.Rule, folder string, uids []uint32) (*models.PreviewResult, error) {
+	if folder != "" {
+		if _, err := c.SelectFolder(folder); err != nil {
+			return nil, err
+		}
+	}
+
+	messages, err := c.FetchMessagesByUID(uids)
+	if err != nil {
+		return nil, err
+	}
+	return c.previewMessages(rules, messages), nil
+}
@@ -0,0 +1,79 @@
+package imap
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotUIDsStableWhenMailArrives(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 1; i <= 5; i++ {
+		ts.AddMessage("sender@example.com", fmt.Sprintf("Message %d", i), "body")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+	uids, err := client.SnapshotUIDs(0)
+	if err != nil {
+		t.Fatalf("SnapshotUIDs failed: %v", err)
+	}
+	if want := []uint32{5, 4, 3, 2, 1}; !slices.Equal(uids, want) {
+		t.Fatalf("SnapshotUIDs = %v, want %v", uids, want)
+	}
+
+	// A message arriving between pages shifts sequence numbers but not UIDs
+	first, err := client.FetchMessagesByUID(uids[:2])
+	if err != nil {
+		t.Fatalf("FetchMessagesByUID failed: %v", err)
+	}
+	ts.AddMessage("sender@example.com", "Message 6", "body")
+	rest, err := client.FetchMessagesByUID(uids[2:])
+	if err != nil {
+		t.Fatalf("FetchMessagesByUID failed: %v", err)
+	}
+
+	var subjects []string
+	for _, m := range append(first, rest...) {
+		subjects = append(subjects, m.Subject)
+	}
+	want := []string{"Message 5", "Message 4", "Message 3", "Message 2", "Message 1"}
+	if !slices.Equal(subjects, want) {
+		t.Errorf("Paged through %v, want %v", subjects, want)
+	}
+}
+
+func TestSnapshotUIDsLimit(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 1; i <= 5; i++ {
+		ts.AddMessage("sender@example.com", fmt.Sprintf("Message %d", i), "body")
+	}
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+	uids, err := client.SnapshotUIDs(2)
+	if err != nil {
+		t.Fatalf("SnapshotUIDs failed: %v", err)
+	}
+	if want := []uint32{5, 4}; !slices.Equal(uids, want) {
+		t.Errorf("SnapshotUIDs(2) = %v, want %v", uids, want)
+	}
+}
@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+)
+
+// folderStatusItems are the STATUS items reported for each folder
+var folderStatusItems = []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen}
+
+// ListFoldersWithStatus is like ListFolders, but also returns the message
+// counts of each folder that can be selected. If the server advertises
+// LIST-STATUS (RFC 5819) the counts come with the folder list in a single
+// command; otherwise a STATUS command is sent for each folder. As with
+// ListFolders, a failure partway returns the folders gathered so far.
+func (c *Client) ListFoldersWithStatus() ([]models.Folder, error) {
+	supported, err := c.conn.Support("LIST-STATUS")
+	if err != nil {
+		return nil, fmt.Errorf("checking capabilities: %w", err)
+	}
+	if supported {
+		return c.listStatus()
+	}
+
+	folders, err := c.ListFolders()
+	if err != nil {
+		return folders, err
+	}
+	for i := range folders {
+		if hasAttr(folders[i].Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		status, err := c.conn.Status(folders[i].Name, folderStatusItems)
+		if err != nil {
+			return folders, fmt.Errorf("getting status of %s: %w", folders[i].Name, err)
+		}
+		folders[i].Status = folderStatus(status)
+	}
+	return folders, nil
+}
+
+// messageCount returns the number of messages in a folder, found with STATUS
+func (c *Client) messageCount(name string) (int, error) {
+	resolved, err := c.ResolveFolder(name)
+	if err != nil {
+		return 0, err
+	}
+	status, err := c.conn.Status(resolved, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		return 0, fmt.Errorf("getting status of %s: %w", resolved, err)
+	}
+	return int(status.Messages), nil
+}
+
+// listStatus lists the folders with LIST ... RETURN (STATUS ...)
+func (c *Client) listStatus() ([]models.Folder, error) {
+	h := &listStatusHandler{index: make(map[string]int)}
+	status, err := c.conn.Execute(&listStatusCommand{items: folderStatusItems}, h)
+	if err != nil {
+		return h.folders, fmt.Errorf("listing mailboxes: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return h.folders, fmt.Errorf("listing mailboxes: %w", err)
+	}
+	return h.folders, nil
+}
+
+func folderStatus(status *imap.MailboxStatus) *models.FolderStatus {
+	return &models.FolderStatus{Messages: int(status.Messages), Unseen: int(status.Unseen)}
+}
+
+// listStatusCommand lists every folder, asking for the given STATUS items of
+// each as allowed by LIST-STATUS
+type listStatusCommand struct {
+	items []imap.StatusItem
+}
+
+func (cmd *listStatusCommand) Command() *imap.Command {
+	items := make([]interface{}, len(cmd.items))
+	for i, item := range cmd.items {
+		items[i] = imap.RawString(item)
+	}
+	return &imap.Command{
+		Name: "LIST",
+		Arguments: []interface{}{
+			"", "*",
+			imap.RawString("RETURN"), []interface{}{imap.RawString("STATUS"), items},
+		},
+	}
+}
+
+// listStatusHandler collects the LIST responses to listStatusCommand and the
+// STATUS responses that go with them
+type listStatusHandler struct {
+	folders []models.Folder
+	index   map[string]int
+}
+
+func (h *listStatusHandler) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	switch name {
+	case "LIST":
+		info := &imap.MailboxInfo{}
+		if err := info.Parse(fields); err != nil {
+			return err
+		}
+		h.index[info.Name] = len(h.folders)
+		h.folders = append(h.folders, models.Folder{
+			Name:       info.Name,
+			Delimiter:  info.Delimiter,
+			Attributes: info.Attributes,
+		})
+		return nil
+	case "STATUS":
+		r := &responses.Status{}
+		if err := r.Handle(resp); err != nil {
+			return err
+		}
+		if i, ok := h.index[r.Mailbox.Name]; ok {
+			h.folders[i].Status = folderStatus(r.Mailbox)
+		}
+		return nil
+	}
+
+	return responses.ErrUnhandled
+}
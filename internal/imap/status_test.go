@@ -0,0 +1,93 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/mailcleaner/mailcleaner/internal/models"
+	"github.com/mailcleaner/mailcleaner/testserver"
+)
+
+func listFoldersWithStatus(t *testing.T, ts *testserver.TestServer, account *models.Account) map[string]*models.FolderStatus {
+	t.Helper()
+
+	ts.AddMessage("a@example.com", "One", "body")
+	ts.AddMessage("b@example.com", "Two", "body")
+	ts.AddMessageToFolder("Archive", "c@example.com", "Three", "body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	folders, err := client.ListFoldersWithStatus()
+	if err != nil {
+		t.Fatalf("ListFoldersWithStatus failed: %v", err)
+	}
+
+	statuses := make(map[string]*models.FolderStatus)
+	for _, f := range folders {
+		if f.Status == nil {
+			t.Errorf("Expected a status for %s", f.Name)
+			continue
+		}
+		statuses[f.Name] = f.Status
+	}
+
+	if got := statuses["INBOX"]; got == nil || got.Messages != 2 || got.Unseen != 2 {
+		t.Errorf("INBOX status = %+v, want 2 messages, 2 unseen", got)
+	}
+	if got := statuses["Archive"]; got == nil || got.Messages != 1 || got.Unseen != 1 {
+		t.Errorf("Archive status = %+v, want 1 message, 1 unseen", got)
+	}
+	return statuses
+}
+
+func TestListFoldersWithStatusListStatus(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.EnableListStatus()
+	listFoldersWithStatus(t, ts, account)
+
+	if n := ts.StatusCommands(); n != 0 {
+		t.Errorf("Expected the counts to come with LIST, got %d STATUS commands", n)
+	}
+}
+
+func TestListFoldersWithStatusFallback(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	statuses := listFoldersWithStatus(t, ts, account)
+
+	if n := ts.StatusCommands(); n != len(statuses) {
+		t.Errorf("Expected a STATUS command per folder (%d), got %d", len(statuses), n)
+	}
+}
+
+func TestListFoldersWithoutStatus(t *testing.T) {
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.EnableListStatus()
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	folders, err := client.ListFolders()
+	if err != nil {
+		t.Fatalf("ListFolders failed: %v", err)
+	}
+	if len(folders) == 0 {
+		t.Fatal("Expected folders")
+	}
+	for _, f := range folders {
+		if f.Status != nil {
+			t.Errorf("Expected no status for %s without asking for it", f.Name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// ErrThrottled is returned when the server still refuses a command because
+// of a rate limit after it has been retried throttleRetries times
+var ErrThrottled = errors.New("server is throttling requests")
+
+// limitCode is the response code (RFC 5530) of a NO sent because the user
+// is over a rate limit; the command may succeed if tried again later
+const limitCode = "LIMIT"
+
+// throttleRetries is how many times a throttled command is retried
+const throttleRetries = 3
+
+// throttleCooldown is how long to wait before the first retry of a
+// throttled command. It doubles with each retry.
+var throttleCooldown = 2 * time.Second
+
+// execute runs cmd on conn and returns the error of a NO or BAD response,
+// as the go-imap client's own methods do. Unlike them, it retries commands
+// the server refuses with NO [LIMIT] after a cooldown, as those methods drop
+// the response code. conn is this client's connection or one of its workers.
+func (c *Client) execute(conn *timedConn, cmd imap.Commander, h responses.Handler) error {
+	cooldown := throttleCooldown
+	for attempt := 0; ; attempt++ {
+		status, err := conn.Execute(cmd, h)
+		if err != nil {
+			return err
+		}
+		if status.Type != imap.StatusRespNo || status.Code != limitCode {
+			return status.Err()
+		}
+		if attempt == throttleRetries {
+			return fmt.Errorf("%w: %s", ErrThrottled, status.Info)
+		}
+
+		timer := time.NewTimer(cooldown)
+		select {
+		case <-timer.C:
+		case <-c.done():
+			timer.Stop()
+			return c.ctx.Err()
+		}
+		cooldown *= 2
+	}
+}
+
+// done returns the channel closed when the client's context is done, or nil
+// if it has none
+func (c *Client) done() <-chan struct{} {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Done()
+}
+
+// uidSearch is conn.UidSearch, retrying when throttled
+func (c *Client) uidSearch(conn *timedConn, criteria *imap.SearchCriteria) ([]uint32, error) {
+	res := new(responses.Search)
+	if err := c.execute(conn, &commands.Uid{Cmd: &commands.Search{Criteria: criteria}}, res); err != nil {
+		return nil, err
+	}
+	return res.Ids, nil
+}
+
+// uidCopy is conn.UidCopy, retrying when throttled
+func (c *Client) uidCopy(conn *timedConn, seqSet *imap.SeqSet, dest string) error {
+	return c.execute(conn, &commands.Uid{Cmd: &commands.Copy{SeqSet: seqSet, Mailbox: dest}}, nil)
+}
+
+// uidAddFlags adds flags to the messages with the given UIDs without asking
+// for their updated flags, retrying when throttled
+func (c *Client) uidAddFlags(conn *timedConn, seqSet *imap.SeqSet, flags ...string) error {
+	values := make([]interface{}, len(flags))
+	for i, flag := range flags {
+		values[i] = imap.RawString(flag)
+	}
+	cmd := &commands.Store{SeqSet: seqSet, Item: imap.FormatFlagsOp(imap.AddFlags, true), Value: values}
+	return c.execute(conn, &commands.Uid{Cmd: cmd}, nil)
+}
+
+// expunge is conn.Expunge(nil), retrying when throttled
+func (c *Client) expunge(conn *timedConn) error {
+	return c.execute(conn, &commands.Expunge{}, nil)
+}
+
+// fetch is conn.Fetch, retrying when throttled. ch is closed once the fetch
+// is done.
+func (c *Client) fetch(conn *timedConn, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	defer close(ch)
+	return c.execute(conn, &commands.Fetch{SeqSet: seqSet, Items: items}, &responses.Fetch{Messages: ch, SeqSet: seqSet})
+}
+
+// uidFetch is conn.UidFetch, retrying when throttled. ch is closed once the
+// fetch is done.
+func (c *Client) uidFetch(conn *timedConn, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	defer close(ch)
+	cmd := &commands.Uid{Cmd: &commands.Fetch{SeqSet: seqSet, Items: items}}
+	return c.execute(conn, cmd, &responses.Fetch{Messages: ch, SeqSet: seqSet, Uid: true})
+}
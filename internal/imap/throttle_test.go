@@ -0,0 +1,71 @@
+package imap
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func shortenThrottleCooldown(t *testing.T) {
+	t.Helper()
+	saved := throttleCooldown
+	throttleCooldown = time.Millisecond
+	t.Cleanup(func() { throttleCooldown = saved })
+}
+
+func TestFetchMessagesRetriesThrottled(t *testing.T) {
+	shortenThrottleCooldown(t)
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "body")
+	ts.AddMessage("b@example.com", "Two", "body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	ts.ThrottleFetches(throttleRetries)
+	messages, err := client.FetchMessages(0)
+	if err != nil {
+		t.Fatalf("Expected the throttled fetch to be retried, got %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected 2 messages, got %d", len(messages))
+	}
+}
+
+func TestFetchMessagesPersistentThrottle(t *testing.T) {
+	shortenThrottleCooldown(t)
+	ts, account, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	ts.AddMessage("a@example.com", "One", "body")
+
+	client, err := Connect(account)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.SelectFolder("INBOX"); err != nil {
+		t.Fatalf("SelectFolder failed: %v", err)
+	}
+
+	ts.ThrottleFetches(throttleRetries + 1)
+	_, err = client.FetchMessages(0)
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Expected ErrThrottled, got %v", err)
+	}
+
+	// Only the retries were sent, so the server's limit has now passed
+	if _, err := client.FetchMessages(0); err != nil {
+		t.Errorf("Expected the next fetch to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+)
+
+// ErrTimeout is returned when a command takes longer than the account's
+// command timeout. The connection is closed, as it is unknown where in the
+// command's response the server stopped.
+var ErrTimeout = errors.New("command timed out")
+
+// timedConn is a go-imap client whose commands fail once they take longer
+// than timeout. go-imap's own Timeout sets the connection's deadline when a
+// command starts but never clears it, so a connection left idle between
+// commands for longer than the timeout would be dropped. Here the timer only
+// runs while a command does.
+//
+// Only the commands this package uses are wrapped.
+type timedConn struct {
+	*client.Client
+	timeout time.Duration
+}
+
+// run runs fn, closing the connection if it is still running after timeout.
+// A command that finished just as the timer fired keeps its own result; only
+// one that failed once the connection was closed under it timed out.
+func (t *timedConn) run(fn func() error) error {
+	if t.timeout <= 0 {
+		return fn()
+	}
+	timer := time.AfterFunc(t.timeout, func() {
+		t.Client.Terminate()
+	})
+	err := fn()
+	if fired := !timer.Stop(); fired && err != nil {
+		return fmt.Errorf("%w after %s", ErrTimeout, t.timeout)
+	}
+	return err
+}
+
+func (t *timedConn) Login(username, password string) error {
+	return t.run(func() error {
+		return t.Client.Login(username, password)
+	})
+}
+
+func (t *timedConn) Logout() error {
+	return t.run(t.Client.Logout)
+}
+
+func (t *timedConn) Capability() (caps map[string]bool, err error) {
+	err = t.run(func() error {
+		caps, err = t.Client.Capability()
+		return err
+	})
+	return caps, err
+}
+
+func (t *timedConn) Support(capability string) (supported bool, err error) {
+	err = t.run(func() error {
+		supported, err = t.Client.Support(capability)
+		return err
+	})
+	return supported, err
+}
+
+func (t *timedConn) Select(name string, readOnly bool) (mbox *imap.MailboxStatus, err error) {
+	err = t.run(func() error {
+		mbox, err = t.Client.Select(name, readOnly)
+		return err
+	})
+	return mbox, err
+}
+
+func (t *timedConn) Search(criteria *imap.SearchCriteria) (seqNums []uint32, err error) {
+	err = t.run(func() error {
+		seqNums, err = t.Client.Search(criteria)
+		return err
+	})
+	return seqNums, err
+}
+
+func (t *timedConn) List(ref, name string, ch chan *imap.MailboxInfo) error {
+	return t.run(func() error {
+		return t.Client.List(ref, name, ch)
+	})
+}
+
+func (t *timedConn) Status(name string, items []imap.StatusItem) (status *imap.MailboxStatus, err error) {
+	err = t.run(func() error {
+		status, err = t.Client.Status(name, items)
+		return err
+	})
+	return status, err
+}
+
+func (t *timedConn) Create(name string) error {
+	return t.run(func() error {
+		return t.Client.Create(name)
+	})
+}
+
+func (t *timedConn) Execute(cmd imap.Commander, h responses.Handler) (status *imap.StatusResp, err error) {
+	err = t.run(func() error {
+		status, err = t.Client.Execute(cmd, h)
+		return err
+	})
+	return status, err
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// RuleShadow reports a rule that can never match, because a rule evaluated
+// before it matches every message it would
+type RuleShadow struct {
+	RuleID         int64  `json:"rule_id"`
+	RuleName       string `json:"rule_name"`
+	ShadowedByID   int64  `json:"shadowed_by_id"`
+	ShadowedByName string `json:"shadowed_by_name"`
+	Reason         string `json:"reason"`
+}
+
+// AnalyzeRules finds enabled rules shadowed by an earlier enabled rule. rules
+// must be in the order they are evaluated, as returned by the store. Each
+// shadowed rule is reported once, for the first rule shadowing it.
+func AnalyzeRules(rules []Rule) []RuleShadow {
+	shadows := []RuleShadow{}
+	for j := range rules {
+		later := &rules[j]
+		if !later.Enabled {
+			continue
+		}
+		for i := 0; i < j; i++ {
+			earlier := &rules[i]
+			if !earlier.Enabled {
+				continue
+			}
+			if reason, ok := shadowReason(earlier, later); ok {
+				shadows = append(shadows, RuleShadow{
+					RuleID:         later.ID,
+					RuleName:       later.Name,
+					ShadowedByID:   earlier.ID,
+					ShadowedByName: earlier.Name,
+					Reason:         reason,
+				})
+				break
+			}
+		}
+	}
+	return shadows
+}
+
+// shadowReason reports whether every message later matches is also matched by
+// earlier, and if so describes why
+func shadowReason(earlier, later *Rule) (string, bool) {
+	// earlier's extra conditions must hold whenever later's do
+	if earlier.UnreadOnly && !later.UnreadOnly {
+		return "", false
+	}
+	if earlier.OlderThanDays > later.OlderThanDays {
+		return "", false
+	}
+	if earlier.ExcludeKeyword != "" && !strings.EqualFold(earlier.ExcludeKeyword, later.ExcludeKeyword) {
+		return "", false
+	}
+	laterFlags := later.FlagConditions()
+	for _, c := range earlier.FlagConditions() {
+		if !slices.Contains(laterFlags, c) {
+			return "", false
+		}
+	}
+	if earlier.IsNewsletter != nil && (later.IsNewsletter == nil || *later.IsNewsletter != *earlier.IsNewsletter) {
+		return "", false
+	}
+
+	earlierType, laterType := patternType(earlier), patternType(later)
+	earlierPatterns := earlier.Patterns()
+	if slices.Contains(earlierPatterns, "") {
+		if reason, ok := emptyPatternReason(earlier.Name, earlierType, laterType); ok {
+			return reason, true
+		}
+	}
+
+	// Each of later's alternatives must be covered by one of earlier's
+	var reasons []string
+	for _, laterPattern := range later.Patterns() {
+		reason, ok := patternShadowReason(earlierType, laterType, earlierPatterns, laterPattern)
+		if !ok {
+			return "", false
+		}
+		reasons = append(reasons, reason)
+	}
+	return strings.Join(reasons, "; "), len(reasons) > 0
+}
+
+// emptyPatternReason reports whether an empty pattern of earlierType matches
+// every message a rule of laterType does, and if so describes why. It matches
+// every message for subject and sender patterns, but from_domain and
+// reply_to ones need the message to have a sender domain or a Reply-To, and
+// an empty keyword matches nothing.
+func emptyPatternReason(earlierName, earlierType, laterType string) (string, bool) {
+	switch earlierType {
+	case "subject", "sender":
+		return fmt.Sprintf("%q has an empty %s pattern, which matches every message", earlierName, earlierType), true
+	case "from_domain":
+		if laterType == "from_domain" {
+			return fmt.Sprintf("%q has an empty from_domain pattern, which matches every message with a sender domain", earlierName), true
+		}
+	case "reply_to":
+		if laterType == "reply_to" {
+			return fmt.Sprintf("%q has an empty reply_to pattern, which matches every message with a Reply-To", earlierName), true
+		}
+	}
+	return "", false
+}
+
+// patternShadowReason reports whether one of the earlier patterns matches
+// every message laterPattern does, and if so describes why
+func patternShadowReason(earlierType, laterType string, earlierPatterns []string, laterPattern string) (string, bool) {
+	for _, earlierPattern := range earlierPatterns {
+		switch {
+		case earlierType == "keyword" || laterType == "keyword":
+			if earlierType == laterType && strings.EqualFold(earlierPattern, laterPattern) {
+				return fmt.Sprintf("both match keyword %q", earlierPattern), true
+			}
+		case earlierType == laterType ||
+			// The sender contains its domain, so a sender pattern found in the
+			// domain is found in the sender too
+			earlierType == "sender" && laterType == "from_domain":
+			if strings.Contains(strings.ToLower(laterPattern), strings.ToLower(earlierPattern)) {
+				return fmt.Sprintf("%s %q contains %s %q", laterType, laterPattern, earlierType, earlierPattern), true
+			}
+		}
+	}
+	return "", false
+}
+
+// patternType returns the rule's pattern type as matching treats it, with
+// unknown types matching the sender
+func patternType(rule *Rule) string {
+	switch rule.PatternType {
+	case "subject", "from_domain", "keyword", "reply_to":
+		return rule.PatternType
+	}
+	return "sender"
+}
+
+// minPatternLength is the length below which a pattern is considered too
+// broad to be intended
+const minPatternLength = 3
+
+// commonTLDs are top-level domains that are found in the addresses of most
+// senders, so a sender pattern of just one of them moves nearly everything
+var commonTLDs = []string{"com", "net", "org", "edu", "gov", "io", "co", "info", "biz", "uk", "de", "fr", "nl", "eu"}
+
+// PatternWarnings reports why the rule's pattern, or any of its
+// alternatives, would match nearly every message, if it would. Keyword
+// patterns match whole keywords and are never reported. The warnings don't
+// make the rule invalid.
+func PatternWarnings(rule *Rule) []string {
+	typ := patternType(rule)
+	if typ == "keyword" {
+		return nil
+	}
+
+	var warnings []string
+	for _, pattern := range rule.Patterns() {
+		core := strings.ToLower(strings.TrimLeft(strings.TrimSpace(pattern), "@."))
+		switch {
+		case typ != "subject" && slices.Contains(commonTLDs, core):
+			warnings = append(warnings, fmt.Sprintf("pattern %q is a top-level domain and matches most senders", pattern))
+		case len(core) < minPatternLength:
+			warnings = append(warnings, fmt.Sprintf("pattern %q is shorter than %d characters and matches most messages", pattern, minPatternLength))
+		}
+	}
+	return warnings
+}
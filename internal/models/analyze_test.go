@@ -0,0 +1,204 @@
+package models
+
+import "testing"
+
+func TestAnalyzeRulesShadowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		earlier  Rule
+		later    Rule
+		shadowed bool
+	}{
+		{
+			name:     "broader sender pattern first",
+			earlier:  Rule{Pattern: "github.com", PatternType: "sender"},
+			later:    Rule{Pattern: "notifications@github.com", PatternType: "sender"},
+			shadowed: true,
+		},
+		{
+			name:     "case differs",
+			earlier:  Rule{Pattern: "GitHub", PatternType: "subject"},
+			later:    Rule{Pattern: "[github] pull request", PatternType: "subject"},
+			shadowed: true,
+		},
+		{
+			name:     "sender pattern covers domain",
+			earlier:  Rule{Pattern: "github", PatternType: "sender"},
+			later:    Rule{Pattern: "github.com", PatternType: "from_domain"},
+			shadowed: true,
+		},
+		{
+			name:     "empty pattern matches everything",
+			earlier:  Rule{Pattern: "", PatternType: "sender"},
+			later:    Rule{Pattern: "Processed", PatternType: "keyword"},
+			shadowed: true,
+		},
+		{
+			name:     "empty from_domain pattern covers domains",
+			earlier:  Rule{Pattern: "", PatternType: "from_domain"},
+			later:    Rule{Pattern: "github.com", PatternType: "from_domain"},
+			shadowed: true,
+		},
+		{
+			name:    "empty from_domain pattern needs a sender domain",
+			earlier: Rule{Pattern: "", PatternType: "from_domain"},
+			later:   Rule{Pattern: "GitHub", PatternType: "subject"},
+		},
+		{
+			name:    "empty reply_to pattern needs a Reply-To",
+			earlier: Rule{Pattern: "", PatternType: "reply_to"},
+			later:   Rule{Pattern: "github.com", PatternType: "sender"},
+		},
+		{
+			name:     "same keyword",
+			earlier:  Rule{Pattern: "Processed", PatternType: "keyword"},
+			later:    Rule{Pattern: "processed", PatternType: "keyword"},
+			shadowed: true,
+		},
+		{
+			name:     "later rule has stricter conditions",
+			earlier:  Rule{Pattern: "github.com", PatternType: "sender", OlderThanDays: 7},
+			later:    Rule{Pattern: "github.com", PatternType: "sender", UnreadOnly: true, OlderThanDays: 30},
+			shadowed: true,
+		},
+		{
+			name:     "every alternative covered",
+			earlier:  Rule{Pattern: "github.com\ngitlab.com", PatternType: "sender"},
+			later:    Rule{Pattern: "notifications@gitlab.com\nnoreply@github.com", PatternType: "sender"},
+			shadowed: true,
+		},
+		{
+			name:    "one alternative not covered",
+			earlier: Rule{Pattern: "github.com", PatternType: "sender"},
+			later:   Rule{Pattern: "noreply@github.com\nnoreply@gitlab.com", PatternType: "sender"},
+		},
+		{
+			name:    "specific pattern first",
+			earlier: Rule{Pattern: "notifications@github.com", PatternType: "sender"},
+			later:   Rule{Pattern: "github.com", PatternType: "sender"},
+		},
+		{
+			name:    "different pattern types",
+			earlier: Rule{Pattern: "github", PatternType: "subject"},
+			later:   Rule{Pattern: "github.com", PatternType: "sender"},
+		},
+		{
+			name:    "domain pattern doesn't cover sender",
+			earlier: Rule{Pattern: "github.com", PatternType: "from_domain"},
+			later:   Rule{Pattern: "notifications@github.com", PatternType: "sender"},
+		},
+		{
+			name:    "earlier rule only matches unread mail",
+			earlier: Rule{Pattern: "github.com", PatternType: "sender", UnreadOnly: true},
+			later:   Rule{Pattern: "github.com", PatternType: "sender"},
+		},
+		{
+			name:    "earlier rule only matches older mail",
+			earlier: Rule{Pattern: "github.com", PatternType: "sender", OlderThanDays: 30},
+			later:   Rule{Pattern: "github.com", PatternType: "sender", OlderThanDays: 7},
+		},
+		{
+			name:    "earlier rule excludes a keyword",
+			earlier: Rule{Pattern: "github.com", PatternType: "sender", ExcludeKeyword: "$Keep"},
+			later:   Rule{Pattern: "github.com", PatternType: "sender"},
+		},
+		{
+			name:     "later rule has the same flag condition",
+			earlier:  Rule{Pattern: "news", PatternType: "sender", IsFlagged: boolPtr(false)},
+			later:    Rule{Pattern: "newsletter@", PatternType: "sender", IsFlagged: boolPtr(false), IsDraft: boolPtr(false)},
+			shadowed: true,
+		},
+		{
+			name:    "earlier rule has a flag condition",
+			earlier: Rule{Pattern: "news", PatternType: "sender", IsFlagged: boolPtr(false)},
+			later:   Rule{Pattern: "newsletter@", PatternType: "sender"},
+		},
+		{
+			name:    "opposite flag conditions",
+			earlier: Rule{Pattern: "news", PatternType: "sender", IsAnswered: boolPtr(true)},
+			later:   Rule{Pattern: "newsletter@", PatternType: "sender", IsAnswered: boolPtr(false)},
+		},
+		{
+			name:    "different keywords",
+			earlier: Rule{Pattern: "Processed", PatternType: "keyword"},
+			later:   Rule{Pattern: "Processed2", PatternType: "keyword"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.earlier.ID, tt.earlier.Name, tt.earlier.Enabled = 1, "Earlier", true
+			tt.later.ID, tt.later.Name, tt.later.Enabled = 2, "Later", true
+
+			shadows := AnalyzeRules([]Rule{tt.earlier, tt.later})
+			if !tt.shadowed {
+				if len(shadows) != 0 {
+					t.Errorf("Expected no shadowing, got %+v", shadows)
+				}
+				return
+			}
+			if len(shadows) != 1 || shadows[0].RuleID != 2 || shadows[0].ShadowedByID != 1 || shadows[0].Reason == "" {
+				t.Errorf("Expected Later to be shadowed by Earlier, got %+v", shadows)
+			}
+		})
+	}
+}
+
+func TestAnalyzeRulesIgnoresDisabledRules(t *testing.T) {
+	rules := []Rule{
+		{ID: 1, Name: "All GitHub", Pattern: "github.com", PatternType: "sender", Enabled: false},
+		{ID: 2, Name: "Notifications", Pattern: "notifications@github.com", PatternType: "sender", Enabled: true},
+		{ID: 3, Name: "Old notifications", Pattern: "notifications@github.com", PatternType: "sender", Enabled: false},
+	}
+
+	if shadows := AnalyzeRules(rules); len(shadows) != 0 {
+		t.Errorf("Expected disabled rules to be ignored, got %+v", shadows)
+	}
+}
+
+func TestAnalyzeRulesReportsFirstShadow(t *testing.T) {
+	rules := []Rule{
+		{ID: 1, Name: "GitHub", Pattern: "github", PatternType: "sender", Enabled: true},
+		{ID: 2, Name: "GitHub.com", Pattern: "github.com", PatternType: "sender", Enabled: true},
+		{ID: 3, Name: "Notifications", Pattern: "notifications@github.com", PatternType: "sender", Enabled: true},
+	}
+
+	shadows := AnalyzeRules(rules)
+	if len(shadows) != 2 {
+		t.Fatalf("Expected 2 shadowed rules, got %+v", shadows)
+	}
+	for _, s := range shadows {
+		if s.ShadowedByID != 1 {
+			t.Errorf("Expected rule %d to be reported as shadowed by the first rule, got %d", s.RuleID, s.ShadowedByID)
+		}
+	}
+}
+
+func TestPatternWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		warn bool
+	}{
+		{"one character", Rule{Pattern: "a", PatternType: "sender"}, true},
+		{"two characters in subject", Rule{Pattern: "re", PatternType: "subject"}, true},
+		{"top-level domain", Rule{Pattern: "com", PatternType: "from_domain"}, true},
+		{"top-level domain with dot", Rule{Pattern: ".COM", PatternType: "sender"}, true},
+		{"top-level domain with at", Rule{Pattern: "@org", PatternType: ""}, true},
+		{"specific sender", Rule{Pattern: "notifications@github.com", PatternType: "sender"}, false},
+		{"specific domain", Rule{Pattern: "github.com", PatternType: "from_domain"}, false},
+		{"top-level domain as subject", Rule{Pattern: "info", PatternType: "subject"}, false},
+		{"short keyword", Rule{Pattern: "$a", PatternType: "keyword"}, false},
+		{"one broad alternative", Rule{Pattern: "github.com, com", PatternType: "from_domain"}, true},
+		{"specific alternatives", Rule{Pattern: "github.com\ngitlab.com", PatternType: "sender"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := PatternWarnings(&tt.rule)
+			if got := len(warnings) > 0; got != tt.warn {
+				t.Errorf("PatternWarnings() = %v, want warning %v", warnings, tt.warn)
+			}
+		})
+	}
+}
@@ -2,61 +2,370 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// MaxFetchConcurrency caps Account.FetchConcurrency so a single fetch can't
+// open enough parallel connections to get an account throttled or banned
+const MaxFetchConcurrency = 8
+
 // Account represents an IMAP email account
 type Account struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Server    string    `json:"server"`
-	Port      int       `json:"port"`
-	Username  string    `json:"username"`
-	Password  string    `json:"password,omitempty"`
-	TLS       bool      `json:"tls"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID               int64  `json:"id"`
+	Name             string `json:"name"`
+	Server           string `json:"server"`
+	Port             int    `json:"port"`
+	Username         string `json:"username"`
+	Password         string `json:"password,omitempty"`
+	TLS              bool   `json:"tls"`
+	FetchConcurrency int    `json:"fetch_concurrency"` // parallel fetch connections, default 1
+	Compress         bool   `json:"compress"`          // use COMPRESS=DEFLATE when the server supports it
+	ProxyURL         string `json:"proxy_url"`         // socks5:// or http:// proxy to connect through, if any
+	ScanWindowDays   int    `json:"scan_window_days"`  // only fetch messages that arrived in the last this many days; 0 fetches all
+	InboxName        string `json:"inbox_name"`        // the primary mailbox, if not INBOX
+
+	// Longest a single IMAP command may take before it fails and the
+	// connection is closed; 0 waits indefinitely
+	CommandTimeoutSeconds int `json:"command_timeout_seconds"`
+
+	// Folders rules and manual moves may move messages to; any folder if empty
+	AllowedDestinations []string `json:"allowed_destinations"`
+
+	Enabled          bool       `json:"enabled"` // disabled accounts are skipped by scheduled runs
+	LastVerifiedAt   *time.Time `json:"last_verified_at,omitempty"`
+	LastVerifyStatus string     `json:"last_verify_status,omitempty"` // "success" or "failed"
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// AccountPatch is a partial account update. Only non-nil fields are changed.
+type AccountPatch struct {
+	Name                  *string   `json:"name"`
+	Server                *string   `json:"server"`
+	Port                  *int      `json:"port"`
+	Username              *string   `json:"username"`
+	Password              *string   `json:"password"`
+	TLS                   *bool     `json:"tls"`
+	FetchConcurrency      *int      `json:"fetch_concurrency"`
+	Compress              *bool     `json:"compress"`
+	ProxyURL              *string   `json:"proxy_url"`
+	ScanWindowDays        *int      `json:"scan_window_days"`
+	InboxName             *string   `json:"inbox_name"`
+	CommandTimeoutSeconds *int      `json:"command_timeout_seconds"`
+	AllowedDestinations   *[]string `json:"allowed_destinations"`
+	Enabled               *bool     `json:"enabled"`
+}
+
+// Apply sets the fields given in the patch on account
+func (p *AccountPatch) Apply(account *Account) {
+	setIfPresent(&account.Name, p.Name)
+	setIfPresent(&account.Server, p.Server)
+	setIfPresent(&account.Port, p.Port)
+	setIfPresent(&account.Username, p.Username)
+	setIfPresent(&account.Password, p.Password)
+	setIfPresent(&account.TLS, p.TLS)
+	setIfPresent(&account.FetchConcurrency, p.FetchConcurrency)
+	setIfPresent(&account.Compress, p.Compress)
+	setIfPresent(&account.ProxyURL, p.ProxyURL)
+	setIfPresent(&account.ScanWindowDays, p.ScanWindowDays)
+	setIfPresent(&account.InboxName, p.InboxName)
+	setIfPresent(&account.CommandTimeoutSeconds, p.CommandTimeoutSeconds)
+	setIfPresent(&account.AllowedDestinations, p.AllowedDestinations)
+	setIfPresent(&account.Enabled, p.Enabled)
 }
 
+func setIfPresent[T any](dst *T, value *T) {
+	if value != nil {
+		*dst = *value
+	}
+}
+
+// Account verification statuses
+const (
+	VerifySuccess = "success"
+	VerifyFailed  = "failed"
+)
+
 // AccountWithoutPassword is Account with password omitted for API responses
 type AccountWithoutPassword struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Server    string    `json:"server"`
-	Port      int       `json:"port"`
-	Username  string    `json:"username"`
-	TLS       bool      `json:"tls"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                    int64      `json:"id"`
+	Name                  string     `json:"name"`
+	Server                string     `json:"server"`
+	Port                  int        `json:"port"`
+	Username              string     `json:"username"`
+	TLS                   bool       `json:"tls"`
+	FetchConcurrency      int        `json:"fetch_concurrency"`
+	Compress              bool       `json:"compress"`
+	ProxyURL              string     `json:"proxy_url"` // with any password redacted
+	ScanWindowDays        int        `json:"scan_window_days"`
+	InboxName             string     `json:"inbox_name"`
+	CommandTimeoutSeconds int        `json:"command_timeout_seconds"`
+	AllowedDestinations   []string   `json:"allowed_destinations"`
+	Enabled               bool       `json:"enabled"`
+	LastVerifiedAt        *time.Time `json:"last_verified_at,omitempty"`
+	LastVerifyStatus      string     `json:"last_verify_status,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// DefaultInboxName is the primary mailbox of accounts without an InboxName
+const DefaultInboxName = "INBOX"
+
+// Inbox returns the account's primary mailbox, InboxName or INBOX by default
+func (a *Account) Inbox() string {
+	if a.InboxName == "" {
+		return DefaultInboxName
+	}
+	return a.InboxName
+}
+
+// CommandTimeout returns the longest a single IMAP command may take, or 0
+// for no limit
+func (a *Account) CommandTimeout() time.Duration {
+	return time.Duration(a.CommandTimeoutSeconds) * time.Second
+}
+
+// AllowsDestination reports whether messages may be moved to folder: any
+// folder if AllowedDestinations is empty, otherwise only those listed. As
+// IMAP requires, INBOX is matched case-insensitively.
+func (a *Account) AllowsDestination(folder string) bool {
+	if len(a.AllowedDestinations) == 0 {
+		return true
+	}
+	for _, allowed := range a.AllowedDestinations {
+		if allowed == folder || strings.EqualFold(allowed, "INBOX") && strings.EqualFold(folder, "INBOX") {
+			return true
+		}
+	}
+	return false
 }
 
 // ToSafe converts an Account to AccountWithoutPassword
 func (a *Account) ToSafe() AccountWithoutPassword {
 	return AccountWithoutPassword{
-		ID:        a.ID,
-		Name:      a.Name,
-		Server:    a.Server,
-		Port:      a.Port,
-		Username:  a.Username,
-		TLS:       a.TLS,
-		CreatedAt: a.CreatedAt,
-		UpdatedAt: a.UpdatedAt,
+		ID:                    a.ID,
+		Name:                  a.Name,
+		Server:                a.Server,
+		Port:                  a.Port,
+		Username:              a.Username,
+		TLS:                   a.TLS,
+		FetchConcurrency:      a.FetchConcurrency,
+		Compress:              a.Compress,
+		ProxyURL:              RedactURL(a.ProxyURL),
+		ScanWindowDays:        a.ScanWindowDays,
+		InboxName:             a.InboxName,
+		CommandTimeoutSeconds: a.CommandTimeoutSeconds,
+		AllowedDestinations:   a.AllowedDestinations,
+		Enabled:               a.Enabled,
+		LastVerifiedAt:        a.LastVerifiedAt,
+		LastVerifyStatus:      a.LastVerifyStatus,
+		CreatedAt:             a.CreatedAt,
+		UpdatedAt:             a.UpdatedAt,
 	}
 }
 
+// RedactURL replaces the password in a URL such as a proxy URL with "xxxxx".
+// URLs that can't be parsed are returned unchanged.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
 // Rule defines a sender-matching rule for email organization
 type Rule struct {
-	ID           int64     `json:"id"`
-	AccountID    int64     `json:"account_id"`
-	Name         string    `json:"name"`
-	Pattern      string    `json:"pattern"`
-	PatternType  string    `json:"pattern_type"` // "sender", "subject", "from_domain"
-	MoveToFolder string    `json:"move_to_folder"`
-	Enabled      bool      `json:"enabled"`
-	Priority     int       `json:"priority"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID             int64     `json:"id"`
+	AccountID      int64     `json:"account_id"`
+	Name           string    `json:"name"`
+	Pattern        string    `json:"pattern"`        // alternatives separated by newlines, or commas for "from_domain" and "keyword"
+	PatternType    string    `json:"pattern_type"`   // "sender", "subject", "from_domain", "keyword", "reply_to"
+	MoveToFolder   string    `json:"move_to_folder"` // for "archive", the fallback if the server has no \Archive folder
+	Action         string    `json:"action"`         // "move" (default) or "archive"
+	Enabled        bool      `json:"enabled"`
+	Priority       int       `json:"priority"`
+	UnreadOnly     bool      `json:"unread_only"`                // only match messages without \Seen
+	OlderThanDays  int       `json:"older_than_days"`            // only match messages older than this; 0 disables
+	ExcludeKeyword string    `json:"exclude_keyword"`            // never match messages tagged with this keyword
+	Fallbacks      []string  `json:"fallback_folders,omitempty"` // tried in order when MoveToFolder doesn't exist
+	IsFlagged      *bool     `json:"is_flagged,omitempty"`       // if set, only match messages with (true) or without (false) \Flagged
+	IsAnswered     *bool     `json:"is_answered,omitempty"`      // likewise for \Answered
+	IsDraft        *bool     `json:"is_draft,omitempty"`         // likewise for \Draft
+	IsNewsletter   *bool     `json:"is_newsletter,omitempty"`    // if set, only match messages with (true) or without (false) List-Unsubscribe or List-Id headers
+	SamplePercent  int       `json:"sample_percent"`             // only act on this percentage of matches; 0 acts on all
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Destinations returns the folders a move rule sends mail to, in order of
+// preference: MoveToFolder, then the fallbacks. Sharing a rule between
+// accounts whose folders are named differently only needs one rule.
+func (r *Rule) Destinations() []string {
+	folders := make([]string, 0, 1+len(r.Fallbacks))
+	folders = append(folders, r.MoveToFolder)
+	for _, f := range r.Fallbacks {
+		if f != "" {
+			folders = append(folders, f)
+		}
+	}
+	return folders
+}
+
+// Patterns returns the alternatives listed in the rule's pattern, which
+// matches a message if any of them does. Alternatives are separated by
+// newlines, and for from_domain and keyword patterns also by commas, which
+// never appear in domains or keywords. Subjects, and the display names
+// sender and reply_to patterns can match ("Smith, John"), may contain
+// commas. Spaces around each alternative are trimmed. A pattern without
+// separators is a single alternative used exactly as given.
+func (r *Rule) Patterns() []string {
+	separators := "\n"
+	if r.PatternType == "from_domain" || r.PatternType == "keyword" {
+		separators = "\n,"
+	}
+	if !strings.ContainsAny(r.Pattern, separators) {
+		return []string{r.Pattern}
+	}
+
+	var patterns []string
+	for _, p := range strings.FieldsFunc(r.Pattern, func(c rune) bool { return strings.ContainsRune(separators, c) }) {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// Samples reports whether the message with the given UID is in the part of
+// the rule's matches it acts on. Selection hashes the rule ID and UID rather
+// than drawing at random, so each run of a rule picks the same messages and
+// different rules pick different ones.
+func (r *Rule) Samples(uid uint32) bool {
+	if r.SamplePercent <= 0 || r.SamplePercent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%d", r.ID, uid)
+	return int(h.Sum32()%100) < r.SamplePercent
+}
+
+// Rule actions
+const (
+	ActionMove    = "move"
+	ActionArchive = "archive"
+)
+
+// OptionalBool is a patch field for a condition that can be unset. Set
+// reports whether the field was given at all; a JSON null gives it with a nil
+// Value, unsetting the condition.
+type OptionalBool struct {
+	Set   bool
+	Value *bool
+}
+
+// UnmarshalJSON records that the field was given, with a nil Value for null
+func (o *OptionalBool) UnmarshalJSON(data []byte) error {
+	o.Set, o.Value = true, nil
+	if string(data) == "null" {
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// RulePatch is a partial rule update. Only non-nil fields, and optional ones
+// that are set, are changed.
+type RulePatch struct {
+	Name           *string      `json:"name"`
+	Pattern        *string      `json:"pattern"`
+	PatternType    *string      `json:"pattern_type"`
+	MoveToFolder   *string      `json:"move_to_folder"`
+	Action         *string      `json:"action"`
+	Enabled        *bool        `json:"enabled"`
+	Priority       *int         `json:"priority"`
+	UnreadOnly     *bool        `json:"unread_only"`
+	OlderThanDays  *int         `json:"older_than_days"`
+	ExcludeKeyword *string      `json:"exclude_keyword"`
+	Fallbacks      *[]string    `json:"fallback_folders"`
+	IsFlagged      OptionalBool `json:"is_flagged"`
+	IsAnswered     OptionalBool `json:"is_answered"`
+	IsDraft        OptionalBool `json:"is_draft"`
+	IsNewsletter   OptionalBool `json:"is_newsletter"`
+	SamplePercent  *int         `json:"sample_percent"`
+}
+
+// Apply sets the fields given in the patch on rule
+func (p *RulePatch) Apply(rule *Rule) {
+	setIfPresent(&rule.Name, p.Name)
+	setIfPresent(&rule.Pattern, p.Pattern)
+	setIfPresent(&rule.PatternType, p.PatternType)
+	setIfPresent(&rule.MoveToFolder, p.MoveToFolder)
+	setIfPresent(&rule.Action, p.Action)
+	setIfPresent(&rule.Enabled, p.Enabled)
+	setIfPresent(&rule.Priority, p.Priority)
+	setIfPresent(&rule.UnreadOnly, p.UnreadOnly)
+	setIfPresent(&rule.OlderThanDays, p.OlderThanDays)
+	setIfPresent(&rule.ExcludeKeyword, p.ExcludeKeyword)
+	setIfPresent(&rule.Fallbacks, p.Fallbacks)
+	setIfPresent(&rule.SamplePercent, p.SamplePercent)
+	setIfGiven(&rule.IsFlagged, p.IsFlagged)
+	setIfGiven(&rule.IsAnswered, p.IsAnswered)
+	setIfGiven(&rule.IsDraft, p.IsDraft)
+	setIfGiven(&rule.IsNewsletter, p.IsNewsletter)
+}
+
+// setIfGiven sets dst to the value of an optional patch field that was given,
+// which may be nil
+func setIfGiven(dst **bool, value OptionalBool) {
+	if value.Set {
+		*dst = value.Value
+	}
+}
+
+// RuleWithAccount is a Rule annotated with the name of its account, used for
+// cross-account rule listings
+type RuleWithAccount struct {
+	Rule
+	AccountName string `json:"account_name"`
+}
+
+// ApplyRun records the progress of applying rules to a folder, so that an
+// apply interrupted by a crash or shutdown can be resumed. Messages are moved
+// newest first, so every matching message with a UID of LastUID or above has
+// been dealt with. A run is in progress until FinishedAt is set.
+type ApplyRun struct {
+	ID          int64      `json:"id"`
+	AccountID   int64      `json:"account_id"`
+	Folder      string     `json:"folder"`
+	UIDValidity uint32     `json:"uid_validity"` // of the folder when the first message was moved
+	LastUID     uint32     `json:"last_uid"`     // the last message moved, 0 if none yet
+	Moved       int        `json:"moved"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// BackupVersion is the version of the Backup format written by this release
+const BackupVersion = 1
+
+// Backup is a portable copy of all accounts and their rules
+type Backup struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported_at"`
+	Accounts   []BackupAccount `json:"accounts"`
+}
+
+// BackupAccount is an account with its rules. IDs are informational: on
+// import, accounts get new IDs and rules belong to the account they are
+// listed under.
+type BackupAccount struct {
+	Account
+	Rules []Rule `json:"rules"`
 }
 
 // Message represents an email message for preview
@@ -65,25 +374,104 @@ type Message struct {
 	SeqNum      uint32    `json:"seq_num"`
 	From        string    `json:"from"`
 	To          string    `json:"to"`
+	ReplyTo     string    `json:"reply_to,omitempty"`
+	Newsletter  bool      `json:"newsletter,omitempty"` // has a List-Unsubscribe or List-Id header
 	Subject     string    `json:"subject"`
 	Date        time.Time `json:"date"`
 	Flags       []string  `json:"flags"`
 	MatchedRule *Rule     `json:"matched_rule,omitempty"`
+
+	// AlreadyInTarget is set when the matched rule moves messages to the
+	// folder this one is already in, so applying leaves it alone
+	AlreadyInTarget bool `json:"already_in_target,omitempty"`
+
+	// SampledOut is set when the matched rule has a sample_percent and this
+	// message isn't in the sample, so applying leaves it alone
+	SampledOut bool `json:"sampled_out,omitempty"`
 }
 
 // PreviewResult represents the result of applying rules to messages
 type PreviewResult struct {
-	TotalMessages   int           `json:"total_messages"`
-	MatchedMessages int           `json:"matched_messages"`
-	Messages        []Message     `json:"messages"`
-	RuleMatches     map[int64]int `json:"rule_matches"` // rule_id -> match count
+	TotalMessages   int            `json:"total_messages"`
+	UIDValidity     uint32         `json:"uid_validity,omitempty"` // of the previewed folder, for passing back to apply
+	MatchedMessages int            `json:"matched_messages"`
+	Messages        []Message      `json:"messages"`
+	RuleMatches     map[int64]int  `json:"rule_matches"`              // rule_id -> match count
+	Remaining       int            `json:"remaining,omitempty"`       // matches not moved because of the apply limit
+	CreatedFolders  []string       `json:"created_folders,omitempty"` // destination folders created by apply
+	FolderDeltas    map[string]int `json:"folder_deltas,omitempty"`   // folder -> change in message count caused by apply
+	SampledOut      int            `json:"sampled_out,omitempty"`     // matches left alone by their rule's sample_percent
+	Warning         string         `json:"warning,omitempty"`
+
+	// Set when previewing a page of a snapshot: the token for requesting
+	// further pages, the number of messages in the snapshot and the offset
+	// of the next page, 0 on the last one
+	Snapshot      string `json:"snapshot,omitempty"`
+	SnapshotTotal int    `json:"snapshot_total,omitempty"`
+	NextOffset    int    `json:"next_offset,omitempty"`
+}
+
+// WarningNoEnabledRules is the result warning when there were no enabled
+// rules to match messages against
+const WarningNoEnabledRules = "no enabled rules"
+
+// FolderResults combines the results of previewing or applying rules across
+// several folders
+type FolderResults struct {
+	TotalMessages   int                       `json:"total_messages"`
+	MatchedMessages int                       `json:"matched_messages"`
+	RuleMatches     map[int64]int             `json:"rule_matches"` // rule_id -> match count over all folders
+	Folders         map[string]*PreviewResult `json:"folders"`
+	Remaining       int                       `json:"remaining,omitempty"`
+	CreatedFolders  []string                  `json:"created_folders,omitempty"`
+	FolderDeltas    map[string]int            `json:"folder_deltas,omitempty"` // summed over the folders applied to
+	SampledOut      int                       `json:"sampled_out,omitempty"`
+	Warning         string                    `json:"warning,omitempty"`
+}
+
+// Add records the result for one folder and adds it to the totals
+func (r *FolderResults) Add(folder string, result *PreviewResult) {
+	if r.Folders == nil {
+		r.Folders = make(map[string]*PreviewResult)
+	}
+	if r.RuleMatches == nil {
+		r.RuleMatches = make(map[int64]int)
+	}
+	r.Folders[folder] = result
+	r.TotalMessages += result.TotalMessages
+	r.MatchedMessages += result.MatchedMessages
+	r.Remaining += result.Remaining
+	r.SampledOut += result.SampledOut
+	r.CreatedFolders = append(r.CreatedFolders, result.CreatedFolders...)
+	for id, n := range result.RuleMatches {
+		r.RuleMatches[id] += n
+	}
+	for name, n := range result.FolderDeltas {
+		if r.FolderDeltas == nil {
+			r.FolderDeltas = make(map[string]int)
+		}
+		r.FolderDeltas[name] += n
+	}
 }
 
 // Folder represents an IMAP folder/mailbox
 type Folder struct {
-	Name       string   `json:"name"`
-	Delimiter  string   `json:"delimiter"`
-	Attributes []string `json:"attributes"`
+	Name       string        `json:"name"`
+	Delimiter  string        `json:"delimiter"`
+	Attributes []string      `json:"attributes"`
+	Status     *FolderStatus `json:"status,omitempty"` // only set when requested
+}
+
+// FolderStatus holds a folder's message counts as reported by STATUS
+type FolderStatus struct {
+	Messages int `json:"messages"`
+	Unseen   int `json:"unseen"`
+}
+
+// SenderCount is the number of messages from a single sender address
+type SenderCount struct {
+	Address string `json:"address"`
+	Count   int    `json:"count"`
 }
 
 // ConnectionStatus represents the status of an IMAP connection test
@@ -92,33 +480,227 @@ type ConnectionStatus struct {
 	Message     string   `json:"message"`
 	Folders     []Folder `json:"folders,omitempty"`
 	TotalEmails int      `json:"total_emails,omitempty"`
+
+	// Capabilities the server advertises, sorted, to show e.g. whether MOVE
+	// is available
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Time in milliseconds taken to connect, log in and list folders
+	ConnectMs int64 `json:"connect_ms"`
+	LoginMs   int64 `json:"login_ms"`
+	ListMs    int64 `json:"list_ms"`
+}
+
+// QuotaResource is the usage and limit of a single quota resource
+type QuotaResource struct {
+	Usage uint32 `json:"usage"`
+	Limit uint32 `json:"limit"`
+}
+
+// Quota represents an account's quota as reported by the QUOTA extension.
+// Storage is measured in units of 1024 octets.
+type Quota struct {
+	Supported bool           `json:"supported"`
+	Root      string         `json:"root,omitempty"`
+	Storage   *QuotaResource `json:"storage,omitempty"`
+	Message   *QuotaResource `json:"message,omitempty"`
+}
+
+// Unsubscribe describes how to unsubscribe from the mailing list that sent a
+// message, from its List-Unsubscribe header (RFC 2369). OneClick is set when
+// the sender also supports unsubscribing with a single POST to the first
+// HTTPS URL (RFC 8058).
+type Unsubscribe struct {
+	UID      uint32   `json:"uid"`
+	URLs     []string `json:"urls,omitempty"`   // http and https links, in the sender's order of preference
+	Mailto   []string `json:"mailto,omitempty"` // mailto: URIs, which may carry a subject and body
+	OneClick bool     `json:"one_click"`
 }
 
+// MailboxSize is the total size of a folder's messages, the most space a
+// cleanup of it could reclaim. Estimated is set when Bytes was extrapolated
+// from the sizes of Sampled messages.
+type MailboxSize struct {
+	Folder    string `json:"folder"`
+	Bytes     int64  `json:"bytes"`
+	Messages  int    `json:"messages"`
+	Estimated bool   `json:"estimated,omitempty"`
+	Sampled   int    `json:"sampled,omitempty"`
+}
+
+// now is the clock used for age-based rule conditions; tests replace it
+var now = time.Now
+
 // MatchesRule checks if a message matches a given rule based on the rule's pattern type.
-// All pattern matching is case-insensitive.
+// All pattern matching is case-insensitive. Rules marked UnreadOnly never match
+// messages that have been read, rules with OlderThanDays set only match
+// messages dated more than that many days ago, rules with ExcludeKeyword
+// set never match messages tagged with it, and rules with flag conditions
+// only match messages whose flags meet them.
 func (m *Message) MatchesRule(rule *Rule) bool {
-	pattern := strings.ToLower(rule.Pattern)
+	matched, _ := m.MatchesRuleWithReason(rule)
+	return matched
+}
 
-	switch rule.PatternType {
-	case "sender", "":
-		return strings.Contains(strings.ToLower(m.From), pattern)
+// MatchesRuleWithReason is like MatchesRule, but also describes why the rule
+// matched, e.g. `sender "news@example.com" contains "news"`, followed by the
+// extra conditions the message met. For a pattern listing alternatives, the
+// reason names the first one that matched. The reason is empty if it doesn't
+// match.
+func (m *Message) MatchesRuleWithReason(rule *Rule) (bool, string) {
+	if rule.UnreadOnly && m.HasFlag(SeenFlag) {
+		return false, ""
+	}
+	if rule.OlderThanDays > 0 && !m.OlderThan(rule.OlderThanDays) {
+		return false, ""
+	}
+	if rule.ExcludeKeyword != "" && m.HasFlag(rule.ExcludeKeyword) {
+		return false, ""
+	}
+	for _, c := range rule.FlagConditions() {
+		if m.HasFlag(c.Flag) != c.Want {
+			return false, ""
+		}
+	}
+	if rule.IsNewsletter != nil && m.Newsletter != *rule.IsNewsletter {
+		return false, ""
+	}
+
+	var reason string
+	for _, pattern := range rule.Patterns() {
+		if r, ok := m.matchesPattern(rule.PatternType, pattern); ok {
+			reason = r
+			break
+		}
+	}
+	if reason == "" {
+		return false, ""
+	}
+
+	if rule.UnreadOnly {
+		reason += ", unread"
+	}
+	if rule.OlderThanDays > 0 {
+		reason += fmt.Sprintf(", older than %d days", rule.OlderThanDays)
+	}
+	for _, c := range rule.FlagConditions() {
+		if c.Want {
+			reason += ", " + c.Name
+		} else {
+			reason += ", not " + c.Name
+		}
+	}
+	if rule.IsNewsletter != nil {
+		if *rule.IsNewsletter {
+			reason += ", newsletter"
+		} else {
+			reason += ", not a newsletter"
+		}
+	}
+	return true, reason
+}
+
+// matchesPattern reports whether a single pattern of the given type matches
+// the message, and if so describes why
+func (m *Message) matchesPattern(patternType, pattern string) (string, bool) {
+	lower := strings.ToLower(pattern)
+
+	switch patternType {
 	case "subject":
-		return strings.Contains(strings.ToLower(m.Subject), pattern)
+		if !strings.Contains(strings.ToLower(m.Subject), lower) {
+			return "", false
+		}
+		return fmt.Sprintf("subject %q contains %q", m.Subject, pattern), true
 	case "from_domain":
-		return matchesDomain(m.From, pattern)
-	default:
-		return strings.Contains(strings.ToLower(m.From), pattern)
+		domain, ok := senderDomain(m.From)
+		if !ok || !strings.Contains(domain, lower) {
+			return "", false
+		}
+		return fmt.Sprintf("sender domain %q contains %q", domain, pattern), true
+	case "reply_to":
+		if m.ReplyTo == "" || !strings.Contains(strings.ToLower(m.ReplyTo), lower) {
+			return "", false
+		}
+		return fmt.Sprintf("reply-to %q contains %q", m.ReplyTo, pattern), true
+	case "keyword":
+		if !m.HasFlag(pattern) {
+			return "", false
+		}
+		return fmt.Sprintf("message has keyword %q", pattern), true
+	default: // "sender", and unknown types for backward compatibility
+		if !strings.Contains(strings.ToLower(m.From), lower) {
+			return "", false
+		}
+		return fmt.Sprintf("sender %q contains %q", m.From, pattern), true
+	}
+}
+
+// OlderThan reports whether the message is dated more than days days ago.
+// Messages without a date are never considered old.
+func (m *Message) OlderThan(days int) bool {
+	if m.Date.IsZero() {
+		return false
 	}
+	return m.Date.Before(now().AddDate(0, 0, -days))
+}
+
+// ProcessedKeyword is the IMAP keyword applying rules tags messages with when
+// asked to, so later runs skip them
+const ProcessedKeyword = "$MailcleanerDone"
+
+// SeenFlag is the IMAP flag set on messages that have been read
+const SeenFlag = `\Seen`
+
+// IMAP flags rules can require or exclude, see Rule.FlagConditions
+const (
+	FlaggedFlag  = `\Flagged`
+	AnsweredFlag = `\Answered`
+	DraftFlag    = `\Draft`
+)
+
+// FlagCondition requires a message to have, or not have, a flag
+type FlagCondition struct {
+	Flag string
+	Name string // e.g. "flagged", used in match reasons
+	Want bool
 }
 
-// matchesDomain extracts the domain from an email address and checks if it contains the pattern
-func matchesDomain(from, pattern string) bool {
+// FlagConditions returns the rule's flag conditions that are set
+func (r *Rule) FlagConditions() []FlagCondition {
+	var conditions []FlagCondition
+	for _, c := range []struct {
+		flag, name string
+		want       *bool
+	}{
+		{FlaggedFlag, "flagged", r.IsFlagged},
+		{AnsweredFlag, "answered", r.IsAnswered},
+		{DraftFlag, "draft", r.IsDraft},
+	} {
+		if c.want != nil {
+			conditions = append(conditions, FlagCondition{Flag: c.flag, Name: c.name, Want: *c.want})
+		}
+	}
+	return conditions
+}
+
+// HasFlag reports whether the message has the given flag. System flags are
+// compared case-insensitively, as IMAP requires.
+func (m *Message) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// senderDomain returns the lowercased domain of an email address
+func senderDomain(from string) (string, bool) {
 	fromLower := strings.ToLower(from)
 	if idx := strings.LastIndex(fromLower, "@"); idx != -1 {
 		domain := fromLower[idx+1:]
 		// Remove trailing > if present (e.g., "user@domain.com>")
-		domain = strings.TrimSuffix(domain, ">")
-		return strings.Contains(domain, pattern)
+		return strings.TrimSuffix(domain, ">"), true
 	}
-	return false
+	return "", false
 }
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MinSuggestionCount is how many messages a sender without an automated-looking
+// address needs before a rule is suggested for it
+const MinSuggestionCount = 10
+
+// MaxSuggestions caps the number of rule suggestions returned
+const MaxSuggestions = 20
+
+// RuleSuggestion is an unsaved rule draft proposed from sender frequency
+type RuleSuggestion struct {
+	Name         string `json:"name"`
+	Pattern      string `json:"pattern"`
+	PatternType  string `json:"pattern_type"`
+	MoveToFolder string `json:"move_to_folder"`
+	MessageCount int    `json:"message_count"`
+}
+
+// automatedPrefixes maps local-part prefixes of automated senders to the
+// folder their mail is suggested to go to. An empty folder means the folder
+// is named after the sender's domain.
+var automatedPrefixes = []struct {
+	prefix string
+	folder string
+}{
+	{"newsletter", "Newsletters"},
+	{"news", "Newsletters"},
+	{"digest", "Newsletters"},
+	{"marketing", "Newsletters"},
+	{"notification", "Notifications"},
+	{"notify", "Notifications"},
+	{"alert", "Notifications"},
+	{"noreply", ""},
+	{"no-reply", ""},
+	{"donotreply", ""},
+	{"do-not-reply", ""},
+}
+
+// SuggestRules proposes rules for the given senders, which are expected to be
+// ordered most frequent first. Senders whose mail an enabled rule already
+// matches are skipped. Automated-looking senders are always suggested; others
+// only once they reach MinSuggestionCount messages.
+func SuggestRules(senders []SenderCount, existing []Rule) []RuleSuggestion {
+	suggestions := []RuleSuggestion{}
+	for _, sender := range senders {
+		if len(suggestions) == MaxSuggestions {
+			break
+		}
+
+		local, domain, ok := strings.Cut(sender.Address, "@")
+		if !ok || local == "" || domain == "" || coveredByRules(sender.Address, existing) {
+			continue
+		}
+
+		folder, automated := automatedFolder(local)
+		if !automated && sender.Count < MinSuggestionCount {
+			continue
+		}
+		if folder == "" {
+			folder = domainFolder(domain)
+		}
+
+		suggestions = append(suggestions, RuleSuggestion{
+			Name:         fmt.Sprintf("Mail from %s", sender.Address),
+			Pattern:      sender.Address,
+			PatternType:  "sender",
+			MoveToFolder: folder,
+			MessageCount: sender.Count,
+		})
+	}
+	return suggestions
+}
+
+// coveredByRules reports whether an enabled rule already matches mail from address
+func coveredByRules(address string, rules []Rule) bool {
+	msg := Message{From: address}
+	for i := range rules {
+		if rules[i].Enabled && msg.MatchesRule(&rules[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// automatedFolder returns the suggested folder for an automated-looking local
+// part, and whether it looked automated at all
+func automatedFolder(local string) (string, bool) {
+	local = strings.ToLower(local)
+	for _, p := range automatedPrefixes {
+		if strings.HasPrefix(local, p.prefix) {
+			return p.folder, true
+		}
+	}
+	return "", false
+}
+
+// domainFolder names a folder after the registrable part of a domain, e.g.
+// "notifications.github.com" becomes "Github"
+func domainFolder(domain string) string {
+	labels := strings.Split(domain, ".")
+	name := labels[0]
+	if len(labels) >= 2 {
+		name = labels[len(labels)-2]
+	}
+	if name == "" {
+		return domain
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,75 @@
+package models
+
+import "testing"
+
+func TestSuggestRules(t *testing.T) {
+	senders := []SenderCount{
+		{Address: "boss@company.com", Count: 40},
+		{Address: "noreply@github.com", Count: 25},
+		{Address: "newsletter@shop.example.com", Count: 12},
+		{Address: "notifications@linear.app", Count: 3},
+		{Address: "friend@example.com", Count: 2},
+	}
+
+	suggestions := SuggestRules(senders, nil)
+
+	expected := []RuleSuggestion{
+		{Name: "Mail from boss@company.com", Pattern: "boss@company.com", PatternType: "sender", MoveToFolder: "Company", MessageCount: 40},
+		{Name: "Mail from noreply@github.com", Pattern: "noreply@github.com", PatternType: "sender", MoveToFolder: "Github", MessageCount: 25},
+		{Name: "Mail from newsletter@shop.example.com", Pattern: "newsletter@shop.example.com", PatternType: "sender", MoveToFolder: "Newsletters", MessageCount: 12},
+		{Name: "Mail from notifications@linear.app", Pattern: "notifications@linear.app", PatternType: "sender", MoveToFolder: "Notifications", MessageCount: 3},
+	}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("Expected %d suggestions, got %d: %+v", len(expected), len(suggestions), suggestions)
+	}
+	for i, want := range expected {
+		if suggestions[i] != want {
+			t.Errorf("Suggestion %d: expected %+v, got %+v", i, want, suggestions[i])
+		}
+	}
+}
+
+func TestSuggestRulesSkipsCoveredSenders(t *testing.T) {
+	senders := []SenderCount{
+		{Address: "noreply@github.com", Count: 25},
+		{Address: "newsletter@example.com", Count: 5},
+	}
+	existing := []Rule{
+		{Pattern: "github.com", PatternType: "from_domain", Enabled: true},
+		{Pattern: "newsletter@", PatternType: "sender", Enabled: false},
+	}
+
+	suggestions := SuggestRules(senders, existing)
+
+	if len(suggestions) != 1 || suggestions[0].Pattern != "newsletter@example.com" {
+		t.Errorf("Expected only the sender not covered by an enabled rule, got %+v", suggestions)
+	}
+}
+
+func TestSuggestRulesLimit(t *testing.T) {
+	var senders []SenderCount
+	for i := 0; i < MaxSuggestions+5; i++ {
+		senders = append(senders, SenderCount{Address: "noreply@example.com", Count: 1})
+	}
+
+	if got := len(SuggestRules(senders, nil)); got != MaxSuggestions {
+		t.Errorf("Expected %d suggestions, got %d", MaxSuggestions, got)
+	}
+}
+
+func TestDomainFolder(t *testing.T) {
+	tests := []struct {
+		domain   string
+		expected string
+	}{
+		{"github.com", "Github"},
+		{"notifications.github.com", "Github"},
+		{"localhost", "Localhost"},
+	}
+
+	for _, tt := range tests {
+		if got := domainFolder(tt.domain); got != tt.expected {
+			t.Errorf("domainFolder(%q) = %q, want %q", tt.domain, got, tt.expected)
+		}
+	}
+}
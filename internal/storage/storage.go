@@ -3,28 +3,47 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 
 	"github.com/mailcleaner/mailcleaner/internal/models"
 )
 
+// maxOpenConns bounds the connection pool. SQLite serializes writers anyway,
+// so a few connections are enough for concurrent reads, and keeping them all
+// idle lets prepared statements be reused instead of re-prepared.
+const maxOpenConns = 4
+
+// ErrForeignKey is returned when a write references a row that doesn't exist,
+// such as a rule for a deleted account
+var ErrForeignKey = errors.New("foreign key constraint failed")
+
 // Store handles all database operations
 type Store struct {
 	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt // prepared statements by query, see prepare
 }
 
 // New creates a new Store with the given database path
 func New(dbPath string) (*Store, error) {
-	// Enable foreign keys with connection string parameter
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	// Enable foreign keys with connection string parameter, and wait for locks
+	// held by other processes (e.g. the CLI running against the same database)
+	// instead of failing immediately
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
 
-	store := &Store{db: db}
+	store := &Store{db: db, stmts: make(map[string]*sql.Stmt)}
 	if err := store.migrate(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("migrating database: %w", err)
@@ -33,11 +52,65 @@ func New(dbPath string) (*Store, error) {
 	return store, nil
 }
 
-// Close closes the database connection
+// Close closes the prepared statements and the database connection
 func (s *Store) Close() error {
+	s.mu.Lock()
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = nil
+	s.mu.Unlock()
+
 	return s.db.Close()
 }
 
+// prepare returns a prepared statement for query, preparing it on first use.
+// Queries are constant strings, so the cache stays small.
+func (s *Store) prepare(query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	if s.stmts == nil {
+		return nil, errors.New("store is closed")
+	}
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (s *Store) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+func (s *Store) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+// queryRow is like sql.DB.QueryRow using a prepared statement. If preparing
+// fails, the query is run unprepared so the error surfaces from Scan.
+func (s *Store) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return s.db.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
 func (s *Store) migrate() error {
 	migrations := []string{
 		`CREATE TABLE IF NOT EXISTS accounts (
@@ -66,6 +139,19 @@ func (s *Store) migrate() error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_rules_account_id ON rules(account_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_rules_priority ON rules(priority)`,
+		`CREATE TABLE IF NOT EXISTS apply_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			account_id INTEGER NOT NULL,
+			folder TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL DEFAULT 0,
+			last_uid INTEGER NOT NULL DEFAULT 0,
+			moved INTEGER NOT NULL DEFAULT 0,
+			started_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			finished_at DATETIME,
+			FOREIGN KEY (account_id) REFERENCES accounts(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_apply_runs_account_id ON apply_runs(account_id)`,
 	}
 
 	for _, m := range migrations {
@@ -74,19 +160,117 @@ func (s *Store) migrate() error {
 		}
 	}
 
+	// Columns added after the initial schema. SQLite has no
+	// ADD COLUMN IF NOT EXISTS, so each one is checked first.
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"accounts", "fetch_concurrency", "INTEGER NOT NULL DEFAULT 1"},
+		{"accounts", "last_verified_at", "DATETIME"},
+		{"accounts", "last_verify_status", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "compress", "INTEGER NOT NULL DEFAULT 0"},
+		{"accounts", "proxy_url", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "enabled", "INTEGER NOT NULL DEFAULT 1"},
+		{"accounts", "scan_window_days", "INTEGER NOT NULL DEFAULT 0"},
+		{"accounts", "inbox_name", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "allowed_destinations", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "command_timeout_seconds", "INTEGER NOT NULL DEFAULT 0"},
+		{"rules", "unread_only", "INTEGER NOT NULL DEFAULT 0"},
+		{"rules", "older_than_days", "INTEGER NOT NULL DEFAULT 0"},
+		{"rules", "action", "TEXT NOT NULL DEFAULT 'move'"},
+		{"rules", "exclude_keyword", "TEXT NOT NULL DEFAULT ''"},
+		{"rules", "fallback_folders", "TEXT NOT NULL DEFAULT ''"},
+		{"rules", "is_flagged", "INTEGER"},
+		{"rules", "is_answered", "INTEGER"},
+		{"rules", "is_draft", "INTEGER"},
+		{"rules", "sample_percent", "INTEGER NOT NULL DEFAULT 0"},
+		{"rules", "is_newsletter", "INTEGER"},
+	}
+
+	for _, c := range columns {
+		if err := s.addColumnIfMissing(c.table, c.name, c.definition); err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+
 	return nil
 }
 
+func (s *Store) addColumnIfMissing(table, column, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
 // Account Operations
 
+const accountColumns = `id, name, server, port, username, password, tls, fetch_concurrency, compress,
+	proxy_url, scan_window_days, inbox_name, command_timeout_seconds, allowed_destinations, enabled, last_verified_at,
+	last_verify_status, created_at, updated_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAccount scans a row selected with accountColumns
+func scanAccount(row rowScanner) (*models.Account, error) {
+	account := &models.Account{}
+	var tls, compress, enabled int
+	var allowed string
+	var lastVerified sql.NullTime
+	if err := row.Scan(&account.ID, &account.Name, &account.Server, &account.Port,
+		&account.Username, &account.Password, &tls, &account.FetchConcurrency, &compress,
+		&account.ProxyURL, &account.ScanWindowDays, &account.InboxName, &account.CommandTimeoutSeconds, &allowed, &enabled,
+		&lastVerified, &account.LastVerifyStatus, &account.CreatedAt, &account.UpdatedAt); err != nil {
+		return nil, err
+	}
+	account.TLS = intToBool(tls)
+	account.Compress = intToBool(compress)
+	account.AllowedDestinations = splitFolders(allowed)
+	account.Enabled = intToBool(enabled)
+	if lastVerified.Valid {
+		account.LastVerifiedAt = &lastVerified.Time
+	}
+	return account, nil
+}
+
 // CreateAccount creates a new account
 func (s *Store) CreateAccount(account *models.Account) error {
 	now := time.Now()
-	result, err := s.db.Exec(
-		`INSERT INTO accounts (name, server, port, username, password, tls, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	result, err := s.exec(
+		`INSERT INTO accounts (name, server, port, username, password, tls, fetch_concurrency, compress, proxy_url,
+		 scan_window_days, inbox_name, command_timeout_seconds, allowed_destinations, enabled, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		account.Name, account.Server, account.Port, account.Username, account.Password,
-		boolToInt(account.TLS), now, now,
+		boolToInt(account.TLS), account.FetchConcurrency, boolToInt(account.Compress), account.ProxyURL,
+		account.ScanWindowDays, account.InboxName, account.CommandTimeoutSeconds, joinFolders(account.AllowedDestinations), boolToInt(account.Enabled),
+		now, now,
 	)
 	if err != nil {
 		return fmt.Errorf("inserting account: %w", err)
@@ -105,29 +289,22 @@ func (s *Store) CreateAccount(account *models.Account) error {
 
 // GetAccount retrieves an account by ID
 func (s *Store) GetAccount(id int64) (*models.Account, error) {
-	account := &models.Account{}
-	var tls int
-	err := s.db.QueryRow(
-		`SELECT id, name, server, port, username, password, tls, created_at, updated_at
-		 FROM accounts WHERE id = ?`, id,
-	).Scan(&account.ID, &account.Name, &account.Server, &account.Port,
-		&account.Username, &account.Password, &tls,
-		&account.CreatedAt, &account.UpdatedAt)
+	account, err := scanAccount(s.queryRow(
+		`SELECT `+accountColumns+` FROM accounts WHERE id = ?`, id,
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("querying account: %w", err)
 	}
-	account.TLS = intToBool(tls)
 	return account, nil
 }
 
 // ListAccounts returns all accounts
 func (s *Store) ListAccounts() ([]models.Account, error) {
-	rows, err := s.db.Query(
-		`SELECT id, name, server, port, username, password, tls, created_at, updated_at
-		 FROM accounts ORDER BY name`,
+	rows, err := s.query(
+		`SELECT ` + accountColumns + ` FROM accounts ORDER BY name`,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("querying accounts: %w", err)
@@ -136,27 +313,58 @@ func (s *Store) ListAccounts() ([]models.Account, error) {
 
 	var accounts []models.Account
 	for rows.Next() {
-		var account models.Account
-		var tls int
-		if err := rows.Scan(&account.ID, &account.Name, &account.Server, &account.Port,
-			&account.Username, &account.Password, &tls,
-			&account.CreatedAt, &account.UpdatedAt); err != nil {
+		account, err := scanAccount(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scanning account: %w", err)
 		}
-		account.TLS = intToBool(tls)
-		accounts = append(accounts, account)
+		accounts = append(accounts, *account)
 	}
 	return accounts, rows.Err()
 }
 
+// ListAccountsPage returns up to limit accounts with an ID greater than
+// afterID, ordered by ID. The returned cursor is the ID to pass as afterID for
+// the next page, or 0 when there are no more accounts.
+func (s *Store) ListAccountsPage(afterID int64, limit int) ([]models.Account, int64, error) {
+	// Fetch one extra row to know whether another page follows
+	rows, err := s.query(
+		`SELECT `+accountColumns+` FROM accounts WHERE id > ? ORDER BY id LIMIT ?`,
+		afterID, limit+1,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []models.Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scanning account: %w", err)
+		}
+		accounts = append(accounts, *account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(accounts) <= limit {
+		return accounts, 0, nil
+	}
+	accounts = accounts[:limit]
+	return accounts, accounts[limit-1].ID, nil
+}
+
 // UpdateAccount updates an existing account
 func (s *Store) UpdateAccount(account *models.Account) error {
 	account.UpdatedAt = time.Now()
-	_, err := s.db.Exec(
-		`UPDATE accounts SET name = ?, server = ?, port = ?, username = ?, password = ?, tls = ?, updated_at = ?
-		 WHERE id = ?`,
+	_, err := s.exec(
+		`UPDATE accounts SET name = ?, server = ?, port = ?, username = ?, password = ?, tls = ?,
+		 fetch_concurrency = ?, compress = ?, proxy_url = ?, scan_window_days = ?, inbox_name = ?,
+		 command_timeout_seconds = ?, allowed_destinations = ?, enabled = ?, updated_at = ? WHERE id = ?`,
 		account.Name, account.Server, account.Port, account.Username, account.Password,
-		boolToInt(account.TLS), account.UpdatedAt, account.ID,
+		boolToInt(account.TLS), account.FetchConcurrency, boolToInt(account.Compress), account.ProxyURL,
+		account.ScanWindowDays, account.InboxName, account.CommandTimeoutSeconds, joinFolders(account.AllowedDestinations), boolToInt(account.Enabled), account.UpdatedAt, account.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("updating account: %w", err)
@@ -164,27 +372,102 @@ func (s *Store) UpdateAccount(account *models.Account) error {
 	return nil
 }
 
-// DeleteAccount deletes an account and its associated rules
-func (s *Store) DeleteAccount(id int64) error {
-	_, err := s.db.Exec(`DELETE FROM accounts WHERE id = ?`, id)
+// PatchAccount updates only the fields set in patch
+func (s *Store) PatchAccount(id int64, patch *models.AccountPatch) error {
+	var u patchUpdate
+	u.setString("name", patch.Name)
+	u.setString("server", patch.Server)
+	u.setInt("port", patch.Port)
+	u.setString("username", patch.Username)
+	u.setString("password", patch.Password)
+	u.setBool("tls", patch.TLS)
+	u.setInt("fetch_concurrency", patch.FetchConcurrency)
+	u.setBool("compress", patch.Compress)
+	u.setString("proxy_url", patch.ProxyURL)
+	u.setInt("scan_window_days", patch.ScanWindowDays)
+	u.setString("inbox_name", patch.InboxName)
+	u.setInt("command_timeout_seconds", patch.CommandTimeoutSeconds)
+	if patch.AllowedDestinations != nil {
+		u.add("allowed_destinations", joinFolders(*patch.AllowedDestinations))
+	}
+	u.setBool("enabled", patch.Enabled)
+
+	if err := s.applyPatch("accounts", id, &u); err != nil {
+		return fmt.Errorf("patching account: %w", err)
+	}
+	return nil
+}
+
+// RecordAccountVerification stores the outcome of a connection test
+func (s *Store) RecordAccountVerification(id int64, at time.Time, status string) error {
+	_, err := s.exec(
+		`UPDATE accounts SET last_verified_at = ?, last_verify_status = ? WHERE id = ?`,
+		at, status, id,
+	)
 	if err != nil {
-		return fmt.Errorf("deleting account: %w", err)
+		return fmt.Errorf("recording account verification: %w", err)
 	}
 	return nil
 }
 
+// DeleteAccount deletes an account and its associated rules, returning the
+// number of accounts deleted
+func (s *Store) DeleteAccount(id int64) (int64, error) {
+	result, err := s.exec(`DELETE FROM accounts WHERE id = ?`, id)
+	if err != nil {
+		return 0, fmt.Errorf("deleting account: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 // Rule Operations
 
+// ruleColumns selects a rule from a query that aliases the rules table as r
+const ruleColumns = `r.id, r.account_id, r.name, r.pattern, r.pattern_type, r.move_to_folder, r.action,
+	r.enabled, r.priority, r.unread_only, r.older_than_days,
+	r.exclude_keyword, r.fallback_folders, r.is_flagged, r.is_answered, r.is_draft, r.is_newsletter, r.sample_percent,
+	r.created_at, r.updated_at`
+
+// scanRule scans a row selected with ruleColumns, followed by any extra
+// destinations for columns selected after them
+func scanRule(row rowScanner, extra ...interface{}) (*models.Rule, error) {
+	rule := &models.Rule{}
+	var enabled, unreadOnly int
+	var fallbacks string
+	var flagged, answered, draft, newsletter sql.NullBool
+	dest := []interface{}{&rule.ID, &rule.AccountID, &rule.Name, &rule.Pattern, &rule.PatternType,
+		&rule.MoveToFolder, &rule.Action, &enabled, &rule.Priority, &unreadOnly, &rule.OlderThanDays, &rule.ExcludeKeyword,
+		&fallbacks, &flagged, &answered, &draft, &newsletter, &rule.SamplePercent, &rule.CreatedAt, &rule.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	rule.Enabled = intToBool(enabled)
+	rule.UnreadOnly = intToBool(unreadOnly)
+	rule.Fallbacks = splitFolders(fallbacks)
+	rule.IsFlagged = nullBoolPtr(flagged)
+	rule.IsAnswered = nullBoolPtr(answered)
+	rule.IsDraft = nullBoolPtr(draft)
+	rule.IsNewsletter = nullBoolPtr(newsletter)
+	return rule, nil
+}
+
 // CreateRule creates a new rule
 func (s *Store) CreateRule(rule *models.Rule) error {
 	now := time.Now()
-	result, err := s.db.Exec(
-		`INSERT INTO rules (account_id, name, pattern, pattern_type, move_to_folder, enabled, priority, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		rule.AccountID, rule.Name, rule.Pattern, rule.PatternType, rule.MoveToFolder,
-		boolToInt(rule.Enabled), rule.Priority, now, now,
+	result, err := s.exec(
+		`INSERT INTO rules (account_id, name, pattern, pattern_type, move_to_folder, action, enabled, priority,
+		 unread_only, older_than_days, exclude_keyword, fallback_folders, is_flagged, is_answered, is_draft,
+		 is_newsletter, sample_percent, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.AccountID, rule.Name, rule.Pattern, rule.PatternType, rule.MoveToFolder, rule.Action,
+		boolToInt(rule.Enabled), rule.Priority, boolToInt(rule.UnreadOnly), rule.OlderThanDays, rule.ExcludeKeyword,
+		joinFolders(rule.Fallbacks), nullableBool(rule.IsFlagged), nullableBool(rule.IsAnswered), nullableBool(rule.IsDraft),
+		nullableBool(rule.IsNewsletter), rule.SamplePercent, now, now,
 	)
 	if err != nil {
+		if isForeignKeyError(err) {
+			return fmt.Errorf("inserting rule: %w", ErrForeignKey)
+		}
 		return fmt.Errorf("inserting rule: %w", err)
 	}
 
@@ -201,55 +484,80 @@ func (s *Store) CreateRule(rule *models.Rule) error {
 
 // GetRule retrieves a rule by ID
 func (s *Store) GetRule(id int64) (*models.Rule, error) {
-	rule := &models.Rule{}
-	var enabled int
-	err := s.db.QueryRow(
-		`SELECT id, account_id, name, pattern, pattern_type, move_to_folder, enabled, priority, created_at, updated_at
-		 FROM rules WHERE id = ?`, id,
-	).Scan(&rule.ID, &rule.AccountID, &rule.Name, &rule.Pattern, &rule.PatternType,
-		&rule.MoveToFolder, &enabled, &rule.Priority, &rule.CreatedAt, &rule.UpdatedAt)
+	rule, err := scanRule(s.queryRow(
+		`SELECT `+ruleColumns+` FROM rules r WHERE r.id = ?`, id,
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("querying rule: %w", err)
 	}
-	rule.Enabled = intToBool(enabled)
 	return rule, nil
 }
 
 // ListRules returns all rules for an account
 func (s *Store) ListRules(accountID int64) ([]models.Rule, error) {
-	rows, err := s.db.Query(
-		`SELECT id, account_id, name, pattern, pattern_type, move_to_folder, enabled, priority, created_at, updated_at
-		 FROM rules WHERE account_id = ? ORDER BY priority DESC, name`,
+	return s.queryRules(
+		`SELECT `+ruleColumns+` FROM rules r WHERE r.account_id = ? ORDER BY r.priority DESC, r.name`,
 		accountID,
 	)
+}
+
+// ListRulesPage returns up to limit rules for an account with an ID greater
+// than afterID, ordered by ID. The returned cursor is the ID to pass as afterID
+// for the next page, or 0 when there are no more rules.
+func (s *Store) ListRulesPage(accountID, afterID int64, limit int) ([]models.Rule, int64, error) {
+	// Fetch one extra row to know whether another page follows
+	rules, err := s.queryRules(
+		`SELECT `+ruleColumns+` FROM rules r WHERE r.account_id = ? AND r.id > ? ORDER BY r.id LIMIT ?`,
+		accountID, afterID, limit+1,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(rules) <= limit {
+		return rules, 0, nil
+	}
+	rules = rules[:limit]
+	return rules, rules[limit-1].ID, nil
+}
+
+// ListAllRules returns all rules across all accounts
+func (s *Store) ListAllRules() ([]models.Rule, error) {
+	return s.queryRules(
+		`SELECT ` + ruleColumns + ` FROM rules r ORDER BY r.account_id, r.priority DESC, r.name`,
+	)
+}
+
+// ListAllRulesWithAccount returns all rules across all accounts together with
+// the name of the account each belongs to
+func (s *Store) ListAllRulesWithAccount() ([]models.RuleWithAccount, error) {
+	rows, err := s.query(
+		`SELECT ` + ruleColumns + `, a.name FROM rules r
+		 JOIN accounts a ON a.id = r.account_id
+		 ORDER BY a.name, r.priority DESC, r.name`,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("querying rules: %w", err)
 	}
 	defer rows.Close()
 
-	var rules []models.Rule
+	var rules []models.RuleWithAccount
 	for rows.Next() {
-		var rule models.Rule
-		var enabled int
-		if err := rows.Scan(&rule.ID, &rule.AccountID, &rule.Name, &rule.Pattern, &rule.PatternType,
-			&rule.MoveToFolder, &enabled, &rule.Priority, &rule.CreatedAt, &rule.UpdatedAt); err != nil {
+		var accountName string
+		rule, err := scanRule(rows, &accountName)
+		if err != nil {
 			return nil, fmt.Errorf("scanning rule: %w", err)
 		}
-		rule.Enabled = intToBool(enabled)
-		rules = append(rules, rule)
+		rules = append(rules, models.RuleWithAccount{Rule: *rule, AccountName: accountName})
 	}
 	return rules, rows.Err()
 }
 
-// ListAllRules returns all rules across all accounts
-func (s *Store) ListAllRules() ([]models.Rule, error) {
-	rows, err := s.db.Query(
-		`SELECT id, account_id, name, pattern, pattern_type, move_to_folder, enabled, priority, created_at, updated_at
-		 FROM rules ORDER BY account_id, priority DESC, name`,
-	)
+func (s *Store) queryRules(query string, args ...interface{}) ([]models.Rule, error) {
+	rows, err := s.query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("querying rules: %w", err)
 	}
@@ -257,26 +565,69 @@ func (s *Store) ListAllRules() ([]models.Rule, error) {
 
 	var rules []models.Rule
 	for rows.Next() {
-		var rule models.Rule
-		var enabled int
-		if err := rows.Scan(&rule.ID, &rule.AccountID, &rule.Name, &rule.Pattern, &rule.PatternType,
-			&rule.MoveToFolder, &enabled, &rule.Priority, &rule.CreatedAt, &rule.UpdatedAt); err != nil {
+		rule, err := scanRule(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scanning rule: %w", err)
 		}
-		rule.Enabled = intToBool(enabled)
-		rules = append(rules, rule)
+		rules = append(rules, *rule)
 	}
 	return rules, rows.Err()
 }
 
+// FindDuplicateRule returns an enabled rule on the account with the same
+// pattern (case-insensitive), pattern type and destination folder, or nil if
+// there is none
+func (s *Store) FindDuplicateRule(accountID int64, pattern, patternType, folder string) (*models.Rule, error) {
+	rule, err := scanRule(s.queryRow(
+		`SELECT `+ruleColumns+` FROM rules r
+		 WHERE r.account_id = ? AND LOWER(r.pattern) = LOWER(?) AND r.pattern_type = ?
+		 AND r.move_to_folder = ? AND r.enabled = 1
+		 ORDER BY r.id LIMIT 1`,
+		accountID, pattern, patternType, folder,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying duplicate rule: %w", err)
+	}
+	return rule, nil
+}
+
+// CloneRule creates a disabled copy of a rule on the same account, named
+// "Copy of <name>". It returns nil if the rule doesn't exist.
+func (s *Store) CloneRule(id int64) (*models.Rule, error) {
+	rule, err := s.GetRule(id)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, nil
+	}
+
+	clone := *rule
+	clone.ID = 0
+	clone.Name = "Copy of " + rule.Name
+	clone.Enabled = false
+
+	if err := s.CreateRule(&clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
 // UpdateRule updates an existing rule
 func (s *Store) UpdateRule(rule *models.Rule) error {
 	rule.UpdatedAt = time.Now()
-	_, err := s.db.Exec(
+	_, err := s.exec(
 		`UPDATE rules SET account_id = ?, name = ?, pattern = ?, pattern_type = ?, move_to_folder = ?,
-		 enabled = ?, priority = ?, updated_at = ? WHERE id = ?`,
-		rule.AccountID, rule.Name, rule.Pattern, rule.PatternType, rule.MoveToFolder,
-		boolToInt(rule.Enabled), rule.Priority, rule.UpdatedAt, rule.ID,
+		 action = ?, enabled = ?, priority = ?, unread_only = ?, older_than_days = ?,
+		 exclude_keyword = ?, fallback_folders = ?, is_flagged = ?, is_answered = ?, is_draft = ?,
+		 is_newsletter = ?, sample_percent = ?, updated_at = ? WHERE id = ?`,
+		rule.AccountID, rule.Name, rule.Pattern, rule.PatternType, rule.MoveToFolder, rule.Action,
+		boolToInt(rule.Enabled), rule.Priority, boolToInt(rule.UnreadOnly), rule.OlderThanDays,
+		rule.ExcludeKeyword, joinFolders(rule.Fallbacks), nullableBool(rule.IsFlagged), nullableBool(rule.IsAnswered),
+		nullableBool(rule.IsDraft), nullableBool(rule.IsNewsletter), rule.SamplePercent, rule.UpdatedAt, rule.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("updating rule: %w", err)
@@ -284,15 +635,306 @@ func (s *Store) UpdateRule(rule *models.Rule) error {
 	return nil
 }
 
-// DeleteRule deletes a rule
-func (s *Store) DeleteRule(id int64) error {
-	_, err := s.db.Exec(`DELETE FROM rules WHERE id = ?`, id)
+// PatchRule updates only the fields set in patch
+func (s *Store) PatchRule(id int64, patch *models.RulePatch) error {
+	var u patchUpdate
+	u.setString("name", patch.Name)
+	u.setString("pattern", patch.Pattern)
+	u.setString("pattern_type", patch.PatternType)
+	u.setString("move_to_folder", patch.MoveToFolder)
+	u.setString("action", patch.Action)
+	u.setBool("enabled", patch.Enabled)
+	u.setInt("priority", patch.Priority)
+	u.setBool("unread_only", patch.UnreadOnly)
+	u.setInt("older_than_days", patch.OlderThanDays)
+	u.setString("exclude_keyword", patch.ExcludeKeyword)
+	if patch.Fallbacks != nil {
+		u.add("fallback_folders", joinFolders(*patch.Fallbacks))
+	}
+	u.setOptionalBool("is_flagged", patch.IsFlagged)
+	u.setOptionalBool("is_answered", patch.IsAnswered)
+	u.setOptionalBool("is_draft", patch.IsDraft)
+	u.setOptionalBool("is_newsletter", patch.IsNewsletter)
+	u.setInt("sample_percent", patch.SamplePercent)
+
+	if err := s.applyPatch("rules", id, &u); err != nil {
+		return fmt.Errorf("patching rule: %w", err)
+	}
+	return nil
+}
+
+// patchUpdate collects the columns of a partial update
+type patchUpdate struct {
+	columns []string
+	args    []interface{}
+}
+
+func (u *patchUpdate) setString(column string, value *string) {
+	if value != nil {
+		u.add(column, *value)
+	}
+}
+
+func (u *patchUpdate) setInt(column string, value *int) {
+	if value != nil {
+		u.add(column, *value)
+	}
+}
+
+func (u *patchUpdate) setBool(column string, value *bool) {
+	if value != nil {
+		u.add(column, boolToInt(*value))
+	}
+}
+
+// setOptionalBool sets a nullable column if value was given, to NULL if it
+// was given as null
+func (u *patchUpdate) setOptionalBool(column string, value models.OptionalBool) {
+	if value.Set {
+		u.add(column, nullableBool(value.Value))
+	}
+}
+
+func (u *patchUpdate) add(column string, value interface{}) {
+	u.columns = append(u.columns, column+" = ?")
+	u.args = append(u.args, value)
+}
+
+// applyPatch runs the update on the row with the given ID in table. It uses
+// the database directly rather than the statement cache, as every
+// combination of columns is a different statement.
+func (s *Store) applyPatch(table string, id int64, u *patchUpdate) error {
+	u.add("updated_at", time.Now())
+	query := fmt.Sprintf(`UPDATE %s SET %s WHERE id = ?`, table, strings.Join(u.columns, ", "))
+	_, err := s.db.Exec(query, append(u.args, id)...)
+	return err
+}
+
+// DeleteRule deletes a rule, returning the number of rules deleted
+func (s *Store) DeleteRule(id int64) (int64, error) {
+	result, err := s.exec(`DELETE FROM rules WHERE id = ?`, id)
+	if err != nil {
+		return 0, fmt.Errorf("deleting rule: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// DeleteOrphanedRules deletes rules whose account no longer exists, left
+// behind if the account was deleted while foreign keys weren't enforced. It
+// returns the number of rules deleted.
+func (s *Store) DeleteOrphanedRules() (int64, error) {
+	result, err := s.exec(`DELETE FROM rules WHERE account_id NOT IN (SELECT id FROM accounts)`)
+	if err != nil {
+		return 0, fmt.Errorf("deleting orphaned rules: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// Apply Run Operations
+
+const applyRunColumns = `id, account_id, folder, uid_validity, last_uid, moved, started_at, updated_at, finished_at`
+
+// StartApplyRun records the start of applying rules to a folder. Runs of the
+// same folder left in progress are finished, as the new run supersedes them.
+func (s *Store) StartApplyRun(run *models.ApplyRun) error {
+	now := time.Now()
+	if _, err := s.exec(
+		`UPDATE apply_runs SET finished_at = ? WHERE account_id = ? AND folder = ? AND finished_at IS NULL`,
+		now, run.AccountID, run.Folder,
+	); err != nil {
+		return fmt.Errorf("finishing earlier apply runs: %w", err)
+	}
+
+	result, err := s.exec(
+		`INSERT INTO apply_runs (account_id, folder, uid_validity, last_uid, moved, started_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		run.AccountID, run.Folder, run.UIDValidity, run.LastUID, run.Moved, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("inserting apply run: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last insert id: %w", err)
+	}
+	run.ID = id
+	run.StartedAt = now
+	run.UpdatedAt = now
+	return nil
+}
+
+// RecordApplyProgress stores that the run has moved the message with the
+// given UID, one more than before
+func (s *Store) RecordApplyProgress(id int64, uidValidity, uid uint32) error {
+	_, err := s.exec(
+		`UPDATE apply_runs SET uid_validity = ?, last_uid = ?, moved = moved + 1, updated_at = ? WHERE id = ?`,
+		uidValidity, uid, time.Now(), id,
+	)
 	if err != nil {
-		return fmt.Errorf("deleting rule: %w", err)
+		return fmt.Errorf("recording apply progress: %w", err)
 	}
 	return nil
 }
 
+// FinishApplyRun marks the run as complete, so it is no longer resumed
+func (s *Store) FinishApplyRun(id int64) error {
+	_, err := s.exec(`UPDATE apply_runs SET finished_at = ? WHERE id = ?`, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("finishing apply run: %w", err)
+	}
+	return nil
+}
+
+// GetInProgressRun returns the latest unfinished run applying rules to the
+// account's folder, or nil if there is none
+func (s *Store) GetInProgressRun(accountID int64, folder string) (*models.ApplyRun, error) {
+	run := &models.ApplyRun{}
+	var finished sql.NullTime
+	err := s.queryRow(
+		`SELECT `+applyRunColumns+` FROM apply_runs
+		 WHERE account_id = ? AND folder = ? AND finished_at IS NULL
+		 ORDER BY id DESC LIMIT 1`,
+		accountID, folder,
+	).Scan(&run.ID, &run.AccountID, &run.Folder, &run.UIDValidity, &run.LastUID, &run.Moved,
+		&run.StartedAt, &run.UpdatedAt, &finished)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying apply run: %w", err)
+	}
+	if finished.Valid {
+		run.FinishedAt = &finished.Time
+	}
+	return run, nil
+}
+
+// Backup Operations
+
+// ExportAll returns every account with its rules. Passwords are left out
+// unless includePasswords is set.
+func (s *Store) ExportAll(includePasswords bool) (*models.Backup, error) {
+	accounts, err := s.ListAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &models.Backup{
+		Version:    models.BackupVersion,
+		ExportedAt: time.Now().UTC(),
+		Accounts:   make([]models.BackupAccount, 0, len(accounts)),
+	}
+	for _, account := range accounts {
+		rules, err := s.ListRules(account.ID)
+		if err != nil {
+			return nil, err
+		}
+		if rules == nil {
+			rules = []models.Rule{}
+		}
+		if !includePasswords {
+			account.Password = ""
+		}
+		backup.Accounts = append(backup.Accounts, models.BackupAccount{Account: account, Rules: rules})
+	}
+	return backup, nil
+}
+
+// ImportAll adds the accounts and rules in backup as new rows, keeping their
+// timestamps. Either everything is imported or, on error, nothing is.
+func (s *Store) ImportAll(backup *models.Backup) error {
+	if backup.Version > models.BackupVersion {
+		return fmt.Errorf("backup version %d is newer than supported version %d", backup.Version, models.BackupVersion)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting import: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, account := range backup.Accounts {
+		created, updated := importTimes(account.CreatedAt, account.UpdatedAt, now)
+		var lastVerified interface{}
+		if account.LastVerifiedAt != nil {
+			lastVerified = *account.LastVerifiedAt
+		}
+		result, err := tx.Exec(
+			`INSERT INTO accounts (name, server, port, username, password, tls, fetch_concurrency, compress, proxy_url,
+			 scan_window_days, inbox_name, command_timeout_seconds, allowed_destinations, enabled, last_verified_at,
+			 last_verify_status, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			account.Name, account.Server, account.Port, account.Username, account.Password,
+			boolToInt(account.TLS), account.FetchConcurrency, boolToInt(account.Compress), account.ProxyURL,
+			account.ScanWindowDays, account.InboxName, account.CommandTimeoutSeconds, joinFolders(account.AllowedDestinations), boolToInt(account.Enabled), lastVerified, account.LastVerifyStatus, created, updated,
+		)
+		if err != nil {
+			return fmt.Errorf("importing account %q: %w", account.Name, err)
+		}
+		accountID, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("getting last insert id: %w", err)
+		}
+
+		for _, rule := range account.Rules {
+			created, updated := importTimes(rule.CreatedAt, rule.UpdatedAt, now)
+			action := rule.Action
+			if action == "" {
+				action = models.ActionMove
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO rules (account_id, name, pattern, pattern_type, move_to_folder, action, enabled, priority,
+				 unread_only, older_than_days, exclude_keyword, fallback_folders, is_flagged, is_answered, is_draft,
+				 is_newsletter, sample_percent, created_at, updated_at)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				accountID, rule.Name, rule.Pattern, rule.PatternType, rule.MoveToFolder, action,
+				boolToInt(rule.Enabled), rule.Priority, boolToInt(rule.UnreadOnly), rule.OlderThanDays, rule.ExcludeKeyword,
+				joinFolders(rule.Fallbacks), nullableBool(rule.IsFlagged), nullableBool(rule.IsAnswered), nullableBool(rule.IsDraft),
+				nullableBool(rule.IsNewsletter), rule.SamplePercent, created, updated,
+			); err != nil {
+				return fmt.Errorf("importing rule %q of account %q: %w", rule.Name, account.Name, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing import: %w", err)
+	}
+	return nil
+}
+
+// importTimes returns the timestamps to import a row with, using now for
+// ones missing from the backup
+func importTimes(created, updated, now time.Time) (time.Time, time.Time) {
+	if created.IsZero() {
+		created = now
+	}
+	if updated.IsZero() {
+		updated = created
+	}
+	return created, updated
+}
+
+func isForeignKeyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+// Folder lists, a rule's fallback folders and an account's allowed
+// destinations, are stored one per line, as folder names can't contain line
+// breaks
+func joinFolders(folders []string) string {
+	return strings.Join(folders, "\n")
+}
+
+func splitFolders(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
 func boolToInt(b bool) int {
 	if b {
 		return 1
@@ -303,3 +945,18 @@ func boolToInt(b bool) int {
 func intToBool(i int) bool {
 	return i != 0
 }
+
+// nullableBool stores an optional bool, with nil as NULL
+func nullableBool(b *bool) interface{} {
+	if b == nil {
+		return nil
+	}
+	return boolToInt(*b)
+}
+
+func nullBoolPtr(b sql.NullBool) *bool {
+	if !b.Valid {
+		return nil
+	}
+	return &b.Bool
+}
@@ -1,13 +1,19 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/mailcleaner/mailcleaner/internal/models"
 )
 
-func setupTestStore(t *testing.T) (*Store, func()) {
+func setupTestStore(t testing.TB) (*Store, func()) {
 	tmpFile, err := os.CreateTemp("", "mailcleaner-test-*.db")
 	if err != nil {
 		t.Fatalf("Failed to create temp file: %v", err)
@@ -81,9 +87,21 @@ func TestAccountCRUD(t *testing.T) {
 	}
 
 	// Delete
-	if err := store.DeleteAccount(account.ID); err != nil {
+	deleted, err := store.DeleteAccount(account.ID)
+	if err != nil {
+		t.Fatalf("DeleteAccount failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted, got %d", deleted)
+	}
+
+	deleted, err = store.DeleteAccount(account.ID)
+	if err != nil {
 		t.Fatalf("DeleteAccount failed: %v", err)
 	}
+	if deleted != 0 {
+		t.Errorf("Expected 0 deleted on second delete, got %d", deleted)
+	}
 
 	fetched, _ = store.GetAccount(account.ID)
 	if fetched != nil {
@@ -160,9 +178,21 @@ func TestRuleCRUD(t *testing.T) {
 	}
 
 	// Delete
-	if err := store.DeleteRule(rule.ID); err != nil {
+	deleted, err := store.DeleteRule(rule.ID)
+	if err != nil {
 		t.Fatalf("DeleteRule failed: %v", err)
 	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted, got %d", deleted)
+	}
+
+	deleted, err = store.DeleteRule(rule.ID)
+	if err != nil {
+		t.Fatalf("DeleteRule failed: %v", err)
+	}
+	if deleted != 0 {
+		t.Errorf("Expected 0 deleted on second delete, got %d", deleted)
+	}
 
 	fetched, _ = store.GetRule(rule.ID)
 	if fetched != nil {
@@ -170,6 +200,188 @@ func TestRuleCRUD(t *testing.T) {
 	}
 }
 
+func TestRuleFallbacks(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Receipts", Pattern: "shop@", PatternType: "sender",
+		MoveToFolder: "Receipts", Fallbacks: []string{"INBOX.Receipts", "Shopping/Receipts"}}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if len(fetched.Fallbacks) != 2 || fetched.Fallbacks[0] != "INBOX.Receipts" || fetched.Fallbacks[1] != "Shopping/Receipts" {
+		t.Errorf("Expected the fallbacks to be kept in order, got %q", fetched.Fallbacks)
+	}
+
+	none := []string{}
+	if err := store.PatchRule(rule.ID, &models.RulePatch{Fallbacks: &none}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.Fallbacks != nil {
+		t.Errorf("Expected the fallbacks to be cleared, got %q", fetched.Fallbacks)
+	}
+}
+
+func TestRuleFlagConditions(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	yes, no := true, false
+	rule := &models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "News", IsFlagged: &no, IsAnswered: &yes}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.IsFlagged == nil || *fetched.IsFlagged || fetched.IsAnswered == nil || !*fetched.IsAnswered || fetched.IsDraft != nil {
+		t.Errorf("Expected unflagged, answered and no draft condition, got %v %v %v", fetched.IsFlagged, fetched.IsAnswered, fetched.IsDraft)
+	}
+
+	if err := store.PatchRule(rule.ID, &models.RulePatch{IsDraft: models.OptionalBool{Set: true, Value: &no}}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.IsDraft == nil || *fetched.IsDraft {
+		t.Errorf("Expected the draft condition to be set, got %v", fetched.IsDraft)
+	}
+
+	if err := store.PatchRule(rule.ID, &models.RulePatch{IsNewsletter: models.OptionalBool{Set: true, Value: &yes}}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.IsNewsletter == nil || !*fetched.IsNewsletter {
+		t.Errorf("Expected the newsletter condition to be set, got %v", fetched.IsNewsletter)
+	}
+
+	// A full update clears conditions left out
+	fetched.IsFlagged, fetched.IsAnswered, fetched.IsDraft = nil, nil, nil
+	if err := store.UpdateRule(fetched); err != nil {
+		t.Fatalf("UpdateRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if len(fetched.FlagConditions()) != 0 {
+		t.Errorf("Expected no flag conditions, got %+v", fetched.FlagConditions())
+	}
+}
+
+func TestRuleSamplePercent(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "News", SamplePercent: 10}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.SamplePercent != 10 {
+		t.Errorf("Expected sample_percent 10, got %d", fetched.SamplePercent)
+	}
+
+	percent := 50
+	if err := store.PatchRule(rule.ID, &models.RulePatch{SamplePercent: &percent}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.SamplePercent != 50 {
+		t.Errorf("Expected sample_percent 50 after patching, got %d", fetched.SamplePercent)
+	}
+}
+
+func TestRuleMultiplePatterns(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Code hosting", Pattern: "github.com\ngitlab.com",
+		PatternType: "from_domain", MoveToFolder: "Code", Enabled: true}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+	fetched, _ := store.GetRule(rule.ID)
+	if got := fetched.Patterns(); !slices.Equal(got, []string{"github.com", "gitlab.com"}) {
+		t.Errorf("Expected both patterns to be stored, got %q", got)
+	}
+
+	pattern := "github.com, gitlab.com, bitbucket.org"
+	if err := store.PatchRule(rule.ID, &models.RulePatch{Pattern: &pattern}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+	fetched, _ = store.GetRule(rule.ID)
+	if got := fetched.Patterns(); len(got) != 3 || got[2] != "bitbucket.org" {
+		t.Errorf("Expected 3 patterns after patching, got %q", got)
+	}
+
+	duplicate, err := store.FindDuplicateRule(account.ID, pattern, "from_domain", "Code")
+	if err != nil {
+		t.Fatalf("FindDuplicateRule failed: %v", err)
+	}
+	if duplicate == nil || duplicate.ID != rule.ID {
+		t.Errorf("Expected the multi-pattern rule to be found as a duplicate, got %+v", duplicate)
+	}
+}
+
+func TestApplyRuns(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	if run, err := store.GetInProgressRun(account.ID, "INBOX"); err != nil || run != nil {
+		t.Fatalf("Expected no run in progress, got %+v, %v", run, err)
+	}
+
+	run := &models.ApplyRun{AccountID: account.ID, Folder: "INBOX"}
+	if err := store.StartApplyRun(run); err != nil {
+		t.Fatalf("StartApplyRun failed: %v", err)
+	}
+	store.RecordApplyProgress(run.ID, 7, 40)
+	store.RecordApplyProgress(run.ID, 7, 38)
+
+	fetched, err := store.GetInProgressRun(account.ID, "INBOX")
+	if err != nil || fetched == nil {
+		t.Fatalf("GetInProgressRun failed: %+v, %v", fetched, err)
+	}
+	if fetched.ID != run.ID || fetched.UIDValidity != 7 || fetched.LastUID != 38 || fetched.Moved != 2 {
+		t.Errorf("Expected run %d at UID 38 after 2 moves, got %+v", run.ID, fetched)
+	}
+	if other, _ := store.GetInProgressRun(account.ID, "Work"); other != nil {
+		t.Errorf("Expected runs to be per folder, got %+v", other)
+	}
+
+	// A new run supersedes the interrupted one
+	next := &models.ApplyRun{AccountID: account.ID, Folder: "INBOX"}
+	if err := store.StartApplyRun(next); err != nil {
+		t.Fatalf("StartApplyRun failed: %v", err)
+	}
+	if fetched, _ := store.GetInProgressRun(account.ID, "INBOX"); fetched == nil || fetched.ID != next.ID || fetched.LastUID != 0 {
+		t.Errorf("Expected the new run to be in progress, got %+v", fetched)
+	}
+
+	if err := store.FinishApplyRun(next.ID); err != nil {
+		t.Fatalf("FinishApplyRun failed: %v", err)
+	}
+	if fetched, _ := store.GetInProgressRun(account.ID, "INBOX"); fetched != nil {
+		t.Errorf("Expected no run in progress after finishing, got %+v", fetched)
+	}
+}
+
 func TestRulePrioritySorting(t *testing.T) {
 	store, cleanup := setupTestStore(t)
 	defer cleanup()
@@ -253,3 +465,743 @@ func TestCascadeDeleteRules(t *testing.T) {
 		t.Errorf("Expected 0 rules after account deletion, got %d", len(rules))
 	}
 }
+
+func TestCreateRuleMissingAccount(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	rule := &models.Rule{
+		AccountID:    999,
+		Name:         "Orphan",
+		Pattern:      "test",
+		PatternType:  "sender",
+		MoveToFolder: "Test",
+	}
+	err := store.CreateRule(rule)
+	if !errors.Is(err, ErrForeignKey) {
+		t.Errorf("CreateRule() error = %v, want ErrForeignKey", err)
+	}
+}
+
+func TestListAccountsPage(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		store.CreateAccount(&models.Account{Name: "Account " + string(rune('E'-i)), Server: "imap.example.com", Port: 993})
+	}
+
+	var ids []int64
+	cursor := int64(0)
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Pagination did not terminate")
+		}
+		accounts, next, err := store.ListAccountsPage(cursor, 2)
+		if err != nil {
+			t.Fatalf("ListAccountsPage failed: %v", err)
+		}
+		if len(accounts) > 2 {
+			t.Fatalf("Page has %d accounts, want at most 2", len(accounts))
+		}
+		for _, a := range accounts {
+			ids = append(ids, a.ID)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	want := []int64{1, 2, 3, 4, 5}
+	if len(ids) != len(want) {
+		t.Fatalf("Got IDs %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("Got IDs %v, want %v", ids, want)
+		}
+	}
+}
+
+func TestListRulesPage(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "A", Server: "imap.example.com", Port: 993}
+	other := &models.Account{Name: "B", Server: "imap.example.com", Port: 993}
+	store.CreateAccount(account)
+	store.CreateAccount(other)
+	for i := 0; i < 4; i++ {
+		store.CreateRule(&models.Rule{AccountID: account.ID, Name: "Rule", Pattern: "test", PatternType: "sender", MoveToFolder: "Test"})
+		store.CreateRule(&models.Rule{AccountID: other.ID, Name: "Other", Pattern: "test", PatternType: "sender", MoveToFolder: "Test"})
+	}
+
+	// A page that ends exactly on the last rule has no next cursor
+	rules, next, err := store.ListRulesPage(account.ID, 0, 4)
+	if err != nil {
+		t.Fatalf("ListRulesPage failed: %v", err)
+	}
+	if len(rules) != 4 || next != 0 {
+		t.Errorf("Got %d rules and cursor %d, want 4 and 0", len(rules), next)
+	}
+
+	rules, next, err = store.ListRulesPage(account.ID, 0, 3)
+	if err != nil {
+		t.Fatalf("ListRulesPage failed: %v", err)
+	}
+	if len(rules) != 3 || next != rules[2].ID {
+		t.Fatalf("Got %d rules and cursor %d, want 3 and %d", len(rules), next, rules[2].ID)
+	}
+	for _, r := range rules {
+		if r.AccountID != account.ID {
+			t.Errorf("Rule %d belongs to account %d", r.ID, r.AccountID)
+		}
+	}
+
+	rules, next, err = store.ListRulesPage(account.ID, next, 3)
+	if err != nil {
+		t.Fatalf("ListRulesPage failed: %v", err)
+	}
+	if len(rules) != 1 || next != 0 {
+		t.Errorf("Got %d rules and cursor %d on the last page, want 1 and 0", len(rules), next)
+	}
+}
+
+func TestAccountFetchConcurrency(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{
+		Name:             "Test Account",
+		Server:           "imap.example.com",
+		Port:             993,
+		Username:         "test@example.com",
+		Password:         "password123",
+		FetchConcurrency: 4,
+	}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	fetched, _ := store.GetAccount(account.ID)
+	if fetched.FetchConcurrency != 4 {
+		t.Errorf("Expected fetch concurrency 4, got %d", fetched.FetchConcurrency)
+	}
+
+	account.FetchConcurrency = 2
+	if err := store.UpdateAccount(account); err != nil {
+		t.Fatalf("UpdateAccount failed: %v", err)
+	}
+
+	accounts, _ := store.ListAccounts()
+	if len(accounts) != 1 || accounts[0].FetchConcurrency != 2 {
+		t.Errorf("Expected fetch concurrency 2 after update, got %+v", accounts)
+	}
+}
+
+func TestAccountCompress(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test Account", Server: "imap.example.com", Port: 993, Compress: true}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	fetched, _ := store.GetAccount(account.ID)
+	if !fetched.Compress {
+		t.Error("Expected compress to be saved")
+	}
+
+	account.Compress = false
+	if err := store.UpdateAccount(account); err != nil {
+		t.Fatalf("UpdateAccount failed: %v", err)
+	}
+
+	fetched, _ = store.GetAccount(account.ID)
+	if fetched.Compress {
+		t.Error("Expected compress to be cleared after update")
+	}
+}
+
+func TestAccountEnabled(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test Account", Server: "imap.example.com", Port: 993, Enabled: true}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	account.Enabled = false
+	if err := store.UpdateAccount(account); err != nil {
+		t.Fatalf("UpdateAccount failed: %v", err)
+	}
+
+	fetched, _ := store.GetAccount(account.ID)
+	if fetched.Enabled {
+		t.Error("Expected account to be disabled after update")
+	}
+}
+
+func TestPatchRule(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test Account", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+	rule := &models.Rule{AccountID: account.ID, Name: "Test", Pattern: "test", PatternType: "sender", MoveToFolder: "Test", Enabled: true, Priority: 2}
+	store.CreateRule(rule)
+
+	name := "Renamed"
+	enabled := false
+	if err := store.PatchRule(rule.ID, &models.RulePatch{Name: &name, Enabled: &enabled}); err != nil {
+		t.Fatalf("PatchRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.Name != "Renamed" || fetched.Enabled {
+		t.Errorf("Expected name and enabled to be patched, got %+v", fetched)
+	}
+	if fetched.Pattern != "test" || fetched.MoveToFolder != "Test" || fetched.Priority != 2 {
+		t.Errorf("Expected other fields to be unchanged, got %+v", fetched)
+	}
+	if !fetched.UpdatedAt.After(rule.UpdatedAt) {
+		t.Error("Expected updated_at to change")
+	}
+}
+
+func TestPatchAccount(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test Account", Server: "imap.example.com", Port: 993, Username: "u", Password: "p", TLS: true, Enabled: true}
+	store.CreateAccount(account)
+
+	port := 143
+	tls := false
+	if err := store.PatchAccount(account.ID, &models.AccountPatch{Port: &port, TLS: &tls}); err != nil {
+		t.Fatalf("PatchAccount failed: %v", err)
+	}
+
+	fetched, _ := store.GetAccount(account.ID)
+	if fetched.Port != 143 || fetched.TLS {
+		t.Errorf("Expected port and tls to be patched, got %+v", fetched)
+	}
+	if fetched.Name != "Test Account" || fetched.Password != "p" || !fetched.Enabled {
+		t.Errorf("Expected other fields to be unchanged, got %+v", fetched)
+	}
+}
+
+func TestMigrateAddsColumnsToExistingDatabase(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "mailcleaner-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// Create a database with the original accounts schema
+	db, err := sql.Open("sqlite3", tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		server TEXT NOT NULL,
+		port INTEGER NOT NULL DEFAULT 993,
+		username TEXT NOT NULL,
+		password TEXT NOT NULL,
+		tls INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO accounts (name, server, username, password) VALUES ('Old', 'imap.example.com', 'u', 'p')`); err != nil {
+		t.Fatalf("Failed to insert legacy account: %v", err)
+	}
+	db.Close()
+
+	store, err := New(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("New failed on legacy database: %v", err)
+	}
+	defer store.Close()
+
+	account, err := store.GetAccount(1)
+	if err != nil {
+		t.Fatalf("GetAccount failed: %v", err)
+	}
+	if account.FetchConcurrency != 1 {
+		t.Errorf("Expected default fetch concurrency 1, got %d", account.FetchConcurrency)
+	}
+	if !account.Enabled {
+		t.Error("Expected existing accounts to be enabled after migration")
+	}
+
+	// Migrating again must be a no-op
+	if err := store.migrate(); err != nil {
+		t.Errorf("Second migrate failed: %v", err)
+	}
+}
+
+func TestListAllRulesWithAccount(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	for _, name := range []string{"Work", "Personal"} {
+		account := &models.Account{Name: name, Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+		if err := store.CreateAccount(account); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+		rule := &models.Rule{AccountID: account.ID, Name: name + " rule", Pattern: "x", PatternType: "sender", MoveToFolder: "F", Enabled: true}
+		if err := store.CreateRule(rule); err != nil {
+			t.Fatalf("CreateRule failed: %v", err)
+		}
+	}
+
+	rules, err := store.ListAllRulesWithAccount()
+	if err != nil {
+		t.Fatalf("ListAllRulesWithAccount failed: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+
+	// Ordered by account name
+	if rules[0].AccountName != "Personal" || rules[0].Name != "Personal rule" {
+		t.Errorf("Expected Personal rule first, got %q (%q)", rules[0].Name, rules[0].AccountName)
+	}
+	if rules[1].AccountName != "Work" || rules[1].Name != "Work rule" {
+		t.Errorf("Expected Work rule second, got %q (%q)", rules[1].Name, rules[1].AccountName)
+	}
+}
+
+func TestRuleUnreadOnly(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Unread", Pattern: "x@", PatternType: "sender", MoveToFolder: "F", Enabled: true, UnreadOnly: true}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if !fetched.UnreadOnly {
+		t.Error("Expected UnreadOnly to be persisted")
+	}
+
+	rule.UnreadOnly = false
+	if err := store.UpdateRule(rule); err != nil {
+		t.Fatalf("UpdateRule failed: %v", err)
+	}
+
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.UnreadOnly {
+		t.Error("Expected UnreadOnly to be cleared after update")
+	}
+}
+
+func TestRuleOlderThanDays(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Old", Pattern: "x@", PatternType: "sender", MoveToFolder: "Archive", Enabled: true, OlderThanDays: 90}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.OlderThanDays != 90 {
+		t.Errorf("Expected older_than_days 90, got %d", fetched.OlderThanDays)
+	}
+
+	rule.OlderThanDays = 0
+	store.UpdateRule(rule)
+
+	fetched, _ = store.GetRule(rule.ID)
+	if fetched.OlderThanDays != 0 {
+		t.Errorf("Expected older_than_days 0 after update, got %d", fetched.OlderThanDays)
+	}
+}
+
+func TestRuleAction(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Archive", Pattern: "x@", PatternType: "sender", Action: models.ActionArchive, Enabled: true}
+	if err := store.CreateRule(rule); err != nil {
+		t.Fatalf("CreateRule failed: %v", err)
+	}
+
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.Action != models.ActionArchive {
+		t.Errorf("Expected action %q, got %q", models.ActionArchive, fetched.Action)
+	}
+}
+
+func TestRuleExcludeKeyword(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Once", Pattern: "x@", PatternType: "sender", MoveToFolder: "F", Enabled: true, ExcludeKeyword: models.ProcessedKeyword}
+	store.CreateRule(rule)
+
+	fetched, _ := store.GetRule(rule.ID)
+	if fetched.ExcludeKeyword != models.ProcessedKeyword {
+		t.Errorf("Expected exclude_keyword %q, got %q", models.ProcessedKeyword, fetched.ExcludeKeyword)
+	}
+}
+
+func TestCloneRule(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	rule := &models.Rule{AccountID: account.ID, Name: "Original", Pattern: "x@", PatternType: "sender", MoveToFolder: "F", Enabled: true, Priority: 3}
+	store.CreateRule(rule)
+
+	clone, err := store.CloneRule(rule.ID)
+	if err != nil {
+		t.Fatalf("CloneRule failed: %v", err)
+	}
+	if clone.Name != "Copy of Original" || clone.Enabled {
+		t.Errorf("Unexpected clone: %+v", clone)
+	}
+
+	rules, _ := store.ListRules(account.ID)
+	if len(rules) != 2 {
+		t.Errorf("Expected 2 rules after clone, got %d", len(rules))
+	}
+
+	missing, err := store.CloneRule(999)
+	if err != nil || missing != nil {
+		t.Errorf("Expected nil, nil for missing rule, got %v, %v", missing, err)
+	}
+}
+
+func TestFindDuplicateRule(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "Enabled", Pattern: "news@", PatternType: "sender", MoveToFolder: "News", Enabled: true})
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "Disabled", Pattern: "promo@", PatternType: "sender", MoveToFolder: "Promo", Enabled: false})
+
+	dup, err := store.FindDuplicateRule(account.ID, "NEWS@", "sender", "News")
+	if err != nil {
+		t.Fatalf("FindDuplicateRule failed: %v", err)
+	}
+	if dup == nil || dup.Name != "Enabled" {
+		t.Errorf("Expected to find 'Enabled' rule, got %+v", dup)
+	}
+
+	if dup, _ := store.FindDuplicateRule(account.ID, "promo@", "sender", "Promo"); dup != nil {
+		t.Errorf("Expected disabled rule not to count as duplicate, got %+v", dup)
+	}
+	if dup, _ := store.FindDuplicateRule(account.ID, "news@", "subject", "News"); dup != nil {
+		t.Errorf("Expected different pattern type not to count as duplicate, got %+v", dup)
+	}
+}
+
+func TestRecordAccountVerification(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	fetched, _ := store.GetAccount(account.ID)
+	if fetched.LastVerifiedAt != nil || fetched.LastVerifyStatus != "" {
+		t.Errorf("Expected no verification on new account, got %v %q", fetched.LastVerifiedAt, fetched.LastVerifyStatus)
+	}
+
+	at := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	if err := store.RecordAccountVerification(account.ID, at, models.VerifySuccess); err != nil {
+		t.Fatalf("RecordAccountVerification failed: %v", err)
+	}
+
+	// Updating other fields must not clear the verification
+	account.Name = "Renamed"
+	store.UpdateAccount(account)
+
+	fetched, _ = store.GetAccount(account.ID)
+	if fetched.LastVerifiedAt == nil || !fetched.LastVerifiedAt.Equal(at) {
+		t.Errorf("Expected last_verified_at %v, got %v", at, fetched.LastVerifiedAt)
+	}
+	if fetched.LastVerifyStatus != models.VerifySuccess {
+		t.Errorf("Expected status %q, got %q", models.VerifySuccess, fetched.LastVerifyStatus)
+	}
+}
+
+func TestPreparedStatementsReused(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.GetAccount(account.ID); err != nil {
+			t.Fatalf("GetAccount failed: %v", err)
+		}
+	}
+
+	// CreateAccount and GetAccount, each prepared once
+	if len(store.stmts) != 2 {
+		t.Errorf("Expected 2 cached statements, got %d", len(store.stmts))
+	}
+}
+
+// backupContents returns backup as JSON without the IDs and export time,
+// which differ between databases with the same contents
+func backupContents(t *testing.T, backup *models.Backup) string {
+	t.Helper()
+
+	backup.ExportedAt = time.Time{}
+	for i := range backup.Accounts {
+		backup.Accounts[i].ID = 0
+		for j := range backup.Accounts[i].Rules {
+			backup.Accounts[i].Rules[j].ID = 0
+			backup.Accounts[i].Rules[j].AccountID = 0
+		}
+	}
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal backup: %v", err)
+	}
+	return string(data)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	work := &models.Account{Name: "Work", Server: "imap.work.com", Port: 993, Username: "me@work.com", Password: "secret",
+		TLS: true, FetchConcurrency: 4, Compress: true, ProxyURL: "socks5://proxy:1080", ScanWindowDays: 30,
+		InboxName: "Posteingang", Enabled: true}
+	home := &models.Account{Name: "Home", Server: "imap.home.com", Port: 143, Username: "me", Password: "hunter2"}
+	store.CreateAccount(work)
+	store.CreateAccount(home)
+	store.RecordAccountVerification(work.ID, time.Now(), models.VerifySuccess)
+
+	// Leave a gap in the IDs so the import has to remap them
+	spare := &models.Account{Name: "Spare", Server: "imap.spare.com", Port: 993, Username: "x", Password: "x"}
+	store.CreateAccount(spare)
+	store.DeleteAccount(spare.ID)
+
+	store.CreateRule(&models.Rule{AccountID: work.ID, Name: "GitHub", Pattern: "github.com", PatternType: "from_domain",
+		MoveToFolder: "GitHub", Action: models.ActionMove, Enabled: true, Priority: 5, UnreadOnly: true,
+		OlderThanDays: 7, ExcludeKeyword: "$Keep"})
+	store.CreateRule(&models.Rule{AccountID: work.ID, Name: "Archive", Pattern: "receipt", PatternType: "subject",
+		MoveToFolder: "Receipts", Action: models.ActionArchive})
+	store.CreateRule(&models.Rule{AccountID: home.ID, Name: "News", Pattern: "newsletter", PatternType: "sender",
+		MoveToFolder: "News", Action: models.ActionMove, Enabled: true})
+
+	backup, err := store.ExportAll(true)
+	if err != nil {
+		t.Fatalf("ExportAll failed: %v", err)
+	}
+	if backup.Version != models.BackupVersion || len(backup.Accounts) != 2 {
+		t.Fatalf("Expected version %d with 2 accounts, got %+v", models.BackupVersion, backup)
+	}
+
+	// Import into a fresh database through JSON, as the CLI does
+	data, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatalf("Failed to marshal backup: %v", err)
+	}
+	var decoded models.Backup
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal backup: %v", err)
+	}
+
+	fresh, freshCleanup := setupTestStore(t)
+	defer freshCleanup()
+	if err := fresh.ImportAll(&decoded); err != nil {
+		t.Fatalf("ImportAll failed: %v", err)
+	}
+
+	reexported, err := fresh.ExportAll(true)
+	if err != nil {
+		t.Fatalf("ExportAll of the imported database failed: %v", err)
+	}
+	if got, want := backupContents(t, reexported), backupContents(t, backup); got != want {
+		t.Errorf("Imported database differs from the original.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+
+	// Rules belong to the accounts they were exported under
+	accounts, _ := fresh.ListAccounts()
+	for _, account := range accounts {
+		rules, _ := fresh.ListRules(account.ID)
+		want := map[string]int{"Work": 2, "Home": 1}[account.Name]
+		if len(rules) != want {
+			t.Errorf("Expected %d rules for %s, got %d", want, account.Name, len(rules))
+		}
+	}
+}
+
+func TestExportAllWithoutPasswords(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	store.CreateAccount(&models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "secret"})
+
+	backup, err := store.ExportAll(false)
+	if err != nil {
+		t.Fatalf("ExportAll failed: %v", err)
+	}
+	if backup.Accounts[0].Password != "" {
+		t.Errorf("Expected the password to be left out, got %q", backup.Accounts[0].Password)
+	}
+	if backup.Accounts[0].Rules == nil {
+		t.Error("Expected an empty rule list rather than null")
+	}
+
+	// The account itself is untouched
+	accounts, _ := store.ListAccounts()
+	if accounts[0].Password != "secret" {
+		t.Errorf("Expected the stored password to be kept, got %q", accounts[0].Password)
+	}
+}
+
+func TestImportAllIsAtomic(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if err := store.ImportAll(&models.Backup{Version: models.BackupVersion + 1}); err == nil {
+		t.Error("Expected a newer backup version to be rejected")
+	}
+
+	// Make the last rule fail to insert, after the accounts before it
+	if _, err := store.db.Exec(`CREATE TRIGGER fail_import BEFORE INSERT ON rules WHEN NEW.name = 'Broken'
+		BEGIN SELECT RAISE(ABORT, 'broken rule'); END`); err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+
+	backup := &models.Backup{
+		Version: models.BackupVersion,
+		Accounts: []models.BackupAccount{
+			{Account: models.Account{Name: "First", Server: "imap.example.com", Port: 993, Username: "u"}},
+			{
+				Account: models.Account{Name: "Second", Server: "imap.example.com", Port: 993, Username: "u"},
+				Rules:   []models.Rule{{Name: "Broken", Pattern: "x", PatternType: "sender", MoveToFolder: "X"}},
+			},
+		},
+	}
+	if err := store.ImportAll(backup); err == nil {
+		t.Fatal("Expected the import to fail")
+	}
+
+	accounts, err := store.ListAccounts()
+	if err != nil {
+		t.Fatalf("ListAccounts failed: %v", err)
+	}
+	if len(accounts) != 0 {
+		t.Errorf("Expected a failed import to add nothing, got %d accounts", len(accounts))
+	}
+}
+
+func BenchmarkGetAccount(b *testing.B) {
+	store, cleanup := setupTestStore(b)
+	defer cleanup()
+
+	account := &models.Account{Name: "Test", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetAccount(account.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDeleteOrphanedRules(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p"}
+	store.CreateAccount(account)
+	store.CreateRule(&models.Rule{AccountID: account.ID, Name: "Valid", Pattern: "a", PatternType: "sender", MoveToFolder: "A", Enabled: true})
+
+	// Seed a rule for a missing account as a database written without
+	// foreign keys enforced would have
+	ctx := context.Background()
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get a connection: %v", err)
+	}
+	for _, query := range []string{
+		`PRAGMA foreign_keys = OFF`,
+		`INSERT INTO rules (account_id, name, pattern, move_to_folder) VALUES (999, 'Orphan', 'b', 'B')`,
+		`PRAGMA foreign_keys = ON`,
+	} {
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			t.Fatalf("%s failed: %v", query, err)
+		}
+	}
+	conn.Close()
+
+	deleted, err := store.DeleteOrphanedRules()
+	if err != nil {
+		t.Fatalf("DeleteOrphanedRules failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 orphaned rule deleted, got %d", deleted)
+	}
+
+	rules, _ := store.ListAllRules()
+	if len(rules) != 1 || rules[0].Name != "Valid" {
+		t.Errorf("Expected only the valid rule to remain, got %+v", rules)
+	}
+
+	if deleted, err := store.DeleteOrphanedRules(); err != nil || deleted != 0 {
+		t.Errorf("Second DeleteOrphanedRules = %d, %v, want 0, nil", deleted, err)
+	}
+}
+
+func TestAccountAllowedDestinations(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	account := &models.Account{Name: "Work", Server: "imap.example.com", Port: 993, Username: "u", Password: "p",
+		AllowedDestinations: []string{"Archive", "Work/Clients"}}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	stored, _ := store.GetAccount(account.ID)
+	if !slices.Equal(stored.AllowedDestinations, account.AllowedDestinations) {
+		t.Errorf("AllowedDestinations = %v, want %v", stored.AllowedDestinations, account.AllowedDestinations)
+	}
+
+	// An empty list allows any destination again
+	if err := store.PatchAccount(account.ID, &models.AccountPatch{AllowedDestinations: &[]string{}}); err != nil {
+		t.Fatalf("PatchAccount failed: %v", err)
+	}
+	stored, _ = store.GetAccount(account.ID)
+	if len(stored.AllowedDestinations) != 0 {
+		t.Errorf("Expected no allowed destinations after patching, got %v", stored.AllowedDestinations)
+	}
+}
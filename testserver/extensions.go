@@ -0,0 +1,349 @@
+package testserver
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// quotaExtension implements the QUOTA extension (RFC 2087). The capability is
+// only advertised once a quota has been configured with SetQuota.
+type quotaExtension struct {
+	backend *MemoryBackend
+}
+
+func (ext *quotaExtension) Capabilities(c server.Conn) []string {
+	if ext.backend.quotaLimits() == nil {
+		return nil
+	}
+	return []string{"QUOTA"}
+}
+
+func (ext *quotaExtension) Command(name string) server.HandlerFactory {
+	if name != "GETQUOTAROOT" {
+		return nil
+	}
+	return func() server.Handler {
+		return &getQuotaRootHandler{backend: ext.backend}
+	}
+}
+
+type getQuotaRootHandler struct {
+	backend *MemoryBackend
+	mailbox string
+}
+
+func (h *getQuotaRootHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("no mailbox name specified")
+	}
+	name, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	if name, err = utf7.Encoding.NewDecoder().String(name); err != nil {
+		return err
+	}
+	h.mailbox = imap.CanonicalMailboxName(name)
+	return nil
+}
+
+func (h *getQuotaRootHandler) Handle(conn server.Conn) error {
+	limits := h.backend.quotaLimits()
+	if limits == nil {
+		return errors.New("QUOTA not supported")
+	}
+
+	if err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("QUOTAROOT"), imap.FormatMailboxName(h.mailbox), "",
+	})); err != nil {
+		return err
+	}
+
+	storage, messages := h.backend.usage()
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("QUOTA"), "", []interface{}{
+			imap.RawString("STORAGE"), storage, limits.storage,
+			imap.RawString("MESSAGE"), messages, limits.messages,
+		},
+	}))
+}
+
+// namespaceExtension implements the NAMESPACE extension (RFC 2342) with a
+// single personal namespace, advertised once SetNamespace has been called
+type namespaceExtension struct {
+	backend *MemoryBackend
+}
+
+func (ext *namespaceExtension) Capabilities(c server.Conn) []string {
+	if ext.backend.personalNamespace() == nil {
+		return nil
+	}
+	return []string{"NAMESPACE"}
+}
+
+func (ext *namespaceExtension) Command(name string) server.HandlerFactory {
+	if name != "NAMESPACE" {
+		return nil
+	}
+	return func() server.Handler {
+		return &namespaceHandler{backend: ext.backend}
+	}
+}
+
+type namespaceHandler struct {
+	backend *MemoryBackend
+}
+
+func (h *namespaceHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *namespaceHandler) Handle(conn server.Conn) error {
+	ns := h.backend.personalNamespace()
+	if ns == nil {
+		return errors.New("NAMESPACE not supported")
+	}
+
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("NAMESPACE"),
+		[]interface{}{[]interface{}{ns.prefix, ns.delimiter}},
+		nil,
+		nil,
+	}))
+}
+
+// compressExtension implements COMPRESS=DEFLATE (RFC 4978), advertised to
+// logged-in clients once EnableCompress has been called
+type compressExtension struct {
+	backend *MemoryBackend
+}
+
+func (ext *compressExtension) Capabilities(c server.Conn) []string {
+	if !ext.backend.compressEnabled() || c.Context().State == imap.NotAuthenticatedState {
+		return nil
+	}
+	return []string{"COMPRESS=DEFLATE"}
+}
+
+func (ext *compressExtension) Command(name string) server.HandlerFactory {
+	if name != "COMPRESS" {
+		return nil
+	}
+	return func() server.Handler {
+		return &compressHandler{backend: ext.backend}
+	}
+}
+
+type compressHandler struct {
+	backend   *MemoryBackend
+	mechanism string
+}
+
+func (h *compressHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("no compression mechanism specified")
+	}
+	mechanism, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mechanism = strings.ToUpper(mechanism)
+	return nil
+}
+
+func (h *compressHandler) Handle(conn server.Conn) error {
+	if !h.backend.compressEnabled() {
+		return errors.New("COMPRESS not supported")
+	}
+	if h.mechanism != "DEFLATE" {
+		return errors.New("unsupported compression mechanism")
+	}
+	return nil
+}
+
+// Upgrade switches the connection to DEFLATE after the OK has been sent
+func (h *compressHandler) Upgrade(conn server.Conn) error {
+	err := conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
+		conn.WaitReady()
+		w, err := flate.NewWriter(sock, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &deflateConn{Conn: sock, r: flate.NewReader(sock), w: w}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	h.backend.countCompressed()
+	return nil
+}
+
+// deflateConn compresses everything written to and decompresses everything
+// read from the underlying connection
+type deflateConn struct {
+	net.Conn
+	r io.Reader
+	w *flate.Writer
+}
+
+func (c *deflateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *deflateConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// listStatusExtension implements LIST-STATUS (RFC 5819), advertised once
+// EnableListStatus has been called. It also counts LIST and STATUS commands,
+// so tests can tell how often a client lists folders and whether it used
+// LIST-STATUS instead of STATUS.
+type listStatusExtension struct {
+	backend *MemoryBackend
+}
+
+func (ext *listStatusExtension) Capabilities(c server.Conn) []string {
+	if !ext.backend.listStatusEnabled() {
+		return nil
+	}
+	return []string{"LIST-STATUS"}
+}
+
+func (ext *listStatusExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "LIST":
+		return func() server.Handler {
+			return &listStatusHandler{backend: ext.backend}
+		}
+	case "STATUS":
+		return func() server.Handler {
+			return &countingStatusHandler{backend: ext.backend}
+		}
+	}
+	return nil
+}
+
+// listStatusHandler handles LIST, returning the requested STATUS items of
+// each selectable mailbox after its LIST response when asked to with
+// RETURN (STATUS (...)). LSUB is left to the built-in handler.
+type listStatusHandler struct {
+	server.List
+	backend *MemoryBackend
+	items   []imap.StatusItem
+}
+
+func (h *listStatusHandler) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		if err := h.parseReturn(fields[2:]); err != nil {
+			return err
+		}
+		fields = fields[:2]
+	}
+	return h.List.Parse(fields)
+}
+
+// parseReturn reads the STATUS items from the RETURN options
+func (h *listStatusHandler) parseReturn(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("unsupported LIST arguments")
+	}
+	if name, _ := imap.ParseString(fields[0]); !strings.EqualFold(name, "RETURN") {
+		return errors.New("unsupported LIST arguments")
+	}
+	options, ok := fields[1].([]interface{})
+	if !ok || len(options) != 2 {
+		return errors.New("unsupported LIST return options")
+	}
+	if name, _ := imap.ParseString(options[0]); !strings.EqualFold(name, "STATUS") {
+		return errors.New("unsupported LIST return options")
+	}
+	items, ok := options[1].([]interface{})
+	if !ok {
+		return errors.New("malformed STATUS return option")
+	}
+	for _, item := range items {
+		name, err := imap.ParseString(item)
+		if err != nil {
+			return err
+		}
+		h.items = append(h.items, imap.StatusItem(strings.ToUpper(name)))
+	}
+	return nil
+}
+
+func (h *listStatusHandler) Handle(conn server.Conn) error {
+	h.backend.countList()
+	if h.items != nil && !h.backend.listStatusEnabled() {
+		return errors.New("LIST-STATUS not supported")
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+	mailboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	// Unlike the built-in LIST, responses are written as they are produced,
+	// so everything listed before a failure reaches the client ahead of the NO
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+		// An empty mailbox name asks for the hierarchy delimiter
+		if h.Mailbox == "" {
+			info = &imap.MailboxInfo{Attributes: []string{imap.NoSelectAttr}, Delimiter: info.Delimiter, Name: info.Delimiter}
+			return writeList(conn, info)
+		}
+		if !info.Match(h.Reference, h.Mailbox) {
+			continue
+		}
+		if err := writeList(conn, info); err != nil {
+			return err
+		}
+		if h.items == nil || slices.Contains(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		status, err := mbox.Status(h.items)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeList(conn server.Conn, info *imap.MailboxInfo) error {
+	fields := append([]interface{}{imap.RawString("LIST")}, info.Format()...)
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// countingStatusHandler handles STATUS as usual, counting each command
+type countingStatusHandler struct {
+	server.Status
+	backend *MemoryBackend
+}
+
+func (h *countingStatusHandler) Handle(conn server.Conn) error {
+	h.backend.countStatus()
+	return h.Status.Handle(conn)
+}
@@ -0,0 +1,175 @@
+package testserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Errors returned by injected faults
+var (
+	ErrInjectedLogin = errors.New("injected login failure")
+	ErrInjectedFetch = errors.New("injected fetch failure")
+	ErrInjectedList  = errors.New("injected list failure")
+	ErrDropped       = errors.New("connection dropped")
+)
+
+// SetLatency delays every backend operation (login, listing, selecting,
+// fetching, searching, copying and flag changes) by d, to simulate a slow
+// server. Zero removes the delay.
+func (ts *TestServer) SetLatency(d time.Duration) {
+	ts.backend.faults.setLatency(d)
+}
+
+// FailNextLogin makes the next login fail as if the credentials were wrong
+func (ts *TestServer) FailNextLogin() {
+	ts.backend.faults.failNextLogin()
+}
+
+// FailNextFetch makes the next FETCH fail with a NO response
+func (ts *TestServer) FailNextFetch() {
+	ts.backend.faults.failNextFetch()
+}
+
+// ThrottleFetches makes the next n FETCH commands fail with NO [LIMIT], as
+// servers do when a user sends too many commands too quickly
+func (ts *TestServer) ThrottleFetches(n int) {
+	ts.backend.faults.throttleFetches(n)
+}
+
+// FailListAfter makes the next LIST fail with a NO response after n
+// mailboxes have been listed
+func (ts *TestServer) FailListAfter(n int) {
+	ts.backend.faults.failListAfter(n)
+}
+
+// DropConnectionAfter closes every open client connection when n more
+// backend operations have completed, simulating a server that goes away
+// mid-session. The operation that triggers the drop fails with ErrDropped.
+func (ts *TestServer) DropConnectionAfter(n int) {
+	ts.backend.faults.dropAfter(n)
+}
+
+// faults holds the failures injected into a MemoryBackend
+type faults struct {
+	mu        sync.Mutex
+	latency   time.Duration
+	failLogin bool
+	failFetch bool
+	throttled int // FETCH commands left to throttle
+	listIn    int // mailboxes left to list before failing, 0 if none
+	dropIn    int // operations left before dropping connections, 0 if none
+	drop      func()
+}
+
+func (f *faults) setLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+func (f *faults) failNextLogin() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failLogin = true
+}
+
+func (f *faults) failNextFetch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failFetch = true
+}
+
+func (f *faults) throttleFetches(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttled = n
+}
+
+func (f *faults) failListAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listIn = n + 1
+}
+
+func (f *faults) dropAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropIn = n + 1
+}
+
+// operation is called at the start of each backend operation. It applies the
+// configured latency and returns ErrDropped if this operation drops the
+// connections.
+func (f *faults) operation() error {
+	f.mu.Lock()
+	latency := f.latency
+	drop := false
+	if f.dropIn > 0 {
+		f.dropIn--
+		drop = f.dropIn == 0
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if drop {
+		if f.drop != nil {
+			f.drop()
+		}
+		return ErrDropped
+	}
+	return nil
+}
+
+// login is called at the start of a login
+func (f *faults) login() error {
+	if err := f.operation(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failLogin {
+		f.failLogin = false
+		return ErrInjectedLogin
+	}
+	return nil
+}
+
+// fetch is called at the start of a FETCH
+func (f *faults) fetch() error {
+	if err := f.operation(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failFetch {
+		f.failFetch = false
+		return ErrInjectedFetch
+	}
+	if f.throttled > 0 {
+		f.throttled--
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "LIMIT",
+			Info: "too many commands, try again later",
+		}}
+	}
+	return nil
+}
+
+// listMailbox is called for each mailbox a LIST returns
+func (f *faults) listMailbox() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.listIn > 0 {
+		f.listIn--
+		if f.listIn == 0 {
+			return ErrInjectedList
+		}
+	}
+	return nil
+}
@@ -2,8 +2,13 @@
 package testserver
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"net"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +31,10 @@ func New(user, pass string) (*TestServer, error) {
 
 	s := server.New(be)
 	s.AllowInsecureAuth = true
+	s.Enable(&quotaExtension{backend: be}, &namespaceExtension{backend: be}, &compressExtension{backend: be}, &listStatusExtension{backend: be})
+	be.faults.drop = func() {
+		s.ForEachConn(func(c server.Conn) { c.Close() })
+	}
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -59,21 +68,126 @@ func (ts *TestServer) AddMessageToFolder(folder, from, subject, body string) {
 	ts.backend.AddMessage(folder, from, subject, body)
 }
 
+// AddMessageWithDate adds a test message to a folder as if it had arrived
+// at date, e.g. to test searches by date
+func (ts *TestServer) AddMessageWithDate(folder, from, subject, body string, date time.Time) {
+	ts.backend.AddMessageWithDate(folder, from, subject, body, date)
+}
+
+// AddMessageWithReplyTo adds a test message to a folder with a Reply-To
+// address that differs from its sender
+func (ts *TestServer) AddMessageWithReplyTo(folder, from, replyTo, subject, body string) {
+	ts.backend.AddMessageWithReplyTo(folder, from, replyTo, subject, body)
+}
+
+// AddMessageWithHeaders adds a test message to a folder with extra header
+// fields, such as List-Unsubscribe, that can be fetched with
+// BODY[HEADER.FIELDS (...)]
+func (ts *TestServer) AddMessageWithHeaders(folder, from, subject, body string, headers map[string]string) {
+	ts.backend.AddMessageWithHeaders(folder, from, subject, body, headers)
+}
+
+// SetUIDValidity changes a folder's UIDVALIDITY, simulating a server that
+// has rebuilt its index
+func (ts *TestServer) SetUIDValidity(folder string, uidValidity uint32) {
+	ts.backend.SetUIDValidity(folder, uidValidity)
+}
+
+// SetReadOnly makes the server report a folder as read-only when it is
+// selected, as it does for folders the user may not modify
+func (ts *TestServer) SetReadOnly(folder string, readOnly bool) {
+	ts.backend.SetReadOnly(folder, readOnly)
+}
+
 // GetMessageCount returns the number of messages in a folder
 func (ts *TestServer) GetMessageCount(folder string) int {
 	return ts.backend.GetMessageCount(folder)
 }
 
+// GetMessageFlags returns the flags and keywords of the message with the
+// given UID, or nil if there is no such message
+func (ts *TestServer) GetMessageFlags(folder string, uid uint32) []string {
+	return ts.backend.GetMessageFlags(folder, uid)
+}
+
 // CreateFolder creates a new mailbox folder
 func (ts *TestServer) CreateFolder(name string) {
 	ts.backend.CreateMailbox(name)
 }
 
+// SetSpecialUse creates the folder if needed and marks it with a special-use
+// attribute such as \Archive, as returned by LIST
+func (ts *TestServer) SetSpecialUse(folder, attr string) {
+	ts.backend.SetSpecialUse(folder, attr)
+}
+
+// SetQuota makes the server advertise QUOTA with the given limits. The
+// storage limit is in units of 1024 octets, as reported by GETQUOTAROOT.
+func (ts *TestServer) SetQuota(storageLimit, messageLimit uint32) {
+	ts.backend.SetQuota(storageLimit, messageLimit)
+}
+
+// SetNamespace makes the server advertise NAMESPACE with the given personal
+// namespace, e.g. SetNamespace("INBOX.", ".") to mimic Dovecot/Courier
+// layouts where folders live under INBOX
+func (ts *TestServer) SetNamespace(prefix, delimiter string) {
+	ts.backend.SetNamespace(prefix, delimiter)
+}
+
+// EnableCompress makes the server advertise COMPRESS=DEFLATE to logged-in
+// clients
+func (ts *TestServer) EnableCompress() {
+	ts.backend.EnableCompress()
+}
+
+// CompressedConns returns how many connections have switched to DEFLATE
+func (ts *TestServer) CompressedConns() int {
+	return ts.backend.CompressedConns()
+}
+
+// EnableListStatus makes the server advertise LIST-STATUS, so that LIST can
+// return the status of each folder
+func (ts *TestServer) EnableListStatus() {
+	ts.backend.EnableListStatus()
+}
+
+// StatusCommands returns how many STATUS commands the server has received
+func (ts *TestServer) StatusCommands() int {
+	return ts.backend.StatusCommands()
+}
+
+// ListCommands returns how many LIST commands the server has received
+func (ts *TestServer) ListCommands() int {
+	return ts.backend.ListCommands()
+}
+
 // MemoryBackend is an in-memory IMAP backend
 type MemoryBackend struct {
 	user     *MemoryUser
 	username string
 	password string
+	quota    *quotaLimits
+	ns       *namespace
+	faults   *faults
+
+	compress        bool
+	compressedConns int
+
+	listStatus     bool
+	statusCommands int
+	listCommands   int
+}
+
+// namespace is the personal namespace reported by the NAMESPACE extension
+type namespace struct {
+	prefix    string
+	delimiter string
+}
+
+// quotaLimits holds the limits reported by the QUOTA extension
+type quotaLimits struct {
+	storage  uint32
+	messages uint32
 }
 
 // NewMemoryBackend creates a new memory backend
@@ -81,11 +195,13 @@ func NewMemoryBackend(username, password string) *MemoryBackend {
 	be := &MemoryBackend{
 		username: username,
 		password: password,
+		faults:   &faults{},
 	}
 	be.user = &MemoryUser{
 		username:  username,
 		password:  password,
 		mailboxes: make(map[string]*MemoryMailbox),
+		faults:    be.faults,
 	}
 	// Create default INBOX
 	be.user.mailboxes["INBOX"] = &MemoryMailbox{
@@ -98,6 +214,9 @@ func NewMemoryBackend(username, password string) *MemoryBackend {
 }
 
 func (be *MemoryBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	if err := be.faults.login(); err != nil {
+		return nil, err
+	}
 	if username != be.username || password != be.password {
 		return nil, errors.New("invalid credentials")
 	}
@@ -105,6 +224,28 @@ func (be *MemoryBackend) Login(_ *imap.ConnInfo, username, password string) (bac
 }
 
 func (be *MemoryBackend) AddMessage(folder, from, subject, body string) {
+	be.AddMessageWithDate(folder, from, subject, body, time.Now())
+}
+
+// AddMessageWithDate adds a message with the given date, which is used both
+// as its Date header and as its internal (arrival) date
+func (be *MemoryBackend) AddMessageWithDate(folder, from, subject, body string, date time.Time) {
+	be.addMessage(folder, &MemoryMessage{from: from, subject: subject, body: body, date: date})
+}
+
+// AddMessageWithReplyTo adds a message with a Reply-To address
+func (be *MemoryBackend) AddMessageWithReplyTo(folder, from, replyTo, subject, body string) {
+	be.addMessage(folder, &MemoryMessage{from: from, replyTo: replyTo, subject: subject, body: body, date: time.Now()})
+}
+
+// AddMessageWithHeaders adds a message with extra header fields
+func (be *MemoryBackend) AddMessageWithHeaders(folder, from, subject, body string, headers map[string]string) {
+	be.addMessage(folder, &MemoryMessage{from: from, subject: subject, body: body, date: time.Now(), headers: headers})
+}
+
+// addMessage appends msg to folder, creating the folder if needed, and
+// assigns it the next UID
+func (be *MemoryBackend) addMessage(folder string, msg *MemoryMessage) {
 	be.user.mu.Lock()
 	defer be.user.mu.Unlock()
 
@@ -119,18 +260,176 @@ func (be *MemoryBackend) AddMessage(folder, from, subject, body string) {
 		be.user.mailboxes[folder] = mbox
 	}
 
-	msg := &MemoryMessage{
-		uid:     mbox.uidNext,
-		from:    from,
-		subject: subject,
-		body:    body,
-		date:    time.Now(),
-		flags:   []string{},
-	}
+	msg.uid = mbox.uidNext
+	msg.flags = []string{}
 	mbox.messages = append(mbox.messages, msg)
 	mbox.uidNext++
 }
 
+// SetQuota enables the QUOTA extension with the given limits
+func (be *MemoryBackend) SetQuota(storageLimit, messageLimit uint32) {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.quota = &quotaLimits{storage: storageLimit, messages: messageLimit}
+}
+
+// SetNamespace enables the NAMESPACE extension with a personal namespace
+func (be *MemoryBackend) SetNamespace(prefix, delimiter string) {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.ns = &namespace{prefix: prefix, delimiter: delimiter}
+}
+
+// EnableCompress enables the COMPRESS=DEFLATE extension
+func (be *MemoryBackend) EnableCompress() {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.compress = true
+}
+
+// CompressedConns returns how many connections have switched to DEFLATE
+func (be *MemoryBackend) CompressedConns() int {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.compressedConns
+}
+
+func (be *MemoryBackend) compressEnabled() bool {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.compress
+}
+
+func (be *MemoryBackend) countCompressed() {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.compressedConns++
+}
+
+func (be *MemoryBackend) personalNamespace() *namespace {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.ns
+}
+
+// EnableListStatus enables the LIST-STATUS extension
+func (be *MemoryBackend) EnableListStatus() {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.listStatus = true
+}
+
+// StatusCommands returns how many STATUS commands have been received
+func (be *MemoryBackend) StatusCommands() int {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.statusCommands
+}
+
+func (be *MemoryBackend) listStatusEnabled() bool {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.listStatus
+}
+
+func (be *MemoryBackend) countStatus() {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.statusCommands++
+}
+
+// ListCommands returns how many LIST commands have been received
+func (be *MemoryBackend) ListCommands() int {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.listCommands
+}
+
+func (be *MemoryBackend) countList() {
+	be.user.mu.Lock()
+	defer be.user.mu.Unlock()
+
+	be.listCommands++
+}
+
+func (be *MemoryBackend) quotaLimits() *quotaLimits {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	return be.quota
+}
+
+// usage returns the storage used (in KiB, rounded up) and the number of
+// messages across all mailboxes
+func (be *MemoryBackend) usage() (storage, messages uint32) {
+	be.user.mu.RLock()
+	defer be.user.mu.RUnlock()
+
+	var bytes int
+	for _, mbox := range be.user.mailboxes {
+		mbox.mu.RLock()
+		for _, m := range mbox.messages {
+			if m.deleted {
+				continue
+			}
+			bytes += len(m.body)
+			messages++
+		}
+		mbox.mu.RUnlock()
+	}
+	return uint32((bytes + 1023) / 1024), messages
+}
+
+func (be *MemoryBackend) SetUIDValidity(folder string, uidValidity uint32) {
+	be.user.mu.RLock()
+	mbox, ok := be.user.mailboxes[folder]
+	be.user.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	mbox.uidValidity = uidValidity
+}
+
+func (be *MemoryBackend) SetReadOnly(folder string, readOnly bool) {
+	be.user.mu.RLock()
+	mbox, ok := be.user.mailboxes[folder]
+	be.user.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	mbox.readOnly = readOnly
+}
+
+func (be *MemoryBackend) SetSpecialUse(folder, attr string) {
+	be.CreateMailbox(folder)
+
+	be.user.mu.RLock()
+	mbox := be.user.mailboxes[folder]
+	be.user.mu.RUnlock()
+
+	mbox.mu.Lock()
+	defer mbox.mu.Unlock()
+	mbox.attributes = append(mbox.attributes, attr)
+}
+
 func (be *MemoryBackend) GetMessageCount(folder string) int {
 	be.user.mu.RLock()
 	defer be.user.mu.RUnlock()
@@ -148,6 +447,24 @@ func (be *MemoryBackend) GetMessageCount(folder string) int {
 	return count
 }
 
+func (be *MemoryBackend) GetMessageFlags(folder string, uid uint32) []string {
+	be.user.mu.RLock()
+	mbox, ok := be.user.mailboxes[folder]
+	be.user.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	mbox.mu.RLock()
+	defer mbox.mu.RUnlock()
+	for _, m := range mbox.messages {
+		if m.uid == uid {
+			return append([]string{}, m.flags...)
+		}
+	}
+	return nil
+}
+
 func (be *MemoryBackend) CreateMailbox(name string) {
 	be.user.mu.Lock()
 	defer be.user.mu.Unlock()
@@ -167,6 +484,7 @@ type MemoryUser struct {
 	username  string
 	password  string
 	mailboxes map[string]*MemoryMailbox
+	faults    *faults
 	mu        sync.RWMutex
 }
 
@@ -175,6 +493,9 @@ func (u *MemoryUser) Username() string {
 }
 
 func (u *MemoryUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	if err := u.faults.operation(); err != nil {
+		return nil, err
+	}
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
@@ -186,6 +507,9 @@ func (u *MemoryUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
 }
 
 func (u *MemoryUser) GetMailbox(name string) (backend.Mailbox, error) {
+	if err := u.faults.operation(); err != nil {
+		return nil, err
+	}
 	u.mu.RLock()
 	defer u.mu.RUnlock()
 
@@ -243,11 +567,14 @@ func (u *MemoryUser) Logout() error {
 
 // MemoryMailbox represents an in-memory mailbox
 type MemoryMailbox struct {
-	name     string
-	messages []*MemoryMessage
-	uidNext  uint32
-	user     *MemoryUser
-	mu       sync.RWMutex
+	name        string
+	messages    []*MemoryMessage
+	uidNext     uint32
+	uidValidity uint32   // 0 is reported as 1
+	attributes  []string // special-use attributes returned by LIST
+	readOnly    bool
+	user        *MemoryUser
+	mu          sync.RWMutex
 }
 
 func (m *MemoryMailbox) Name() string {
@@ -255,10 +582,16 @@ func (m *MemoryMailbox) Name() string {
 }
 
 func (m *MemoryMailbox) Info() (*imap.MailboxInfo, error) {
+	if err := m.user.faults.listMailbox(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	return &imap.MailboxInfo{
 		Name:       m.name,
 		Delimiter:  "/",
-		Attributes: nil,
+		Attributes: append([]string(nil), m.attributes...),
 	}, nil
 }
 
@@ -268,8 +601,17 @@ func (m *MemoryMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, er
 
 	status := imap.NewMailboxStatus(m.name, items)
 	status.Messages = uint32(len(m.messages))
+	for _, msg := range m.messages {
+		if !msg.deleted && !slices.Contains(msg.flags, imap.SeenFlag) {
+			status.Unseen++
+		}
+	}
 	status.UidNext = m.uidNext
-	status.UidValidity = 1
+	status.UidValidity = m.uidValidity
+	if status.UidValidity == 0 {
+		status.UidValidity = 1
+	}
+	status.ReadOnly = m.readOnly
 	return status, nil
 }
 
@@ -283,6 +625,9 @@ func (m *MemoryMailbox) Check() error {
 
 func (m *MemoryMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
+	if err := m.user.faults.fetch(); err != nil {
+		return err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -307,14 +652,24 @@ func (m *MemoryMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap
 }
 
 func (m *MemoryMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if err := m.user.faults.operation(); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	// Only SINCE and UID are supported; other criteria match every message
 	var results []uint32
 	for i, msg := range m.messages {
 		if msg.deleted {
 			continue
 		}
+		if !criteria.Since.IsZero() && msg.date.Before(criteria.Since) {
+			continue
+		}
+		if criteria.Uid != nil && !criteria.Uid.Contains(msg.uid) {
+			continue
+		}
 		if uid {
 			results = append(results, msg.uid)
 		} else {
@@ -339,6 +694,9 @@ func (m *MemoryMailbox) CreateMessage(flags []string, date time.Time, body imap.
 }
 
 func (m *MemoryMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	if err := m.user.faults.operation(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -358,7 +716,9 @@ func (m *MemoryMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op im
 					if f == imap.DeletedFlag {
 						msg.deleted = true
 					}
-					msg.flags = append(msg.flags, f)
+					if !hasFlag(msg.flags, f) {
+						msg.flags = append(msg.flags, f)
+					}
 				}
 			case imap.RemoveFlags:
 				for _, f := range flags {
@@ -366,6 +726,13 @@ func (m *MemoryMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op im
 						msg.deleted = false
 					}
 				}
+				kept := msg.flags[:0]
+				for _, f := range msg.flags {
+					if !hasFlag(flags, f) {
+						kept = append(kept, f)
+					}
+				}
+				msg.flags = kept
 			case imap.SetFlags:
 				msg.flags = flags
 				msg.deleted = false
@@ -380,10 +747,21 @@ func (m *MemoryMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op im
 	return nil
 }
 
-func (m *MemoryMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// hasFlag reports whether flags contains flag. Flags and keywords are
+// compared case-insensitively.
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
 
+func (m *MemoryMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	if err := m.user.faults.operation(); err != nil {
+		return err
+	}
 	// Get destination mailbox
 	m.user.mu.Lock()
 	dest, ok := m.user.mailboxes[destName]
@@ -393,7 +771,10 @@ func (m *MemoryMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName str
 	}
 	m.user.mu.Unlock()
 
-	// Find and copy matching messages
+	// Find matching messages, releasing the lock before copying so that
+	// copying into the same mailbox doesn't deadlock
+	var matched []*MemoryMessage
+	m.mu.RLock()
 	for i, msg := range m.messages {
 		if msg.deleted {
 			continue
@@ -408,20 +789,24 @@ func (m *MemoryMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName str
 		}
 
 		if match {
-			dest.mu.Lock()
-			copied := &MemoryMessage{
-				uid:     dest.uidNext,
+			matched = append(matched, &MemoryMessage{
 				from:    msg.from,
 				subject: msg.subject,
 				body:    msg.body,
 				date:    msg.date,
 				flags:   append([]string{}, msg.flags...),
-			}
-			dest.messages = append(dest.messages, copied)
-			dest.uidNext++
-			dest.mu.Unlock()
+			})
 		}
 	}
+	m.mu.RUnlock()
+
+	dest.mu.Lock()
+	defer dest.mu.Unlock()
+	for _, copied := range matched {
+		copied.uid = dest.uidNext
+		dest.messages = append(dest.messages, copied)
+		dest.uidNext++
+	}
 	return nil
 }
 
@@ -443,6 +828,8 @@ func (m *MemoryMailbox) Expunge() error {
 type MemoryMessage struct {
 	uid     uint32
 	from    string
+	replyTo string
+	headers map[string]string
 	subject string
 	body    string
 	date    time.Time
@@ -462,15 +849,48 @@ func (m *MemoryMessage) ToIMAP(seqNum uint32, items []imap.FetchItem) *imap.Mess
 				From:    parseAddress(m.from),
 				Date:    m.date,
 			}
+			if m.replyTo != "" {
+				msg.Envelope.ReplyTo = parseAddress(m.replyTo)
+			}
 		case imap.FetchFlags:
 			msg.Flags = m.flags
 		case imap.FetchUid:
 			msg.Uid = m.uid
+		case imap.FetchRFC822Size:
+			// Messages have no stored headers, so their size is the body's
+			msg.Size = uint32(len(m.body))
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil || section.Specifier != imap.HeaderSpecifier {
+				continue
+			}
+			msg.Body[section] = m.headerFields(section.Fields, section.NotFields)
 		}
 	}
 	return msg
 }
 
+// headerFields returns the message's extra header fields named in fields,
+// or all of them if fields is empty, as a header block ending in a blank
+// line. With not set, the fields named are left out instead.
+func (m *MemoryMessage) headerFields(fields []string, not bool) imap.Literal {
+	var names []string
+	for name := range m.headers {
+		named := slices.ContainsFunc(fields, func(f string) bool { return strings.EqualFold(f, name) })
+		if len(fields) == 0 || named != not {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, m.headers[name])
+	}
+	b.WriteString("\r\n")
+	return &b
+}
+
 func parseAddress(email string) []*imap.Address {
 	if email == "" {
 		return nil
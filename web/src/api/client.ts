@@ -2,11 +2,18 @@ import axios from 'axios';
 import type {
   Account,
   AccountCreate,
+  AccountApplyResult,
   Rule,
   RuleCreate,
   ConnectionStatus,
   PreviewResult,
-  Folder
+  Folder,
+  FolderResults,
+  MessageAction,
+  Page,
+  RuleSuggestion,
+  SenderCount,
+  Unsubscribe
 } from './types';
 
 const API_BASE = import.meta.env.VITE_API_URL || 'http://localhost:8080';
@@ -22,6 +29,9 @@ const api = axios.create({
 export const accountsApi = {
   list: () => api.get<Account[]>('/accounts').then(r => r.data),
 
+  listPage: (limit = 50, cursor?: string) =>
+    api.get<Page<Account>>('/accounts', { params: { limit, cursor } }).then(r => r.data),
+
   get: (id: number) => api.get<Account>(`/accounts/${id}`).then(r => r.data),
 
   create: (data: AccountCreate) =>
@@ -30,6 +40,9 @@ export const accountsApi = {
   update: (id: number, data: Partial<AccountCreate>) =>
     api.put<Account>(`/accounts/${id}`, data).then(r => r.data),
 
+  patch: (id: number, data: Partial<AccountCreate> & { enabled?: boolean }) =>
+    api.patch<Account>(`/accounts/${id}`, data).then(r => r.data),
+
   delete: (id: number) => api.delete(`/accounts/${id}`),
 
   test: (id: number) =>
@@ -38,11 +51,19 @@ export const accountsApi = {
   testDirect: (data: AccountCreate) =>
     api.post<ConnectionStatus>('/accounts/test', data).then(r => r.data),
 
-  getFolders: (id: number) =>
-    api.get<Folder[]>(`/accounts/${id}/folders`).then(r => r.data),
+  getFolders: (id: number, pattern?: string) =>
+    api.get<Folder[]>(`/accounts/${id}/folders`, { params: { pattern } }).then(r => r.data),
 
   createFolder: (id: number, name: string) =>
     api.post(`/accounts/${id}/folders`, { name }).then(r => r.data),
+
+  getCapabilities: (id: number) =>
+    api.get<string[]>(`/accounts/${id}/capabilities`).then(r => r.data),
+
+  getSenders: (id: number, folder = 'INBOX', limit = 200) =>
+    api.get<SenderCount[]>(`/accounts/${id}/senders`, {
+      params: { folder, limit }
+    }).then(r => r.data),
 };
 
 // Rules API
@@ -50,6 +71,11 @@ export const rulesApi = {
   list: (accountId: number) =>
     api.get<Rule[]>(`/accounts/${accountId}/rules`).then(r => r.data),
 
+  listPage: (accountId: number, limit = 50, cursor?: string) =>
+    api.get<Page<Rule>>(`/accounts/${accountId}/rules`, {
+      params: { limit, cursor }
+    }).then(r => r.data),
+
   get: (id: number) =>
     api.get<Rule>(`/rules/${id}`).then(r => r.data),
 
@@ -59,7 +85,15 @@ export const rulesApi = {
   update: (id: number, data: Partial<RuleCreate>) =>
     api.put<Rule>(`/rules/${id}`, data).then(r => r.data),
 
+  patch: (id: number, data: Partial<RuleCreate>) =>
+    api.patch<Rule>(`/rules/${id}`, data).then(r => r.data),
+
   delete: (id: number) => api.delete(`/rules/${id}`),
+
+  suggestions: (accountId: number, folder = 'INBOX', limit = 200) =>
+    api.get<RuleSuggestion[]>(`/accounts/${accountId}/rules/suggestions`, {
+      params: { folder, limit }
+    }).then(r => r.data),
 };
 
 // Preview API
@@ -69,9 +103,60 @@ export const previewApi = {
       params: { folder, limit }
     }).then(r => r.data),
 
-  apply: (accountId: number, folder = 'INBOX', dryRun = false) =>
+  // Pages through a snapshot of the folder; pass the returned snapshot token
+  // and next_offset to get the following page
+  previewPage: (accountId: number, folder = 'INBOX', limit = 100, offset = 0, snapshot?: string) =>
+    api.get<PreviewResult>(`/accounts/${accountId}/preview`, {
+      params: { folder, limit, offset, snapshot }
+    }).then(r => r.data),
+
+  // maxMoves caps the messages moved; the result's remaining counts the rest
+  apply: (accountId: number, folder = 'INBOX', dryRun = false, tagProcessed = false, maxMoves?: number) =>
     api.post<PreviewResult>(`/accounts/${accountId}/apply`, null, {
-      params: { folder, dry_run: dryRun }
+      params: { folder, dry_run: dryRun, tag_processed: tagProcessed, max_moves: maxMoves }
+    }).then(r => r.data),
+
+  previewAll: (accountId: number, limit = 100) =>
+    api.get<FolderResults>(`/accounts/${accountId}/preview`, {
+      params: { folder: 'all', limit }
+    }).then(r => r.data),
+
+  applyAll: (accountId: number, dryRun = false, tagProcessed = false, maxMoves?: number) =>
+    api.post<FolderResults>(`/accounts/${accountId}/apply`, null, {
+      params: { folder: 'all', dry_run: dryRun, tag_processed: tagProcessed, max_moves: maxMoves }
+    }).then(r => r.data),
+
+  // Applies rules to several accounts, or every enabled account if none are given
+  applyAccounts: (accountIds: number[] = [], folder = 'INBOX', dryRun = false, tagProcessed = false) =>
+    api.post<Record<number, AccountApplyResult>>('/apply', null, {
+      params: {
+        accounts: accountIds.length ? accountIds.join(',') : undefined,
+        folder,
+        dry_run: dryRun,
+        tag_processed: tagProcessed,
+      }
+    }).then(r => r.data),
+};
+
+// Messages API
+export const messagesApi = {
+  move: (accountId: number, uid: number, folder: string, sourceFolder = 'INBOX') =>
+    api.post(`/accounts/${accountId}/messages/${uid}/move`, {
+      folder, source_folder: sourceFolder
+    }).then(r => r.data),
+
+  batch: (accountId: number, uids: number[], action: MessageAction, target = '', sourceFolder = 'INBOX') =>
+    api.post(`/accounts/${accountId}/messages/actions`, {
+      uids,
+      action,
+      folder: action === 'move' ? target : '',
+      keyword: action === 'add_keyword' ? target : '',
+      source_folder: sourceFolder
+    }).then(r => r.data),
+
+  unsubscribeInfo: (accountId: number, uid: number, folder = 'INBOX') =>
+    api.get<Unsubscribe>(`/accounts/${accountId}/messages/${uid}/unsubscribe`, {
+      params: { folder }
     }).then(r => r.data),
 };
 
@@ -8,6 +8,16 @@ export interface Account {
   username: string;
   password?: string;
   tls: boolean;
+  fetch_concurrency: number;
+  compress: boolean;
+  proxy_url: string;
+  scan_window_days: number;
+  inbox_name: string;
+  command_timeout_seconds: number;
+  allowed_destinations: string[] | null;
+  enabled: boolean;
+  last_verified_at?: string;
+  last_verify_status?: 'success' | 'failed';
   created_at: string;
   updated_at: string;
 }
@@ -19,45 +29,115 @@ export interface AccountCreate {
   username: string;
   password: string;
   tls: boolean;
+  fetch_concurrency?: number;
+  compress?: boolean;
+  proxy_url?: string;
+  scan_window_days?: number;
+  inbox_name?: string;
+  command_timeout_seconds?: number;
+  allowed_destinations?: string[];
+  enabled?: boolean;
 }
 
+export type RuleAction = 'move' | 'archive';
+
 export interface Rule {
   id: number;
   account_id: number;
   name: string;
   pattern: string;
-  pattern_type: 'sender' | 'subject' | 'from_domain';
+  pattern_type: 'sender' | 'subject' | 'from_domain' | 'keyword' | 'reply_to';
   move_to_folder: string;
+  action: RuleAction;
   enabled: boolean;
   priority: number;
+  unread_only: boolean;
+  older_than_days: number;
+  exclude_keyword: string;
+  fallback_folders?: string[];
+  is_flagged?: boolean | null;
+  is_answered?: boolean | null;
+  is_draft?: boolean | null;
+  is_newsletter?: boolean | null;
+  sample_percent: number;
   created_at: string;
   updated_at: string;
+  // Only in responses to creating or updating a rule
+  warning?: string;
+  warnings?: string[];
 }
 
 export interface RuleCreate {
   name: string;
   pattern: string;
-  pattern_type: 'sender' | 'subject' | 'from_domain';
+  pattern_type: 'sender' | 'subject' | 'from_domain' | 'keyword' | 'reply_to';
   move_to_folder: string;
+  action?: RuleAction;
   enabled: boolean;
   priority: number;
+  unread_only?: boolean;
+  older_than_days?: number;
+  exclude_keyword?: string;
+  fallback_folders?: string[];
+  is_flagged?: boolean | null;
+  is_answered?: boolean | null;
+  is_draft?: boolean | null;
+  is_newsletter?: boolean | null;
+  sample_percent?: number;
+}
+
+export interface Page<T> {
+  items: T[];
+  next_cursor?: string;
 }
 
+export interface SenderCount {
+  address: string;
+  count: number;
+}
+
+export interface RuleSuggestion {
+  name: string;
+  pattern: string;
+  pattern_type: 'sender' | 'subject' | 'from_domain' | 'keyword' | 'reply_to';
+  move_to_folder: string;
+  message_count: number;
+}
+
+export type MessageAction = 'move' | 'delete' | 'mark_read' | 'add_keyword';
+
 export interface Message {
   uid: number;
   seq_num: number;
   from: string;
   to: string;
+  reply_to?: string;
+  newsletter?: boolean;
   subject: string;
   date: string;
   flags: string[];
   matched_rule?: Rule;
+  already_in_target?: boolean;
+  sampled_out?: boolean;
+}
+
+export interface Unsubscribe {
+  uid: number;
+  urls?: string[];
+  mailto?: string[];
+  one_click: boolean;
 }
 
 export interface Folder {
   name: string;
   delimiter: string;
   attributes: string[];
+  status?: FolderStatus;
+}
+
+export interface FolderStatus {
+  messages: number;
+  unseen: number;
 }
 
 export interface ConnectionStatus {
@@ -65,19 +145,48 @@ export interface ConnectionStatus {
   message: string;
   folders?: Folder[];
   total_emails?: number;
+  capabilities?: string[];
+  connect_ms?: number;
+  login_ms?: number;
+  list_ms?: number;
 }
 
 export interface PreviewResult {
   total_messages: number;
   matched_messages: number;
+  uid_validity?: number;
   messages: Message[];
   rule_matches: Record<number, number>;
+  remaining?: number;
+  created_folders?: string[];
+  folder_deltas?: Record<string, number>;
+  warning?: string;
+  snapshot?: string;
+  snapshot_total?: number;
+  next_offset?: number;
+}
+
+export interface FolderResults {
+  total_messages: number;
+  matched_messages: number;
+  rule_matches: Record<number, number>;
+  folders: Record<string, PreviewResult>;
+  remaining?: number;
+  created_folders?: string[];
+  folder_deltas?: Record<string, number>;
+  warning?: string;
+}
+
+export interface AccountApplyResult {
+  result?: PreviewResult | FolderResults;
+  error?: string;
 }
 
 export interface WSMessage {
-  type: 'progress' | 'result' | 'error' | 'pong';
+  type: 'progress' | 'result' | 'error' | 'warning' | 'pong';
   payload?: unknown;
   error?: string;
+  warning?: string;
 }
 
 export interface PreviewProgress {
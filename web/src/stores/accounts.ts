@@ -123,6 +123,8 @@ export const useAccountsStore = defineStore('accounts', () => {
       folders.value = await accountsApi.getFolders(id);
     } catch (e: any) {
       error.value = e.response?.data?.error || e.message;
+      // The server may have failed partway; keep the folders it did list
+      folders.value = e.response?.data?.folders ?? [];
     }
   }
 
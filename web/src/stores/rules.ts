@@ -60,7 +60,8 @@ export const useRulesStore = defineStore('rules', () => {
     loading.value = true;
     error.value = null;
     try {
-      const rule = await rulesApi.update(id, data);
+      // PATCH, so callers like toggleRule can send only the fields they change
+      const rule = await rulesApi.patch(id, data);
       const index = rules.value.findIndex(r => r.id === id);
       if (index >= 0) {
         rules.value[index] = rule;